@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// AdminServer serves the local admin API on a Unix domain socket, access is
+// controlled by the ownership and permissions of the socket file
+type AdminServer struct {
+	path     string
+	listener net.Listener
+	server   *http.Server
+	tunnel   *SocketTunnel
+	logger   *zap.Logger
+}
+
+// NewAdminServer creates the socket at path with the given mode, owned by group if not empty.
+// level is the log-level of pe-terminal, changed through the /loglevel endpoint.
+func NewAdminServer(path string, mode os.FileMode, group string, tunnel *SocketTunnel, level zap.AtomicLevel, logger *zap.Logger) (*AdminServer, error) {
+	listener, err := listenUnix(path, mode, group)
+	if err != nil {
+		return nil, err
+	}
+
+	admin := &AdminServer{
+		path:     path,
+		listener: listener,
+		tunnel:   tunnel,
+		logger:   logger.With(zap.String("component", "admin")),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", admin.onStatus)
+	mux.HandleFunc("/sessions", admin.onSessions)
+	mux.HandleFunc("/sessions/", admin.onSession)
+	mux.HandleFunc("/reconnect", admin.onReconnect)
+	mux.HandleFunc("/approvals", admin.onApprovals)
+	mux.HandleFunc("/approvals/", admin.onApproval)
+	mux.Handle("/loglevel", level)
+	admin.server = &http.Server{Handler: mux}
+	return admin, nil
+}
+
+// Serve handles requests until Close is called
+func (admin *AdminServer) Serve() {
+	admin.logger.Info("Serving admin API", zap.String("socket", admin.path))
+	if err := admin.server.Serve(admin.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		admin.logger.Error("Failed to serve admin API", zap.Error(err))
+	}
+}
+
+// Close stops serving and removes the socket
+func (admin *AdminServer) Close() error {
+	return admin.server.Close()
+}
+
+func (admin *AdminServer) onStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, admin.tunnel.Status())
+}
+
+func (admin *AdminServer) onSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, admin.tunnel.Sessions())
+}
+
+// onSession handles DELETE /sessions/<sessionID> and GET /sessions/<sessionID>/screen
+func (admin *AdminServer) onSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if strings.HasSuffix(sessionID, "/screen") {
+		admin.onScreen(w, r, strings.TrimSuffix(sessionID, "/screen"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "use DELETE")
+		return
+	}
+	if !admin.tunnel.hasSession(sessionID) {
+		writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	admin.logger.Info("Killing session on admin request", zap.String("sessionID", sessionID))
+	if err := admin.tunnel.KillSession(sessionID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "killed"})
+}
+
+// onScreen answers with the text on the screen of a session
+func (admin *AdminServer) onScreen(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	screenshot, err := admin.tunnel.Screenshot(sessionID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, screenshot)
+}
+
+func (admin *AdminServer) onReconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	admin.logger.Info("Reconnecting on admin request")
+	if err := admin.tunnel.Reconnect(); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "reconnecting"})
+}
+
+func (admin *AdminServer) onApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, admin.tunnel.PendingSessions())
+}
+
+// ApprovalRequest is the body of POST /approvals/<sessionID>
+type ApprovalRequest struct {
+	Approve bool   `json:"approve"`
+	Reason  string `json:"reason,omitempty"` // Told to the user when denied
+}
+
+// onApproval handles POST /approvals/<sessionID>
+func (admin *AdminServer) onApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/approvals/")
+	var request ApprovalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	var err error
+	if request.Approve {
+		err = admin.tunnel.ApproveSession(sessionID)
+	} else {
+		err = admin.tunnel.DenySession(sessionID, request.Reason)
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	result := "denied"
+	if request.Approve {
+		result = "approved"
+	}
+	admin.logger.Info("Session "+result+" on admin request", zap.String("sessionID", sessionID))
+	writeJSON(w, http.StatusOK, map[string]string{"result": result})
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError answers with the same {"error": ...} body as zap.AtomicLevel
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// listenUnix creates a Unix domain socket at path with the given mode, owned by group if not empty.
+// The socket is bound in a private directory and moved to path once its mode is set, it would
+// otherwise be open to anyone for a moment under the umask of the process.
+func listenUnix(path string, mode os.FileMode, group string) (net.Listener, error) {
+	// Remove a stale socket left behind by a previous instance
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".pe-terminal-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false) // Moved, removed by unixListener
+	if err := os.Chmod(bound, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if group != "" {
+		gid, err := LookupGroup(group)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Chown(bound, -1, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(bound, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener removes its socket from where it was moved once closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixListener) Close() error {
+	err := listener.UnixListener.Close()
+	os.Remove(listener.path)
+	return err
+}
+
+// LookupGroup finds a group by name, falling back to a numeric gid
+func LookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAdminServer(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/bash")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	level := zap.NewAtomicLevel()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin, err := NewAdminServer(path, 0660, "", tunnel, level, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go admin.Serve()
+	defer admin.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected socket with mode 0660, got %v (%v)", info.Mode(), err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	request := func(method string, path string, body string, result interface{}) int {
+		req, _ := http.NewRequest(method, "http://admin"+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if result != nil {
+			json.NewDecoder(resp.Body).Decode(result)
+		}
+		return resp.StatusCode
+	}
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	tunnel.onInput("s1", "true\r")
+
+	var sessions []SessionInfo
+	if code := request(http.MethodGet, "/sessions", "", &sessions); code != http.StatusOK || len(sessions) != 1 ||
+		sessions[0].SessionID != "s1" || sessions[0].Profile != "default" || sessions[0].BytesIn != 5 || sessions[0].Pid == 0 {
+		t.Fatalf("Unexpected sessions %+v (%d)", sessions, code)
+	}
+	var status TunnelStatus
+	if code := request(http.MethodGet, "/status", "", &status); code != http.StatusOK || status.Sessions != 1 || status.Connected {
+		t.Fatalf("Unexpected status %+v (%d)", status, code)
+	}
+	if code := request(http.MethodPut, "/loglevel", `{"level": "debug"}`, nil); code != http.StatusOK || level.Level() != zap.DebugLevel {
+		t.Fatalf("Expected log-level debug, got %v (%d)", level.Level(), code)
+	}
+	var screenshot Screenshot
+	if code := request(http.MethodGet, "/sessions/s1/screen", "", &screenshot); code != http.StatusOK || screenshot.SessionID != "s1" ||
+		len(screenshot.Lines) != screenshot.Height {
+		t.Fatalf("Unexpected screenshot %+v (%d)", screenshot, code)
+	}
+	if code := request(http.MethodGet, "/sessions/unknown/screen", "", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for the screen of an unknown session, got %d", code)
+	}
+	if code := request(http.MethodDelete, "/sessions/unknown", "", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown session, got %d", code)
+	}
+	if code := request(http.MethodDelete, "/sessions/s1", "", nil); code != http.StatusOK {
+		t.Fatalf("Expected session to be killed, got %d", code)
+	}
+	for {
+		if message := nextMessage(t, messages); message.Type == typeEnd {
+			if message.Reason != reasonKilledLocally {
+				t.Fatalf("Unexpected end reason %q", message.Reason)
+			}
+			break
+		}
+	}
+	if code := request(http.MethodPost, "/reconnect", "", nil); code != http.StatusConflict {
+		t.Fatalf("Expected reconnect to fail while disconnected, got %d", code)
+	}
+
+	tunnel.SetOptions(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		Approval:       &Approval{Timeout: time.Minute},
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": null}`)
+	var pending []PendingSession
+	if code := request(http.MethodGet, "/approvals", "", &pending); code != http.StatusOK || len(pending) != 1 || pending[0].SessionID != "s2" {
+		t.Fatalf("Unexpected pending sessions %+v (%d)", pending, code)
+	}
+	if code := request(http.MethodPost, "/approvals/unknown", `{"approve": true}`, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown session, got %d", code)
+	}
+	if code := request(http.MethodPost, "/approvals/s2", `{"approve": false, "reason": "busy"}`, nil); code != http.StatusOK {
+		t.Fatalf("Expected session to be denied, got %d", code)
+	}
+	for {
+		if message := nextMessage(t, messages); message.Type == typeError {
+			if message.SessionID != "s2" || message.Payload.(map[string]interface{})["message"] != "denied by local operator: busy" {
+				t.Fatalf("Unexpected error %+v", message)
+			}
+			break
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	// A stale socket is replaced, the socket is moved in place once private
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listenUnix(path, 0600, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 || info.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("Expected a socket with mode 0600, got %v (%v)", info.Mode(), err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected only the socket in the directory, got %v", files)
+	}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed once closed, got %v", err)
+	}
+
+	// Other files are left alone
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, 0600, ""); err == nil {
+		t.Fatal("Expected an error for a regular file in the way")
+	}
+}
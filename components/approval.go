@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	approvalStatusInterval = 10 * time.Second       // Between status messages of a pending session
+	approvalPollInterval   = 500 * time.Millisecond // Between checks of the flag-files
+	statePending           = "pending-approval"
+	stateApproved          = "approved"
+	reasonApprovalTimeout  = "no local operator approved the session in time"
+)
+
+// Approval makes sessions wait for a local operator, who approves or denies them through
+// the admin API, the hook or the flag-files. Without a decision within the timeout the
+// session is rejected.
+type Approval struct {
+	Timeout  time.Duration
+	Profiles []string  // Profiles requiring approval, every profile when empty
+	Hook     *ExecHook // Asked for a decision, exit status 0 approves, optional
+	Dir      string    // Directory of the flag-files, optional
+}
+
+// requires tells if sessions of profile need approval, approval is nil when disabled
+func (approval *Approval) requires(profile string) bool {
+	if approval == nil {
+		return false
+	}
+	if len(approval.Profiles) == 0 {
+		return true
+	}
+	for _, name := range approval.Profiles {
+		if name == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingSession describes a session waiting for approval
+type PendingSession struct {
+	SessionID string    `json:"sessionID"`
+	Profile   string    `json:"profile"`
+	User      string    `json:"user"`
+	Role      string    `json:"role,omitempty"`
+	Operator  string    `json:"operator,omitempty"`
+	Requested time.Time `json:"requested"`
+	Expires   time.Time `json:"expires"`
+}
+
+// statusPayload is the payload of a status message, telling the cloud about a session not started yet
+type statusPayload struct {
+	State     string `json:"state"`
+	Message   string `json:"message"`
+	Remaining int    `json:"remaining,omitempty"` // Seconds left for a decision
+}
+
+// approvalDecision ends the wait of a pending session, a decision that neither approves
+// nor carries an error code silently drops the session
+type approvalDecision struct {
+	approved bool
+	code     string // Error code sent to the cloud
+	reason   string
+	by       string // Which approver decided
+}
+
+// denial is the decision of an approver rejecting a session, reason is optional
+func denial(by string, reason string) approvalDecision {
+	message := "denied by local operator"
+	if reason != "" {
+		message += ": " + reason
+	}
+	return approvalDecision{code: errCodeDenied, reason: message, by: by}
+}
+
+type pendingApproval struct {
+	info     PendingSession
+	decision chan approvalDecision // Holds the first decision only
+}
+
+// requestApproval parks a session until a local operator decides on it
+func (tunnel *SocketTunnel) requestApproval(sessionID string, options TunnelOptions, profileName string, request startRequest) {
+	now := time.Now()
+	pending := &pendingApproval{
+		info: PendingSession{
+			SessionID: sessionID,
+			Profile:   profileName,
+			User:      options.Profiles[profileName].sessionSpec(request).effectiveUser(),
+			Role:      request.role,
+			Operator:  request.operator,
+			Requested: now,
+			Expires:   now.Add(options.Approval.Timeout),
+		},
+		decision: make(chan approvalDecision, 1),
+	}
+	tunnel.mutex.Lock()
+	_, duplicate := tunnel.pending[sessionID]
+	if !duplicate {
+		tunnel.pending[sessionID] = pending
+		tunnel.sessionsWait.Add(1) // Shutdown waits for the session to be rejected
+	}
+	tunnel.mutex.Unlock()
+	if duplicate {
+		tunnel.logger.Warn("Ignoring repeated start of a pending session", zap.String("sessionID", sessionID))
+		return
+	}
+	tunnel.logger.Info("Session waiting for local approval", zap.String("sessionID", sessionID), zap.String("profile", profileName),
+		zap.Duration("timeout", options.Approval.Timeout))
+	go tunnel.awaitApproval(options, request, pending)
+}
+
+// awaitApproval asks the approvers and starts or rejects the session once decided
+func (tunnel *SocketTunnel) awaitApproval(options TunnelOptions, request startRequest, pending *pendingApproval) {
+	defer tunnel.sessionsWait.Done()
+	approval := options.Approval
+	sessionID := pending.info.SessionID
+	event := Event{Type: EventApproval, SessionID: sessionID, Profile: pending.info.Profile, User: pending.info.User, Role: pending.info.Role, Operator: pending.info.Operator}
+	tunnel.events.Publish(event)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // Stops the hook once decided
+	if approval.Hook != nil {
+		go func() {
+			output, err := approval.Hook.run(ctx, event)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				tunnel.decide(sessionID, denial("hook", firstLine(output)))
+			} else {
+				tunnel.decide(sessionID, approvalDecision{approved: true, by: "hook"})
+			}
+		}()
+	}
+	flagsRemoved := make(chan struct{})
+	if approval.Dir != "" {
+		go func() {
+			defer close(flagsRemoved)
+			tunnel.watchFlags(ctx, approval.Dir, pending.info)
+		}()
+	} else {
+		close(flagsRemoved)
+	}
+
+	timeout := time.NewTimer(time.Until(pending.info.Expires))
+	defer timeout.Stop()
+	ticker := time.NewTicker(approvalStatusInterval)
+	defer ticker.Stop()
+	var decision approvalDecision
+	for waiting := true; waiting; {
+		tunnel.sendStatus(sessionID, statusPayload{
+			State:     statePending,
+			Message:   "waiting for approval by a local operator",
+			Remaining: int(time.Until(pending.info.Expires).Round(time.Second).Seconds()),
+		})
+		select {
+		case decision = <-pending.decision:
+			waiting = false
+		case <-timeout.C:
+			decision = approvalDecision{code: errCodeDenied, reason: reasonApprovalTimeout}
+			waiting = false
+		case <-ticker.C:
+		}
+	}
+
+	cancel()
+	<-flagsRemoved
+	tunnel.mutex.Lock()
+	delete(tunnel.pending, sessionID)
+	tunnel.mutex.Unlock()
+	switch {
+	case decision.approved:
+		tunnel.logger.Info("Session approved by local operator", zap.String("sessionID", sessionID), zap.String("by", decision.by))
+		tunnel.sendStatus(sessionID, statusPayload{State: stateApproved, Message: "approved by a local operator"})
+		tunnel.startSession(sessionID, options, pending.info.Profile, request)
+	case decision.code != "":
+		tunnel.logger.Warn("Rejecting new session, not approved", zap.String("sessionID", sessionID), zap.String("by", decision.by), zap.String("reason", decision.reason))
+		tunnel.reject(sessionID, decision.code, decision.reason)
+	default:
+		tunnel.end(sessionID, decision.reason)
+	}
+}
+
+// decide hands a decision to a pending session, only the first decision counts
+func (tunnel *SocketTunnel) decide(sessionID string, decision approvalDecision) error {
+	tunnel.mutex.Lock()
+	pending, ok := tunnel.pending[sessionID]
+	tunnel.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending session %q", sessionID)
+	}
+	select {
+	case pending.decision <- decision:
+	default: // Decided already
+	}
+	return nil
+}
+
+// cancelApprovals decides on every pending session at once
+func (tunnel *SocketTunnel) cancelApprovals(decision approvalDecision) {
+	tunnel.mutex.Lock()
+	sessionIDs := make([]string, 0, len(tunnel.pending))
+	for sessionID := range tunnel.pending {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	tunnel.mutex.Unlock()
+	for _, sessionID := range sessionIDs {
+		tunnel.decide(sessionID, decision)
+	}
+}
+
+// ApproveSession lets a pending session start on behalf of a local operator
+func (tunnel *SocketTunnel) ApproveSession(sessionID string) error {
+	return tunnel.decide(sessionID, approvalDecision{approved: true, by: "admin"})
+}
+
+// DenySession rejects a pending session on behalf of a local operator, reason is optional
+func (tunnel *SocketTunnel) DenySession(sessionID string, reason string) error {
+	return tunnel.decide(sessionID, denial("admin", reason))
+}
+
+// PendingSessions lists the sessions waiting for approval, oldest first
+func (tunnel *SocketTunnel) PendingSessions() []PendingSession {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	infos := make([]PendingSession, 0, len(tunnel.pending))
+	for _, pending := range tunnel.pending {
+		infos = append(infos, pending.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Requested.Before(infos[j].Requested) })
+	return infos
+}
+
+// watchFlags publishes a pending session as <sessionID>.pending in dir and waits for the
+// operator to create <sessionID>.approve or <sessionID>.deny, holding an optional reason.
+// The files are removed once decided.
+func (tunnel *SocketTunnel) watchFlags(ctx context.Context, dir string, info PendingSession) {
+	name := flagName(info.SessionID)
+	paths := []string{filepath.Join(dir, name+".pending"), filepath.Join(dir, name+".approve"), filepath.Join(dir, name+".deny")}
+	removeFlags := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+	removeFlags() // Left behind by an earlier session
+	defer removeFlags()
+	encoded, _ := json.Marshal(info)
+	if err := os.WriteFile(paths[0], append(encoded, '\n'), 0644); err != nil {
+		tunnel.logger.Error("Failed to publish pending session", zap.String("sessionID", info.SessionID), zap.Error(err))
+	}
+
+	ticker := time.NewTicker(approvalPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := os.Stat(paths[1]); err == nil {
+			tunnel.decide(info.SessionID, approvalDecision{approved: true, by: "file"})
+		} else if reason, err := os.ReadFile(paths[2]); err == nil {
+			tunnel.decide(info.SessionID, denial("file", firstLine(string(reason))))
+		}
+	}
+}
+
+// flagName encodes a session ID, which comes from the cloud, as the base name of its flag-files.
+// Dots are escaped too, so that no ID, e.g. "..", can name a file outside the directory.
+func flagName(sessionID string) string {
+	return strings.ReplaceAll(url.PathEscape(sessionID), ".", "%2E")
+}
+
+// sendStatus tells the cloud about a session that did not start yet
+func (tunnel *SocketTunnel) sendStatus(sessionID string, status statusPayload) {
+	tunnel.sendEnvelope(envelope{Type: typeStatus, SessionID: sessionID, Payload: status})
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return line
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextOfType skips messages until one of the given type
+func nextOfType(t *testing.T, messages chan envelope, messageType string) envelope {
+	for {
+		if message := nextMessage(t, messages); message.Type == messageType {
+			return message
+		}
+	}
+}
+
+// expectDenied waits for the error message rejecting a session
+func expectDenied(t *testing.T, messages chan envelope, sessionID string, reason string) {
+	message := nextOfType(t, messages, typeError)
+	payload, _ := message.Payload.(map[string]interface{})
+	if message.SessionID != sessionID || payload["code"] != errCodeDenied || payload["message"] != reason {
+		t.Fatalf("Expected %s to be denied with %q, got %+v", sessionID, reason, message)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	dir := t.TempDir()
+	spec, _ := NewSessionSpec("/bin/sh")
+	options := TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}, "logs": {Spec: spec}},
+		DefaultProfile: "default",
+		Approval:       &Approval{Timeout: time.Minute, Profiles: []string{"default"}, Dir: dir},
+	}
+	tunnel, messages := newTestTunnel(options)
+
+	// Pending sessions are reported to the cloud and wait for a decision
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"role": "admin"}}`)
+	message := nextMessage(t, messages)
+	if payload, ok := message.Payload.(map[string]interface{}); message.Type != typeStatus || !ok || payload["state"] != statePending || payload["remaining"] == nil {
+		t.Fatalf("Expected a pending status, got %+v", message)
+	}
+	if pending := tunnel.PendingSessions(); len(pending) != 1 || pending[0].SessionID != "s1" || pending[0].Role != "admin" || tunnel.hasSession("s1") {
+		t.Fatalf("Expected s1 to be pending, got %+v", pending)
+	}
+	if tunnel.ApproveSession("unknown") == nil {
+		t.Fatal("Expected an error approving an unknown session")
+	}
+	if err := tunnel.ApproveSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if message := nextOfType(t, messages, typeStatus); message.Payload.(map[string]interface{})["state"] != stateApproved {
+		t.Fatalf("Expected an approved status, got %+v", message)
+	}
+	// Started by the goroutine waiting for the decision
+	deadline := time.Now().Add(5 * time.Second)
+	for !tunnel.hasSession("s1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tunnel.hasSession("s1") || len(tunnel.PendingSessions()) != 0 {
+		t.Fatal("Expected s1 to start once approved")
+	}
+	tunnel.onEnd("s1")
+	nextOfType(t, messages, typeEnd)
+
+	// Profiles not listed start right away
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": {"profile": "logs"}}`)
+	if !tunnel.hasSession("s2") {
+		t.Fatal("Expected s2 to start without approval")
+	}
+	tunnel.onEnd("s2")
+	nextOfType(t, messages, typeEnd)
+
+	// Denied by flag-file
+	tunnel.onMessage(`{"type": "start", "sessionID": "s/3", "payload": null}`)
+	base := filepath.Join(dir, "s%2F3")
+	for _, err := os.Stat(base + ".pending"); err != nil; _, err = os.Stat(base + ".pending") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := os.WriteFile(base+".deny", []byte("maintenance running\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectDenied(t, messages, "s/3", "denied by local operator: maintenance running")
+	tunnel.sessionsWait.Wait()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the flag-files to be removed, got %v", files)
+	}
+
+	// Session IDs do not escape the directory of the flag-files
+	for sessionID, name := range map[string]string{"..": "%2E%2E", "../s5": "%2E%2E%2Fs5", "": ""} {
+		tunnel.onMessage(fmt.Sprintf(`{"type": "start", "sessionID": %q, "payload": null}`, sessionID))
+		nextOfType(t, messages, typeStatus)
+		path := filepath.Join(dir, name+".pending")
+		for _, err := os.Stat(path); err != nil; _, err = os.Stat(path) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := tunnel.DenySession(sessionID, ""); err != nil {
+			t.Fatal(err)
+		}
+		expectDenied(t, messages, sessionID, "denied by local operator")
+	}
+	tunnel.sessionsWait.Wait()
+	if files, _ := os.ReadDir(filepath.Dir(dir)); len(files) != 1 {
+		t.Fatalf("Expected no flag-files outside the directory, got %v", files)
+	}
+
+	// Cancelled by the cloud
+	tunnel.onMessage(`{"type": "start", "sessionID": "s4", "payload": null}`)
+	nextOfType(t, messages, typeStatus)
+	tunnel.onEnd("s4")
+	if message := nextMessage(t, messages); message.Type != typeEnd || message.SessionID != "s4" || message.Reason != reasonCancelled {
+		t.Fatalf("Expected s4 to end, got %+v", message)
+	}
+
+	// Decided by the hook, or rejected once the timeout expires
+	options.Approval = &Approval{Timeout: time.Second, Hook: newHook(t, `[ "$EVENT_ROLE" = operator ] || { echo "role $EVENT_ROLE"; exit 1; }`)}
+	tunnel.SetOptions(options)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s5", "payload": {"role": "guest"}}`)
+	expectDenied(t, messages, "s5", "denied by local operator: role guest")
+	tunnel.onMessage(`{"type": "start", "sessionID": "s6", "payload": {"role": "operator"}}`)
+	nextOfType(t, messages, typeStatus)
+	if message := nextOfType(t, messages, typeStatus); message.Payload.(map[string]interface{})["state"] != stateApproved {
+		t.Fatalf("Expected s6 to be approved by the hook, got %+v", message)
+	}
+	options.Approval = &Approval{Timeout: 100 * time.Millisecond}
+	tunnel.SetOptions(options)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s7", "payload": null}`)
+	message = nextOfType(t, messages, typeError)
+	if message.SessionID != "s7" || message.Payload.(map[string]interface{})["message"] != reasonApprovalTimeout {
+		t.Fatalf("Expected s7 to time out, got %+v", message)
+	}
+
+	// Shutdown rejects the pending sessions
+	options.Approval = &Approval{Timeout: time.Minute}
+	tunnel.SetOptions(options)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s8", "payload": null}`)
+	tunnel.Shutdown(5 * time.Second)
+	message = nextOfType(t, messages, typeError)
+	if message.SessionID != "s8" || message.Payload.(map[string]interface{})["code"] != errCodeShuttingDown {
+		t.Fatalf("Expected s8 to be rejected, got %+v", message)
+	}
+}
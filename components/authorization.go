@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Authorization makes start messages carry a token signed by the cloud, a JWT signed with
+// Ed25519 ("alg": "EdDSA"). Its claims name the operator ("sub"), the session ("sid"), the
+// profile and the expiry ("exp"), and optionally the role, "nbf", "iat" and "aud".
+type Authorization struct {
+	Keys        map[string]ed25519.PublicKey // By key ID ("kid"), tokens without a kid are checked against every key
+	Audience    string                       // Required in the "aud" claim when set, e.g. the ID of the device
+	MaxLifetime time.Duration                // Tokens expiring further in the future are refused
+	Leeway      time.Duration                // Tolerated clock skew
+}
+
+// authorizationClaims are the claims of a token
+type authorizationClaims struct {
+	Operator  string      `json:"sub"`
+	SessionID string      `json:"sid"`
+	Profile   string      `json:"profile"`
+	Role      string      `json:"role"`
+	Expires   *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+	IssuedAt  *int64      `json:"iat"`
+	Audience  interface{} `json:"aud"` // A string or a list of strings
+}
+
+// verify checks a token authorizing sessionID to start profile, and returns its claims. The
+// claims are empty unless the signature is valid.
+func (authorization *Authorization) verify(token string, sessionID string, profile string, now time.Time) (authorizationClaims, error) {
+	var claims authorizationClaims
+	if token == "" {
+		return claims, errors.New("missing authorization token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed authorization token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return claims, errors.New("malformed authorization token header")
+	}
+	if header.Algorithm != "EdDSA" {
+		return claims, fmt.Errorf("unsupported token algorithm %q", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed authorization token signature")
+	}
+	if !authorization.checkSignature(header.KeyID, []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, errors.New("invalid authorization token signature")
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return authorizationClaims{}, errors.New("malformed authorization token claims")
+	}
+
+	// Signed by the cloud, the claims are trusted from here on
+	refuse := func(format string, args ...interface{}) (authorizationClaims, error) {
+		return claims, fmt.Errorf(format, args...)
+	}
+	switch {
+	case claims.Operator == "":
+		return refuse("authorization token does not name the operator")
+	case claims.Expires == nil:
+		return refuse("authorization token does not expire")
+	case now.After(time.Unix(*claims.Expires, 0).Add(authorization.Leeway)):
+		return refuse("authorization token expired")
+	case authorization.MaxLifetime > 0 && time.Unix(*claims.Expires, 0).After(now.Add(authorization.MaxLifetime+authorization.Leeway)):
+		return refuse("authorization token is valid for longer than %s", authorization.MaxLifetime)
+	case claims.NotBefore != nil && now.Add(authorization.Leeway).Before(time.Unix(*claims.NotBefore, 0)):
+		return refuse("authorization token is not valid yet")
+	case claims.IssuedAt != nil && now.Add(authorization.Leeway).Before(time.Unix(*claims.IssuedAt, 0)):
+		return refuse("authorization token is issued in the future")
+	case claims.SessionID != sessionID:
+		return refuse("authorization token is for session %q", claims.SessionID)
+	case claims.Profile != profile:
+		return refuse("authorization token is for profile %q", claims.Profile)
+	case authorization.Audience != "" && !claims.hasAudience(authorization.Audience):
+		return refuse("authorization token is not for this device")
+	}
+	return claims, nil
+}
+
+// checkSignature verifies the signature with the key named, or with every key
+func (authorization *Authorization) checkSignature(keyID string, signed []byte, signature []byte) bool {
+	if keyID != "" {
+		key, ok := authorization.Keys[keyID]
+		return ok && ed25519.Verify(key, signed, signature)
+	}
+	for _, key := range authorization.Keys {
+		if ed25519.Verify(key, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAudience tells if the "aud" claim names audience
+func (claims authorizationClaims) hasAudience(audience string) bool {
+	switch aud := claims.Audience.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeTokenPart decodes the base64url JSON of a token part
+func decodeTokenPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// authorize verifies the token of a start request, and takes the operator and role from it.
+// Tokens are accepted once, so that a start message can not be replayed. It returns false if
+// the session was rejected.
+func (tunnel *SocketTunnel) authorize(sessionID string, options TunnelOptions, profileName string, request *startRequest) bool {
+	if options.Authorization == nil {
+		return true
+	}
+	now := time.Now()
+	claims, err := options.Authorization.verify(request.token, sessionID, profileName, now)
+	if err == nil && request.role != "" && claims.Role != request.role {
+		err = fmt.Errorf("authorization token is for role %q", claims.Role)
+	}
+	if err == nil && !tunnel.useToken(sessionID, time.Unix(*claims.Expires, 0).Add(options.Authorization.Leeway), now) {
+		err = errors.New("authorization token already used")
+	}
+	if err != nil {
+		tunnel.logger.Warn("Rejecting new session, not authorized", zap.String("sessionID", sessionID), zap.String("profile", profileName),
+			zap.String("operator", claims.Operator), zap.Error(err))
+		tunnel.sendEnvelope(envelope{
+			Type:      typeError,
+			Payload:   errorPayload{Code: errCodeUnauthorized, Message: err.Error()},
+			SessionID: sessionID,
+		})
+		tunnel.end(sessionID, err.Error())
+		tunnel.events.Publish(Event{Type: EventError, SessionID: sessionID, Profile: profileName, Operator: claims.Operator, Code: errCodeUnauthorized, Reason: err.Error()})
+		return false
+	}
+	request.operator = claims.Operator
+	request.role = claims.Role
+	tunnel.logger.Info("Session authorized", zap.String("sessionID", sessionID), zap.String("profile", profileName),
+		zap.String("operator", claims.Operator), zap.String("role", claims.Role))
+	tunnel.events.Publish(Event{Type: EventAuthorized, SessionID: sessionID, Profile: profileName, Operator: claims.Operator, Role: claims.Role})
+	return true
+}
+
+// useToken records the token of a session until it expires, it returns false if it was already used
+func (tunnel *SocketTunnel) useToken(sessionID string, expires time.Time, now time.Time) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	for id, expiry := range tunnel.usedTokens {
+		if now.After(expiry) {
+			delete(tunnel.usedTokens, id)
+		}
+	}
+	if _, ok := tunnel.usedTokens[sessionID]; ok {
+		return false
+	}
+	tunnel.usedTokens[sessionID] = expires
+	return true
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken returns a JWT of claims signed with key
+func signToken(key ed25519.PrivateKey, keyID string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": keyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+func TestAuthorizationVerify(t *testing.T) {
+	oldPublic, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newPublic, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, strangerKey, _ := ed25519.GenerateKey(rand.Reader)
+	authorization := &Authorization{
+		Keys:        map[string]ed25519.PublicKey{"2023": oldPublic, "2024": newPublic},
+		Audience:    "gateway-1",
+		MaxLifetime: 5 * time.Minute,
+		Leeway:      30 * time.Second,
+	}
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alice", "sid": "s1", "profile": "admin", "exp": now.Add(time.Minute).Unix(), "iat": now.Unix(), "aud": "gateway-1"}
+		for key, value := range changes {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		return claims
+	}
+	valid := signToken(newKey, "2024", claims(nil))
+	for _, token := range []string{valid, signToken(oldKey, "2023", claims(nil)), signToken(oldKey, "", claims(map[string]interface{}{"aud": []string{"other", "gateway-1"}}))} {
+		if verified, err := authorization.verify(token, "s1", "admin", now); err != nil || verified.Operator != "alice" {
+			t.Fatalf("Expected %s to be valid, got %+v %v", token, verified, err)
+		}
+	}
+
+	parts := strings.Split(valid, ".")
+	for token, expected := range map[string]string{
+		"":                                      "missing authorization token",
+		"not-a-token":                           "malformed authorization token",
+		signToken(strangerKey, "", claims(nil)): "invalid authorization token signature",
+		signToken(newKey, "2023", claims(nil)):  "invalid authorization token signature", // Signed with another key than named
+		signToken(newKey, "2025", claims(nil)):  "invalid authorization token signature",
+		parts[0] + "." + parts[1] + "x." + parts[2]:                                                     "invalid authorization token signature",
+		"eyJhbGciOiJub25lIn0." + parts[1] + ".":                                                         `unsupported token algorithm "none"`,
+		signToken(newKey, "", claims(map[string]interface{}{"sub": nil})):                               "does not name the operator",
+		signToken(newKey, "", claims(map[string]interface{}{"exp": nil})):                               "does not expire",
+		signToken(newKey, "", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})):      "expired",
+		signToken(newKey, "", claims(map[string]interface{}{"exp": now.Add(time.Hour).Unix()})):         "valid for longer than 5m0s",
+		signToken(newKey, "", claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})):   "not valid yet",
+		signToken(newKey, "", claims(map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()})):   "issued in the future",
+		signToken(newKey, "", claims(map[string]interface{}{"sid": "s2"})):                              `for session "s2"`,
+		signToken(newKey, "", claims(map[string]interface{}{"profile": "default"})):                     `for profile "default"`,
+		signToken(newKey, "", claims(map[string]interface{}{"aud": "gateway-2"})):                       "not for this device",
+		signToken(newKey, "", claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})): "", // Within the leeway
+	} {
+		_, err := authorization.verify(token, "s1", "admin", now)
+		if expected == "" && err != nil || expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Errorf("%s: expected %q, got %v", token, expected, err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}, "admin": {Spec: spec, AllowedRoles: []string{"admin"}}},
+		DefaultProfile: "default",
+		Authorization:  &Authorization{Keys: map[string]ed25519.PublicKey{"k1": public}, MaxLifetime: time.Minute},
+	})
+	events := make(chan Event, 16)
+	tunnel.Events().Subscribe(EventFunc(func(event Event) { events <- event }), EventAuthorized, EventError, EventSessionStarted)
+	start := func(sessionID string, token string) string {
+		return fmt.Sprintf(`{"type": "start", "sessionID": %q, "payload": {"profile": "admin", "token": %q}}`, sessionID, token)
+	}
+	token := signToken(key, "k1", map[string]interface{}{"sub": "alice", "sid": "s1", "profile": "admin", "role": "admin", "exp": time.Now().Add(time.Minute).Unix()})
+
+	// The operator and role are taken from the token
+	tunnel.onMessage(start("s1", token))
+	if sessions := tunnel.Sessions(); len(sessions) != 1 || sessions[0].Operator != "alice" || sessions[0].Role != "admin" {
+		t.Fatalf("Expected a session of alice, got %+v", sessions)
+	}
+	if event := <-events; event.Type != EventAuthorized || event.Operator != "alice" || event.Profile != "admin" {
+		t.Fatalf("Expected the authorization audited, got %+v", event)
+	}
+	if event := <-events; event.Type != EventSessionStarted || event.Operator != "alice" {
+		t.Fatalf("Expected the session of alice started, got %+v", event)
+	}
+	tunnel.onEnd("s1")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+
+	// Replayed, unsigned and mismatching starts are rejected and audited
+	for _, test := range []struct {
+		message  string
+		operator string
+		reason   string
+	}{
+		{start("s1", token), "alice", "already used"},
+		{`{"type": "start", "sessionID": "s2", "payload": {"profile": "admin", "role": "admin"}}`, "", "missing authorization token"},
+		{strings.Replace(start("s3", token), `"profile": "admin"`, `"profile": "admin", "role": "operator"`, 1), "alice", `for session "s1"`},
+	} {
+		tunnel.onMessage(test.message)
+		message := nextMessage(t, messages)
+		if payload, ok := message.Payload.(map[string]interface{}); !ok || message.Type != typeError || payload["code"] != errCodeUnauthorized ||
+			!strings.Contains(payload["message"].(string), test.reason) {
+			t.Fatalf("Expected an unauthorized error %q, got %+v", test.reason, message)
+		}
+		if message := nextMessage(t, messages); message.Type != typeEnd {
+			t.Fatalf("Expected an end message, got %+v", message)
+		}
+		if event := <-events; event.Type != EventError || event.Code != errCodeUnauthorized || event.Operator != test.operator || !strings.Contains(event.Reason, test.reason) {
+			t.Fatalf("Expected the rejection audited, got %+v", event)
+		}
+	}
+	token = signToken(key, "k1", map[string]interface{}{"sub": "bob", "sid": "s4", "profile": "admin", "role": "admin", "exp": time.Now().Add(time.Minute).Unix()})
+	tunnel.onMessage(strings.Replace(start("s4", token), `"profile": "admin"`, `"profile": "admin", "role": "operator"`, 1))
+	if message := nextMessage(t, messages); message.Type != typeError || !strings.Contains(message.Payload.(map[string]interface{})["message"].(string), `for role "admin"`) {
+		t.Fatalf("Expected a role mismatch, got %+v", message)
+	}
+}
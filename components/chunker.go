@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+const (
+	escape   = 0x1b
+	bell     = 0x07
+	maxCarry = 4096 // Longer escape sequences are sent unfinished, e.g. of binary output
+)
+
+// outputChunker cuts the output of a terminal into chunks holding whole characters and escape
+// sequences. The end of a read that is an incomplete UTF-8 sequence, or an escape sequence
+// still waiting for its final byte or terminator, is carried over to the next read. Sent as it
+// is, JSON encoding would replace the bytes of a split character by U+FFFD.
+type outputChunker struct {
+	carry []byte
+}
+
+// next returns the complete part of the output read so far
+func (chunker *outputChunker) next(data []byte) string {
+	if len(chunker.carry) > 0 {
+		data = append(chunker.carry, data...)
+	}
+	complete := incompleteTail(data)
+	chunker.carry = append([]byte(nil), data[complete:]...)
+	return string(data[:complete])
+}
+
+// flush returns the output carried over, once the terminal was closed
+func (chunker *outputChunker) flush() string {
+	rest := string(chunker.carry)
+	chunker.carry = nil
+	return rest
+}
+
+// incompleteTail returns where the incomplete sequence at the end of data starts, or len(data)
+func incompleteTail(data []byte) int {
+	window := 0
+	if len(data) > maxCarry {
+		window = len(data) - maxCarry
+	}
+	if start := bytes.LastIndexByte(data[window:], escape); start >= 0 && !escapeComplete(data[window+start:]) {
+		// An escape character ending the read may start the ST of a string sequence
+		if previous := bytes.LastIndexByte(data[window:window+start], escape); start == len(data)-window-1 && previous >= 0 &&
+			isStringSequence(data[window+previous:]) && !escapeComplete(data[window+previous:window+start]) {
+			return window + previous
+		}
+		return window + start
+	}
+	// A character is at most utf8.UTFMax bytes long, look for the start of the last one
+	for start := len(data) - 1; start >= 0 && start >= len(data)-utf8.UTFMax; start-- {
+		if utf8.RuneStart(data[start]) {
+			if !utf8.FullRune(data[start:]) {
+				return start
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// escapeComplete tells if the escape sequence starting sequence ends in it, or can not be
+// completed any more. The sequence holds no further escape character but a terminating ST.
+func escapeComplete(sequence []byte) bool {
+	if len(sequence) < 2 {
+		return false
+	}
+	if isStringSequence(sequence) {
+		return bytes.IndexByte(sequence[2:], bell) >= 0
+	}
+	if sequence[1] == '[' { // CSI: parameter and intermediate bytes, then the final byte
+		for _, b := range sequence[2:] {
+			if b < 0x20 || b > 0x3f {
+				return true
+			}
+		}
+		return false
+	}
+	// nF escape sequences, e.g. ESC ( B: intermediate bytes, then the final byte
+	for _, b := range sequence[1:] {
+		if b < 0x20 || b > 0x2f {
+			return true
+		}
+	}
+	return false
+}
+
+// isStringSequence tells if sequence is an OSC, DCS, APC, PM or SOS, a string terminated by ST or BEL
+func isStringSequence(sequence []byte) bool {
+	return len(sequence) >= 2 && bytes.IndexByte([]byte("]P_^X"), sequence[1]) >= 0
+}
+
+// utf8Boundary returns the largest cut of output no longer than limit that does not split a character,
+// 0 if the first character is longer than limit
+func utf8Boundary(output string, limit int) int {
+	if limit >= len(output) {
+		return len(output)
+	}
+	for cut := limit; cut >= 0 && cut > limit-utf8.UTFMax; cut-- {
+		if cut == 0 || utf8.RuneStart(output[cut]) {
+			return cut
+		}
+	}
+	return limit // Not UTF-8
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// Output the chunks of which must arrive intact
+var chunkerSamples = map[string]string{
+	"cjk":     "终端会话已建立。日本語のテキスト、한국어 텍스트。",
+	"emoji":   "build ✅ deploy 🚀 family 👨‍👩‍👧‍👦 flag 🇩🇪 skin 👍🏽",
+	"colours": "\x1b[1;31merror\x1b[0m \x1b[38;5;208morange\x1b[0m \x1b[38;2;255;128;0mtrue colour 🎨\x1b[0m\x1b[K\x1b[?25l\x1b[12;40H",
+	"osc":     "\x1b]0;user@gateway: ~/日志\x07prompt \x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\ \x1b(B\x1b)0\x1bPq#0;2;0;0;0\x1b\\",
+}
+
+// checkChunks checks that every chunk survives JSON encoding and ends with a whole character and
+// escape sequence, and that the chunks make up expected
+func checkChunks(t *testing.T, name string, chunks []string, expected string) {
+	t.Helper()
+	for _, chunk := range chunks {
+		encoded, _ := json.Marshal(chunk)
+		var decoded string
+		json.Unmarshal(encoded, &decoded)
+		if !utf8.ValidString(chunk) || decoded != chunk || incompleteTail([]byte(chunk)) != len(chunk) {
+			t.Fatalf("%s: corrupted chunk %q", name, chunk)
+		}
+	}
+	if joined := strings.Join(chunks, ""); joined != expected {
+		t.Fatalf("%s: expected %q, got %q", name, expected, joined)
+	}
+}
+
+func TestOutputChunker(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for name, sample := range chunkerSamples {
+		// Split at every position
+		for split := 0; split <= len(sample); split++ {
+			var chunker outputChunker
+			chunks := []string{chunker.next([]byte(sample[:split])), chunker.next([]byte(sample[split:]))}
+			if chunker.flush() != "" {
+				t.Fatalf("%s: expected nothing carried at the end", name)
+			}
+			checkChunks(t, name, chunks, sample)
+		}
+		// Reads of random sizes
+		text := strings.Repeat(sample, 50)
+		var chunker outputChunker
+		var chunks []string
+		for start := 0; start < len(text); {
+			end := start + 1 + random.Intn(64)
+			if end > len(text) {
+				end = len(text)
+			}
+			chunks = append(chunks, chunker.next([]byte(text[start:end])))
+			start = end
+		}
+		checkChunks(t, name, chunks, text)
+	}
+
+	// What is left is sent when the terminal closes
+	var chunker outputChunker
+	if chunk := chunker.next([]byte("abc\x1b[1;3")); chunk != "abc" || chunker.flush() != "\x1b[1;3" {
+		t.Fatalf("Expected the unfinished sequence carried, got %q", chunk)
+	}
+	// Unterminated sequences are not held back for ever, e.g. in binary output
+	chunker = outputChunker{}
+	output := chunker.next([]byte("\x1b]" + strings.Repeat("x", 2*maxCarry)))
+	if len(output) < maxCarry || len(chunker.carry) > maxCarry {
+		t.Fatalf("Expected the carry to be bounded, sent %d and carried %d bytes", len(output), len(chunker.carry))
+	}
+}
+
+func TestUTF8Boundary(t *testing.T) {
+	for _, test := range []struct {
+		output string
+		limit  int
+		cut    int
+	}{
+		{"abc", 2, 2},
+		{"abc", 5, 3},
+		{"a世b", 2, 1},
+		{"a世b", 4, 4},
+		{"🚀x", 3, 0},
+		{"\xff\xff\xff\xff\xff", 3, 3},
+	} {
+		if cut := utf8Boundary(test.output, test.limit); cut != test.cut {
+			t.Errorf("%q cut at %d: expected %d, got %d", test.output, test.limit, test.cut, cut)
+		}
+	}
+}
+
+func TestTerminalChunks(t *testing.T) {
+	// Printed by cat, the output arrives in reads of the terminal's buffer size
+	var expected strings.Builder
+	for i := 0; i < 200; i++ {
+		for _, name := range []string{"cjk", "emoji", "colours", "osc"} {
+			fmt.Fprintf(&expected, "%d %s\r\n", i, chunkerSamples[name])
+		}
+	}
+	file := filepath.Join(t.TempDir(), "output")
+	os.WriteFile(file, []byte(strings.ReplaceAll(expected.String(), "\r\n", "\n")), 0644)
+	spec, _ := NewSessionSpec("/bin/cat " + file)
+	output := make(chan string, 1024)
+	closed := make(chan struct{})
+	term, err := NewTerminal(spec, zap.NewNop(), func(chunk string) { output <- chunk }, func(error) { close(closed) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout, cat did not exit")
+	}
+	close(output)
+	var chunks []string
+	for chunk := range output {
+		chunks = append(chunks, chunk)
+	}
+	checkChunks(t, "terminal", chunks, expected.String())
+}
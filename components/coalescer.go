@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"sync"
+	"time"
+)
+
+// Coalescing batches the output of a session, so that floods (e.g. dmesg) are sent
+// in fewer, larger messages instead of one message per read of the terminal
+type Coalescing struct {
+	Window   time.Duration // How long output is held back at most, disabled when 0
+	MaxBytes int           // Output held back is sent without waiting once it reaches this size, no limit when 0
+}
+
+// outputQueue passes output on in the order it was pushed, without the lock of the pushing side
+// being held while the output waits, e.g. for credit granted on the goroutine reading the socket
+type outputQueue struct {
+	mutex   *sync.Mutex
+	drained *sync.Cond
+	queued  []string
+	busy    bool // A goroutine passes the output queued on
+	output  func(string)
+}
+
+func newOutputQueue(output func(string)) *outputQueue {
+	mutex := &sync.Mutex{}
+	return &outputQueue{mutex: mutex, drained: sync.NewCond(mutex), output: output}
+}
+
+// push queues output, the caller may hold its own lock to keep the order
+func (queue *outputQueue) push(output string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.queued = append(queue.queued, output)
+}
+
+// drain passes the output queued on. When another goroutine is at it, drain returns at once,
+// or with wait set once that goroutine is done, so that the caller is held back with the output.
+func (queue *outputQueue) drain(wait bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.busy {
+		for wait && queue.busy {
+			queue.drained.Wait()
+		}
+		return
+	}
+	queue.busy = true
+	for len(queue.queued) > 0 {
+		output := queue.queued[0]
+		queue.queued = queue.queued[1:]
+		queue.mutex.Unlock()
+		queue.output(output)
+		queue.mutex.Lock()
+	}
+	queue.busy = false
+	queue.drained.Broadcast()
+}
+
+// coalescer collects the output of a session and hands it to flush in batches
+type coalescer struct {
+	mutex      *sync.Mutex
+	coalescing Coalescing
+	buffer     []byte
+	generation int // Tells a timer of an earlier batch from the one of the current batch
+	timer      *time.Timer
+	closed     bool
+	queue      *outputQueue // Of the batches to flush
+}
+
+func newCoalescer(coalescing Coalescing, flush func(string)) *coalescer {
+	return &coalescer{mutex: &sync.Mutex{}, coalescing: coalescing, queue: newOutputQueue(flush)}
+}
+
+// write adds output to the current batch, which is flushed once the window elapsed since
+// its first output or it reached the size threshold. Batches are flushed in order, a flush
+// blocking on a full send-queue or waiting for credit holds back the terminal.
+func (coalescer *coalescer) write(output string) {
+	coalescer.mutex.Lock()
+	if coalescer.closed {
+		coalescer.mutex.Unlock()
+		return
+	}
+	if coalescer.coalescing.Window <= 0 {
+		coalescer.queue.push(output)
+	} else {
+		if len(coalescer.buffer) == 0 {
+			generation := coalescer.generation
+			coalescer.timer = time.AfterFunc(coalescer.coalescing.Window, func() { coalescer.expire(generation) })
+		}
+		coalescer.buffer = append(coalescer.buffer, output...)
+		if coalescer.coalescing.MaxBytes > 0 && len(coalescer.buffer) >= coalescer.coalescing.MaxBytes {
+			coalescer.flushBuffer()
+		}
+	}
+	coalescer.mutex.Unlock()
+	coalescer.queue.drain(true)
+}
+
+// expire flushes the batch the timer was started for, unless it was flushed already
+func (coalescer *coalescer) expire(generation int) {
+	coalescer.mutex.Lock()
+	if generation == coalescer.generation {
+		coalescer.flushBuffer()
+	}
+	coalescer.mutex.Unlock()
+	coalescer.queue.drain(false)
+}
+
+// close flushes the output held back, later output is dropped
+func (coalescer *coalescer) close() {
+	coalescer.mutex.Lock()
+	coalescer.flushBuffer()
+	coalescer.closed = true
+	coalescer.mutex.Unlock()
+	coalescer.queue.drain(true)
+}
+
+// flushBuffer queues the current batch and starts the next, the mutex must be held
+func (coalescer *coalescer) flushBuffer() {
+	if coalescer.timer != nil {
+		coalescer.timer.Stop()
+		coalescer.timer = nil
+	}
+	coalescer.generation++
+	if len(coalescer.buffer) == 0 {
+		return
+	}
+	coalescer.queue.push(string(coalescer.buffer))
+	coalescer.buffer = coalescer.buffer[:0]
+}
@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestCoalescer(t *testing.T) {
+	flushed := make(chan string, 16)
+	coalescer := newCoalescer(Coalescing{Window: 50 * time.Millisecond, MaxBytes: 10}, func(output string) { flushed <- output })
+	expect := func(expected string, within time.Duration) {
+		select {
+		case output := <-flushed:
+			if output != expected {
+				t.Fatalf("Expected %q flushed, got %q", expected, output)
+			}
+		case <-time.After(within):
+			t.Fatalf("Expected %q flushed within %s", expected, within)
+		}
+	}
+
+	// Held back until the window elapsed
+	coalescer.write("ab")
+	coalescer.write("cd")
+	select {
+	case output := <-flushed:
+		t.Fatalf("Expected the output held back, got %q", output)
+	case <-time.After(20 * time.Millisecond):
+	}
+	expect("abcd", time.Second)
+
+	// Sent without waiting once the size threshold is reached
+	coalescer.write("0123")
+	coalescer.write("456789ab")
+	expect("0123456789ab", 10*time.Millisecond)
+
+	// Closing flushes what is left, later output is dropped
+	coalescer.write("tail")
+	coalescer.close()
+	expect("tail", 10*time.Millisecond)
+	coalescer.write("dropped")
+	select {
+	case output := <-flushed:
+		t.Fatalf("Expected no output after close, got %q", output)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without a window every write is sent as is
+	coalescer = newCoalescer(Coalescing{}, func(output string) { flushed <- output })
+	coalescer.write("x")
+	expect("x", 10*time.Millisecond)
+}
+
+// floodOutput is the output of a kernel log flood, as printed by dmesg
+func floodOutput(lines int) string {
+	var output strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&output, "[%12.6f] usb 1-1.%d: new high-speed USB device number %d using xhci_hcd\r\n", float64(i)*0.000731, i%4, i%128)
+	}
+	return output.String()
+}
+
+// sendFlood feeds output to a session in reads of the terminal's buffer size and returns the
+// number of messages sent and their size, compressed per message as with permessage-deflate
+func sendFlood(output string, coalescing Coalescing, compress bool) (int, int) {
+	messages, size := 0, 0
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestSpeed) // The level of gorilla/websocket
+	coalescer := newCoalescer(coalescing, func(output string) {
+		message, _ := json.Marshal(envelope{Type: typeOutput, Payload: output, SessionID: "2c8b7c5e-41d6-4b86-8f5c-8f2f0c1c9a3e"})
+		messages++
+		if !compress {
+			size += len(message)
+			return
+		}
+		compressed.Reset()
+		writer.Reset(&compressed)
+		writer.Write(message)
+		writer.Flush()
+		size += compressed.Len() - 4 // Without the empty block trailing the flush
+	})
+	for start := 0; start < len(output); start += 1024 {
+		coalescer.write(output[start:min(start+1024, len(output))])
+	}
+	coalescer.close()
+	return messages, size
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestOutputFloodReduction(t *testing.T) {
+	output := floodOutput(10000)
+	coalescing := Coalescing{Window: 10 * time.Millisecond, MaxBytes: 16384}
+	perRead, perReadBytes := sendFlood(output, Coalescing{}, false)
+	coalesced, coalescedBytes := sendFlood(output, coalescing, false)
+	_, compressedBytes := sendFlood(output, coalescing, true)
+	if coalesced*10 > perRead || coalescedBytes >= perReadBytes {
+		t.Fatalf("Expected coalescing to send fewer messages and bytes, got %d/%d messages and %d/%d bytes", coalesced, perRead, coalescedBytes, perReadBytes)
+	}
+	if compressedBytes*4 > coalescedBytes {
+		t.Fatalf("Expected compression to shrink the flood, got %d of %d bytes", compressedBytes, coalescedBytes)
+	}
+}
+
+// BenchmarkOutputFlood reports the messages and bytes a dmesg flood of about 1 MB is sent in
+func BenchmarkOutputFlood(b *testing.B) {
+	output := floodOutput(13000)
+	coalescing := Coalescing{Window: 10 * time.Millisecond, MaxBytes: 16384}
+	for _, benchmark := range []struct {
+		name       string
+		coalescing Coalescing
+		compress   bool
+	}{
+		{"per-read", Coalescing{}, false},
+		{"coalesced", coalescing, false},
+		{"per-read-deflate", Coalescing{}, true},
+		{"coalesced-deflate", coalescing, true},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.SetBytes(int64(len(output)))
+			var messages, size int
+			for i := 0; i < b.N; i++ {
+				messages, size = sendFlood(output, benchmark.coalescing, benchmark.compress)
+			}
+			b.ReportMetric(float64(messages), "messages/flood")
+			b.ReportMetric(float64(size), "sent-bytes/flood")
+		})
+	}
+}
+
+// countingListener counts the bytes read from the connections it accepts
+type countingListener struct {
+	net.Listener
+	read *atomic.Int64
+}
+
+func (listener countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	return countingConn{Conn: conn, read: listener.read}, err
+}
+
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (conn countingConn) Read(data []byte) (int, error) {
+	n, err := conn.Conn.Read(data)
+	conn.read.Add(int64(n))
+	return n, err
+}
+
+func TestSocketCompression(t *testing.T) {
+	message, _ := json.Marshal(envelope{Type: typeOutput, Payload: floodOutput(500), SessionID: "s1"})
+	for _, compression := range []bool{true, false} {
+		read := &atomic.Int64{}
+		offered := make(chan bool, 1)
+		received := make(chan []byte, 1)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offered <- strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+			upgrader := websocket.Upgrader{EnableCompression: true}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, data, _ := conn.ReadMessage()
+			received <- data
+			conn.ReadMessage() // Until closed
+		}))
+		server.Listener = countingListener{Listener: server.Listener, read: read}
+		server.Start()
+
+		tunnel := NewTunnel("ws://"+server.Listener.Addr().String(), TunnelOptions{Compression: compression}, zap.NewNop())
+		go tunnel.Connect()
+		tunnel.socket.Send(message)
+		if <-offered != compression {
+			t.Fatalf("Expected permessage-deflate offered: %v", compression)
+		}
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, message) {
+				t.Fatal("Message corrupted")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout, message not received")
+		}
+		if wire := int(read.Load()); compression && wire*4 > len(message) || !compression && wire < len(message) {
+			t.Fatalf("Unexpected %d bytes on the wire for a message of %d bytes, compression %v", wire, len(message), compression)
+		}
+		tunnel.Close()
+		server.Close()
+	}
+}
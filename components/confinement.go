@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+// Confinement restricts the shell of a session and everything it runs, on Linux. Landlock
+// limits the file-system to the listed paths and a seccomp filter makes the denied system
+// calls fail with EPERM, each denial is logged by pe-terminal. A confined shell can not
+// gain privileges, e.g. through sudo.
+type Confinement struct {
+	Name         string
+	ReadOnly     []string // Readable and executable with everything beneath, the file-system is not restricted if both are empty
+	ReadWrite    []string // Writable too
+	DenySyscalls []string // By name, e.g. "mount"
+	DenyNetwork  bool     // Only Unix sockets can be created
+}
+
+// adminSyscalls change the system, load code into the kernel or reach into other processes
+var adminSyscalls = []string{
+	"mount", "umount2", "pivot_root", "chroot", "open_tree", "move_mount", "fsopen", "fsconfig", "fsmount", "fspick", "mount_setattr",
+	"reboot", "kexec_load", "kexec_file_load", "init_module", "finit_module", "delete_module", "swapon", "swapoff",
+	"settimeofday", "clock_settime", "clock_adjtime", "adjtimex", "sethostname", "setdomainname", "acct", "quotactl", "syslog",
+	"ptrace", "process_vm_readv", "process_vm_writev", "perf_event_open", "bpf", "userfaultfd", "kcmp",
+	"unshare", "setns", "keyctl", "add_key", "request_key", "open_by_handle_at", "name_to_handle_at",
+}
+
+// ConfinementProfiles returns the built-in confinements by name. Paths missing on the
+// gateway are skipped.
+func ConfinementProfiles() map[string]Confinement {
+	return map[string]Confinement{
+		// Look around, without changing anything besides temporary files
+		"diagnostics-readonly": {
+			Name:         "diagnostics-readonly",
+			ReadOnly:     []string{"/"},
+			ReadWrite:    []string{"/tmp", "/var/tmp", sandboxScratch, "/dev/null", "/dev/zero", "/dev/tty", "/dev/pts"},
+			DenySyscalls: adminSyscalls,
+		},
+		// No connections to or from the network, io_uring could open sockets too
+		"no-network": {
+			Name:         "no-network",
+			DenySyscalls: []string{"io_uring_setup"},
+			DenyNetwork:  true,
+		},
+	}
+}
+
+// restrictsFiles tells if the confinement uses Landlock
+func (confinement *Confinement) restrictsFiles() bool {
+	return len(confinement.ReadOnly) > 0 || len(confinement.ReadWrite) > 0
+}
+
+// filtersSyscalls tells if the confinement uses seccomp
+func (confinement *Confinement) filtersSyscalls() bool {
+	return len(confinement.DenySyscalls) > 0 || confinement.DenyNetwork
+}
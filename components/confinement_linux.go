@@ -0,0 +1,399 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// Landlock, see linux/landlock.h, the system calls have the same numbers on every architecture
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulesetVersion   = 1 << 0
+	landlockRulePathBeneath  = 1
+
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+	accessRefer      = 1 << 13 // ABI 2
+	accessTruncate   = 1 << 14 // ABI 3
+
+	accessV1       = 1<<13 - 1
+	accessReadOnly = accessExecute | accessReadFile | accessReadDir
+	accessFile     = accessExecute | accessWriteFile | accessReadFile | accessTruncate // The rights applying to files rather than directories
+)
+
+// seccomp, see linux/seccomp.h
+const (
+	seccompSetModeFilter     = 1
+	seccompFlagNewListener   = 1 << 3
+	seccompRetAllow          = 0x7fff0000
+	seccompRetUserNotif      = 0x7fc00000
+	seccompRetErrno          = 0x00050000
+	seccompIoctlNotifRecv    = 0xc0502100 // SECCOMP_IOCTL_NOTIF_RECV
+	seccompIoctlNotifSend    = 0xc0182101 // SECCOMP_IOCTL_NOTIF_SEND
+	seccompDataNr            = 0          // Offsets in struct seccomp_data
+	seccompDataArch          = 4
+	seccompDataArg0          = 16
+	prSetNoNewPrivs          = 38
+	oPath                    = 0x200000 // O_PATH
+	confinementListenerFd    = 3        // The helper sends the seccomp listener to pe-terminal on this socket
+	confinementListenerLabel = "seccomp-listener"
+)
+
+// seccompNotif is struct seccomp_notif
+type seccompNotif struct {
+	id    uint64
+	pid   uint32
+	flags uint32
+	nr    int32
+	arch  uint32
+	ip    uint64
+	args  [6]uint64
+}
+
+// seccompNotifResp is struct seccomp_notif_resp
+type seccompNotifResp struct {
+	id    uint64
+	val   int64
+	error int32
+	flags uint32
+}
+
+// check tells why the confinement can not be applied on this gateway, if so
+func (confinement *Confinement) check() error {
+	if _, err := confinement.filter(); err != nil {
+		return err
+	}
+	if confinement.restrictsFiles() {
+		if _, err := landlockABI(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateSyscall fails unless a confinement can deny the system call name
+func ValidateSyscall(name string) error {
+	if auditArch == 0 {
+		return fmt.Errorf("confinements are not supported on %s", runtime.GOARCH)
+	}
+	if _, ok := syscallNumbers[name]; !ok {
+		return fmt.Errorf("unknown system call %q", name)
+	}
+	return nil
+}
+
+// syscallName returns the name of a system call denied by a confinement
+func syscallName(nr int32) string {
+	for name, numbers := range syscallNumbers {
+		for _, number := range numbers {
+			if int32(number) == nr {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("#%d", nr)
+}
+
+// filter compiles the seccomp filter, denied system calls are handed to pe-terminal. Those
+// of another architecture (or ABI) fail right away.
+func (confinement *Confinement) filter() ([]syscall.SockFilter, error) {
+	statement := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt uint8, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	const (
+		load    = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		ret     = syscall.BPF_RET | syscall.BPF_K
+		jumpEq  = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jumpGeq = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		deny    = seccompRetErrno | uint32(syscall.EPERM)
+	)
+	program := []syscall.SockFilter{
+		statement(load, seccompDataArch),
+		jump(jumpEq, auditArch, 1, 0),
+		statement(ret, deny),
+		statement(load, seccompDataNr),
+	}
+	if x32Bit != 0 {
+		program = append(program, jump(jumpGeq, x32Bit, 0, 1), statement(ret, deny))
+	}
+	for _, name := range confinement.DenySyscalls {
+		if err := ValidateSyscall(name); err != nil {
+			return nil, err
+		}
+		for _, number := range syscallNumbers[name] {
+			program = append(program, jump(jumpEq, number, 0, 1), statement(ret, seccompRetUserNotif))
+		}
+	}
+	if confinement.DenyNetwork {
+		if err := ValidateSyscall("socket"); err != nil {
+			return nil, err
+		}
+		// Last, as it loads the address family
+		program = append(program,
+			jump(jumpEq, syscallNumbers["socket"][0], 0, 4),
+			statement(load, seccompDataArg0),
+			jump(jumpEq, syscall.AF_UNIX, 0, 1),
+			statement(ret, seccompRetAllow),
+			statement(ret, seccompRetUserNotif),
+		)
+	}
+	return append(program, statement(ret, seccompRetAllow)), nil
+}
+
+// confine applies the confinement to the calling thread, which has to be locked, and the
+// processes it starts. The seccomp listener is sent to pe-terminal on notify.
+func (confinement *Confinement) confine(notify *os.File) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+	if confinement.restrictsFiles() {
+		if err := confinement.restrictFiles(); err != nil {
+			return fmt.Errorf("landlock: %w", err)
+		}
+	}
+	if confinement.filtersSyscalls() {
+		if err := confinement.filterSyscalls(notify); err != nil {
+			return fmt.Errorf("seccomp: %w", err)
+		}
+	}
+	return nil
+}
+
+// landlockABI returns the version of Landlock supported by the kernel
+func landlockABI() (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockRulesetVersion)
+	if errno != 0 {
+		return 0, fmt.Errorf("Landlock is not available: %w", errno)
+	}
+	return int(abi), nil
+}
+
+func (confinement *Confinement) restrictFiles() error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	handled := uint64(accessV1)
+	if abi >= 2 {
+		handled |= accessRefer
+	}
+	if abi >= 3 {
+		handled |= accessTruncate
+	}
+	attr := struct{ handledAccessFS uint64 }{handled}
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating ruleset: %w", errno)
+	}
+	defer syscall.Close(int(ruleset))
+	for _, path := range confinement.ReadOnly {
+		if err := addLandlockRule(int(ruleset), path, accessReadOnly&handled); err != nil {
+			return err
+		}
+	}
+	for _, path := range confinement.ReadWrite {
+		if err := addLandlockRule(int(ruleset), path, handled); err != nil {
+			return err
+		}
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return fmt.Errorf("restricting: %w", errno)
+	}
+	return nil
+}
+
+// addLandlockRule allows access beneath path, a missing path is skipped
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer syscall.Close(fd)
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= accessFile
+	}
+	// struct landlock_path_beneath_attr is packed, the fields are at the same offsets
+	attr := struct {
+		allowedAccess uint64
+		parentFd      int32
+	}{access, int32(fd)}
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("allowing %s: %w", path, errno)
+	}
+	return nil
+}
+
+// filterSyscalls installs the seccomp filter and hands its listener to pe-terminal
+func (confinement *Confinement) filterSyscalls(notify *os.File) error {
+	program, err := confinement.filter()
+	if err != nil {
+		return err
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	listener, _, errno := syscall.Syscall(uintptr(syscallNumbers["seccomp"][0]), seccompSetModeFilter, seccompFlagNewListener, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("installing filter: %w", errno)
+	}
+	defer syscall.Close(int(listener))
+	return syscall.Sendmsg(int(notify.Fd()), []byte{0}, syscall.UnixRights(int(listener)), nil, 0)
+}
+
+// superviseSyscalls receives the seccomp listener of a confined shell on socket and
+// denies the system calls reported by it, logging each. It returns once the confined
+// processes are gone, or the shell exited.
+func superviseSyscalls(socket *os.File, confinement *Confinement, logger *zap.Logger, exited <-chan struct{}) {
+	listener, err := receiveListener(socket)
+	socket.Close()
+	if err != nil {
+		logger.Warn("Failed to receive the seccomp listener of the shell", zap.Error(err))
+		return
+	}
+	defer listener.Close()
+	go func() {
+		<-exited
+		listener.Close() // Left-over processes get ENOSYS
+	}()
+	rawListener, err := listener.SyscallConn()
+	if err != nil {
+		logger.Error("Failed to supervise confined shell", zap.Error(err))
+		return
+	}
+	for {
+		var notification seccompNotif
+		gone, received := false, false
+		err := rawListener.Read(func(fd uintptr) bool {
+			pollFd := struct {
+				fd      int32
+				events  int16
+				revents int16
+			}{int32(fd), 0x1, 0} // POLLIN
+			var timeout syscall.Timespec
+			syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pollFd)), 1, uintptr(unsafe.Pointer(&timeout)), 0, 0, 0)
+			if pollFd.revents&0x10 != 0 { // POLLHUP, the confined processes are gone
+				gone = true
+				return true
+			}
+			if pollFd.revents&0x1 == 0 {
+				return false // Wait for the poller
+			}
+			// Fails with ENOENT if the caller died meanwhile
+			_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, seccompIoctlNotifRecv, uintptr(unsafe.Pointer(&notification)))
+			received = errno == 0
+			return true
+		})
+		if err != nil || gone {
+			return
+		}
+		if !received {
+			continue
+		}
+		name := syscallName(notification.nr)
+		fields := []zap.Field{zap.String("confinement", confinement.Name), zap.String("syscall", name), zap.Uint32("pid", notification.pid)}
+		if name == "socket" {
+			fields = append(fields, zap.Uint64("family", notification.args[0]))
+		}
+		logger.Warn("System call denied by confinement", fields...)
+		response := seccompNotifResp{id: notification.id, error: -int32(syscall.EPERM)}
+		rawListener.Control(func(fd uintptr) {
+			syscall.Syscall(syscall.SYS_IOCTL, fd, seccompIoctlNotifSend, uintptr(unsafe.Pointer(&response)))
+		})
+	}
+}
+
+// receiveListener reads the file-descriptor sent by the helper
+func receiveListener(socket *os.File) (*os.File, error) {
+	conn, err := socket.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	oob := make([]byte, syscall.CmsgSpace(4))
+	var oobn int
+	var recvErr error
+	err = conn.Read(func(fd uintptr) bool {
+		_, oobn, _, _, recvErr = syscall.Recvmsg(int(fd), make([]byte, 1), oob, 0)
+		return recvErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if recvErr != nil {
+		return nil, recvErr
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, errors.New("the helper exited before confining the shell")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errors.New("no seccomp listener received")
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		return nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), confinementListenerLabel), nil
+}
+
+// confinementSocket returns the ends of the socket the helper sends the seccomp listener on
+func confinementSocket() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "seccomp-supervisor"), os.NewFile(uintptr(fds[1]), "seccomp-helper"), nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logBuffer collects the log of a test
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (log *logBuffer) Write(data []byte) (int, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.buffer.Write(data)
+}
+
+func (log *logBuffer) String() string {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.buffer.String()
+}
+
+// runConfined runs script with bash under confinement and returns its output, skipping the
+// test where Landlock or seccomp are not available
+func runConfined(t *testing.T, confinement Confinement, script string, log *logBuffer) string {
+	if runtime.GOOS != "linux" {
+		t.Skip("Confinements require Linux")
+	}
+	if err := confinement.check(); err != nil {
+		t.Skipf("Confinement not available: %v", err)
+	}
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	logger := zap.New(zapcore.NewCore(encoder, zapcore.AddSync(log), zapcore.DebugLevel))
+	spec := SessionSpec{Argv: []string{"/bin/bash", "--noprofile", "--norc", "-c", script}, Kill: DefaultKillPolicy(), Confinement: &confinement}
+	var mutex sync.Mutex
+	var output strings.Builder
+	closed := make(chan struct{})
+	term, err := NewTerminal(spec, logger,
+		func(data string) {
+			mutex.Lock()
+			output.WriteString(data)
+			mutex.Unlock()
+		}, func(error) { close(closed) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout, the confined shell did not exit")
+	}
+	term.exitCode()
+	mutex.Lock()
+	defer mutex.Unlock()
+	return strings.ReplaceAll(output.String(), "\r\n", "\n")
+}
+
+func TestConfinement(t *testing.T) {
+	writable, readable := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(readable, "file"), []byte("readable\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log logBuffer
+	output := runConfined(t, Confinement{
+		Name:         "test",
+		ReadOnly:     []string{"/usr", "/bin", "/lib", "/lib64", "/etc", readable},
+		ReadWrite:    []string{writable, "/dev/null"},
+		DenySyscalls: []string{"kill"},
+		DenyNetwork:  true,
+	}, `
+		cd `+writable+`
+		echo written > file && echo "write=allowed"
+		cat `+readable+`/file
+		echo lost > `+readable+`/other || echo "write=denied"
+		kill -0 $$ || echo "kill=denied"
+		(exec 3<>/dev/tcp/127.0.0.1/9) || echo "network=denied"
+		echo done`, &log)
+	for _, expected := range []string{"write=allowed\n", "readable\n", "write=denied\n", "kill=denied\n", "network=denied\n", "done\n"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in output %q", expected, output)
+		}
+	}
+	if !strings.Contains(output, "Operation not permitted") || !strings.Contains(output, "Permission denied") {
+		t.Errorf("Expected the denials to fail with EPERM and EACCES: %q", output)
+	}
+	if _, err := os.Stat(filepath.Join(readable, "other")); err == nil {
+		t.Error("Expected no file created in a read-only path")
+	}
+	logged := log.String()
+	for _, expected := range []string{`"syscall":"kill"`, `"syscall":"socket"`, `"confinement":"test"`} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("Expected the denial %s logged: %s", expected, logged)
+		}
+	}
+}
+
+func TestConfinementProfiles(t *testing.T) {
+	var log logBuffer
+	profiles := ConfinementProfiles()
+	output := runConfined(t, profiles["diagnostics-readonly"], `
+		cat /proc/version > /dev/null && echo "read=allowed"
+		touch /etc/pe-terminal-test || echo "write=denied"
+		echo tmp > /tmp/pe-terminal-confinement-$$ && rm /tmp/pe-terminal-confinement-$$ && echo "tmp=allowed"
+		unshare -r true 2>/dev/null || echo "unshare=denied"`, &log)
+	for _, expected := range []string{"read=allowed\n", "write=denied\n", "tmp=allowed\n", "unshare=denied\n"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("diagnostics-readonly: expected %q in output %q", expected, output)
+		}
+	}
+
+	output = runConfined(t, profiles["no-network"], `(exec 3<>/dev/tcp/127.0.0.1/9) || echo "network=denied"; touch /tmp/pe-terminal-confinement-$$ && rm /tmp/pe-terminal-confinement-$$ && echo "files=allowed"`, &log)
+	if !strings.Contains(output, "network=denied\n") || !strings.Contains(output, "files=allowed\n") {
+		t.Errorf("no-network: unexpected output %q", output)
+	}
+}
+
+func TestConfinementInvalid(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Confinements require Linux")
+	}
+	spec := SessionSpec{Argv: []string{"/bin/sh"}, Kill: DefaultKillPolicy(), Confinement: &Confinement{DenySyscalls: []string{"no_such_call"}}}
+	if _, err := NewTerminal(spec, zap.NewNop(), func(string) {}, func(error) {}); err == nil || !strings.Contains(err.Error(), "no_such_call") {
+		t.Fatalf("Expected an unknown system call to be refused, got %v", err)
+	}
+}
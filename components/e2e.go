@@ -0,0 +1,394 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	e2eVersion       = "pe-terminal-e2e-v1"
+	e2eCounterSize   = 8 // Big-endian message counter prefixed to every sealed payload
+	e2eOperatorLabel = "operator-to-device"
+	e2eDeviceLabel   = "device-to-operator"
+)
+
+// E2E encrypts sessions end-to-end between the operator and the device, so that the relay
+// only routes opaque envelopes. The operator offers an ephemeral X25519 key in the start
+// message, signed with an Ed25519 key of the allowlist. The device answers with its own
+// ephemeral key, signed with the device key if set, after which input, output and resize
+// travel in sealed messages, encrypted with AES-256-GCM and a key per direction.
+type E2E struct {
+	OperatorKeys []ed25519.PublicKey // Operators allowed to start encrypted sessions
+	DeviceKey    ed25519.PrivateKey  // Proves the identity of the device to operators, optional
+	Required     bool                // Reject sessions that are not encrypted
+}
+
+// e2eOffer is the e2e field of a start payload
+type e2eOffer struct {
+	operatorKey []byte // Ed25519
+	publicKey   []byte // Ephemeral X25519
+	signature   []byte // By operatorKey of the version, "start", the session and the profile requested and publicKey
+}
+
+// e2eAnswer is the payload of the e2e message answering an offer
+type e2eAnswer struct {
+	PublicKey string `json:"publicKey"`           // Ephemeral X25519
+	DeviceKey string `json:"deviceKey,omitempty"` // Ed25519
+	Signature string `json:"signature,omitempty"` // By deviceKey of the version, "answer", the session and both public keys
+}
+
+// e2eChannel seals and opens the payloads of an encrypted session
+type e2eChannel struct {
+	mutex    *sync.Mutex
+	sealer   cipher.AEAD
+	opener   cipher.AEAD
+	sent     uint64
+	received uint64 // Counter of the last message opened, older ones are replays
+	aad      []byte
+}
+
+// ParseEd25519Key decodes a base64 Ed25519 public key, or a private key when private is set
+// (either the 32 bytes seed or the 64 bytes key)
+func ParseEd25519Key(encoded string, private bool) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	switch {
+	case !private && len(key) == ed25519.PublicKeySize:
+		return key, nil
+	case private && len(key) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case private && len(key) == ed25519.PrivateKeySize:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid key, %d bytes is not an Ed25519 key", len(key))
+}
+
+// ReadEd25519Key reads a base64 Ed25519 private key from a file
+func ReadEd25519Key(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEd25519Key(string(data), true)
+}
+
+// parseE2EOffer validates the e2e field of a start payload
+func parseE2EOffer(value interface{}) (*e2eOffer, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("field \"e2e\" should be an object")
+	}
+	offer := &e2eOffer{}
+	for key, value := range fields {
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("field \"e2e.%s\" should be a string", key)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("field \"e2e.%s\" should be base64", key)
+		}
+		switch key {
+		case "operatorKey":
+			offer.operatorKey = decoded
+		case "publicKey":
+			offer.publicKey = decoded
+		case "signature":
+			offer.signature = decoded
+		default:
+			return nil, fmt.Errorf("unknown field \"e2e.%s\"", key)
+		}
+	}
+	if len(offer.operatorKey) != ed25519.PublicKeySize || len(offer.publicKey) != 32 || len(offer.signature) != ed25519.SignatureSize {
+		return nil, errors.New("field \"e2e\" should hold an operatorKey, a publicKey and a signature")
+	}
+	return offer, nil
+}
+
+// e2eTranscript is what the operator and the device sign, the fields are length-prefixed
+func e2eTranscript(step string, sessionID string, fields ...[]byte) []byte {
+	var transcript bytes.Buffer
+	for _, field := range append([][]byte{[]byte(e2eVersion), []byte(step), []byte(sessionID)}, fields...) {
+		binary.Write(&transcript, binary.BigEndian, uint32(len(field)))
+		transcript.Write(field)
+	}
+	return transcript.Bytes()
+}
+
+// e2eSettings returns what the operator signs of a start request besides its profile, as sorted
+// name=value fields: cwd, env.<name> for every variable including term and lang, mode and window
+func e2eSettings(request startRequest) [][]byte {
+	var settings []string
+	if request.cwd != nil {
+		settings = append(settings, "cwd="+*request.cwd)
+	}
+	for name, value := range request.env {
+		settings = append(settings, "env."+name+"="+value)
+	}
+	if request.sync {
+		settings = append(settings, "mode="+modeSync)
+	}
+	if request.window > 0 {
+		settings = append(settings, "window="+strconv.FormatInt(request.window, 10))
+	}
+	sort.Strings(settings)
+	fields := make([][]byte, len(settings))
+	for i, setting := range settings {
+		fields[i] = []byte(setting)
+	}
+	return fields
+}
+
+// accept authenticates the offer of an operator in a start request and returns the channel of the
+// session and the answer to send, e2e is nil when end-to-end encryption is disabled
+func (e2e *E2E) accept(sessionID string, request startRequest) (*e2eChannel, *e2eAnswer, error) {
+	if e2e == nil {
+		return nil, nil, errors.New("end-to-end encryption is not enabled on the device")
+	}
+	offer := request.e2e
+	allowed := false
+	for _, key := range e2e.OperatorKeys {
+		if bytes.Equal(key, offer.operatorKey) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, nil, errors.New("operator key not allowed")
+	}
+	// The settings are signed too, or a relay could e.g. inject variables run by the shell
+	transcript := e2eTranscript("start", sessionID, append([][]byte{[]byte(request.profile), offer.publicKey}, e2eSettings(request)...)...)
+	if !ed25519.Verify(offer.operatorKey, transcript, offer.signature) {
+		return nil, nil, errors.New("invalid operator signature")
+	}
+	operatorPublic, err := ecdh.X25519().NewPublicKey(offer.publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := private.ECDH(operatorPublic)
+	if err != nil {
+		return nil, nil, err // A low-order key
+	}
+	devicePublic := private.PublicKey().Bytes()
+	channel, err := newE2EChannel(secret, sessionID, offer.publicKey, devicePublic, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	answer := &e2eAnswer{PublicKey: base64.StdEncoding.EncodeToString(devicePublic)}
+	if e2e.DeviceKey != nil {
+		answer.DeviceKey = base64.StdEncoding.EncodeToString(e2e.DeviceKey.Public().(ed25519.PublicKey))
+		signature := ed25519.Sign(e2e.DeviceKey, e2eTranscript("answer", sessionID, offer.publicKey, devicePublic))
+		answer.Signature = base64.StdEncoding.EncodeToString(signature)
+	}
+	return channel, answer, nil
+}
+
+// newE2EChannel derives the keys of both directions from the shared secret, operator
+// tells which end of the session the channel is for
+func newE2EChannel(secret []byte, sessionID string, operatorPublic []byte, devicePublic []byte, operator bool) (*e2eChannel, error) {
+	salt := append(append([]byte{}, operatorPublic...), devicePublic...)
+	pseudoRandom := hmacSHA256(salt, secret)
+	toDevice, err := e2eCipher(pseudoRandom, e2eOperatorLabel, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	toOperator, err := e2eCipher(pseudoRandom, e2eDeviceLabel, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	channel := &e2eChannel{mutex: &sync.Mutex{}, sealer: toOperator, opener: toDevice, aad: []byte(sessionID)}
+	if operator {
+		channel.sealer, channel.opener = toDevice, toOperator
+	}
+	return channel, nil
+}
+
+// e2eCipher expands the key of one direction, HKDF-SHA256 with a single output block
+func e2eCipher(pseudoRandom []byte, label string, sessionID string) (cipher.AEAD, error) {
+	key := hmacSHA256(pseudoRandom, []byte(e2eVersion+" "+label+" "+sessionID+"\x01"))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// seal encrypts a message, the result is the payload of a sealed message
+func (channel *e2eChannel) seal(plaintext []byte) string {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	channel.sent++
+	sealed := make([]byte, e2eCounterSize, e2eCounterSize+len(plaintext)+channel.sealer.Overhead())
+	binary.BigEndian.PutUint64(sealed, channel.sent)
+	sealed = channel.sealer.Seal(sealed, e2eNonce(channel.sent), plaintext, channel.aad)
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// open decrypts the payload of a sealed message, refusing forged and replayed messages
+func (channel *e2eChannel) open(payload string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < e2eCounterSize {
+		return nil, errors.New("malformed sealed payload")
+	}
+	counter := binary.BigEndian.Uint64(sealed)
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	if counter <= channel.received {
+		return nil, fmt.Errorf("replayed message %d", counter)
+	}
+	plaintext, err := channel.opener.Open(nil, e2eNonce(counter), sealed[e2eCounterSize:], channel.aad)
+	if err != nil {
+		return nil, errors.New("message authentication failed")
+	}
+	channel.received = counter
+	return plaintext, nil
+}
+
+// sealEnvelope wraps a message of the session into a sealed one, only the session stays visible
+func (channel *e2eChannel) sealEnvelope(inner envelope) envelope {
+	plaintext, _ := json.Marshal(envelope{Type: inner.Type, Payload: inner.Payload})
+	return envelope{Type: typeSealed, SessionID: inner.SessionID, Payload: channel.seal(plaintext)}
+}
+
+// acceptE2E runs the key exchange offered in a start request, or rejects the session if it
+// fails or encryption is required but not offered. It returns false if the session was rejected.
+func (tunnel *SocketTunnel) acceptE2E(sessionID string, options TunnelOptions, request *startRequest) bool {
+	if request.e2e == nil {
+		if options.E2E != nil && options.E2E.Required {
+			tunnel.logger.Warn("Rejecting new session, not end-to-end encrypted", zap.String("sessionID", sessionID))
+			tunnel.reject(sessionID, errCodeForbidden, "end-to-end encryption is required")
+			return false
+		}
+		return true
+	}
+	if options.E2E == nil {
+		tunnel.logger.Warn("Rejecting new session, end-to-end encryption is not enabled", zap.String("sessionID", sessionID))
+		tunnel.reject(sessionID, errCodeInvalidRequest, "end-to-end encryption is not enabled on the device")
+		return false
+	}
+	channel, answer, err := options.E2E.accept(sessionID, *request)
+	if err != nil {
+		tunnel.logger.Warn("Rejecting new session, key exchange failed", zap.String("sessionID", sessionID), zap.Error(err))
+		tunnel.reject(sessionID, errCodeForbidden, "end-to-end encryption: "+err.Error())
+		return false
+	}
+	request.channel, request.answer = channel, answer
+	return true
+}
+
+// refusePlaintext drops an input or resize message sent in plaintext to an encrypted
+// session, as it could have been injected by the relay
+func (tunnel *SocketTunnel) refusePlaintext(sessionID string, messageType string) bool {
+	session := tunnel.getSession(sessionID)
+	if session == nil || session.channel == nil {
+		return false
+	}
+	tunnel.logger.Warn("Dropping plaintext message of an encrypted session", zap.String("sessionID", sessionID), zap.String("type", messageType))
+	tunnel.metrics.parseErrors.add(1, errInvalidSealed)
+	return true
+}
+
+// onSealed opens an encrypted input or resize message
+func (tunnel *SocketTunnel) onSealed(sessionID string, payload string) {
+	session := tunnel.getSession(sessionID)
+	if session == nil {
+		return
+	}
+	if session.channel == nil {
+		tunnel.invalidMessage(errInvalidSealed, payload, errors.New("session is not encrypted"))
+		return
+	}
+	plaintext, err := session.channel.open(payload)
+	if err != nil {
+		tunnel.invalidMessage(errInvalidSealed, payload, err)
+		return
+	}
+	var inner envelope
+	decoder := json.NewDecoder(bytes.NewReader(plaintext))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&inner); err != nil {
+		tunnel.invalidMessage(errInvalidSealed, payload, err)
+		return
+	}
+	switch inner.Type {
+	case typeInput:
+		input, ok := inner.Payload.(string)
+		if !ok {
+			tunnel.invalidMessage(errInvalidSealed, payload, errors.New("input should be a string"))
+			return
+		}
+		tunnel.onInput(sessionID, input)
+	case typeResize:
+		width, height, ok := parseResize(inner.Payload)
+		if !ok {
+			tunnel.invalidMessage(errInvalidSealed, payload, errors.New("invalid resize"))
+			return
+		}
+		tunnel.onResize(sessionID, width, height)
+	case typeAck:
+		id, err := parseFrameID(inner.Payload)
+		if err != nil {
+			tunnel.invalidMessage(errInvalidSealed, payload, err)
+			return
+		}
+		tunnel.onAck(sessionID, id)
+	default:
+		tunnel.invalidMessage(errInvalidSealed, payload, fmt.Errorf("unexpected message type %q", inner.Type))
+	}
+}
+
+// e2eNonce is the GCM nonce of a message, unique as every direction has its own key
+func e2eNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
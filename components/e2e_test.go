@@ -0,0 +1,244 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testOperator is the operator end of an encrypted session
+type testOperator struct {
+	key     ed25519.PrivateKey
+	private *ecdh.PrivateKey
+}
+
+func newTestOperator(t *testing.T) *testOperator {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testOperator{key: key, private: private}
+}
+
+func (operator *testOperator) public() ed25519.PublicKey {
+	return operator.key.Public().(ed25519.PublicKey)
+}
+
+// start returns the start message offering the key exchange
+func (operator *testOperator) start(sessionID string, profile string) string {
+	return operator.startWith(sessionID, map[string]interface{}{"profile": profile})
+}
+
+// startWith returns the start message of payload offering the key exchange, signing its settings
+func (operator *testOperator) startWith(sessionID string, payload map[string]interface{}) string {
+	encoded, _ := json.Marshal(payload)
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var fields interface{}
+	decoder.Decode(&fields)
+	request, err := parseStartRequest(fields)
+	if err != nil {
+		panic(err)
+	}
+	publicKey := operator.private.PublicKey().Bytes()
+	transcript := e2eTranscript("start", sessionID, append([][]byte{[]byte(request.profile), publicKey}, e2eSettings(request)...)...)
+	encode := base64.StdEncoding.EncodeToString
+	payload["e2e"] = map[string]string{
+		"operatorKey": encode(operator.public()),
+		"publicKey":   encode(publicKey),
+		"signature":   encode(ed25519.Sign(operator.key, transcript)),
+	}
+	message, _ := json.Marshal(envelope{Type: typeStart, SessionID: sessionID, Payload: payload})
+	return string(message)
+}
+
+// finish checks the answer of the device and returns the channel of the operator
+func (operator *testOperator) finish(t *testing.T, sessionID string, answer envelope, deviceKey ed25519.PublicKey) *e2eChannel {
+	if answer.Type != typeE2E || answer.SessionID != sessionID {
+		t.Fatalf("Expected the answer to the key exchange, got %+v", answer)
+	}
+	payload := answer.Payload.(map[string]interface{})
+	devicePublic, _ := base64.StdEncoding.DecodeString(payload["publicKey"].(string))
+	signature, _ := base64.StdEncoding.DecodeString(payload["signature"].(string))
+	if payload["deviceKey"] != base64.StdEncoding.EncodeToString(deviceKey) ||
+		!ed25519.Verify(deviceKey, e2eTranscript("answer", sessionID, operator.private.PublicKey().Bytes(), devicePublic), signature) {
+		t.Fatalf("Invalid device signature in %v", payload)
+	}
+	public, err := ecdh.X25519().NewPublicKey(devicePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := operator.private.ECDH(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := newE2EChannel(secret, sessionID, operator.private.PublicKey().Bytes(), devicePublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return channel
+}
+
+// sealed returns a sealed message of the operator
+func sealed(channel *e2eChannel, sessionID string, messageType string, payload interface{}) string {
+	message, _ := json.Marshal(channel.sealEnvelope(envelope{Type: messageType, SessionID: sessionID, Payload: payload}))
+	return string(message)
+}
+
+func TestE2E(t *testing.T) {
+	deviceKey, _ := ParseEd25519Key(base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize)), true)
+	operator, stranger := newTestOperator(t), newTestOperator(t)
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}, "admin": {Spec: spec}},
+		DefaultProfile: "default",
+		E2E:            &E2E{OperatorKeys: []ed25519.PublicKey{operator.public()}, DeviceKey: deviceKey},
+	})
+
+	tunnel.onMessage(operator.start("s1", "default"))
+	channel := operator.finish(t, "s1", nextMessage(t, messages), ed25519.PrivateKey(deviceKey).Public().(ed25519.PublicKey))
+	if sessions := tunnel.Sessions(); len(sessions) != 1 || !sessions[0].Encrypted {
+		t.Fatalf("Expected an encrypted session, got %+v", sessions)
+	}
+
+	// Input and output travel sealed, plaintext and replayed input is dropped
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "injected\n"}`)
+	replayed := sealed(channel, "s1", typeInput, "top-secret\n")
+	tunnel.onMessage(replayed)
+	tunnel.onMessage(replayed)
+	tunnel.onMessage(sealed(channel, "s1", typeResize, map[string]int{"width": 100, "height": 40}))
+	var output strings.Builder
+	for !strings.Contains(output.String(), "top-secret\r\ntop-secret\r\n") {
+		message := nextMessage(t, messages)
+		if message.Type != typeSealed {
+			t.Fatalf("Expected sealed output, got %+v", message)
+		}
+		plaintext, err := channel.open(message.Payload.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var inner envelope
+		json.Unmarshal(plaintext, &inner)
+		if inner.Type != typeOutput {
+			t.Fatalf("Expected output, got %+v", inner)
+		}
+		output.WriteString(inner.Payload.(string))
+	}
+	if strings.Contains(output.String(), "injected") || strings.Count(output.String(), "top-secret") != 2 { // Echo and cat
+		t.Fatalf("Unexpected output %q", output.String())
+	}
+	if _, err := channel.open(sealed(channel, "s1", typeOutput, "forged")); err == nil {
+		t.Fatal("Expected a message sealed for the device to be refused by the operator")
+	}
+	tunnel.onEnd("s1")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+
+	// The offer must be signed by an allowed operator, for the profile requested
+	for _, start := range []string{
+		stranger.start("s2", "default"),
+		strings.Replace(operator.start("s2", "default"), `"profile":"default"`, `"profile":"admin"`, 1),
+	} {
+		tunnel.onMessage(start)
+		if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeForbidden {
+			t.Fatalf("Expected a forbidden error, got %+v", message)
+		}
+		nextMessage(t, messages)
+	}
+
+	// Plaintext sessions are refused when encryption is required
+	tunnel.SetOptions(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		E2E:            &E2E{OperatorKeys: []ed25519.PublicKey{operator.public()}, Required: true},
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s3", "payload": null}`)
+	if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeForbidden {
+		t.Fatalf("Expected a forbidden error, got %+v", message)
+	}
+	nextMessage(t, messages)
+}
+
+func TestE2ESignedSettings(t *testing.T) {
+	operator := newTestOperator(t)
+	spec, _ := NewSessionSpec("/bin/sh")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		E2E:            &E2E{OperatorKeys: []ed25519.PublicKey{operator.public()}},
+	})
+
+	// The relay may not change the settings of the session signed by the operator
+	start := operator.startWith("s1", map[string]interface{}{"profile": "default", "term": "xterm", "env": map[string]string{"FOO": "bar"}, "window": 4096})
+	for _, tampered := range []string{
+		strings.Replace(start, `"FOO":"bar"`, `"BASH_ENV":"/tmp/payload"`, 1),
+		strings.Replace(start, `"FOO":"bar"`, `"FOO":"bar","LD_PRELOAD":"/tmp/payload.so"`, 1),
+		strings.Replace(start, `"term":"xterm"`, `"term":"xterm","cwd":"/tmp"`, 1),
+		strings.Replace(start, `"window":4096`, `"window":1024`, 1),
+		strings.Replace(start, `"window":4096`, `"window":4096,"mode":"sync"`, 1),
+	} {
+		if tampered == start {
+			t.Fatalf("Failed to tamper with %s", start)
+		}
+		tunnel.onMessage(tampered)
+		if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeForbidden {
+			t.Fatalf("Expected a forbidden error for %s, got %+v", tampered, message)
+		}
+		nextMessage(t, messages)
+	}
+	if tunnel.hasSession("s1") {
+		t.Fatal("Tampered session should not start")
+	}
+
+	tunnel.onMessage(start)
+	if message := nextMessage(t, messages); message.Type != typeE2E {
+		t.Fatalf("Expected the signed session to start, got %+v", message)
+	}
+	tunnel.onEnd("s1")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+}
+
+func TestParseEd25519Key(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	if key, err := ParseEd25519Key(base64.StdEncoding.EncodeToString(public), false); err != nil || !public.Equal(ed25519.PublicKey(key)) {
+		t.Fatalf("Expected the public key, got %v %v", key, err)
+	}
+	for _, encoded := range []string{base64.StdEncoding.EncodeToString(private.Seed()) + "\n", base64.StdEncoding.EncodeToString(private)} {
+		if key, err := ParseEd25519Key(encoded, true); err != nil || !private.Equal(ed25519.PrivateKey(key)) {
+			t.Fatalf("Expected the private key, got %v %v", key, err)
+		}
+	}
+	for _, encoded := range []string{"", "not base64", base64.StdEncoding.EncodeToString(private)} {
+		if _, err := ParseEd25519Key(encoded, false); err == nil {
+			t.Fatalf("Expected %q to be refused as a public key", encoded)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Event types published by the tunnel
+const (
+	EventConnected      = "connected"       // The tunnel connected to the cloud
+	EventDisconnected   = "disconnected"    // The tunnel lost its connection
+	EventSessionStarted = "session-started" // A shell was spawned for a session
+	EventSessionEnded   = "session-ended"   // The shell of a session exited
+	EventResize         = "resize"          // The window of a session was resized
+	EventError          = "error"           // A session was rejected or the tunnel failed to connect
+	EventApproval       = "approval"        // A session waits for approval by a local operator
+	EventAuthorized     = "authorized"      // The authorization token of a session was accepted
+	EventThrottled      = "throttled"       // Output of a session was dropped, exceeding a rate limit
+)
+
+// EventTypes lists every event type
+var EventTypes = []string{EventConnected, EventDisconnected, EventSessionStarted, EventSessionEnded, EventResize, EventError, EventApproval, EventAuthorized, EventThrottled}
+
+// Error codes of error events, besides the ones sent to the cloud
+const errCodeConnectFailed = "connect-failed"
+
+const eventQueueSize = 64 // Per sink
+
+// Event describes something that happened to the tunnel or to a session, fields not
+// applying to the type are empty
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url,omitempty"`
+	SessionID string    `json:"sessionID,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Operator  string    `json:"operator,omitempty"` // Named by the authorization token
+	Pid       int       `json:"pid,omitempty"`
+	Width     uint16    `json:"width,omitempty"`
+	Height    uint16    `json:"height,omitempty"`
+	Reason    string    `json:"reason,omitempty"`   // Why a session ended or the tunnel disconnected
+	Code      string    `json:"code,omitempty"`     // Error code of error events
+	Duration  float64   `json:"duration,omitempty"` // Of an ended session, in seconds
+	BytesIn   int64     `json:"bytesIn,omitempty"`
+	BytesOut  int64     `json:"bytesOut,omitempty"`
+	Dropped   int64     `json:"dropped,omitempty"` // Bytes of output dropped by the rate limits
+}
+
+// environ returns the fields of the event as EVENT_* environment variables
+func (event Event) environ() []string {
+	variables := []string{"EVENT_TYPE=" + event.Type, "EVENT_TIME=" + event.Time.Format(time.RFC3339Nano)}
+	add := func(name string, value string) {
+		if value != "" && value != "0" {
+			variables = append(variables, "EVENT_"+name+"="+value)
+		}
+	}
+	add("URL", event.URL)
+	add("SESSION_ID", event.SessionID)
+	add("PROFILE", event.Profile)
+	add("USER", event.User)
+	add("ROLE", event.Role)
+	add("OPERATOR", event.Operator)
+	add("PID", strconv.Itoa(event.Pid))
+	add("WIDTH", strconv.Itoa(int(event.Width)))
+	add("HEIGHT", strconv.Itoa(int(event.Height)))
+	add("REASON", event.Reason)
+	add("CODE", event.Code)
+	add("DURATION", strconv.FormatFloat(event.Duration, 'f', -1, 64))
+	add("BYTES_IN", strconv.FormatInt(event.BytesIn, 10))
+	add("BYTES_OUT", strconv.FormatInt(event.BytesOut, 10))
+	add("DROPPED", strconv.FormatInt(event.Dropped, 10))
+	return variables
+}
+
+// EventSink receives the events it subscribed to, one at a time
+type EventSink interface {
+	Handle(event Event) error
+	Close() error
+}
+
+// EventFunc adapts a function to an EventSink
+type EventFunc func(event Event)
+
+// Handle calls the function
+func (fn EventFunc) Handle(event Event) error {
+	fn(event)
+	return nil
+}
+
+// Close does nothing
+func (fn EventFunc) Close() error {
+	return nil
+}
+
+// EventBus delivers the events of the tunnel to the subscribed sinks. Every sink has its
+// own queue, a sink falling behind misses events rather than stalling the tunnel.
+type EventBus struct {
+	mutex  *sync.Mutex
+	queues []*eventQueue
+	closed bool
+	logger *zap.Logger
+}
+
+type eventQueue struct {
+	sink   EventSink
+	types  map[string]bool // Empty for every type
+	events chan Event
+	done   chan struct{}
+}
+
+func newEventBus(logger *zap.Logger) *EventBus {
+	return &EventBus{
+		mutex:  &sync.Mutex{},
+		logger: logger.With(zap.String("component", "events")),
+	}
+}
+
+// Subscribe delivers the events of the given types to sink, every event if no type is given
+func (bus *EventBus) Subscribe(sink EventSink, types ...string) {
+	queue := &eventQueue{
+		sink:   sink,
+		types:  make(map[string]bool),
+		events: make(chan Event, eventQueueSize),
+		done:   make(chan struct{}),
+	}
+	for _, eventType := range types {
+		queue.types[eventType] = true
+	}
+	bus.mutex.Lock()
+	bus.queues = append(bus.queues, queue)
+	bus.mutex.Unlock()
+
+	go func() {
+		defer close(queue.done)
+		for event := range queue.events {
+			if err := sink.Handle(event); err != nil {
+				bus.logger.Warn("Failed to deliver event", zap.String("type", event.Type), zap.Error(err))
+			}
+		}
+	}()
+}
+
+// Publish queues event for the sinks subscribed to its type, setting its time if missing
+func (bus *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.closed {
+		return
+	}
+	for _, queue := range bus.queues {
+		if len(queue.types) > 0 && !queue.types[event.Type] {
+			continue
+		}
+		select {
+		case queue.events <- event:
+		default:
+			bus.logger.Warn("Event sink is falling behind, dropping event", zap.String("type", event.Type), zap.String("sessionID", event.SessionID))
+		}
+	}
+}
+
+// Close stops publishing, waits up to timeout for the queued events to be delivered and
+// closes the sinks
+func (bus *EventBus) Close(timeout time.Duration) {
+	bus.mutex.Lock()
+	queues := bus.queues
+	if !bus.closed {
+		bus.closed = true
+		for _, queue := range queues {
+			close(queue.events)
+		}
+	}
+	bus.mutex.Unlock()
+
+	deadline := time.After(timeout)
+drain:
+	for _, queue := range queues {
+		select {
+		case <-queue.done:
+		case <-deadline:
+			bus.logger.Warn("Timed out delivering the remaining events")
+			break drain
+		}
+	}
+	for _, queue := range queues {
+		if err := queue.sink.Close(); err != nil {
+			bus.logger.Warn("Failed to close event sink", zap.Error(err))
+		}
+	}
+}
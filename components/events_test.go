@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// nextEvent waits for the next event delivered on events
+func nextEvent(t *testing.T, events chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout, no event published")
+	}
+	return Event{}
+}
+
+func TestTunnelEvents(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/sh")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	events := make(chan Event, 16)
+	tunnel.Events().Subscribe(EventFunc(func(event Event) { events <- event }), EventSessionStarted, EventSessionEnded, EventResize, EventError)
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"profile": "unknown"}}`)
+	if event := nextEvent(t, events); event.Type != EventError || event.SessionID != "s1" || event.Code != errCodeUnknownProfile {
+		t.Fatalf("Expected an error event, got %+v", event)
+	}
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": {"width": 100, "height": 30}}`)
+	event := nextEvent(t, events)
+	if event.Type != EventSessionStarted || event.SessionID != "s2" || event.Profile != "default" || event.Pid == 0 ||
+		event.Width != 100 || event.Height != 30 || event.User == "" || event.Time.IsZero() {
+		t.Fatalf("Expected a session-started event, got %+v", event)
+	}
+	tunnel.onMessage(`{"type": "resize", "sessionID": "s2", "payload": {"width": 120, "height": 40}}`)
+	if event := nextEvent(t, events); event.Type != EventResize || event.Width != 120 || event.Height != 40 {
+		t.Fatalf("Expected a resize event, got %+v", event)
+	}
+	tunnel.onMessage(`{"type": "input", "sessionID": "s2", "payload": "exit\n"}`)
+	event = nextEvent(t, events)
+	if event.Type != EventSessionEnded || event.SessionID != "s2" || event.Reason != reasonExited || event.BytesIn != 5 || event.Duration <= 0 {
+		t.Fatalf("Expected a session-ended event, got %+v", event)
+	}
+	for nextMessage(t, messages).SessionID != "s2" {
+	}
+
+	// A closed bus delivers the queued events and drops new ones
+	tunnel.Events().Close(time.Second)
+	tunnel.Events().Publish(Event{Type: EventError})
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected event after close %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	eventSocket, err := NewEventSocket(path, 0660, "", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("Unexpected socket %v %v", info, err)
+	}
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The client is registered asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		eventSocket.mutex.Lock()
+		registered := len(eventSocket.clients) == 1
+		eventSocket.mutex.Unlock()
+		if registered || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	eventSocket.Handle(Event{Type: EventSessionStarted, SessionID: "s1"})
+	eventSocket.Handle(Event{Type: EventSessionEnded, SessionID: "s1", Reason: reasonExited})
+	reader := bufio.NewReader(client)
+	for _, expected := range []string{EventSessionStarted, EventSessionEnded} {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil || event.Type != expected || event.SessionID != "s1" {
+			t.Fatalf("Unexpected line %q: %v", line, err)
+		}
+	}
+
+	eventSocket.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies <- body
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(server.URL, time.Second)
+	if err := webhook.Handle(Event{Type: EventConnected, URL: "wss://cloud"}); err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(<-bodies, &event); err != nil || event.Type != EventConnected || event.URL != "wss://cloud" {
+		t.Fatalf("Unexpected event %+v: %v", event, err)
+	}
+	if err := webhook.Handle(Event{Type: EventError, Reason: "fail"}); err == nil {
+		t.Fatal("Expected an error on a failed request")
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "env")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv | grep ^EVENT_ > \"$1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewExecHook(script+" "+output, time.Second, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Handle(Event{Type: EventSessionEnded, SessionID: "s1", Profile: "default", Duration: 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	environ, _ := os.ReadFile(output)
+	for _, expected := range []string{"EVENT_TYPE=session-ended\n", "EVENT_SESSION_ID=s1\n", "EVENT_PROFILE=default\n", "EVENT_DURATION=1.5\n", `EVENT_JSON={"type":"session-ended"`} {
+		if !strings.Contains(string(environ), expected) {
+			t.Errorf("Expected %q in the environment of the hook:\n%s", expected, environ)
+		}
+	}
+	if strings.Contains(string(environ), "EVENT_PID=") {
+		t.Errorf("Empty fields should not be set:\n%s", environ)
+	}
+
+	// A failing or hanging hook is an error
+	for _, command := range []string{"/bin/false", "/bin/sleep 5"} {
+		hook, _ := NewExecHook(command, 100*time.Millisecond, zap.NewNop())
+		if err := hook.Handle(Event{Type: EventError}); err == nil {
+			t.Errorf("%s: expected an error", command)
+		}
+	}
+}
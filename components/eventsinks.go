@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const eventWriteTimeout = time.Second // Per client of the event socket
+
+const hookWaitDelay = time.Second // For the output of a hook once killed
+
+// EventSocket streams events as JSON lines to every client connected to a Unix domain socket
+type EventSocket struct {
+	path     string
+	listener net.Listener
+	mutex    *sync.Mutex
+	clients  map[net.Conn]bool
+	logger   *zap.Logger
+}
+
+// NewEventSocket creates the socket at path with the given mode, owned by group if not empty
+func NewEventSocket(path string, mode os.FileMode, group string, logger *zap.Logger) (*EventSocket, error) {
+	listener, err := listenUnix(path, mode, group)
+	if err != nil {
+		return nil, err
+	}
+	eventSocket := &EventSocket{
+		path:     path,
+		listener: listener,
+		mutex:    &sync.Mutex{},
+		clients:  make(map[net.Conn]bool),
+		logger:   logger.With(zap.String("component", "events")),
+	}
+	go eventSocket.accept()
+	return eventSocket, nil
+}
+
+func (eventSocket *EventSocket) accept() {
+	eventSocket.logger.Info("Streaming events", zap.String("socket", eventSocket.path))
+	for {
+		client, err := eventSocket.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				eventSocket.logger.Error("Failed to accept event client", zap.Error(err))
+			}
+			return
+		}
+		eventSocket.mutex.Lock()
+		eventSocket.clients[client] = true
+		eventSocket.mutex.Unlock()
+	}
+}
+
+// Handle writes event to every client, clients too slow to keep up are disconnected
+func (eventSocket *EventSocket) Handle(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	eventSocket.mutex.Lock()
+	defer eventSocket.mutex.Unlock()
+	for client := range eventSocket.clients {
+		client.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := client.Write(line); err != nil {
+			eventSocket.logger.Debug("Disconnecting event client", zap.Error(err))
+			client.Close()
+			delete(eventSocket.clients, client)
+		}
+	}
+	return nil
+}
+
+// Close disconnects the clients and removes the socket
+func (eventSocket *EventSocket) Close() error {
+	err := eventSocket.listener.Close()
+	eventSocket.mutex.Lock()
+	defer eventSocket.mutex.Unlock()
+	for client := range eventSocket.clients {
+		client.Close()
+		delete(eventSocket.clients, client)
+	}
+	return err
+}
+
+// Webhook posts every event as JSON to a URL
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook posts to url, giving up on a request after timeout
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Handle posts event, any answer but 2xx is an error
+func (webhook *Webhook) Handle(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	response, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", webhook.url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", webhook.url, response.Status)
+	}
+	return nil
+}
+
+// Close does nothing
+func (webhook *Webhook) Close() error {
+	return nil
+}
+
+// ExecHook runs a command for every event, with the event in EVENT_* environment
+// variables and as JSON in EVENT_JSON
+type ExecHook struct {
+	argv    []string
+	timeout time.Duration
+	logger  *zap.Logger
+}
+
+// NewExecHook runs command, killing it after timeout
+func NewExecHook(command string, timeout time.Duration, logger *zap.Logger) (*ExecHook, error) {
+	argv, err := SplitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return &ExecHook{argv: argv, timeout: timeout, logger: logger.With(zap.String("component", "events"))}, nil
+}
+
+// Handle runs the command and waits for it to exit
+func (hook *ExecHook) Handle(event Event) error {
+	output, err := hook.run(context.Background(), event)
+	if err != nil {
+		return fmt.Errorf("hook %s: %w: %s", hook.argv[0], err, output)
+	}
+	return nil
+}
+
+// run runs the command for event until done or cancelled, returning its trimmed output
+func (hook *ExecHook) run(ctx context.Context, event Event) (string, error) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+	defer cancel()
+	encoded, _ := json.Marshal(event)
+	cmd := exec.CommandContext(ctx, hook.argv[0], hook.argv[1:]...)
+	cmd.Env = append(append(os.Environ(), event.environ()...), "EVENT_JSON="+string(encoded))
+	// Kill the children of the command too, which would otherwise hold its output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	hook.logger.Debug("Ran hook", zap.String("hook", hook.argv[0]), zap.String("type", event.Type), zap.ByteString("output", output), zap.Error(err))
+	return string(bytes.TrimSpace(output)), err
+}
+
+// Close does nothing
+func (hook *ExecHook) Close() error {
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const maxCredit = 1 << 40 // Credit granted beyond is ignored, so that it can not overflow
+
+// flowControl holds the credit of a session, the bytes of output the cloud is ready to receive.
+// The cloud grants an initial window with the start message, and more with credit messages as
+// it consumes the output. Without credit the output waits, and with it the reading of the terminal.
+type flowControl struct {
+	mutex    *sync.Mutex
+	credit   int64
+	released bool
+	granted  chan struct{} // Signalled when credit is granted or the flow control is released
+}
+
+func newFlowControl(window int64) *flowControl {
+	return &flowControl{mutex: &sync.Mutex{}, credit: window, granted: make(chan struct{}, 1)}
+}
+
+// grant adds bytes to the credit
+func (flow *flowControl) grant(bytes int64) {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	flow.credit += bytes
+	if flow.credit > maxCredit {
+		flow.credit = maxCredit
+	}
+	flow.signal()
+}
+
+// settle gives back bytes taken but not sent, or takes more when negative, the credit may run below zero
+func (flow *flowControl) settle(bytes int64) {
+	if flow == nil {
+		return
+	}
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	flow.credit += bytes
+}
+
+// release lifts the flow control, so that the output of a closing session drains
+func (flow *flowControl) release() {
+	if flow == nil {
+		return
+	}
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	flow.released = true
+	flow.signal()
+}
+
+// take waits for credit and returns how many of wanted bytes may be sent, a nil flow
+// control does not limit the output
+func (flow *flowControl) take(wanted int) int {
+	if flow == nil {
+		return wanted
+	}
+	for {
+		flow.mutex.Lock()
+		if flow.released {
+			flow.mutex.Unlock()
+			return wanted
+		}
+		if flow.credit > 0 {
+			allowed := wanted
+			if int64(allowed) > flow.credit {
+				allowed = int(flow.credit)
+			}
+			flow.credit -= int64(allowed)
+			flow.mutex.Unlock()
+			return allowed
+		}
+		flow.mutex.Unlock()
+		<-flow.granted
+	}
+}
+
+// signal wakes up the output waiting for credit, the mutex must be held
+func (flow *flowControl) signal() {
+	select {
+	case flow.granted <- struct{}{}:
+	default:
+	}
+}
+
+// flowConsole releases the flow control of a session when it is closed, the terminal can
+// only be read to its end if the output is not waiting for credit
+type flowConsole struct {
+	console
+	flow *flowControl
+}
+
+func (term flowConsole) Close() error {
+	term.flow.release()
+	return term.console.Close()
+}
+
+// parseCredit validates the payload of a credit message, or the window of a start payload,
+// decoded with UseNumber
+func parseCredit(payload interface{}) (int64, error) {
+	number, ok := payload.(json.Number)
+	if !ok {
+		return 0, errors.New("should be a number")
+	}
+	credit, err := number.Int64()
+	if err != nil || credit <= 0 {
+		return 0, errors.New("should be a positive number of bytes")
+	}
+	return credit, nil
+}
+
+// sendFlow sends output of a session as its credit allows, waiting for more credit to send the rest
+func (tunnel *SocketTunnel) sendFlow(sessionID string, flow *flowControl, output string) {
+	for len(output) > 0 {
+		allowed := flow.take(len(output))
+		// Characters are not split, the credit is settled for the bytes sent
+		cut := utf8Boundary(output, allowed)
+		if cut == 0 {
+			_, cut = utf8.DecodeRuneInString(output)
+		}
+		flow.settle(int64(allowed - cut))
+		tunnel.send(sessionID, output[:cut])
+		output = output[cut:]
+		if len(output) > 0 {
+			tunnel.logger.Debug("Session out of credit, output paused", zap.String("sessionID", sessionID), zap.Int("bytes", len(output)))
+		}
+	}
+}
+
+// onCredit grants more credit to the output of a session
+func (tunnel *SocketTunnel) onCredit(sessionID string, credit int64) {
+	session := tunnel.getSession(sessionID)
+	if session == nil || session.flow == nil {
+		tunnel.logger.Debug("Ignoring credit, session without flow control", zap.String("sessionID", sessionID))
+		return
+	}
+	session.flow.grant(credit)
+}
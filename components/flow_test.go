@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	scheduler := newScheduler(3)
+	for _, message := range []string{"a1", "a2", "a3"} {
+		scheduler.push("a", []byte(message))
+	}
+	scheduler.push("b", []byte("b1"))
+	scheduler.push("", []byte("t1"))
+	scheduler.push("b", []byte("b2"))
+
+	// A full queue holds back its session only
+	pushed := make(chan struct{})
+	go func() {
+		scheduler.push("a", []byte("a4"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected the push to wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if scheduler.len() != 6 {
+		t.Fatalf("Expected 6 messages queued, got %d", scheduler.len())
+	}
+
+	// Sessions are served in turn
+	var order []string
+	for len(order) < 7 {
+		select {
+		case <-scheduler.ready:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the scheduler to be ready, got %v", order)
+		}
+		message, ok := scheduler.pop()
+		if !ok {
+			t.Fatalf("Expected a message, got %v", order)
+		}
+		order = append(order, string(message))
+		if len(order) == 1 {
+			<-pushed
+		}
+	}
+	if strings.Join(order, " ") != "a1 b1 t1 a2 b2 a3 a4" {
+		t.Fatalf("Unexpected order %v", order)
+	}
+	if _, ok := scheduler.pop(); ok || scheduler.len() != 0 {
+		t.Fatal("Expected the scheduler to be empty")
+	}
+}
+
+// collectOutput returns the output of a session received until quiet passed without a message
+func collectOutput(t *testing.T, messages chan envelope, sessionID string, quiet time.Duration) (string, bool) {
+	var output strings.Builder
+	for {
+		select {
+		case message := <-messages:
+			if message.SessionID != sessionID {
+				t.Fatalf("Unexpected message %+v", message)
+			}
+			if message.Type == typeEnd {
+				return output.String(), true
+			}
+			if message.Type != typeOutput {
+				t.Fatalf("Expected output, got %+v", message)
+			}
+			output.WriteString(message.Payload.(string))
+		case <-time.After(quiet):
+			return output.String(), false
+		}
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+
+	// The output stops once the window is used up, and goes on with more credit
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"window": 8}}`)
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "0123456789\n"}`)
+	if output, _ := collectOutput(t, messages, "s1", 300*time.Millisecond); output != "01234567" {
+		t.Fatalf("Expected the output of the window only, got %q", output)
+	}
+	tunnel.onMessage(`{"type": "credit", "sessionID": "s1", "payload": 1000}`)
+	if output, _ := collectOutput(t, messages, "s1", 300*time.Millisecond); output != "89\r\n0123456789\r\n" {
+		t.Fatalf("Expected the rest of the output, got %q", output)
+	}
+
+	// Ending a session drains the output waiting for credit
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": {"window": 1}}`)
+	tunnel.onMessage(`{"type": "input", "sessionID": "s2", "payload": "hello\n"}`)
+	if output, _ := collectOutput(t, messages, "s2", 300*time.Millisecond); output != "h" {
+		t.Fatalf("Expected the output of the window only, got %q", output)
+	}
+	tunnel.onEnd("s2")
+	if output, ended := collectOutput(t, messages, "s2", 5*time.Second); !ended || !strings.HasPrefix(output, "ello\r\n") {
+		t.Fatalf("Expected the rest of the output and the end, got %q %v", output, ended)
+	}
+
+	// Invalid credit is refused
+	for _, payload := range []string{`{"window": 0}`, `{"window": "lots"}`} {
+		tunnel.onMessage(`{"type": "start", "sessionID": "s3", "payload": ` + payload + `}`)
+		if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeInvalidRequest {
+			t.Fatalf("Expected an invalid-request error, got %+v", message)
+		}
+		nextMessage(t, messages)
+	}
+	tunnel.onMessage(`{"type": "credit", "sessionID": "s1", "payload": -5}`)
+	if len(tunnel.Sessions()) != 1 {
+		t.Fatal("Expected the session to go on")
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// Types of the events given to the lifecycle hooks, in EVENT_TYPE
+const (
+	hookPreStart = "pre-start"
+	hookPostEnd  = "post-end"
+)
+
+const vetoMessage = "vetoed by pre-start hook"
+
+// preStart runs the pre-start hook of options for a session about to start, until done or
+// ctx is cancelled. It returns false if the hook vetoed the session, which is then rejected.
+func (tunnel *SocketTunnel) preStart(ctx context.Context, options TunnelOptions, event Event) bool {
+	if options.PreStartHook == nil {
+		return true
+	}
+	event.Type = hookPreStart
+	output, err := options.PreStartHook.run(ctx, event)
+	if err == nil || ctx.Err() != nil { // The caller ends a cancelled session
+		return true
+	}
+	if !options.PreStartVeto {
+		tunnel.logger.Warn("Pre-start hook failed", zap.String("sessionID", event.SessionID), zap.String("output", output), zap.Error(err))
+		return true
+	}
+	tunnel.logger.Warn("Rejecting new session, vetoed by pre-start hook", zap.String("sessionID", event.SessionID), zap.String("output", output), zap.Error(err))
+	message := vetoMessage
+	// The first line of the output tells the user why
+	if line := firstLine(output); line != "" {
+		message += ": " + line
+	}
+	tunnel.reject(event.SessionID, errCodeVetoed, message)
+	return false
+}
+
+// postEnd runs the post-end hook of options for a session that ended
+func (tunnel *SocketTunnel) postEnd(options TunnelOptions, event Event) {
+	if options.PostEndHook == nil {
+		return
+	}
+	event.Type = hookPostEnd
+	if output, err := options.PostEndHook.run(context.Background(), event); err != nil {
+		tunnel.logger.Warn("Post-end hook failed", zap.String("sessionID", event.SessionID), zap.String("output", output), zap.Error(err))
+	}
+}
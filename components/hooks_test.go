@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newHook creates a hook running a shell script
+func newHook(t *testing.T, script string) *ExecHook {
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewExecHook(path, time.Second, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestSessionHooks(t *testing.T) {
+	dir := t.TempDir()
+	spec, _ := NewSessionSpec("/bin/sh")
+	options := TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		PreStartHook:   newHook(t, "env > "+filepath.Join(dir, "pre-start")),
+		PostEndHook:    newHook(t, "env > "+filepath.Join(dir, "post-end")),
+	}
+	tunnel, messages := newTestTunnel(options)
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"role": "admin"}}`)
+	nextOfType(t, messages, typeOutput) // The prompt, once the hook ran
+	if !tunnel.hasSession("s1") {
+		t.Fatal("Expected the session to start")
+	}
+	environ, _ := os.ReadFile(filepath.Join(dir, "pre-start"))
+	for _, expected := range []string{"EVENT_TYPE=pre-start\n", "EVENT_SESSION_ID=s1\n", "EVENT_PROFILE=default\n", "EVENT_ROLE=admin\n"} {
+		if !strings.Contains(string(environ), expected) {
+			t.Errorf("Expected %q in the environment of the pre-start hook:\n%s", expected, environ)
+		}
+	}
+	tunnel.onEnd("s1")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+	tunnel.sessionsWait.Wait() // Released once the post-end hook ran
+	environ, _ = os.ReadFile(filepath.Join(dir, "post-end"))
+	for _, expected := range []string{"EVENT_TYPE=post-end\n", "EVENT_SESSION_ID=s1\n", "EVENT_REASON=shell exited\n", "EVENT_DURATION="} {
+		if !strings.Contains(string(environ), expected) {
+			t.Errorf("Expected %q in the environment of the post-end hook:\n%s", expected, environ)
+		}
+	}
+
+	// A failing pre-start hook only vetoes the session if asked to
+	os.Remove(filepath.Join(dir, "post-end"))
+	options.PreStartHook = newHook(t, "echo maintenance window closed\necho details\nexit 1")
+	tunnel.SetOptions(options)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": null}`)
+	nextOfType(t, messages, typeOutput)
+	if !tunnel.hasSession("s2") {
+		t.Fatal("Expected the session to start despite the failing hook")
+	}
+	tunnel.onEnd("s2")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+	tunnel.sessionsWait.Wait()
+
+	os.Remove(filepath.Join(dir, "post-end"))
+	options.PreStartVeto = true
+	tunnel.SetOptions(options)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s3", "payload": null}`)
+	message := nextMessage(t, messages)
+	if payload, ok := message.Payload.(map[string]interface{}); message.Type != typeError || !ok || payload["code"] != errCodeVetoed ||
+		payload["message"] != vetoMessage+": maintenance window closed" {
+		t.Fatalf("Expected the session to be vetoed, got %+v", message)
+	}
+	if tunnel.hasSession("s3") {
+		t.Fatal("Vetoed session should not start")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "post-end")); !os.IsNotExist(err) {
+		t.Fatal("Post-end hook should not run for a vetoed session")
+	}
+}
+
+func TestPreStartHookInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n[ \"$EVENT_SESSION_ID\" != slow ] || sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewExecHook(path, time.Minute, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, _ := NewSessionSpec("/bin/sh")
+	options := TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		PreStartHook:   hook,
+	}
+	tunnel, messages := newTestTunnel(options)
+
+	// A slow hook does not hold up the other sessions
+	tunnel.onMessage(`{"type": "start", "sessionID": "slow", "payload": null}`)
+	tunnel.onMessage(`{"type": "start", "sessionID": "fast", "payload": null}`)
+	if message := nextMessage(t, messages); message.Type != typeOutput || message.SessionID != "fast" {
+		t.Fatalf("Expected the prompt of the fast session, got %+v", message)
+	}
+	if tunnel.hasSession("slow") {
+		t.Fatal("Expected the slow session to wait for its hook")
+	}
+
+	// Ending a session starting kills its hook
+	started := time.Now()
+	tunnel.onEnd("slow")
+	message := nextMessage(t, messages)
+	if message.Type != typeEnd || message.SessionID != "slow" || message.Reason != reasonCancelled {
+		t.Fatalf("Expected the slow session to be cancelled, got %+v", message)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected the hook to be killed at once, took %v", elapsed)
+	}
+	if tunnel.hasSession("slow") {
+		t.Fatal("Cancelled session should not start")
+	}
+	tunnel.onEnd("fast")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+	tunnel.sessionsWait.Wait()
+}
+
+func TestHookTimeoutKillsChildren(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 30 &\nwait\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewExecHook(path, 200*time.Millisecond, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The child holds the output open, unless killed with its parent
+	started := time.Now()
+	if _, err := hook.run(context.Background(), Event{Type: hookPreStart}); err == nil {
+		t.Fatal("Expected the hook to time out")
+	}
+	if elapsed := time.Since(started); elapsed > hookWaitDelay {
+		t.Fatalf("Expected the children of the hook to be killed, took %v", elapsed)
+	}
+}
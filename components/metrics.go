@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a single metric family written in the Prometheus text format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// metricVec is a counter or gauge with an optional set of labels
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	mutex  *sync.Mutex
+	values map[string]float64 // Keyed by the label values joined with \xff
+}
+
+func newMetricVec(kind string, name string, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, mutex: &sync.Mutex{}, values: make(map[string]float64)}
+}
+
+func (vec *metricVec) add(value float64, labelValues ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.values[strings.Join(labelValues, "\xff")] += value
+}
+
+func (vec *metricVec) set(value float64, labelValues ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.values[strings.Join(labelValues, "\xff")] = value
+}
+
+func (vec *metricVec) get(labelValues ...string) float64 {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	return vec.values[strings.Join(labelValues, "\xff")]
+}
+
+func (vec *metricVec) write(w *bufio.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	writeHeader(w, vec.name, vec.help, vec.kind)
+	if len(vec.labels) == 0 && len(vec.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", vec.name)
+		return
+	}
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", vec.name, formatLabels(vec.labels, strings.Split(key, "\xff")), formatValue(vec.values[key]))
+	}
+}
+
+// gaugeFunc is a gauge whose value is read at scrape time
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (gauge *gaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatValue(gauge.value()))
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	mutex   *sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name string, help string, bounds ...float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, mutex: &sync.Mutex{}, buckets: make([]uint64, len(bounds))}
+}
+
+func (hist *histogram) observe(value float64) {
+	hist.mutex.Lock()
+	defer hist.mutex.Unlock()
+	for i, bound := range hist.bounds {
+		if value <= bound {
+			hist.buckets[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (hist *histogram) write(w *bufio.Writer) {
+	hist.mutex.Lock()
+	defer hist.mutex.Unlock()
+	writeHeader(w, hist.name, hist.help, "histogram")
+	for i, bound := range hist.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", hist.name, formatValue(bound), hist.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", hist.name, hist.count)
+	fmt.Fprintf(w, "%s_sum %s\n", hist.name, formatValue(hist.sum))
+	fmt.Fprintf(w, "%s_count %d\n", hist.name, hist.count)
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Metrics holds the Prometheus metrics of a tunnel
+type Metrics struct {
+	families          []metric
+	tunnelConnected   *metricVec
+	reconnectAttempts *metricVec
+	reconnectBackoff  *metricVec
+	messages          *metricVec
+	bytes             *metricVec
+	parseErrors       *metricVec
+	ptyErrors         *metricVec
+	droppedBytes      *metricVec
+	sessions          *metricVec
+	sessionDuration   *histogram
+}
+
+// newMetrics creates the metrics of a tunnel, the queue depth and active
+// sessions are read from queue and sessionsMap at scrape time
+func newMetrics(queue *scheduler, sessionsMap map[string]*session, mutex *sync.Mutex) *Metrics {
+	metrics := &Metrics{
+		tunnelConnected:   newMetricVec("gauge", "pe_terminal_tunnel_connected", "Whether the tunnel is connected to the cloud (1) or not (0)."),
+		reconnectAttempts: newMetricVec("counter", "pe_terminal_tunnel_reconnect_attempts_total", "Number of attempts to re-establish the tunnel."),
+		reconnectBackoff:  newMetricVec("gauge", "pe_terminal_tunnel_reconnect_backoff_seconds", "Delay before the next attempt to re-establish the tunnel."),
+		messages:          newMetricVec("counter", "pe_terminal_messages_total", "Number of messages travelling through the tunnel.", "direction", "type"),
+		bytes:             newMetricVec("counter", "pe_terminal_message_bytes_total", "Size of the messages travelling through the tunnel.", "direction", "type"),
+		parseErrors:       newMetricVec("counter", "pe_terminal_message_parse_errors_total", "Number of received messages that could not be parsed.", "reason"),
+		ptyErrors:         newMetricVec("counter", "pe_terminal_pty_errors_total", "Number of failed operations on session terminals.", "operation"),
+		droppedBytes:      newMetricVec("counter", "pe_terminal_output_dropped_bytes_total", "Bytes of session output dropped by the rate limits."),
+		sessions:          newMetricVec("counter", "pe_terminal_sessions_total", "Number of sessions started, by profile.", "profile"),
+		sessionDuration:   newHistogram("pe_terminal_session_duration_seconds", "Duration of ended sessions.", 10, 60, 300, 900, 1800, 3600, 4*3600, 12*3600, 24*3600),
+	}
+	metrics.families = []metric{
+		metrics.tunnelConnected,
+		metrics.reconnectAttempts,
+		metrics.reconnectBackoff,
+		metrics.messages,
+		metrics.bytes,
+		metrics.parseErrors,
+		&gaugeFunc{"pe_terminal_send_queue_depth", "Number of messages waiting to be written to the websocket.", func() float64 {
+			return float64(queue.len())
+		}},
+		&gaugeFunc{"pe_terminal_sessions_active", "Number of running sessions.", func() float64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return float64(len(sessionsMap))
+		}},
+		metrics.sessions,
+		metrics.sessionDuration,
+		metrics.ptyErrors,
+		metrics.droppedBytes,
+	}
+	return metrics
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffer := bufio.NewWriter(w)
+	for _, family := range metrics.families {
+		family.write(buffer)
+	}
+	buffer.Flush()
+}
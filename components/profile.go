@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile is a named kind of session the cloud can select in the start message
+type Profile struct {
+	Description  string
+	Spec         SessionSpec
+	Recording    bool     // Record the output of the session to the recording directory
+	AllowedRoles []string // Roles allowed to start the profile, empty allows any
+	MaxSessions  int      // Concurrent sessions of the profile, 0 is unlimited
+	MaxDuration  time.Duration
+	Policy       *Policy // Restricts the session to the commands allowed, a free shell when nil
+}
+
+// TunnelOptions holds the session settings of a tunnel
+type TunnelOptions struct {
+	Profiles        map[string]Profile
+	DefaultProfile  string // Used when the start message does not name a profile
+	RecordingDir    string
+	PreStartHook    *ExecHook      // Run before a shell is spawned, optional
+	PreStartVeto    bool           // A failing pre-start hook rejects the session
+	PostEndHook     *ExecHook      // Run once a session ended, optional
+	Approval        *Approval      // Sessions wait for a local operator, disabled when nil
+	E2E             *E2E           // End-to-end encryption of sessions, disabled when nil
+	Authorization   *Authorization // Start messages need a token signed by the cloud, disabled when nil
+	Coalescing      Coalescing     // Batching of the output of sessions
+	Compression     bool           // Negotiate permessage-deflate, from the next connection on
+	RateLimit       int            // Output of a session in bytes per second, unlimited when 0
+	GlobalRateLimit int            // Output of all sessions in bytes per second, unlimited when 0
+	SyncInterval    time.Duration  // Between two frames of a session in sync mode, sync mode is disabled when 0
+}
+
+// profileInfo describes a profile in the answer to a profiles query
+type profileInfo struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Default      bool     `json:"default"`
+	Recording    bool     `json:"recording"`
+	AllowedRoles []string `json:"allowedRoles"`
+	MaxSessions  int      `json:"maxSessions,omitempty"`
+	Restricted   bool     `json:"restricted,omitempty"` // Only allowed commands can be run
+}
+
+// profileInfos lists the profiles sorted by name
+func (options TunnelOptions) profileInfos() []profileInfo {
+	infos := make([]profileInfo, 0, len(options.Profiles))
+	for name, profile := range options.Profiles {
+		roles := profile.AllowedRoles
+		if roles == nil {
+			roles = []string{}
+		}
+		infos = append(infos, profileInfo{
+			Name:         name,
+			Description:  profile.Description,
+			Default:      name == options.DefaultProfile,
+			Recording:    profile.Recording,
+			AllowedRoles: roles,
+			MaxSessions:  profile.MaxSessions,
+			Restricted:   profile.Policy != nil,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// sessionSpec returns the spec of a session of the profile started by request, a restricted
+// session does not take its environment nor its directory from the cloud
+func (profile Profile) sessionSpec(request startRequest) SessionSpec {
+	if profile.Policy != nil {
+		return restrictedSpec(request.restricted().apply(profile.Spec))
+	}
+	return request.apply(profile.Spec)
+}
+
+// allowsRole tells if role may start the profile
+func (profile Profile) allowsRole(role string) bool {
+	if len(profile.AllowedRoles) == 0 {
+		return true
+	}
+	for _, allowed := range profile.AllowedRoles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// startRequest holds the optional fields of a start payload
+type startRequest struct {
+	profile     string
+	role        string
+	token       string
+	operator    string // Once the token is verified
+	env         map[string]string
+	cwd         *string
+	width       uint16
+	height      uint16
+	pixelWidth  uint16
+	pixelHeight uint16
+	window      int64 // Initial credit of the session output, no flow control when 0
+	sync        bool  // The screen is asked for as frames rather than the output
+	e2e         *e2eOffer
+	channel     *e2eChannel // Once the offer is accepted
+	answer      *e2eAnswer
+}
+
+// parseStartRequest validates a start payload, a payload-less start is an empty request
+func parseStartRequest(payload interface{}) (startRequest, error) {
+	request := startRequest{env: make(map[string]string)}
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return request, nil
+	}
+	for key, value := range fields {
+		switch key {
+		case "profile", "role", "term", "lang", "cwd", "token", "mode":
+			text, ok := value.(string)
+			if !ok {
+				return request, fmt.Errorf("field %q should be a string", key)
+			}
+			switch key {
+			case "profile":
+				request.profile = text
+			case "role":
+				request.role = text
+			case "token":
+				request.token = text
+			case "term":
+				request.env["TERM"] = text
+			case "lang":
+				request.env["LANG"] = text
+			case "cwd":
+				request.cwd = &text
+			case "mode":
+				if text != modeStream && text != modeSync {
+					return request, fmt.Errorf("field %q should be %q or %q", key, modeStream, modeSync)
+				}
+				request.sync = text == modeSync
+			}
+		case "env":
+			env, ok := value.(map[string]interface{})
+			if !ok {
+				return request, fmt.Errorf("field %q should be an object", key)
+			}
+			for name, value := range env {
+				if name == "" || strings.Contains(name, "=") {
+					return request, fmt.Errorf("invalid variable name %q", name)
+				}
+				text, ok := value.(string)
+				if !ok {
+					return request, fmt.Errorf("variable %q should be a string", name)
+				}
+				request.env[name] = text
+			}
+		case "window":
+			window, err := parseCredit(value)
+			if err != nil {
+				return request, fmt.Errorf("field %q %v", key, err)
+			}
+			request.window = window
+		case "e2e":
+			offer, err := parseE2EOffer(value)
+			if err != nil {
+				return request, err
+			}
+			request.e2e = offer
+		case "width", "height", "pixelWidth", "pixelHeight":
+			dimension, err := parseDimension(value)
+			if err != nil {
+				return request, fmt.Errorf("field %q: %w", key, err)
+			}
+			switch key {
+			case "width":
+				request.width = dimension
+			case "height":
+				request.height = dimension
+			case "pixelWidth":
+				request.pixelWidth = dimension
+			case "pixelHeight":
+				request.pixelHeight = dimension
+			}
+		default:
+			return request, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	_, hasWidth := fields["width"]
+	_, hasHeight := fields["height"]
+	if hasWidth != hasHeight {
+		return request, errors.New("fields \"width\" and \"height\" should be given together")
+	}
+	return request, nil
+}
+
+// apply returns a copy of spec with the fields of the request set, variables of the request
+// not allowed by spec.EnvAllow are left out
+func (request startRequest) apply(spec SessionSpec) SessionSpec {
+	env := make(map[string]string, len(spec.Env)+len(request.env))
+	for key, value := range spec.Env {
+		env[key] = value
+	}
+	for key, value := range request.env {
+		if spec.allows(key) {
+			env[key] = value
+		}
+	}
+	spec.Env = env
+	if request.cwd != nil {
+		spec.Dir = *request.cwd
+	}
+	if request.width > 0 && request.height > 0 {
+		spec.Width = request.width
+		spec.Height = request.height
+		spec.PixelWidth = request.pixelWidth
+		spec.PixelHeight = request.pixelHeight
+	}
+	return spec
+}
+
+// parseDimension validates a window dimension decoded with UseNumber
+func parseDimension(value interface{}) (uint16, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, errors.New("should be a number")
+	}
+	dimension, err := number.Int64()
+	if err != nil || dimension < 0 || dimension > math.MaxUint16 {
+		return 0, fmt.Errorf("invalid dimension %s", number)
+	}
+	return uint16(dimension), nil
+}
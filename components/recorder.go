@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// recorder writes the output of a session as an asciicast v2 file
+type recorder struct {
+	file    *os.File
+	started time.Time
+	mutex   *sync.Mutex
+}
+
+// newRecorder creates <dir>/<time>-<sessionID>.cast and writes its header
+func newRecorder(dir string, sessionID string, spec SessionSpec) (*recorder, error) {
+	started := time.Now()
+	name := fmt.Sprintf("%s-%s.cast", started.UTC().Format("20060102T150405Z"), unsafeFileChars.ReplaceAllString(sessionID, "_"))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	width, height := spec.Width, spec.Height
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": started.Unix(),
+		"env":       map[string]string{"TERM": spec.Env["TERM"]},
+	})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recorder{file: file, started: started, mutex: &sync.Mutex{}}, nil
+}
+
+// event appends an event, code is "o" for output and "r" for resize
+func (rec *recorder) event(code string, data string) error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	line, _ := json.Marshal([]interface{}{time.Since(rec.started).Seconds(), code, data})
+	_, err := rec.file.Write(append(line, '\n'))
+	return err
+}
+
+func (rec *recorder) close() error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.file.Close()
+}
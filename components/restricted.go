@@ -0,0 +1,429 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	restrictedPrompt = "$ "
+	restrictedBanner = "Restricted session, type 'help' for the available commands.\r\n"
+	historySize      = 100
+)
+
+// restrictedEnv is forced on the commands of restricted sessions, so that e.g. a pager cannot be
+// made to run a shell, and restrictedDeny drops the variables of the dynamic linker
+var (
+	restrictedEnv  = map[string]string{"PAGER": "cat", "SYSTEMD_PAGER": "", "LESSSECURE": "1"}
+	restrictedDeny = []string{"LD_*"}
+	plainName      = regexp.MustCompile(`^[A-Za-z0-9._@+-]*$`)
+)
+
+// CommandRule allows a command of a restricted session
+type CommandRule struct {
+	Path string         // Absolute path of the binary run for the command
+	Args *regexp.Regexp // Matched against the arguments joined by spaces, any arguments when nil
+}
+
+// Policy decides which commands a restricted session may run. Commands are looked up
+// by name and run without a shell, so pipes, redirections and variables are only
+// arguments, which the rules have to allow.
+type Policy struct {
+	Commands map[string]CommandRule
+	Deny     []*regexp.Regexp // Matched against the whole command-line, denies even allowed commands
+}
+
+// check returns the command-line to run for argv, or why it is not allowed
+func (policy Policy) check(argv []string) ([]string, error) {
+	rule, ok := policy.Commands[argv[0]]
+	if !ok {
+		return nil, fmt.Errorf("command %q is not allowed", argv[0])
+	}
+	args := strings.Join(argv[1:], " ")
+	if rule.Args != nil && !rule.Args.MatchString(args) {
+		return nil, fmt.Errorf("arguments %q are not allowed for %s", args, argv[0])
+	}
+	line := strings.Join(argv, " ")
+	for _, deny := range policy.Deny {
+		if deny.MatchString(line) {
+			return nil, fmt.Errorf("command-line matches denied pattern %q", deny.String())
+		}
+	}
+	return append([]string{rule.Path}, argv[1:]...), nil
+}
+
+// restricted keeps of a request what a restricted session takes from the cloud: the size of the
+// window and plain terminal and language names, not the other variables nor the directory
+func (request startRequest) restricted() startRequest {
+	env := make(map[string]string)
+	for _, name := range []string{"TERM", "LANG"} {
+		if value, ok := request.env[name]; ok && plainName.MatchString(value) {
+			env[name] = value
+		}
+	}
+	request.env = env
+	request.cwd = nil
+	return request
+}
+
+// restrictedSpec forces the safe environment of restricted sessions on spec
+func restrictedSpec(spec SessionSpec) SessionSpec {
+	env := make(map[string]string, len(spec.Env)+len(restrictedEnv))
+	for key, value := range spec.Env {
+		env[key] = value
+	}
+	for key, value := range restrictedEnv {
+		env[key] = value
+	}
+	spec.Env = env
+	spec.EnvDeny = append(append([]string{}, spec.EnvDeny...), restrictedDeny...)
+	return spec
+}
+
+// RestrictedShell is a session reading command-lines with its own prompt and running
+// the ones allowed by its policy, each on a Terminal of its own
+type RestrictedShell struct {
+	spec        SessionSpec
+	policy      Policy
+	logger      *zap.Logger
+	onData      func(string)
+	onClose     func(error)
+	onViolation func(command string, reason string)
+	mutex       *sync.Mutex
+	editor      *lineEditor
+	running     *Terminal // The command being run, nil at the prompt
+	closed      bool
+	closeOnce   *sync.Once
+	screen      *screenMirror // Of the prompt and the commands
+}
+
+// NewRestrictedShell starts a restricted session, commands are run as described by spec.
+// onViolation is called for every command-line refused by policy.
+func NewRestrictedShell(spec SessionSpec, policy Policy, logger *zap.Logger, onData func(string), onClose func(error),
+	onViolation func(command string, reason string)) (*RestrictedShell, error) {
+	if len(policy.Commands) == 0 {
+		return nil, fmt.Errorf("no command allowed")
+	}
+	screen := newScreenMirror(spec.Width, spec.Height, onData)
+	shell := &RestrictedShell{
+		spec:        spec,
+		policy:      policy,
+		logger:      logger.With(zap.String("component", "restricted")),
+		onData:      screen.write,
+		onClose:     onClose,
+		onViolation: onViolation,
+		mutex:       &sync.Mutex{},
+		editor:      &lineEditor{prompt: restrictedPrompt},
+		closeOnce:   &sync.Once{},
+		screen:      screen,
+	}
+	shell.logger.Info("Starting restricted session", zap.Strings("commands", shell.commandNames()))
+	go shell.onData(restrictedBanner + restrictedPrompt) // Passed on once the session is registered
+	return shell, nil
+}
+
+// Pid returns the process-id of the command being run, 0 at the prompt
+func (shell *RestrictedShell) Pid() int {
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+	if shell.running == nil {
+		return 0
+	}
+	return shell.running.Pid()
+}
+
+// Write edits the command-line, or passes input on to the command being run
+func (shell *RestrictedShell) Write(input string) error {
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+	var echo strings.Builder
+	defer func() {
+		if echo.Len() > 0 {
+			shell.onData(echo.String())
+		}
+	}()
+	for len(input) > 0 && !shell.closed {
+		if shell.running != nil {
+			return shell.running.Write(input)
+		}
+		key, size := utf8.DecodeRuneInString(input)
+		input = input[size:]
+		output, action, line := shell.editor.key(key)
+		echo.WriteString(output)
+		switch action {
+		case editSubmit:
+			// The output of the command follows the echo
+			shell.onData(echo.String() + "\r\n")
+			echo.Reset()
+			if !shell.run(line, &echo) {
+				echo.WriteString(restrictedPrompt)
+			}
+		case editEOF:
+			echo.WriteString("\r\n")
+			go shell.Close()
+			return nil
+		}
+	}
+	return nil
+}
+
+// run runs a command-line, it returns true if a command was started
+func (shell *RestrictedShell) run(line string, echo *strings.Builder) bool {
+	argv, err := SplitCommand(line)
+	if err != nil {
+		fmt.Fprintf(echo, "%v\r\n", err)
+		return false
+	}
+	if len(argv) == 0 {
+		return false
+	}
+	switch argv[0] {
+	case "help":
+		fmt.Fprintf(echo, "Available commands: %s\r\n", strings.Join(shell.commandNames(), ", "))
+		return false
+	case "exit":
+		go shell.Close()
+		return true
+	}
+	command, err := shell.policy.check(argv)
+	if err != nil {
+		shell.logger.Warn("Command denied by policy", zap.String("command", line), zap.Error(err))
+		fmt.Fprintf(echo, "pe-terminal: %v\r\n", err)
+		shell.onViolation(line, err.Error())
+		return false
+	}
+	shell.logger.Info("Command allowed by policy", zap.String("command", line), zap.Strings("argv", command))
+	spec := shell.spec
+	spec.Argv = command
+	var term Terminal
+	term, err = NewTerminal(spec, shell.logger, shell.onData, func(error) { shell.exited(&term) })
+	if err != nil {
+		fmt.Fprintf(echo, "pe-terminal: failed to run %s: %v\r\n", argv[0], err)
+		return false
+	}
+	shell.running = &term
+	return true
+}
+
+// exited returns to the prompt once a command is done
+func (shell *RestrictedShell) exited(term *Terminal) {
+	shell.mutex.Lock() // Held by run until term is set
+	defer shell.mutex.Unlock()
+	code := term.exitCode()
+	if shell.running == term {
+		shell.running = nil
+	}
+	if shell.closed {
+		return
+	}
+	status := ""
+	if code != 0 {
+		status = fmt.Sprintf("\r\n[exit status %d]", code)
+	}
+	shell.onData(status + "\r\n" + restrictedPrompt)
+}
+
+// Resize changes the window size of the commands
+func (shell *RestrictedShell) Resize(width uint16, height uint16) error {
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+	shell.spec.Width, shell.spec.Height = width, height
+	shell.screen.resize(width, height)
+	if shell.running != nil {
+		return shell.running.Resize(width, height)
+	}
+	return nil
+}
+
+// mirror returns the model of the screen of the session
+func (shell *RestrictedShell) mirror() *screenMirror {
+	return shell.screen
+}
+
+// Close stops the command being run and ends the session, calling it more than once is safe
+func (shell *RestrictedShell) Close() error {
+	var err error
+	shell.closeOnce.Do(func() {
+		shell.mutex.Lock()
+		shell.closed = true
+		running := shell.running
+		shell.mutex.Unlock()
+		if running != nil {
+			err = running.Close()
+		}
+		shell.logger.Info("Restricted session ended")
+		go shell.onClose(nil) // Callers may hold the lock of the session
+	})
+	return err
+}
+
+func (shell *RestrictedShell) commandNames() []string {
+	names := make([]string, 0, len(shell.policy.Commands))
+	for name := range shell.policy.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Actions of lineEditor.key
+const (
+	editNone = iota
+	editSubmit
+	editEOF
+)
+
+// lineEditor reads a command-line key by key, echoing the edits. It handles the arrow,
+// home and end keys, backspace and delete, history and the usual control keys.
+type lineEditor struct {
+	prompt  string
+	line    []rune
+	cursor  int
+	history []string
+	recall  int    // Position in history while browsing it with up and down
+	escape  []rune // Incomplete escape sequence
+}
+
+// key handles a key, returning the output to echo, the resulting action and the submitted line
+func (editor *lineEditor) key(key rune) (string, int, string) {
+	if len(editor.escape) > 0 || key == '\x1b' {
+		return editor.escapeKey(key), editNone, ""
+	}
+	switch key {
+	case '\r', '\n':
+		line := string(editor.line)
+		if strings.TrimSpace(line) != "" && (len(editor.history) == 0 || editor.history[len(editor.history)-1] != line) {
+			editor.history = append(editor.history, line)
+			if len(editor.history) > historySize {
+				editor.history = editor.history[1:]
+			}
+		}
+		editor.line, editor.cursor, editor.recall = nil, 0, len(editor.history)
+		return "", editSubmit, line
+	case '\x03': // Ctrl-C drops the line
+		editor.line, editor.cursor, editor.recall = nil, 0, len(editor.history)
+		return "^C\r\n" + editor.prompt, editNone, ""
+	case '\x04': // Ctrl-D ends the session on an empty line
+		if len(editor.line) == 0 {
+			return "", editEOF, ""
+		}
+		return editor.delete(editor.cursor), editNone, ""
+	case '\x7f', '\b':
+		if editor.cursor == 0 {
+			return "", editNone, ""
+		}
+		editor.cursor--
+		return editor.delete(editor.cursor), editNone, ""
+	case '\x01': // Ctrl-A
+		editor.cursor = 0
+	case '\x05': // Ctrl-E
+		editor.cursor = len(editor.line)
+	case '\x15': // Ctrl-U
+		editor.line, editor.cursor = editor.line[editor.cursor:], 0
+	case '\x0b': // Ctrl-K
+		editor.line = editor.line[:editor.cursor]
+	case '\x0c': // Ctrl-L
+		return "\x1b[H\x1b[2J" + editor.redraw(), editNone, ""
+	default:
+		if key < ' ' || key == utf8.RuneError {
+			return "", editNone, ""
+		}
+		editor.line = append(editor.line[:editor.cursor], append([]rune{key}, editor.line[editor.cursor:]...)...)
+		editor.cursor++
+		if editor.cursor == len(editor.line) {
+			return string(key), editNone, ""
+		}
+	}
+	return editor.redraw(), editNone, ""
+}
+
+// escapeKey collects an escape sequence, acting on it once complete
+func (editor *lineEditor) escapeKey(key rune) string {
+	editor.escape = append(editor.escape, key)
+	sequence := string(editor.escape)
+	switch {
+	case sequence == "\x1b", sequence == "\x1b[", sequence == "\x1bO":
+		return "" // Incomplete
+	case strings.HasPrefix(sequence, "\x1b[") && (key < 0x40 || key > 0x7e):
+		return "" // Parameters of a CSI sequence
+	}
+	editor.escape = nil
+	switch sequence {
+	case "\x1b[D", "\x1bOD":
+		if editor.cursor > 0 {
+			editor.cursor--
+		}
+	case "\x1b[C", "\x1bOC":
+		if editor.cursor < len(editor.line) {
+			editor.cursor++
+		}
+	case "\x1b[H", "\x1bOH", "\x1b[1~":
+		editor.cursor = 0
+	case "\x1b[F", "\x1bOF", "\x1b[4~":
+		editor.cursor = len(editor.line)
+	case "\x1b[3~":
+		return editor.delete(editor.cursor)
+	case "\x1b[A", "\x1bOA":
+		if editor.recall == 0 {
+			return ""
+		}
+		editor.recall--
+		editor.line = []rune(editor.history[editor.recall])
+		editor.cursor = len(editor.line)
+	case "\x1b[B", "\x1bOB":
+		if editor.recall >= len(editor.history) {
+			return ""
+		}
+		editor.recall++
+		editor.line = nil
+		if editor.recall < len(editor.history) {
+			editor.line = []rune(editor.history[editor.recall])
+		}
+		editor.cursor = len(editor.line)
+	default:
+		return "" // Unsupported keys are ignored
+	}
+	return editor.redraw()
+}
+
+// delete removes the character at position, if any
+func (editor *lineEditor) delete(position int) string {
+	if position >= len(editor.line) {
+		return ""
+	}
+	editor.line = append(editor.line[:position], editor.line[position+1:]...)
+	return editor.redraw()
+}
+
+// redraw rewrites the prompt and the line, placing the cursor
+func (editor *lineEditor) redraw() string {
+	output := "\r" + editor.prompt + string(editor.line) + "\x1b[K"
+	if back := len(editor.line) - editor.cursor; back > 0 {
+		output += fmt.Sprintf("\x1b[%dD", back)
+	}
+	return output
+}
@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineEditor(t *testing.T) {
+	editor := &lineEditor{prompt: "$ "}
+	typeKeys := func(keys string) []string {
+		var lines []string
+		for _, key := range keys {
+			if _, action, line := editor.key(key); action == editSubmit {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	for keys, expected := range map[string]string{
+		"ls\r":         "ls",
+		"lsx\x7f -l\r": "ls -l",
+		"ping host\x1b[D\x1b[D\x1b[D\x1b[D-c 1 \r": "ping -c 1 host",
+		"uptime\x01\x1b[3~\x05s\r":                 "ptimes",
+		"df -h\x15free\r":                          "free",
+		"cat /etc/passwd\x1b[H\x0b\r":              "",
+		"ls\x03df\r":                               "df",
+		"ünïcödé\x7f\r":                            "ünïcöd",
+		"\x1b[1;5Cwho\x1bOH\x1bOFami\r":            "whoami",
+	} {
+		if lines := typeKeys(keys); !reflect.DeepEqual(lines, []string{expected}) {
+			t.Errorf("%q: expected %q, got %q", keys, expected, lines)
+		}
+	}
+
+	// History, skipping empty and repeated lines
+	editor = &lineEditor{prompt: "$ "}
+	typeKeys("one\rtwo\rtwo\r\r")
+	if lines := typeKeys("\x1b[A\x1b[A\r"); !reflect.DeepEqual(lines, []string{"one"}) {
+		t.Errorf("Expected the line before last, got %q", lines)
+	}
+	if lines := typeKeys("\x1b[A\x1b[A\x1b[B\x1b[B\r"); !reflect.DeepEqual(lines, []string{""}) {
+		t.Errorf("Expected an empty line past the history, got %q", lines)
+	}
+	if _, action, _ := editor.key('\x04'); action != editEOF {
+		t.Errorf("Expected Ctrl-D to end the session on an empty line")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{
+		Commands: map[string]CommandRule{
+			"ping":   {Path: "/bin/ping", Args: regexp.MustCompile(`^-c [0-9]+ [a-z0-9.-]+$`)},
+			"uptime": {Path: "/usr/bin/uptime"},
+		},
+		Deny: []*regexp.Regexp{regexp.MustCompile(`\b10\.0\.0\.1\b`)},
+	}
+	for command, expected := range map[string][]string{
+		"ping -c 3 example.com": {"/bin/ping", "-c", "3", "example.com"},
+		"uptime -p":             {"/usr/bin/uptime", "-p"},
+		"ping example.com":      nil,
+		"ping -c 3 a.com;ls":    nil,
+		"ping -c 1 10.0.0.1":    nil,
+		"/bin/ping -c 1 a.com":  nil,
+		"bash":                  nil,
+	} {
+		argv, _ := SplitCommand(command)
+		allowed, err := policy.check(argv)
+		if !reflect.DeepEqual(allowed, expected) || (expected == nil) != (err != nil) {
+			t.Errorf("%q: expected %q, got %q (%v)", command, expected, allowed, err)
+		}
+	}
+}
+
+func TestRestrictedShell(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/sh")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles: map[string]Profile{"diagnostics": {Spec: spec, Policy: &Policy{
+			Commands: map[string]CommandRule{
+				"echo":  {Path: "/bin/echo", Args: regexp.MustCompile(`^[a-z ]*$`)},
+				"false": {Path: "/bin/false"},
+			},
+			Deny: []*regexp.Regexp{regexp.MustCompile(`secret`)},
+		}}},
+		DefaultProfile: "diagnostics",
+	})
+	// output collects the output of the session until it contains expected
+	output := func(expected string) string {
+		var received strings.Builder
+		for !strings.Contains(received.String(), expected) {
+			message := nextMessage(t, messages)
+			if message.Type == typeOutput {
+				received.WriteString(message.Payload.(string))
+			}
+		}
+		return received.String()
+	}
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	output(restrictedBanner + restrictedPrompt)
+	if tunnel.getOptions().profileInfos()[0].Restricted != true {
+		t.Error("Expected the profile to be listed as restricted")
+	}
+
+	tunnel.onInput("s1", "echo hello world\r")
+	if received := output("\r\n" + restrictedPrompt); !strings.Contains(received, "hello world\r\n") || strings.Count(received, "hello world") != 2 {
+		t.Fatalf("Expected the echo and the output of the command, got %q", received)
+	}
+	tunnel.onInput("s1", "false\r")
+	output("[exit status 1]\r\n" + restrictedPrompt)
+	tunnel.onInput("s1", "help\r")
+	output("Available commands: echo, false\r\n" + restrictedPrompt)
+
+	for command, reason := range map[string]string{
+		"sh -c id":        `command "sh" is not allowed`,
+		"echo ../../etc":  `arguments "../../etc" are not allowed for echo`,
+		"echo the secret": `command-line matches denied pattern "secret"`,
+	} {
+		tunnel.onInput("s1", command+"\r")
+		for {
+			message := nextMessage(t, messages)
+			if message.Type != typeError {
+				continue
+			}
+			if payload := message.Payload.(map[string]interface{}); payload["code"] != errCodePolicy || payload["message"] != reason {
+				t.Fatalf("%s: unexpected error %+v", command, message)
+			}
+			break
+		}
+		output(reason + "\r\n" + restrictedPrompt)
+		if !tunnel.hasSession("s1") {
+			t.Fatal("A violation should not end the session")
+		}
+	}
+
+	tunnel.onInput("s1", "exit\r")
+	for message := nextMessage(t, messages); message.Type != typeEnd; message = nextMessage(t, messages) {
+	}
+	if tunnel.hasSession("s1") {
+		t.Fatal("Expected the session to end")
+	}
+}
+
+func TestRestrictedEnvironment(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/sh")
+	spec.Dir = t.TempDir()
+	spec.Env = map[string]string{"PAGER": "less", "LD_LIBRARY_PATH": "/opt/lib"}
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles: map[string]Profile{"diagnostics": {Spec: spec, Policy: &Policy{
+			Commands: map[string]CommandRule{
+				"env": {Path: "/usr/bin/env"},
+				"pwd": {Path: "/bin/pwd"},
+			},
+		}}},
+		DefaultProfile: "diagnostics",
+	})
+	// The variables and the directory of the request are not taken by a restricted session
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"term": "xterm", "lang": "$(id)", "cwd": "/",
+		"env": {"BASH_ENV": "/tmp/payload", "LD_PRELOAD": "/tmp/payload.so", "PAGER": "sh"}}}`)
+	var output string
+	for _, command := range []string{"env", "pwd"} { // Each once the previous one is done
+		tunnel.onInput("s1", command+"\r")
+		received, _ := collectOutput(t, messages, "s1", 500*time.Millisecond)
+		output += received
+	}
+	for _, expected := range []string{"TERM=xterm\r\n", "PAGER=cat\r\n", "SYSTEMD_PAGER=\r\n", "LESSSECURE=1\r\n", spec.Dir + "\r\n"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in the output %q", expected, output)
+		}
+	}
+	for _, injected := range []string{"BASH_ENV", "LD_PRELOAD", "LD_LIBRARY_PATH", "$(id)", "PAGER=sh", "PAGER=less"} {
+		if strings.Contains(output, injected) {
+			t.Errorf("Unexpected %q in the output %q", injected, output)
+		}
+	}
+	tunnel.onInput("s1", "exit\r")
+	for message := nextMessage(t, messages); message.Type != typeEnd; message = nextMessage(t, messages) {
+	}
+}
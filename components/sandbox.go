@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	sandboxInitName = "pe-terminal-sandbox"         // argv[0] of the helper setting up the sandbox
+	sandboxInitEnv  = "PE_TERMINAL_SANDBOX_INIT"    // Passes the setup to the helper, removed before the shell runs
+	sandboxScratch  = "/scratch"                    // Where the scratch directory appears in the sandbox
+	sandboxExitCode = 127                           // Exit status of the helper if the setup failed
+	sandboxMessage  = "pe-terminal: sandbox failed" // Prefix of setup errors, shown in the session
+)
+
+// Sandbox runs the shell of a session in its own mount, PID, IPC and UTS namespaces (and
+// optionally network namespace). The shell sees a read-only root holding only the mounts
+// of the sandbox, a private /tmp, /proc, a minimal /dev and a writable /scratch.
+// When pe-terminal is not root, an unprivileged user namespace is created as well.
+type Sandbox struct {
+	Mounts         []Mount // Bind-mounted read-only, DefaultSandboxMounts when empty
+	Scratch        string  // Host directory mounted writable at /scratch, optional
+	Hostname       string  // Host name in the sandbox, empty keeps the one of the gateway
+	PrivateNetwork bool    // Only a loopback interface, no access to the network of the gateway
+}
+
+// Mount is a host path bind-mounted read-only into a sandbox
+type Mount struct {
+	Source   string
+	Target   string // Path in the sandbox, the same as Source when empty
+	Optional bool   // Skipped if Source does not exist
+}
+
+// DefaultSandboxMounts gives the shell the system binaries, libraries and configuration
+func DefaultSandboxMounts() []Mount {
+	var mounts []Mount
+	for _, dir := range []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"} {
+		mounts = append(mounts, Mount{Source: dir, Optional: true})
+	}
+	return mounts
+}
+
+// ParseMount parses a mount given as "path" or "source:target", both absolute
+func ParseMount(mount string) (Mount, error) {
+	source, target, _ := strings.Cut(mount, ":")
+	if !path.IsAbs(source) || (target != "" && !path.IsAbs(target)) {
+		return Mount{}, fmt.Errorf("invalid mount %q, should be an absolute path or source:target", mount)
+	}
+	if target == "" {
+		target = source
+	}
+	target = path.Clean(target)
+	if target == "/" || target == "/tmp" || target == "/proc" || target == "/dev" || target == sandboxScratch {
+		return Mount{}, fmt.Errorf("invalid mount %q, %s is set up by the sandbox", mount, target)
+	}
+	return Mount{Source: path.Clean(source), Target: target}, nil
+}
+
+// sandboxInit is handed to the helper, which sets up the sandbox and the confinement and
+// runs the shell
+type sandboxInit struct {
+	Sandbox       *Sandbox     `json:",omitempty"`
+	Confinement   *Confinement `json:",omitempty"`
+	Argv          []string
+	Dir           string
+	Uid           *uint32 `json:",omitempty"` // Run the shell as, the user of pe-terminal when nil
+	Gid           uint32
+	Groups        []uint32
+	UserNamespace bool // The helper is root of an unprivileged user namespace
+	HostUid       uint32
+	HostGid       uint32
+}
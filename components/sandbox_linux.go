@@ -0,0 +1,504 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Flags of statfs, the kernel refuses to remount a bind-mount in a user namespace without them
+const (
+	stNoSuid      = 0x2
+	stNoDev       = 0x4
+	stNoExec      = 0x8
+	stNoAtime     = 0x400
+	stNoDirAtime  = 0x800
+	stRelAtime    = 0x1000
+	oldRoot       = "/oldroot" // The root of the gateway while the sandbox is set up
+	newRoot       = "/newroot" // The root of the sandbox while it is set up
+	sandboxTmpDir = "/tmp"     // Briefly the root, so that the host is not touched
+)
+
+// devices are bind-mounted from the gateway into /dev of the sandbox
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// wrap returns the helper that sets up the sandbox and the confinement and runs cmd. The
+// helper is pe-terminal itself, handed the setup in the environment. With a confinement,
+// the returned socket receives the seccomp listener of the shell.
+func wrap(cmd *exec.Cmd, sandbox *Sandbox, confinement *Confinement) (*exec.Cmd, *os.File, error) {
+	setup := sandboxInit{Sandbox: sandbox, Confinement: confinement, Argv: append([]string{cmd.Path}, cmd.Args[1:]...), Dir: cmd.Dir}
+	helper := &exec.Cmd{
+		Path: "/proc/self/exe", // Still the binary of pe-terminal if it was replaced meanwhile
+		Args: []string{sandboxInitName},
+		Env:  cmd.Env,
+	}
+	if sandbox == nil {
+		// The helper runs as the user of the shell and becomes the shell
+		helper.Dir, helper.SysProcAttr = cmd.Dir, cmd.SysProcAttr
+	} else {
+		if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+			credential := cmd.SysProcAttr.Credential
+			setup.Uid, setup.Gid, setup.Groups = &credential.Uid, credential.Gid, credential.Groups
+		}
+		attr := &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS}
+		if sandbox.PrivateNetwork {
+			attr.Cloneflags |= syscall.CLONE_NEWNET
+		}
+		if os.Geteuid() != 0 {
+			if setup.Uid != nil {
+				return nil, nil, errors.New("running a sandboxed shell as another user requires pe-terminal to run as root")
+			}
+			// The helper is root of the user namespace only, the shell gets the ids of pe-terminal back
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+			setup.UserNamespace, setup.HostUid, setup.HostGid = true, uint32(os.Geteuid()), uint32(os.Getegid())
+		}
+		helper.SysProcAttr = attr
+	}
+	var supervisor *os.File
+	if confinement != nil {
+		if err := confinement.check(); err != nil {
+			return nil, nil, err
+		}
+		if confinement.filtersSyscalls() {
+			var helperEnd *os.File
+			var err error
+			if supervisor, helperEnd, err = confinementSocket(); err != nil {
+				return nil, nil, err
+			}
+			helper.ExtraFiles = []*os.File{helperEnd} // Closed by the caller once started
+		}
+	}
+	encoded, err := json.Marshal(setup)
+	if err != nil {
+		return nil, nil, err
+	}
+	helper.Env = append(helper.Env, sandboxInitEnv+"="+string(encoded))
+	return helper, supervisor, nil
+}
+
+// RunSandboxInit sets up the sandbox and the confinement and runs the shell when pe-terminal
+// was started as their helper, it returns at once otherwise. Call it first thing in main.
+func RunSandboxInit() {
+	if len(os.Args) == 0 || os.Args[0] != sandboxInitName {
+		return
+	}
+	runtime.LockOSThread() // Landlock and seccomp apply to the calling thread and its children
+	var setup sandboxInit
+	err := json.Unmarshal([]byte(os.Getenv(sandboxInitEnv)), &setup)
+	os.Unsetenv(sandboxInitEnv)
+	if err == nil && setup.Sandbox != nil {
+		err = setup.mount()
+	}
+	if err == nil && setup.Sandbox == nil {
+		err = setup.exec()
+	}
+	if err != nil {
+		// Output goes to the session
+		fmt.Fprintf(os.Stderr, "%s: %v\r\n", sandboxMessage, err)
+		os.Exit(sandboxExitCode)
+	}
+	os.Exit(setup.run())
+}
+
+// confine applies the confinement, if any, to the calling thread
+func (setup sandboxInit) confine() error {
+	if setup.Confinement == nil {
+		return nil
+	}
+	var notify *os.File
+	if setup.Confinement.filtersSyscalls() {
+		notify = os.NewFile(confinementListenerFd, confinementListenerLabel)
+		defer notify.Close() // Not passed on to the shell
+	}
+	return setup.Confinement.confine(notify)
+}
+
+// exec confines the helper and replaces it by the shell, without a sandbox
+func (setup sandboxInit) exec() error {
+	if err := setup.confine(); err != nil {
+		return err
+	}
+	return syscall.Exec(setup.Argv[0], setup.Argv, os.Environ())
+}
+
+// mount builds the file-system of the sandbox and makes it the root
+func (setup sandboxInit) mount() error {
+	// The pty of the session, on which the helper was started
+	pty, _ := os.Readlink("/proc/self/fd/0")
+	if !strings.HasPrefix(pty, "/dev/pts/") {
+		pty = ""
+	}
+	// Keep the mounts to come from propagating to the gateway
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// Work on a tmpfs as root, with the root of the gateway below it, to not need a directory on the gateway
+	if err := syscall.Mount("tmpfs", sandboxTmpDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting tmpfs: %w", err)
+	}
+	for _, dir := range []string{oldRoot, newRoot} {
+		if err := os.Mkdir(sandboxTmpDir+dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.PivotRoot(sandboxTmpDir, sandboxTmpDir+oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"root", func() error { return mountTmpfs(newRoot, "mode=0755") }},
+		{"mounts", setup.bindMounts},
+		{"/tmp", func() error { return mountTmpfs(newRoot+"/tmp", "mode=1777") }},
+		{"scratch", setup.bindScratch},
+		{"/proc", func() error {
+			return mountOn("proc", newRoot+"/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		}},
+		{"/dev", func() error { return mountDev(pty) }},
+		{"network", setup.network},
+		{"hostname", setup.hostname},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+
+	// Swap in the new root, stacking the old one on top of it and detaching it
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the root of the gateway: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+	if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+		return fmt.Errorf("making the root read-only: %w", err)
+	}
+	return nil
+}
+
+// bindMounts bind-mounts the read-only layout
+func (setup sandboxInit) bindMounts() error {
+	mounts := setup.Sandbox.Mounts
+	if len(mounts) == 0 {
+		mounts = DefaultSandboxMounts()
+	}
+	for _, mount := range mounts {
+		target := mount.Target
+		if target == "" {
+			target = mount.Source
+		}
+		if err := bindReadOnly(oldRoot+mount.Source, newRoot+target, mount.Optional); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindScratch mounts the scratch directory writable
+func (setup sandboxInit) bindScratch() error {
+	if setup.Sandbox.Scratch == "" {
+		return nil
+	}
+	return mountOn(oldRoot+setup.Sandbox.Scratch, newRoot+sandboxScratch, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+// network brings up the loopback interface of a private network namespace
+func (setup sandboxInit) network() error {
+	if !setup.Sandbox.PrivateNetwork {
+		return nil
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var request struct { // struct ifreq
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(request.name[:], "lo")
+	request.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		return fmt.Errorf("bringing up lo: %w", errno)
+	}
+	return nil
+}
+
+func (setup sandboxInit) hostname() error {
+	if setup.Sandbox.Hostname == "" {
+		return nil
+	}
+	return syscall.Sethostname([]byte(setup.Sandbox.Hostname))
+}
+
+// run starts the shell and stays as init of the PID namespace, reaping orphans and passing
+// on the signals of the kill-policy. It returns the exit status of the shell.
+func (setup sandboxInit) run() int {
+	cmd := &exec.Cmd{
+		Path:        setup.Argv[0],
+		Args:        setup.Argv,
+		Env:         os.Environ(),
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{},
+	}
+	// The home directory of the gateway is usually not mounted
+	if home := os.Getenv("HOME"); home == "" || !isDir(home) {
+		home = "/tmp"
+		if setup.Sandbox.Scratch != "" {
+			home = sandboxScratch
+		}
+		cmd.Env = append(cmd.Env, "HOME="+home)
+	}
+	for _, dir := range []string{setup.Dir, os.Getenv("HOME"), "/"} {
+		if dir != "" && isDir(dir) {
+			cmd.Dir = dir
+			break
+		}
+	}
+	if setup.Uid != nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: *setup.Uid, Gid: setup.Gid, Groups: setup.Groups}
+	}
+	if setup.UserNamespace {
+		// Nested user namespace mapping root of the sandbox back to the user of pe-terminal
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: int(setup.HostUid), HostID: 0, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: int(setup.HostGid), HostID: 0, Size: 1}}
+	}
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	if err := setup.confine(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\r\n", sandboxMessage, err)
+		return sandboxExitCode
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\r\n", sandboxMessage, err)
+		return sandboxExitCode
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return sandboxExitCode
+		}
+		if pid != cmd.Process.Pid {
+			continue // An orphan
+		}
+		// The processes left in the sandbox are killed once init exits
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// bindReadOnly bind-mounts source at target read-only, symbolic links are copied
+func bindReadOnly(source string, target string, optional bool) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if err := mountOn(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	// The mounts below source came along and are remounted read-only one by one
+	points, err := submounts(target)
+	if err != nil {
+		return err
+	}
+	for _, point := range points {
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | lockedFlags(point)
+		if err := syscall.Mount("", point, "", flags, ""); err != nil {
+			return fmt.Errorf("making %s read-only: %w", point, err)
+		}
+	}
+	return nil
+}
+
+// submounts returns the mount points at or below path, from the mountinfo of the process
+// in the /proc of the gateway, while the sandbox is set up
+func submounts(path string) ([]string, error) {
+	data, err := os.ReadFile(oldRoot + "/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	var points []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		point := unescapeMountinfo(fields[4])
+		if point == path || strings.HasPrefix(point, path+"/") {
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// unescapeMountinfo decodes the octal escapes of a mountinfo field, e.g. \040 for a space
+func unescapeMountinfo(field string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if code, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(field[i])
+	}
+	return unescaped.String()
+}
+
+// mountDev sets up a minimal /dev, holding the usual devices and the pty of the session only
+func mountDev(pty string) error {
+	dev := newRoot + "/dev"
+	if err := mountTmpfs(dev, "mode=0755"); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := mountOn(oldRoot+"/dev/"+device, dev+"/"+device, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+	// The pty of the session comes from the gateway, the others are not seen
+	if err := mountTmpfs(dev+"/pts", "mode=0755"); err != nil {
+		return err
+	}
+	if pty != "" {
+		if err := mountOn(oldRoot+pty, newRoot+pty, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+	if err := mountTmpfs(dev+"/shm", "mode=1777"); err != nil {
+		return err
+	}
+	links := map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"}
+	for name, link := range links {
+		if err := os.Symlink(link, dev+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mountTmpfs(target string, options string) error {
+	return mountOn("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, options)
+}
+
+// mountOn mounts source at target, creating target like source (a directory or a file)
+func mountOn(source string, target string, fsType string, flags uintptr, options string) error {
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	} else if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, fsType, flags, options); err != nil {
+		return fmt.Errorf("mounting %s: %w", target, err)
+	}
+	return nil
+}
+
+// lockedFlags returns the flags of the mount at path that have to be kept when remounting it
+func lockedFlags(path string) uintptr {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0
+	}
+	var flags uintptr
+	for statFlag, mountFlag := range map[int64]uintptr{
+		stNoSuid:     syscall.MS_NOSUID,
+		stNoDev:      syscall.MS_NODEV,
+		stNoExec:     syscall.MS_NOEXEC,
+		stNoAtime:    syscall.MS_NOATIME,
+		stNoDirAtime: syscall.MS_NODIRATIME,
+		stRelAtime:   syscall.MS_RELATIME,
+	} {
+		if int64(stat.Flags)&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+	return flags
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSandboxSubmounts(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A writable mount below a read-only one
+	if err := syscall.Mount("tmpfs", sub, "tmpfs", 0, "mode=0777"); err != nil {
+		t.Skipf("Mounting requires root: %v", err)
+	}
+	defer syscall.Unmount(sub, syscall.MNT_DETACH)
+	mounts := append(DefaultSandboxMounts(), Mount{Source: dir, Target: "/opt/data"})
+	output, code := runSandboxed(t, Sandbox{Mounts: mounts}, `
+		[ -d /opt/data/sub ] && echo "sub=mounted"
+		touch /opt/data/sub/file 2>/dev/null || echo "sub=read-only"`)
+	if code != 0 || !strings.Contains(output, "sub=mounted\n") || !strings.Contains(output, "sub=read-only\n") {
+		t.Fatalf("Expected the submount read-only, got %q, exit status %d", output, code)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"go.uber.org/zap"
+)
+
+// wrap fails, namespaces, Landlock and seccomp are only available on Linux
+func wrap(cmd *exec.Cmd, sandbox *Sandbox, confinement *Confinement) (*exec.Cmd, *os.File, error) {
+	return nil, nil, errors.New("sandboxed and confined sessions are only supported on Linux")
+}
+
+// RunSandboxInit returns at once, there is no sandbox helper besides on Linux
+func RunSandboxInit() {}
+
+// check fails, confinements are only supported on Linux
+func (confinement *Confinement) check() error {
+	return errors.New("confinements are only supported on Linux")
+}
+
+// ValidateSyscall accepts any name, confinements fail elsewhere anyway
+func ValidateSyscall(name string) error {
+	return nil
+}
+
+func superviseSyscalls(socket *os.File, confinement *Confinement, logger *zap.Logger, exited <-chan struct{}) {
+}
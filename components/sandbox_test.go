@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestMain lets the test binary act as the sandbox helper, like pe-terminal does
+func TestMain(m *testing.M) {
+	RunSandboxInit()
+	os.Exit(m.Run())
+}
+
+// runSandboxed runs script in a sandbox and returns its output and exit status. It skips
+// the test where namespaces are not available, e.g. without unprivileged user namespaces.
+func runSandboxed(t *testing.T, sandbox Sandbox, script string) (string, int) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Sandboxes require Linux")
+	}
+	spec := SessionSpec{Argv: []string{"/bin/sh", "-c", script}, Kill: DefaultKillPolicy(), Sandbox: &sandbox}
+	var mutex sync.Mutex
+	var output strings.Builder
+	closed := make(chan struct{})
+	term, err := NewTerminal(spec, zap.NewNop(),
+		func(data string) {
+			mutex.Lock()
+			output.WriteString(data)
+			mutex.Unlock()
+		}, func(error) { close(closed) })
+	if err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("Namespaces not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+	defer term.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout, the sandboxed shell did not exit")
+	}
+	code := term.exitCode()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if code == sandboxExitCode && strings.Contains(output.String(), sandboxMessage) && strings.Contains(output.String(), "operation not permitted") {
+		t.Skipf("Namespaces not available: %s", output.String())
+	}
+	return strings.ReplaceAll(output.String(), "\r\n", "\n"), code
+}
+
+func TestSandbox(t *testing.T) {
+	scratch := t.TempDir()
+	output, code := runSandboxed(t, Sandbox{Scratch: scratch, Hostname: "sandboxed", PrivateNetwork: true}, `
+		echo "init=$(tr '\0' '\n' < /proc/1/cmdline)"
+		echo "host=$(cat /proc/sys/kernel/hostname)"
+		echo "tmp=$(ls -A /tmp | wc -l)"
+		echo written > /scratch/file && echo "scratch=ok"
+		touch /usr/pe-terminal-test 2>/dev/null || echo "usr=read-only"
+		mkdir /pe-terminal-test 2>/dev/null || echo "root=read-only"
+		touch /tmp/file && echo "tmp=writable"
+		echo "interfaces=$(grep -c : /proc/net/dev)"
+		echo "home=$HOME"
+		echo "uid=$(id -u)"
+		[ -z "$PE_TERMINAL_SANDBOX_INIT" ] && echo "env=clean"
+		exit 3`)
+	for _, expected := range []string{"init=pe-terminal-sandbox\n", "host=sandboxed\n", "tmp=0\n", "scratch=ok\n", "usr=read-only\n", "root=read-only\n",
+		"tmp=writable\n", "interfaces=1\n", "home=/scratch\n", "env=clean\n",
+		fmt.Sprintf("uid=%d\n", os.Getuid())} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in output %q", expected, output)
+		}
+	}
+	if code != 3 {
+		t.Errorf("Expected the exit status of the shell, got %d", code)
+	}
+	if content, err := os.ReadFile(filepath.Join(scratch, "file")); err != nil || string(content) != "written\n" {
+		t.Errorf("Expected the file written to /scratch on the gateway, got %q, %v", content, err)
+	}
+}
+
+func TestSandboxMounts(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), []byte("mounted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts := append(DefaultSandboxMounts(), Mount{Source: dir, Target: "/opt/data"})
+	output, code := runSandboxed(t, Sandbox{Mounts: mounts}, `cat /opt/data/data; echo; ls /home 2>/dev/null || echo "home=missing"`)
+	if code != 0 || !strings.Contains(output, "mounted\n") || !strings.Contains(output, "home=missing") {
+		t.Fatalf("Unexpected output %q, exit status %d", output, code)
+	}
+
+	// A mount missing on the gateway fails the session
+	mounts = append(DefaultSandboxMounts(), Mount{Source: filepath.Join(dir, "missing")})
+	output, code = runSandboxed(t, Sandbox{Mounts: mounts}, "echo started")
+	if code != sandboxExitCode || !strings.Contains(output, sandboxMessage) || strings.Contains(output, "started") {
+		t.Fatalf("Expected the sandbox to fail, got %q, exit status %d", output, code)
+	}
+}
+
+func TestSandboxPty(t *testing.T) {
+	// Another pty of the gateway, e.g. of another session
+	other, err := NewTerminal(SessionSpec{Argv: []string{"/bin/cat"}, Kill: DefaultKillPolicy()}, zap.NewNop(), func(string) {}, func(error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	output, code := runSandboxed(t, Sandbox{}, `
+		echo "ptys=$(ls -A /dev/pts | wc -l)"
+		[ -e "$(tty)" ] && echo "tty=ok"`)
+	if code != 0 || !strings.Contains(output, "ptys=1\n") || !strings.Contains(output, "tty=ok\n") {
+		t.Fatalf("Expected only the pty of the session, got %q, exit status %d", output, code)
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	for mount, expected := range map[string]Mount{
+		"/usr":               {Source: "/usr", Target: "/usr"},
+		"/srv/tools:/tools/": {Source: "/srv/tools", Target: "/tools"},
+	} {
+		if parsed, err := ParseMount(mount); err != nil || parsed != expected {
+			t.Errorf("%s: expected %+v, got %+v, %v", mount, expected, parsed, err)
+		}
+	}
+	for _, mount := range []string{"usr", "/srv:tools", "/data:/tmp", "/", "/srv:/scratch"} {
+		if _, err := ParseMount(mount); err == nil {
+			t.Errorf("%s: expected an error", mount)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import "sync"
+
+// scheduler queues the messages for the cloud by session and hands them to the write-loop
+// round-robin, so that a session flooding output can not hold back the echo of the others.
+// A sender blocks while the queue of its session is full, other sessions are not affected.
+type scheduler struct {
+	mutex  *sync.Mutex
+	space  *sync.Cond          // Broadcast when a message was taken
+	queues map[string][][]byte // By session, "" for the messages of the tunnel
+	ring   []string            // Sessions with queued messages, in the order they are served
+	length int
+	limit  int           // Messages queued per session
+	ready  chan struct{} // Signalled while messages are queued
+}
+
+func newScheduler(limit int) *scheduler {
+	mutex := &sync.Mutex{}
+	return &scheduler{
+		mutex:  mutex,
+		space:  sync.NewCond(mutex),
+		queues: make(map[string][][]byte),
+		limit:  limit,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a message of sessionID, waiting while its queue is full
+func (scheduler *scheduler) push(sessionID string, message []byte) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	for len(scheduler.queues[sessionID]) >= scheduler.limit {
+		scheduler.space.Wait()
+	}
+	if len(scheduler.queues[sessionID]) == 0 {
+		scheduler.ring = append(scheduler.ring, sessionID)
+	}
+	scheduler.queues[sessionID] = append(scheduler.queues[sessionID], message)
+	scheduler.length++
+	scheduler.signal()
+}
+
+// pop takes the next message, from the session after the one served last
+func (scheduler *scheduler) pop() ([]byte, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if len(scheduler.ring) == 0 {
+		return nil, false
+	}
+	sessionID := scheduler.ring[0]
+	scheduler.ring = scheduler.ring[1:]
+	queue := scheduler.queues[sessionID]
+	message := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		delete(scheduler.queues, sessionID)
+	} else {
+		scheduler.queues[sessionID] = queue[1:]
+		scheduler.ring = append(scheduler.ring, sessionID)
+	}
+	scheduler.length--
+	scheduler.space.Broadcast()
+	if scheduler.length > 0 {
+		scheduler.signal()
+	}
+	return message, true
+}
+
+// len returns the number of messages queued
+func (scheduler *scheduler) len() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.length
+}
+
+// signal wakes up the write-loop, the mutex must be held
+func (scheduler *scheduler) signal() {
+	select {
+	case scheduler.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,1270 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultScreenWidth  = 80
+	defaultScreenHeight = 24
+	maxScreenWidth      = 512 // Larger windows are modelled in part, bounding the memory of a session
+	maxScreenHeight     = 256
+	maxSequence         = 1024 // Bytes of a control sequence or OSC string kept at most
+	maxCellText         = 32   // Bytes of a character and its combining marks kept at most
+)
+
+// Attributes of a cell, set by SGR
+const (
+	attrBold uint16 = 1 << iota
+	attrFaint
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrInverse
+	attrHidden
+	attrStrike
+)
+
+// SGR codes of the attributes, in the order of their bits
+var attrCodes = []int{1, 2, 3, 4, 5, 7, 8, 9}
+
+// colour is colourDefault, an index of the 256-colour palette, or colourRGB with a 24-bit value
+type colour int32
+
+const (
+	colourDefault colour = -1
+	colourRGB     colour = 1 << 24
+)
+
+// style is the rendition of a cell
+type style struct {
+	attributes uint16
+	foreground colour
+	background colour
+}
+
+var defaultStyle = style{foreground: colourDefault, background: colourDefault}
+
+// cell is a character on the screen, a wide character is followed by a cell of width 0
+type cell struct {
+	text  string // The character and its combining marks
+	width uint8
+	style style
+}
+
+var blankCell = cell{text: " ", width: 1, style: defaultStyle}
+
+// The text of the ASCII characters, sparing an allocation per character printed
+var asciiText = func() []string {
+	text := make([]string, utf8.RuneSelf)
+	for r := range text {
+		text[r] = string(rune(r))
+	}
+	return text
+}()
+
+// The DEC special graphics set, for 0x5f to 0x7e
+var lineDrawing = []rune(" ◆▒␉␌␍␊°±␤␋┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π≠£·")
+
+// Private modes that only matter to the program and the operator's terminal, kept to be
+// sent along with a snapshot: cursor keys, mouse tracking, focus events and bracketed paste
+var replayedModes = []int{1, 1000, 1002, 1003, 1004, 1005, 1006, 1015, 2004}
+
+// savedCursor is what DECSC saves
+type savedCursor struct {
+	set      bool
+	x, y     int
+	pen      style
+	origin   bool
+	charsets [2]bool
+	charset  int
+}
+
+// screenBuffer is the main or the alternate screen
+type screenBuffer struct {
+	lines [][]cell
+	saved savedCursor
+}
+
+// States of the parser of control sequences
+const (
+	stateGround = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateString // DCS, APC, PM or SOS, ignored
+)
+
+// screen is a headless VT100/xterm screen fed with the output of a terminal, so that the
+// operator of a running session can be shown what is on it. Programs drawing the screen
+// with the usual control sequences are modelled, scrollback is not.
+type screen struct {
+	mutex        *sync.Mutex
+	width        int
+	height       int
+	main         *screenBuffer
+	alternate    *screenBuffer // nil unless in use or kept by mode 47
+	buffer       *screenBuffer // The one shown
+	x, y         int
+	wrapPending  bool // The cursor is past the last column, the next character goes to the next line
+	pen          style
+	top, bottom  int     // Scroll region
+	charsets     [2]bool // G0 and G1 hold the line drawing set
+	charset      int     // Shifted in, G0 or G1
+	origin       bool
+	autowrap     bool
+	insert       bool
+	cursorHidden bool
+	keypad       bool // Application keypad
+	modes        map[int]bool
+	title        string
+	last         rune // The last character printed, for REP
+	state        int
+	intermediate []byte
+	params       []byte
+	osc          []byte
+	partial      string // Incomplete UTF-8 sequence ending the output
+}
+
+// newScreen returns a blank screen, 80x24 if the size is not known
+func newScreen(width int, height int) *screen {
+	if width <= 0 || height <= 0 {
+		width, height = defaultScreenWidth, defaultScreenHeight
+	}
+	screen := &screen{mutex: &sync.Mutex{}}
+	screen.width, screen.height = clampScreenSize(width, height)
+	screen.reset()
+	return screen
+}
+
+func clampScreenSize(width int, height int) (int, int) {
+	if width > maxScreenWidth {
+		width = maxScreenWidth
+	}
+	if height > maxScreenHeight {
+		height = maxScreenHeight
+	}
+	return width, height
+}
+
+// write updates the screen with output of the terminal
+func (screen *screen) write(output string) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	if screen.partial != "" {
+		output = screen.partial + output
+		screen.partial = ""
+	}
+	for len(output) > 0 {
+		r, size := utf8.DecodeRuneInString(output)
+		if r == utf8.RuneError && !utf8.FullRuneInString(output) {
+			screen.partial = output
+			return
+		}
+		output = output[size:]
+		screen.process(r)
+	}
+}
+
+// resize changes the size of the screen, the line of the cursor is kept on it
+func (screen *screen) resize(width int, height int) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	if width <= 0 || height <= 0 {
+		return
+	}
+	width, height = clampScreenSize(width, height)
+	if width == screen.width && height == screen.height {
+		return
+	}
+	for _, buffer := range []*screenBuffer{screen.main, screen.alternate} {
+		if buffer == nil {
+			continue
+		}
+		lines := buffer.lines
+		if height < len(lines) {
+			drop := 0
+			if buffer == screen.buffer && screen.y >= height {
+				drop = screen.y - height + 1
+				screen.y -= drop
+			}
+			lines = lines[drop : drop+height]
+		}
+		for len(lines) < height {
+			lines = append(lines, nil)
+		}
+		for i, line := range lines {
+			lines[i] = resizeLine(line, width)
+		}
+		buffer.lines = lines
+	}
+	screen.width, screen.height = width, height
+	screen.top, screen.bottom = 0, height-1
+	screen.moveTo(screen.x, screen.y)
+}
+
+// resizeLine cuts or extends line to width
+func resizeLine(line []cell, width int) []cell {
+	if width <= len(line) {
+		line = line[:width:width]
+		if width > 0 && line[width-1].width == 2 {
+			line[width-1] = blankCell
+		}
+		return line
+	}
+	for len(line) < width {
+		line = append(line, blankCell)
+	}
+	return line
+}
+
+// text returns the lines shown on the screen, without trailing spaces
+func (screen *screen) text() []string {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	lines := make([]string, 0, screen.height)
+	for _, line := range screen.buffer.lines {
+		var text strings.Builder
+		for _, cell := range line {
+			if cell.width > 0 {
+				text.WriteString(cell.text)
+			}
+		}
+		lines = append(lines, strings.TrimRight(text.String(), " "))
+	}
+	return lines
+}
+
+// cursor returns the position of the cursor and if it is shown
+func (screen *screen) cursor() (int, int, bool) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	return screen.x, screen.y, !screen.cursorHidden
+}
+
+// size returns the width and height of the screen
+func (screen *screen) size() (int, int) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	return screen.width, screen.height
+}
+
+// snapshot returns output reproducing the screen, the cursor and the modes on a terminal of
+// the same size, whatever was shown on it before. Not reproduced are a pending wrap at the end
+// of a line, the origin mode saved with the cursor and, in origin mode, a cursor restored
+// outside of the scroll region.
+func (screen *screen) snapshot() string {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	var out strings.Builder
+	// Back to the main screen and the default modes, then clear it
+	out.WriteString("\x1b[?1049l\x1b[!p\x1b[?25l\x1b[4l\x1b[?6l\x1b[?7h\x1b[r\x1b(B\x1b)B\x0f\x1b[0m\x1b[H\x1b[2J")
+	screen.drawBuffer(&out, screen.main)
+	if screen.buffer == screen.alternate {
+		if saved := screen.main.saved; saved.set {
+			writeSavedCursor(&out, saved)
+			out.WriteString("\x1b[?1049h") // Saves the cursor on its way
+		} else {
+			out.WriteString("\x1b[?47h")
+		}
+		out.WriteString("\x1b[0m\x1b(B\x1b)B\x0f\x1b[H\x1b[2J")
+		screen.drawBuffer(&out, screen.alternate)
+	}
+	if saved := screen.buffer.saved; saved.set {
+		writeSavedCursor(&out, saved)
+		out.WriteString("\x1b7\x1b(B\x1b)B\x0f")
+	}
+
+	fmt.Fprintf(&out, "\x1b]2;%s\x07", screen.title)
+	if screen.top != 0 || screen.bottom != screen.height-1 {
+		fmt.Fprintf(&out, "\x1b[%d;%dr", screen.top+1, screen.bottom+1)
+	}
+	for _, mode := range replayedModes {
+		fmt.Fprintf(&out, "\x1b[?%d%c", mode, modeFinal(screen.modes[mode]))
+	}
+	if screen.keypad {
+		out.WriteString("\x1b=")
+	} else {
+		out.WriteString("\x1b>")
+	}
+	if screen.insert {
+		out.WriteString("\x1b[4h")
+	}
+	if !screen.autowrap {
+		out.WriteString("\x1b[?7l")
+	}
+	writeCharsets(&out, screen.charsets, screen.charset)
+	y := screen.y
+	if screen.origin {
+		out.WriteString("\x1b[?6h")
+		y -= screen.top
+	}
+	out.WriteString(sgr(screen.pen))
+	fmt.Fprintf(&out, "\x1b[%d;%dH", y+1, screen.x+1)
+	if !screen.cursorHidden {
+		out.WriteString("\x1b[?25h")
+	}
+	return out.String()
+}
+
+// drawBuffer writes the lines of buffer that are not blank
+func (screen *screen) drawBuffer(out *strings.Builder, buffer *screenBuffer) {
+	for y, line := range buffer.lines {
+		end := len(line)
+		for end > 0 && line[end-1] == blankCell {
+			end--
+		}
+		if end == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\x1b[%d;1H", y+1)
+		current := defaultStyle
+		for x, cell := range line[:end] {
+			if cell.width == 0 && x > 0 && line[x-1].width == 2 {
+				continue // Drawn along with the wide character
+			}
+			if cell.style != current {
+				out.WriteString(sgr(cell.style))
+				current = cell.style
+			}
+			if cell.width == 0 {
+				out.WriteByte(' ')
+				continue
+			}
+			out.WriteString(cell.text)
+		}
+		if current != defaultStyle {
+			out.WriteString("\x1b[0m")
+		}
+	}
+}
+
+// writeSavedCursor moves the cursor to where it was saved, with the rendition and character sets saved
+func writeSavedCursor(out *strings.Builder, saved savedCursor) {
+	fmt.Fprintf(out, "\x1b[%d;%dH", saved.y+1, saved.x+1)
+	out.WriteString(sgr(saved.pen))
+	writeCharsets(out, saved.charsets, saved.charset)
+}
+
+// writeCharsets designates G0 and G1 and shifts to charset
+func writeCharsets(out *strings.Builder, charsets [2]bool, charset int) {
+	for i, designator := range []string{"\x1b(", "\x1b)"} {
+		if charsets[i] {
+			out.WriteString(designator + "0")
+		} else {
+			out.WriteString(designator + "B")
+		}
+	}
+	if charset == 1 {
+		out.WriteByte(0x0e)
+	} else {
+		out.WriteByte(0x0f)
+	}
+}
+
+func modeFinal(set bool) byte {
+	if set {
+		return 'h'
+	}
+	return 'l'
+}
+
+// sgr returns the SGR sequence selecting style from the default rendition
+func sgr(style style) string {
+	var out strings.Builder
+	out.WriteString("\x1b[0")
+	for i, code := range attrCodes {
+		if style.attributes&(1<<i) != 0 {
+			fmt.Fprintf(&out, ";%d", code)
+		}
+	}
+	writeColour(&out, style.foreground, 30, 90, 38)
+	writeColour(&out, style.background, 40, 100, 48)
+	out.WriteByte('m')
+	return out.String()
+}
+
+func writeColour(out *strings.Builder, colour colour, base int, bright int, extended int) {
+	switch {
+	case colour == colourDefault:
+	case colour&colourRGB != 0:
+		fmt.Fprintf(out, ";%d;2;%d;%d;%d", extended, colour>>16&0xff, colour>>8&0xff, colour&0xff)
+	case colour < 8:
+		fmt.Fprintf(out, ";%d", base+int(colour))
+	case colour < 16:
+		fmt.Fprintf(out, ";%d", bright+int(colour)-8)
+	default:
+		fmt.Fprintf(out, ";%d;5;%d", extended, colour)
+	}
+}
+
+// reset returns to the initial state, keeping the size
+func (screen *screen) reset() {
+	screen.main = &screenBuffer{lines: blankLines(screen.width, screen.height)}
+	screen.alternate = nil
+	screen.buffer = screen.main
+	screen.x, screen.y, screen.wrapPending = 0, 0, false
+	screen.pen = defaultStyle
+	screen.top, screen.bottom = 0, screen.height-1
+	screen.charsets, screen.charset = [2]bool{}, 0
+	screen.origin, screen.autowrap, screen.insert = false, true, false
+	screen.cursorHidden, screen.keypad = false, false
+	screen.modes = make(map[int]bool)
+	screen.title = ""
+}
+
+// softReset is DECSTR
+func (screen *screen) softReset() {
+	screen.cursorHidden, screen.insert, screen.origin, screen.autowrap, screen.keypad = false, false, false, true, false
+	delete(screen.modes, 1)
+	screen.top, screen.bottom = 0, screen.height-1
+	screen.charsets, screen.charset = [2]bool{}, 0
+	screen.pen = defaultStyle
+	screen.buffer.saved = savedCursor{}
+}
+
+func blankLines(width int, height int) [][]cell {
+	lines := make([][]cell, height)
+	for i := range lines {
+		lines[i] = resizeLine(nil, width)
+	}
+	return lines
+}
+
+// process handles a character of the output
+func (screen *screen) process(r rune) {
+	if r < 0x20 || r == 0x7f {
+		switch {
+		case r == 0x18 || r == 0x1a: // CAN and SUB cancel a sequence
+			screen.state = stateGround
+		case screen.state == stateOSC && (r == bell || r == escape):
+			screen.dispatchOSC()
+			screen.escape(r == escape)
+		case screen.state == stateOSC || screen.state == stateString:
+			screen.escape(r == escape)
+		case r == escape:
+			screen.escape(true)
+		default:
+			screen.control(r) // Even within a control sequence
+		}
+		return
+	}
+	switch screen.state {
+	case stateGround:
+		screen.print(r)
+	case stateEscape:
+		if r >= 0x20 && r <= 0x2f {
+			screen.intermediate = appendBounded(screen.intermediate, byte(r))
+			return
+		}
+		screen.state = stateGround
+		if len(screen.intermediate) == 0 {
+			switch r {
+			case '[':
+				screen.state = stateCSI
+				screen.params, screen.intermediate = screen.params[:0], screen.intermediate[:0]
+				return
+			case ']':
+				screen.state = stateOSC
+				screen.osc = screen.osc[:0]
+				return
+			case 'P', 'X', '^', '_':
+				screen.state = stateString
+				return
+			}
+		}
+		screen.dispatchEscape(r)
+	case stateCSI:
+		switch {
+		case r >= 0x40 && r <= 0x7e:
+			screen.state = stateGround
+			screen.dispatchCSI(r)
+		case r >= 0x20 && r <= 0x2f:
+			screen.intermediate = appendBounded(screen.intermediate, byte(r))
+		case r < 0x80:
+			screen.params = appendBounded(screen.params, byte(r))
+		default:
+			screen.state = stateGround
+		}
+	case stateOSC:
+		if len(screen.osc)+utf8.RuneLen(r) <= maxSequence {
+			screen.osc = utf8.AppendRune(screen.osc, r)
+		}
+	}
+}
+
+// escape starts an escape sequence, or returns to the ground state
+func (screen *screen) escape(start bool) {
+	screen.state = stateGround
+	if start {
+		screen.state = stateEscape
+		screen.intermediate = screen.intermediate[:0]
+	}
+}
+
+func appendBounded(sequence []byte, b byte) []byte {
+	if len(sequence) >= maxSequence {
+		return sequence
+	}
+	return append(sequence, b)
+}
+
+// control handles a C0 control character
+func (screen *screen) control(r rune) {
+	switch r {
+	case '\b':
+		screen.moveTo(screen.x-1, screen.y)
+	case '\t':
+		screen.tab(1)
+	case '\n', '\v', '\f':
+		screen.index()
+	case '\r':
+		screen.moveTo(0, screen.y)
+	case 0x0e: // SO
+		screen.charset = 1
+	case 0x0f: // SI
+		screen.charset = 0
+	}
+}
+
+// print puts a character at the cursor and moves the cursor past it
+func (screen *screen) print(r rune) {
+	if screen.charsets[screen.charset] && r >= 0x5f && r <= 0x7e {
+		r = lineDrawing[r-0x5f]
+	}
+	width := runeWidth(r)
+	if width == 0 {
+		// Joins the character before the cursor
+		x := screen.x - 1
+		if screen.wrapPending {
+			x = screen.x
+		}
+		line := screen.buffer.lines[screen.y]
+		if x > 0 && line[x].width == 0 {
+			x--
+		}
+		if x >= 0 && len(line[x].text)+utf8.RuneLen(r) <= maxCellText {
+			line[x].text += string(r)
+		}
+		return
+	}
+	if width > screen.width {
+		return
+	}
+	screen.last = r
+	if screen.wrapPending || (width == 2 && screen.x == screen.width-1 && screen.autowrap) {
+		if !screen.wrapPending {
+			screen.eraseCells(screen.x, screen.x+1) // Does not fit, the rest of the line stays blank
+		}
+		screen.x = 0
+		screen.index()
+	} else if width == 2 && screen.x == screen.width-1 {
+		screen.x--
+	}
+	if screen.insert {
+		screen.insertCells(width)
+	}
+	line := screen.buffer.lines[screen.y]
+	splitWide(line, screen.x)
+	splitWide(line, screen.x+width)
+	text := asciiText[r&0x7f]
+	if r >= utf8.RuneSelf {
+		text = string(r)
+	}
+	line[screen.x] = cell{text: text, width: uint8(width), style: screen.pen}
+	if width == 2 {
+		line[screen.x+1] = cell{style: screen.pen}
+	}
+	screen.x += width
+	if screen.x >= screen.width {
+		screen.x = screen.width - 1
+		screen.wrapPending = screen.autowrap
+	}
+}
+
+// dispatchEscape handles an escape sequence
+func (screen *screen) dispatchEscape(final rune) {
+	switch string(screen.intermediate) {
+	case "":
+		switch final {
+		case '7':
+			screen.saveCursor()
+		case '8':
+			screen.restoreCursor()
+		case 'D':
+			screen.index()
+		case 'E':
+			screen.moveTo(0, screen.y)
+			screen.index()
+		case 'M':
+			screen.reverseIndex()
+		case 'c':
+			screen.reset()
+		case '=':
+			screen.keypad = true
+		case '>':
+			screen.keypad = false
+		}
+	case "(":
+		screen.charsets[0] = final == '0'
+	case ")":
+		screen.charsets[1] = final == '0'
+	}
+}
+
+// dispatchCSI handles a control sequence
+func (screen *screen) dispatchCSI(final rune) {
+	raw := string(screen.params)
+	if len(screen.intermediate) > 0 {
+		if string(screen.intermediate) == "!" && final == 'p' {
+			screen.softReset()
+		}
+		return
+	}
+	if raw != "" && strings.IndexByte("<=>?", raw[0]) >= 0 {
+		if raw[0] != '?' {
+			return
+		}
+		switch final {
+		case 'h', 'l':
+			for _, param := range parseParameters(raw[1:]) {
+				screen.setPrivateMode(param[0], final == 'h')
+			}
+			return
+		case 'J', 'K': // Selective erase, nothing is protected here
+			raw = raw[1:]
+		default:
+			return
+		}
+	}
+	params := parseParameters(raw)
+	n := parameter(params, 0, 1)
+	switch final {
+	case '@':
+		screen.insertCells(n)
+	case 'A':
+		screen.cursorUp(n)
+	case 'B', 'e':
+		screen.cursorDown(n)
+	case 'C', 'a':
+		screen.moveTo(screen.x+n, screen.y)
+	case 'D':
+		screen.moveTo(screen.x-n, screen.y)
+	case 'E':
+		screen.cursorDown(n)
+		screen.moveTo(0, screen.y)
+	case 'F':
+		screen.cursorUp(n)
+		screen.moveTo(0, screen.y)
+	case 'G', '`':
+		screen.moveTo(n-1, screen.y)
+	case 'H', 'f':
+		screen.setCursor(parameter(params, 1, 1)-1, n-1)
+	case 'd':
+		screen.setCursor(screen.x, n-1)
+	case 'I':
+		screen.tab(n)
+	case 'Z':
+		screen.tab(-n)
+	case 'J':
+		screen.eraseDisplay(parameter(params, 0, 0))
+	case 'K':
+		screen.eraseLine(parameter(params, 0, 0))
+	case 'L':
+		screen.insertLines(n)
+	case 'M':
+		screen.deleteLines(n)
+	case 'P':
+		screen.deleteCells(n)
+	case 'X':
+		screen.eraseCells(screen.x, screen.x+n)
+	case 'S':
+		screen.scrollUp(n)
+	case 'T':
+		if len(params) <= 1 { // With more, mouse highlight tracking
+			screen.scrollDown(n)
+		}
+	case 'b':
+		if screen.last != 0 {
+			for i := 0; i < n && i < screen.width*screen.height; i++ {
+				screen.print(screen.last)
+			}
+		}
+	case 'h', 'l':
+		for _, param := range params {
+			if param[0] == 4 {
+				screen.insert = final == 'h'
+			}
+		}
+	case 'm':
+		screen.selectGraphics(params)
+	case 'r':
+		screen.setScrollRegion(parameter(params, 0, 1), parameter(params, 1, screen.height))
+	case 's':
+		screen.saveCursor()
+	case 'u':
+		screen.restoreCursor()
+	}
+}
+
+// parseParameters splits the parameters of a control sequence, sub-parameters are separated by colons
+func parseParameters(raw string) [][]int {
+	if raw == "" {
+		return nil
+	}
+	fields := strings.Split(raw, ";")
+	params := make([][]int, len(fields))
+	for i, field := range fields {
+		for _, sub := range strings.Split(field, ":") {
+			value, err := strconv.Atoi(sub)
+			if err != nil || value < 0 {
+				value = 0
+			} else if value > 0xffff {
+				value = 0xffff
+			}
+			params[i] = append(params[i], value)
+		}
+	}
+	return params
+}
+
+// parameter returns the i-th parameter, or fallback if it is missing or 0
+func parameter(params [][]int, i int, fallback int) int {
+	if i < len(params) && params[i][0] > 0 {
+		return params[i][0]
+	}
+	return fallback
+}
+
+// setPrivateMode handles DECSET and DECRST
+func (screen *screen) setPrivateMode(mode int, set bool) {
+	switch mode {
+	case 6:
+		screen.origin = set
+		screen.setCursor(0, 0)
+	case 7:
+		screen.autowrap = set
+		if !set {
+			screen.wrapPending = false
+		}
+	case 25:
+		screen.cursorHidden = !set
+	case 47:
+		screen.switchBuffer(set)
+	case 1047:
+		if !set && screen.buffer == screen.alternate {
+			screen.alternate = nil // Cleared on the way out
+		}
+		screen.switchBuffer(set)
+	case 1048:
+		if set {
+			screen.saveCursor()
+		} else {
+			screen.restoreCursor()
+		}
+	case 1049:
+		if set {
+			screen.saveCursor()
+			screen.alternate = nil // Cleared on the way in
+			screen.switchBuffer(true)
+		} else {
+			if screen.buffer == screen.alternate {
+				screen.alternate = nil
+			}
+			screen.switchBuffer(false)
+			screen.restoreCursor()
+		}
+	default:
+		for _, replayed := range replayedModes {
+			if mode == replayed {
+				screen.modes[mode] = set
+			}
+		}
+	}
+}
+
+// switchBuffer shows the alternate or the main screen, the cursor stays where it is
+func (screen *screen) switchBuffer(alternate bool) {
+	if !alternate {
+		screen.buffer = screen.main
+		return
+	}
+	if screen.alternate == nil {
+		screen.alternate = &screenBuffer{lines: blankLines(screen.width, screen.height)}
+	}
+	screen.buffer = screen.alternate
+	screen.wrapPending = false
+}
+
+func (screen *screen) saveCursor() {
+	screen.buffer.saved = savedCursor{
+		set:      true,
+		x:        screen.x,
+		y:        screen.y,
+		pen:      screen.pen,
+		origin:   screen.origin,
+		charsets: screen.charsets,
+		charset:  screen.charset,
+	}
+}
+
+// restoreCursor restores what saveCursor saved, or moves the cursor home if nothing was
+func (screen *screen) restoreCursor() {
+	saved := screen.buffer.saved
+	if !saved.set {
+		saved.pen = defaultStyle
+	}
+	screen.pen, screen.origin, screen.charsets, screen.charset = saved.pen, saved.origin, saved.charsets, saved.charset
+	screen.moveTo(saved.x, saved.y)
+}
+
+// selectGraphics handles SGR
+func (screen *screen) selectGraphics(params [][]int) {
+	if len(params) == 0 {
+		screen.pen = defaultStyle
+		return
+	}
+	for i := 0; i < len(params); i++ {
+		code := params[i][0]
+		switch {
+		case code == 0:
+			screen.pen = defaultStyle
+		case code == 4 && len(params[i]) > 1 && params[i][1] == 0:
+			screen.pen.attributes &^= attrUnderline
+		case code == 6: // Rapid blink
+			screen.pen.attributes |= attrBlink
+		case code == 21: // Double underline
+			screen.pen.attributes |= attrUnderline
+		case code == 22:
+			screen.pen.attributes &^= attrBold | attrFaint
+		case code >= 23 && code <= 29:
+			for bit, attrCode := range attrCodes {
+				if attrCode == code-20 {
+					screen.pen.attributes &^= 1 << bit
+				}
+			}
+		case code >= 30 && code <= 37:
+			screen.pen.foreground = colour(code - 30)
+		case code == 39:
+			screen.pen.foreground = colourDefault
+		case code >= 40 && code <= 47:
+			screen.pen.background = colour(code - 40)
+		case code == 49:
+			screen.pen.background = colourDefault
+		case code >= 90 && code <= 97:
+			screen.pen.foreground = colour(code - 90 + 8)
+		case code >= 100 && code <= 107:
+			screen.pen.background = colour(code - 100 + 8)
+		case code == 38 || code == 48:
+			colour, used, ok := extendedColour(params[i:])
+			i += used
+			if ok && code == 38 {
+				screen.pen.foreground = colour
+			} else if ok {
+				screen.pen.background = colour
+			}
+		default:
+			for bit, attrCode := range attrCodes {
+				if attrCode == code {
+					screen.pen.attributes |= 1 << bit
+				}
+			}
+		}
+	}
+}
+
+// extendedColour parses the colour following 38 or 48 in params[0], as sub-parameters or
+// as the parameters following it. It returns the colour and how many parameters it took.
+func extendedColour(params [][]int) (colour, int, bool) {
+	values := params[0][1:]
+	used := 0
+	if len(values) == 0 { // Separated by semicolons
+		for _, param := range params[1:] {
+			values = append(values, param[0])
+		}
+	}
+	if len(values) == 0 {
+		return 0, 0, false
+	}
+	switch {
+	case values[0] == 5 && len(values) >= 2:
+		if len(params[0]) == 1 {
+			used = 2
+		}
+		return colour(values[1] & 0xff), used, true
+	case values[0] == 2 && len(values) >= 4:
+		rgb := values[1:4]
+		if len(params[0]) == 1 {
+			used = 4
+		} else if len(values) >= 5 { // With the colour space: 38:2::r:g:b
+			rgb = values[2:5]
+		}
+		return colourRGB | colour((rgb[0]&0xff)<<16|(rgb[1]&0xff)<<8|rgb[2]&0xff), used, true
+	}
+	return 0, len(params) - 1, false
+}
+
+// dispatchOSC handles an operating system command, only the title is kept
+func (screen *screen) dispatchOSC() {
+	code, text, _ := strings.Cut(string(screen.osc), ";")
+	if code == "0" || code == "2" {
+		screen.title = text
+	}
+}
+
+// moveTo moves the cursor, kept on the screen
+func (screen *screen) moveTo(x int, y int) {
+	screen.x = clamp(x, 0, screen.width-1)
+	screen.y = clamp(y, 0, screen.height-1)
+	screen.wrapPending = false
+}
+
+// setCursor moves the cursor, relative to the scroll region in origin mode
+func (screen *screen) setCursor(x int, y int) {
+	if screen.origin {
+		y = clamp(y+screen.top, screen.top, screen.bottom)
+	}
+	screen.moveTo(x, y)
+}
+
+func clamp(value int, low int, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+// cursorUp moves the cursor up, stopping at the top of the scroll region if it is in it
+func (screen *screen) cursorUp(n int) {
+	top := 0
+	if screen.y >= screen.top {
+		top = screen.top
+	}
+	screen.moveTo(screen.x, clamp(screen.y-n, top, screen.height-1))
+}
+
+// cursorDown moves the cursor down, stopping at the bottom of the scroll region if it is in it
+func (screen *screen) cursorDown(n int) {
+	bottom := screen.height - 1
+	if screen.y <= screen.bottom {
+		bottom = screen.bottom
+	}
+	screen.moveTo(screen.x, clamp(screen.y+n, 0, bottom))
+}
+
+// tab moves the cursor n tab stops forward, or backward if negative, every 8 columns
+func (screen *screen) tab(n int) {
+	x := screen.x
+	for ; n > 0 && x < screen.width-1; n-- {
+		x = (x/8 + 1) * 8
+	}
+	for ; n < 0 && x > 0; n++ {
+		x = (x - 1) / 8 * 8
+	}
+	screen.moveTo(x, screen.y)
+}
+
+// index moves the cursor down, scrolling at the bottom of the scroll region
+func (screen *screen) index() {
+	screen.wrapPending = false
+	if screen.y == screen.bottom {
+		screen.scrollUp(1)
+	} else if screen.y < screen.height-1 {
+		screen.y++
+	}
+}
+
+// reverseIndex moves the cursor up, scrolling at the top of the scroll region
+func (screen *screen) reverseIndex() {
+	screen.wrapPending = false
+	if screen.y == screen.top {
+		screen.scrollDown(1)
+	} else if screen.y > 0 {
+		screen.y--
+	}
+}
+
+// scrollUp moves the lines of the scroll region up by n, blank lines come in at the bottom
+func (screen *screen) scrollUp(n int) {
+	region := screen.buffer.lines[screen.top : screen.bottom+1]
+	n = clamp(n, 0, len(region))
+	scrolled := append([][]cell(nil), region[:n]...)
+	copy(region, region[n:])
+	for i, line := range scrolled {
+		screen.clearLine(line)
+		region[len(region)-n+i] = line
+	}
+}
+
+// scrollDown moves the lines of the scroll region down by n, blank lines come in at the top
+func (screen *screen) scrollDown(n int) {
+	region := screen.buffer.lines[screen.top : screen.bottom+1]
+	n = clamp(n, 0, len(region))
+	scrolled := append([][]cell(nil), region[len(region)-n:]...)
+	copy(region[n:], region)
+	for i, line := range scrolled {
+		screen.clearLine(line)
+		region[i] = line
+	}
+}
+
+// insertLines inserts n blank lines at the cursor, within the scroll region
+func (screen *screen) insertLines(n int) {
+	if screen.y < screen.top || screen.y > screen.bottom {
+		return
+	}
+	top := screen.top
+	screen.top = screen.y
+	screen.scrollDown(n)
+	screen.top = top
+	screen.moveTo(0, screen.y)
+}
+
+// deleteLines deletes n lines at the cursor, within the scroll region
+func (screen *screen) deleteLines(n int) {
+	if screen.y < screen.top || screen.y > screen.bottom {
+		return
+	}
+	top := screen.top
+	screen.top = screen.y
+	screen.scrollUp(n)
+	screen.top = top
+	screen.moveTo(0, screen.y)
+}
+
+// blank is an erased cell, in the background colour of the pen
+func (screen *screen) blank() cell {
+	return cell{text: " ", width: 1, style: style{foreground: colourDefault, background: screen.pen.background}}
+}
+
+func (screen *screen) clearLine(line []cell) {
+	blank := screen.blank()
+	for i := range line {
+		line[i] = blank
+	}
+}
+
+// splitWide erases a wide character split by the boundary before column x
+func splitWide(line []cell, x int) {
+	if x > 0 && x < len(line) && line[x].width == 0 {
+		line[x-1], line[x] = blankCell, blankCell
+	}
+}
+
+// eraseCells erases the columns from to to of the line of the cursor
+func (screen *screen) eraseCells(from int, to int) {
+	line := screen.buffer.lines[screen.y]
+	from, to = clamp(from, 0, screen.width), clamp(to, 0, screen.width)
+	splitWide(line, from)
+	splitWide(line, to)
+	blank := screen.blank()
+	for x := from; x < to; x++ {
+		line[x] = blank
+	}
+}
+
+// insertCells inserts n blank cells at the cursor, the cells pushed past the end of the line are lost
+func (screen *screen) insertCells(n int) {
+	line := screen.buffer.lines[screen.y]
+	n = clamp(n, 0, screen.width-screen.x)
+	splitWide(line, screen.x)
+	copy(line[screen.x+n:], line[screen.x:])
+	screen.eraseCells(screen.x, screen.x+n)
+	if last := line[screen.width-1]; last.width == 2 {
+		line[screen.width-1] = screen.blank()
+	}
+}
+
+// deleteCells deletes n cells at the cursor, blank cells come in at the end of the line
+func (screen *screen) deleteCells(n int) {
+	line := screen.buffer.lines[screen.y]
+	n = clamp(n, 0, screen.width-screen.x)
+	splitWide(line, screen.x)
+	splitWide(line, screen.x+n)
+	copy(line[screen.x:], line[screen.x+n:])
+	blank := screen.blank()
+	for x := screen.width - n; x < screen.width; x++ {
+		line[x] = blank
+	}
+}
+
+// eraseDisplay handles ED: below the cursor, above it, or everything
+func (screen *screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		screen.eraseCells(screen.x, screen.width)
+		for _, line := range screen.buffer.lines[screen.y+1:] {
+			screen.clearLine(line)
+		}
+	case 1:
+		screen.eraseCells(0, screen.x+1)
+		for _, line := range screen.buffer.lines[:screen.y] {
+			screen.clearLine(line)
+		}
+	case 2:
+		for _, line := range screen.buffer.lines {
+			screen.clearLine(line)
+		}
+	}
+}
+
+// eraseLine handles EL: right of the cursor, left of it, or the whole line
+func (screen *screen) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		screen.eraseCells(screen.x, screen.width)
+	case 1:
+		screen.eraseCells(0, screen.x+1)
+	case 2:
+		screen.eraseCells(0, screen.width)
+	}
+}
+
+// setScrollRegion handles DECSTBM, the lines are counted from 1
+func (screen *screen) setScrollRegion(top int, bottom int) {
+	bottom = clamp(bottom, 1, screen.height)
+	if top >= bottom {
+		return
+	}
+	screen.top, screen.bottom = top-1, bottom-1
+	screen.setCursor(0, 0)
+}
+
+// Wide characters, taking two columns: East Asian wide and fullwidth ranges and emoji
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec}, {0x23f0, 0x23f0}, {0x23f3, 0x23f3},
+	{0x25fd, 0x25fe}, {0x2614, 0x2615}, {0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce}, {0x26d4, 0x26d4}, {0x26ea, 0x26ea},
+	{0x26f2, 0x26f3}, {0x26f5, 0x26f5}, {0x26fa, 0x26fa}, {0x26fd, 0x26fd}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x274e, 0x274e}, {0x2753, 0x2755}, {0x2757, 0x2757}, {0x2795, 0x2797},
+	{0x27b0, 0x27b0}, {0x27bf, 0x27bf}, {0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55}, {0x2e80, 0x303e},
+	{0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff}, {0xa000, 0xa4cf}, {0xa960, 0xa97f}, {0xac00, 0xd7a3},
+	{0xf900, 0xfaff}, {0xfe10, 0xfe19}, {0xfe30, 0xfe6f}, {0xff00, 0xff60}, {0xffe0, 0xffe6}, {0x16fe0, 0x16fe4},
+	{0x17000, 0x18cff}, {0x1b000, 0x1b2ff}, {0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf}, {0x1f18e, 0x1f18e},
+	{0x1f191, 0x1f19a}, {0x1f200, 0x1f202}, {0x1f210, 0x1f23b}, {0x1f240, 0x1f248}, {0x1f250, 0x1f251},
+	{0x1f260, 0x1f265}, {0x1f300, 0x1f320}, {0x1f32d, 0x1f335}, {0x1f337, 0x1f37c}, {0x1f37e, 0x1f393},
+	{0x1f3a0, 0x1f3ca}, {0x1f3cf, 0x1f3d3}, {0x1f3e0, 0x1f3f0}, {0x1f3f4, 0x1f3f4}, {0x1f3f8, 0x1f3fa},
+	{0x1f400, 0x1f43e}, {0x1f440, 0x1f440}, {0x1f442, 0x1f4fc}, {0x1f4ff, 0x1f53d}, {0x1f54b, 0x1f54e},
+	{0x1f550, 0x1f567}, {0x1f57a, 0x1f57a}, {0x1f595, 0x1f596}, {0x1f5a4, 0x1f5a4}, {0x1f5fb, 0x1f64f},
+	{0x1f680, 0x1f6c5}, {0x1f6cc, 0x1f6cc}, {0x1f6d0, 0x1f6d2}, {0x1f6d5, 0x1f6d7}, {0x1f6dc, 0x1f6df},
+	{0x1f6eb, 0x1f6ec}, {0x1f6f4, 0x1f6fc}, {0x1f7e0, 0x1f7eb}, {0x1f7f0, 0x1f7f0}, {0x1f90c, 0x1f93a},
+	{0x1f93c, 0x1f945}, {0x1f947, 0x1f9ff}, {0x1fa70, 0x1faff}, {0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+// runeWidth returns the columns r takes on a terminal, 0 for the marks combining with the character before
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x300: // Before the first combining marks
+		return 1
+	case r == 0x200b || r == 0x200c || r == 0x200d || r == 0x2060 || (r >= 0x1f3fb && r <= 0x1f3ff) ||
+		unicode.In(r, unicode.Mn, unicode.Me):
+		return 0
+	case r < 0x1100:
+		return 1
+	}
+	i := sort.Search(len(wideRanges), func(i int) bool { return wideRanges[i][1] >= r })
+	if i < len(wideRanges) && wideRanges[i][0] <= r {
+		return 2
+	}
+	return 1
+}
+
+// screenMirror keeps the screen of a console in step with the output passed on to onData
+type screenMirror struct {
+	mutex  *sync.Mutex // Held while output is passed on, so that a snapshot falls between two chunks
+	screen *screen
+	onData func(string)
+}
+
+func newScreenMirror(width uint16, height uint16, onData func(string)) *screenMirror {
+	return &screenMirror{mutex: &sync.Mutex{}, screen: newScreen(int(width), int(height)), onData: onData}
+}
+
+// write updates the screen with output, then passes it on
+func (mirror *screenMirror) write(output string) {
+	mirror.mutex.Lock()
+	defer mirror.mutex.Unlock()
+	mirror.screen.write(output)
+	mirror.onData(output)
+}
+
+// snapshot passes a snapshot of the screen to deliver, in order with the output passed on
+func (mirror *screenMirror) snapshot(deliver func(string)) {
+	mirror.mutex.Lock()
+	defer mirror.mutex.Unlock()
+	deliver(mirror.screen.snapshot())
+}
+
+func (mirror *screenMirror) resize(width uint16, height uint16) {
+	mirror.screen.resize(int(width), int(height))
+}
+
+// Screenshot is the text on the screen of a session
+type Screenshot struct {
+	SessionID     string   `json:"sessionID"`
+	Width         int      `json:"width"`
+	Height        int      `json:"height"`
+	CursorX       int      `json:"cursorX"`
+	CursorY       int      `json:"cursorY"`
+	CursorVisible bool     `json:"cursorVisible"`
+	Lines         []string `json:"lines"`
+}
+
+// Screenshot returns the text on the screen of a running session
+func (tunnel *SocketTunnel) Screenshot(sessionID string) (Screenshot, error) {
+	session := tunnel.getSession(sessionID)
+	if session == nil {
+		return Screenshot{}, fmt.Errorf("no such session %q", sessionID)
+	}
+	screen := session.terminal.mirror().screen
+	shot := Screenshot{SessionID: sessionID, Lines: screen.text()}
+	shot.Width, shot.Height = screen.size()
+	shot.CursorX, shot.CursorY, shot.CursorVisible = screen.cursor()
+	return shot, nil
+}
+
+// onAttach sends a snapshot of the screen of a session to the operator joining it, as output
+func (tunnel *SocketTunnel) onAttach(sessionID string) {
+	session := tunnel.getSession(sessionID)
+	if session == nil {
+		tunnel.logger.Warn("Attach to an unknown session", zap.String("sessionID", sessionID))
+		tunnel.end(sessionID, reasonUnknownSession)
+		return
+	}
+	tunnel.logger.Info("Operator attached, sending screen snapshot", zap.String("sessionID", sessionID))
+	if session.frames != nil {
+		go session.frames.reset()
+		return
+	}
+	// Waits for the output being passed on, which may wait for credit arriving on this goroutine
+	go session.terminal.mirror().snapshot(session.output.write)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// screenState describes everything a snapshot reproduces
+func screenState(screen *screen) string {
+	var state strings.Builder
+	fmt.Fprintf(&state, "%dx%d cursor %d,%d hidden %v pen %+v region %d-%d charsets %v %d origin %v wrap %v insert %v keypad %v title %q\n",
+		screen.width, screen.height, screen.x, screen.y, screen.cursorHidden, screen.pen, screen.top, screen.bottom,
+		screen.charsets, screen.charset, screen.origin, screen.autowrap, screen.insert, screen.keypad, screen.title)
+	for _, mode := range replayedModes {
+		fmt.Fprintf(&state, "mode %d %v\n", mode, screen.modes[mode])
+	}
+	buffers := []*screenBuffer{screen.main}
+	if screen.buffer == screen.alternate {
+		buffers = append(buffers, screen.alternate)
+	}
+	for i, buffer := range buffers {
+		saved := buffer.saved
+		saved.origin = false
+		fmt.Fprintf(&state, "buffer %d saved %+v\n", i, saved)
+		for y, line := range buffer.lines {
+			for x, cell := range line {
+				if cell != blankCell {
+					fmt.Fprintf(&state, "%d,%d %q %d %+v\n", x, y, cell.text, cell.width, cell.style)
+				}
+			}
+		}
+	}
+	return state.String()
+}
+
+func TestScreen(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		output string
+		lines  []string
+		x, y   int
+	}{
+		{"text", "hello\r\nworld", []string{"hello", "world", "", ""}, 5, 1},
+		{"wrap", "abcdefghij", []string{"abcdefgh", "ij", "", ""}, 2, 1},
+		{"scroll", "1\r\n2\r\n3\r\n4\r\n5", []string{"2", "3", "4", "5"}, 1, 3},
+		{"cursor", "\x1b[2;3Hx\x1b[Ay\x1b[10;10Hz", []string{"   y", "  x", "", "       z"}, 7, 3},
+		{"erase", "abcdefgh\x1b[1;4H\x1b[K\r\nabcdefgh\x1b[1K", []string{"abc", "", "", ""}, 7, 1},
+		{"insert and delete", "abcdef\x1b[1;2H\x1b[2@\x1b[4G\x1b[P", []string{"a  cdef"}, 3, 0},
+		{"wide", "日本語x", []string{"日本語x"}, 7, 0},
+		{"wide wrap", "abcdefg語", []string{"abcdefg", "語"}, 2, 1},
+		{"wide split", "日本\x1b[1;2Hx", []string{" x本"}, 2, 0},
+		{"combining", "é 🇩🇪", []string{"é 🇩🇪"}, 4, 0},
+		{"region", "\x1b[2;3r\x1b[3;1Ha\r\nb\r\nc", []string{"", "b", "c"}, 1, 2},
+		{"lines", "1\r\n2\r\n3\r\n4\x1b[2;1H\x1b[L\x1b[3;1H\x1b[2M", []string{"1", "", "", ""}, 0, 2},
+		{"line drawing", "\x1b(0lqk\x1b(B", []string{"┌─┐"}, 3, 0},
+		{"alternate", "main\x1b[?1049h\x1b[Halt\x1b[?1049l", []string{"main"}, 4, 0},
+		{"reset", "text\x1b[31m\x1bcx", []string{"x"}, 1, 0},
+		{"split sequences", "\x1b[", nil, 0, 0},
+	} {
+		screen := newScreen(8, 4)
+		screen.write(test.output)
+		lines := screen.text()
+		for i, expected := range test.lines {
+			if lines[i] != expected {
+				t.Errorf("%s: expected line %d %q, got %q", test.name, i, expected, lines[i])
+			}
+		}
+		if x, y, _ := screen.cursor(); x != test.x || y != test.y {
+			t.Errorf("%s: expected the cursor at %d,%d, got %d,%d", test.name, test.x, test.y, x, y)
+		}
+	}
+
+	// Sequences and characters cut between writes
+	screen := newScreen(8, 4)
+	for _, part := range []string{"\x1b", "[3", "1m", "\xe6\x97", "\xa5", "\x1b]0;ti", "tle\x07"} {
+		screen.write(part)
+	}
+	if lines := screen.text(); lines[0] != "日" || screen.pen.foreground != 1 || screen.title != "title" {
+		t.Fatalf("Expected the parts put together, got %q %+v %q", lines[0], screen.pen, screen.title)
+	}
+
+	// Resizing keeps the line of the cursor on the screen
+	screen = newScreen(8, 4)
+	screen.write("1\r\n2\r\n3\r\n4")
+	screen.resize(4, 2)
+	if lines, x, y := screen.text(), screen.x, screen.y; strings.Join(lines, "|") != "3|4" || x != 1 || y != 1 {
+		t.Fatalf("Expected the last lines kept, got %q at %d,%d", lines, x, y)
+	}
+	screen.resize(1000, 1000)
+	if width, height := screen.size(); width != maxScreenWidth || height != maxScreenHeight {
+		t.Fatalf("Expected the size bounded, got %dx%d", width, height)
+	}
+}
+
+// Pieces of output the random screens are drawn with
+var screenPieces = []string{
+	"hello", "日本語", "🚀", "é", "\r\n", "\r", "\n", "\b", "\t", "\x1bM", "\x1bD", "\x1bE",
+	"\x1b[H", "\x1b[5;10H", "\x1b[3A", "\x1b[2B", "\x1b[4C", "\x1b[7D", "\x1b[12G", "\x1b[3d",
+	"\x1b[J", "\x1b[1J", "\x1b[2J", "\x1b[K", "\x1b[1K", "\x1b[2K", "\x1b[3@", "\x1b[2P", "\x1b[4X",
+	"\x1b[2L", "\x1b[M", "\x1b[S", "\x1b[2T", "\x1b[3b",
+	"\x1b[1;31m", "\x1b[0m", "\x1b[7;4m", "\x1b[38;5;208m", "\x1b[48;2;10;20;30m", "\x1b[38:2::1:2:3m", "\x1b[22;27;39m", "\x1b[44m",
+	"\x1b[3;8r", "\x1b[r", "\x1b[?6h", "\x1b[?6l", "\x1b[?7l", "\x1b[?7h", "\x1b[4h", "\x1b[4l",
+	"\x1b[?25l", "\x1b[?25h", "\x1b[?1h", "\x1b[?1000h", "\x1b[?1006h", "\x1b[?2004h", "\x1b[?2004l", "\x1b=", "\x1b>",
+	"\x1b7", "\x1b8", "\x1b[s", "\x1b[u", "\x1b(0", "\x1b(B", "\x1b)0", "\x0e", "\x0f",
+	"\x1b[?1049h", "\x1b[?1049l", "\x1b[?47h", "\x1b[?47l", "\x1b[?1047h", "\x1b[?1047l",
+	"\x1b]0;window title\x07", "\x1b]8;;https://example.com\x1b\\", "\x1bPq#0\x1b\\", "\x1b[!p",
+	"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+}
+
+func TestScreenSnapshot(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		width, height := 10+random.Intn(40), 3+random.Intn(15)
+		original := newScreen(width, height)
+		var output strings.Builder
+		for j := random.Intn(200); j > 0; j-- {
+			output.WriteString(screenPieces[random.Intn(len(screenPieces))])
+		}
+		original.write(output.String())
+		if original.origin && (original.y < original.top || original.y > original.bottom) {
+			continue // Only restoring the cursor gets it there, see snapshot
+		}
+
+		// Whatever the operator's terminal showed before
+		copied := newScreen(width, height)
+		copied.write(screenPieces[random.Intn(len(screenPieces))] + "\x1b[?1049h\x1b[?1000h\x1b[31mgarbage\x1b(0")
+		copied.write(original.snapshot())
+		expected, got := strings.Split(screenState(original), "\n"), strings.Split(screenState(copied), "\n")
+		for line := range expected {
+			if line >= len(got) || got[line] != expected[line] {
+				t.Fatalf("Screen %d not reproduced by the snapshot of %q\nexpected: %s\ngot:      %s", i, output.String(), expected[line], got[min(line, len(got)-1)])
+			}
+		}
+	}
+}
+
+func TestAttach(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	spec.Width, spec.Height = 40, 10
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "hello\n"}`)
+	output, _ := collectOutput(t, messages, "s1", 300*time.Millisecond)
+
+	// The operator joining sees the same screen as the one there from the start
+	tunnel.onMessage(`{"type": "attach", "sessionID": "s1", "payload": null}`)
+	snapshot, _ := collectOutput(t, messages, "s1", 300*time.Millisecond)
+	watching, joining := newScreen(40, 10), newScreen(40, 10)
+	watching.write(output)
+	joining.write(snapshot)
+	if lines := joining.text(); lines[0] != "hello" || lines[1] != "hello" || screenState(joining) != screenState(watching) {
+		t.Fatalf("Expected the screen reproduced, got %q", lines)
+	}
+	screenshot, err := tunnel.Screenshot("s1")
+	if err != nil || screenshot.Width != 40 || screenshot.Height != 10 || screenshot.Lines[1] != "hello" || screenshot.CursorY != 2 {
+		t.Fatalf("Unexpected screenshot %+v (%v)", screenshot, err)
+	}
+
+	// A resize changes the size of the screen
+	tunnel.onMessage(`{"type": "resize", "sessionID": "s1", "payload": {"width": 20, "height": 5}}`)
+	if screenshot, _ := tunnel.Screenshot("s1"); screenshot.Width != 20 || screenshot.Height != 5 {
+		t.Fatalf("Expected the screen resized, got %dx%d", screenshot.Width, screenshot.Height)
+	}
+
+	// The cloud is told a session it attaches to is gone
+	tunnel.onMessage(`{"type": "attach", "sessionID": "unknown", "payload": null}`)
+	if message := nextMessage(t, messages); message.Type != typeEnd || message.SessionID != "unknown" || message.Reason != reasonUnknownSession {
+		t.Fatalf("Expected an end message, got %+v", message)
+	}
+	if _, err := tunnel.Screenshot("unknown"); err == nil {
+		t.Fatal("Expected no screenshot of an unknown session")
+	}
+	tunnel.onMessage(`{"type": "end", "sessionID": "s1", "payload": null}`)
+}
+
+func BenchmarkScreen(b *testing.B) {
+	output := strings.Repeat(floodOutput(100)+"\x1b[1;31merror\x1b[0m 日本語\r\n", 10)
+	screen := newScreen(80, 24)
+	b.SetBytes(int64(len(output)))
+	for i := 0; i < b.N; i++ {
+		screen.write(output)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestShutdown(t *testing.T) {
+	// The relay starts a session and records what the tunnel sends until the connection is closed
+	messages := make(chan envelope, 64)
+	closeCode := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		connection.WriteMessage(websocket.TextMessage, []byte(`{"type": "start", "sessionID": "s1", "payload": null}`))
+		for {
+			_, message, err := connection.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					closeCode <- closeErr.Code
+				}
+				close(messages)
+				return
+			}
+			var envelope envelope
+			json.Unmarshal(message, &envelope)
+			messages <- envelope
+		}
+	}))
+	defer server.Close()
+
+	spec, _ := NewSessionSpec("/bin/sh")
+	tunnel := NewTunnel("ws"+strings.TrimPrefix(server.URL, "http"), TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	}, zap.NewNop())
+	go tunnel.Connect()
+	for start := time.Now(); !tunnel.hasSession("s1"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timeout, the session did not start")
+		}
+	}
+
+	if !tunnel.Shutdown(5 * time.Second) {
+		t.Fatal("Expected the shutdown to complete within the grace period")
+	}
+
+	// The session is warned, then ended with the shutdown reason, then the connection is closed
+	warned, ended := false, false
+	for message := range messages {
+		switch message.Type {
+		case typeOutput:
+			if output, _ := message.Payload.(string); strings.Contains(output, shutdownNotice) {
+				warned = true
+			}
+		case typeEnd:
+			if !warned {
+				t.Fatal("Expected the shutdown notice before the end of the session")
+			}
+			if message.SessionID != "s1" || message.Reason != reasonShutdown {
+				t.Fatalf("Expected session s1 ended with reason %q, got %+v", reasonShutdown, message)
+			}
+			ended = true
+		}
+	}
+	if !ended {
+		t.Fatal("Expected the session ended")
+	}
+	select {
+	case code := <-closeCode:
+		if code != websocket.CloseGoingAway {
+			t.Fatalf("Expected close code %d, got %d", websocket.CloseGoingAway, code)
+		}
+	default:
+		t.Fatal("Expected the connection closed with a close frame")
+	}
+	if tunnel.hasSession("s1") {
+		t.Fatal("Expected no session left")
+	}
+}
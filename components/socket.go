@@ -22,6 +22,8 @@ package components
 import (
 	"crypto/tls"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -33,28 +35,38 @@ import (
  * @author github.com/adwardstark
  */
 
+const (
+	handshakeTimeout = 45 * time.Second // Dialing the cloud, as the default dialer of gorilla/websocket
+	loopStallTimeout = 10 * time.Second // The write-loop beats every second while connected
+)
+
 // Socket struct holds terminal connection information
 type Socket struct {
 	logger      *zap.Logger
 	url         string
-	messageBus  chan []byte
-	closeSignal chan bool
+	queue       *scheduler
+	closeSignal chan []byte
 	isExited    bool
+	compression bool          // Offer permessage-deflate when dialing
+	mutex       *sync.Mutex   // Guards url
+	progress    *atomic.Int64 // Unix-nano deadline by which the connection loop has to make progress again
 }
 
 // SetupSocket creates the socket for terminal connection
 func (socket *Socket) SetupSocket(onConnected func(), onError func(error), onMessage func(string)) {
 	socket.isExited = false
-	websocketDialer := &websocket.Dialer{}
+	socket.expectProgress(handshakeTimeout + loopStallTimeout)
+	websocketDialer := &websocket.Dialer{HandshakeTimeout: handshakeTimeout, EnableCompression: socket.compression}
 	websocketDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: false}
-	connection, resp, err := websocketDialer.Dial(socket.url, nil)
+	connection, resp, err := websocketDialer.Dial(socket.getURL(), nil)
 	if err != nil {
 		socket.logger.Debug("Websocket: Failed to connect", zap.Error(err))
 		onError(err)
 		return
 	}
 	if resp != nil {
-		socket.logger.Debug("Websocket: Got an HTTP Response", zap.Int("code", resp.StatusCode), zap.String("status", resp.Status))
+		socket.logger.Debug("Websocket: Got an HTTP Response", zap.Int("code", resp.StatusCode), zap.String("status", resp.Status),
+			zap.String("extensions", resp.Header.Get("Sec-WebSocket-Extensions")))
 	}
 	defer connection.Close()
 	socket.logger.Debug("Websocket: Connected")
@@ -69,6 +81,9 @@ func (socket *Socket) SetupSocket(onConnected func(), onError func(error), onMes
 	})
 
 	done := make(chan struct{})
+	beat := time.NewTicker(time.Second)
+	defer beat.Stop()
+	socket.expectProgress(loopStallTimeout)
 	go func() {
 		defer close(done)
 		for {
@@ -85,16 +100,25 @@ func (socket *Socket) SetupSocket(onConnected func(), onError func(error), onMes
 
 	for {
 		select {
-		case message := <-socket.messageBus:
+		case <-socket.queue.ready:
+			message, ok := socket.queue.pop()
+			if !ok {
+				continue
+			}
 			err := connection.WriteMessage(websocket.TextMessage, message)
 			if err != nil {
 				socket.logger.Debug("Websocket: Write-failed", zap.Error(err))
-				socket.Close() // Close the socket and try to reestablish the connection
-				return
+				onError(err)
+				return // Closing the connection stops the reader, the caller re-establishes it
 			}
-		case <-socket.closeSignal:
+		case <-done:
+			return // Reading failed, the connection is gone
+		case <-beat.C:
+			socket.expectProgress(loopStallTimeout)
+		case closeMessage := <-socket.closeSignal:
 			socket.logger.Debug("Websocket: Closing connection")
-			err := connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			socket.flush(connection)
+			err := connection.WriteMessage(websocket.CloseMessage, closeMessage)
 			if err != nil {
 				socket.logger.Debug("Websocket: Write-close", zap.Error(err))
 			}
@@ -106,10 +130,40 @@ func (socket *Socket) SetupSocket(onConnected func(), onError func(error), onMes
 		}
 	}
 }
+
+// flush writes the messages still queued
+func (socket *Socket) flush(connection *websocket.Conn) {
+	for message, ok := socket.queue.pop(); ok; message, ok = socket.queue.pop() {
+		if err := connection.WriteMessage(websocket.TextMessage, message); err != nil {
+			socket.logger.Debug("Websocket: Write-failed", zap.Error(err))
+			return
+		}
+	}
+}
+
+// expectProgress gives the connection loop until within from now to make progress
+func (socket *Socket) expectProgress(within time.Duration) {
+	socket.progress.Store(time.Now().Add(within).UnixNano())
+}
+
+// healthy tells if the connection loop made progress in time, a stuck write or dial makes it unhealthy
+func (socket *Socket) healthy() bool {
+	return time.Now().UnixNano() < socket.progress.Load()
+}
+
 func (socket *Socket) getURL() string {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
 	return socket.url
 }
 
+// setURL changes the URL used from the next connection on
+func (socket *Socket) setURL(url string) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.url = url
+}
+
 // IsExited tells if the terminal connection has been finished
 func (socket *Socket) IsExited() bool {
 	return socket.isExited
@@ -117,11 +171,38 @@ func (socket *Socket) IsExited() bool {
 
 // Send function sends (a command) to the terminal
 func (socket *Socket) Send(message []byte) {
-	socket.messageBus <- message
+	socket.queue.push("", message)
+}
+
+// sendFor queues a message of a session, waiting while the session has too many messages queued
+func (socket *Socket) sendFor(sessionID string, message []byte) {
+	socket.queue.push(sessionID, message)
 }
 
 // Close function closes the terminal connection
 func (socket *Socket) Close() {
 	socket.isExited = true
-	socket.closeSignal <- true
+	socket.closeSignal <- websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+}
+
+// Reconnect closes the current connection without exiting, so that it gets re-established
+func (socket *Socket) Reconnect(timeout time.Duration) bool {
+	select {
+	case socket.closeSignal <- websocket.FormatCloseMessage(websocket.CloseServiceRestart, "reconnecting"):
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// CloseWithReason closes the terminal connection with the given close-code and reason,
+// giving up after timeout if the write-loop is not running (e.g. while reconnecting)
+func (socket *Socket) CloseWithReason(code int, reason string, timeout time.Duration) bool {
+	socket.isExited = true
+	select {
+	case socket.closeSignal <- websocket.FormatCloseMessage(code, reason):
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
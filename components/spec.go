@@ -0,0 +1,225 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SessionSpec describes the process spawned for a session
+type SessionSpec struct {
+	Argv        []string          // Command and its arguments
+	Env         map[string]string // Set on top of the inherited environment, e.g. TERM and LANG
+	EnvAllow    []string          // Inherited and requested variables passed to the shell (glob patterns), empty allows all
+	EnvDeny     []string          // Variables never passed to the shell (glob patterns), applies to Env too
+	Dir         string            // Working directory, empty uses the one of pe-terminal (or the home of User)
+	User        string            // Run as this user (name or uid), empty keeps the user of pe-terminal
+	Width       uint16            // Initial window width in columns, 0 keeps the pty default
+	Height      uint16            // Initial window height in rows, 0 keeps the pty default
+	PixelWidth  uint16            // Initial window width in pixels, optional
+	PixelHeight uint16            // Initial window height in pixels, optional
+	Kill        KillPolicy
+	Sandbox     *Sandbox     // Run the shell in Linux namespaces, optional
+	Confinement *Confinement // Restrict the shell with Landlock and seccomp, optional
+}
+
+// NewSessionSpec returns a spec running command (split like a shell would) with the default kill-policy
+func NewSessionSpec(command string) (SessionSpec, error) {
+	argv, err := SplitCommand(command)
+	if err != nil {
+		return SessionSpec{}, err
+	}
+	return SessionSpec{Argv: argv, Kill: DefaultKillPolicy()}, nil
+}
+
+// SplitCommand splits a command-line into arguments, honouring single/double quotes and backslash escapes
+func SplitCommand(command string) ([]string, error) {
+	var argv []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			// Within double quotes a backslash only escapes characters special to them
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				argv = append(argv, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape in command %q", command)
+	}
+	if inArg {
+		argv = append(argv, arg.String())
+	}
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return argv, nil
+}
+
+// command builds the process described by the spec. With a confinement, the returned
+// socket receives the seccomp listener of the shell.
+func (spec SessionSpec) command() (*exec.Cmd, *os.File, error) {
+	if len(spec.Argv) == 0 {
+		return nil, nil, errors.New("empty command")
+	}
+	cmd := exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	if cmd.Err != nil {
+		return nil, nil, cmd.Err
+	}
+	cmd.Env = spec.environ(os.Environ())
+	cmd.Dir = spec.Dir
+	if spec.User != "" {
+		account, err := LookupUser(spec.User)
+		if err != nil {
+			return nil, nil, err
+		}
+		credential, err := credentialOf(account)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		cmd.Env = append(cmd.Env, "HOME="+account.HomeDir, "USER="+account.Username, "LOGNAME="+account.Username)
+		if cmd.Dir == "" {
+			cmd.Dir = account.HomeDir
+		}
+	}
+	if spec.Sandbox != nil || spec.Confinement != nil {
+		return wrap(cmd, spec.Sandbox, spec.Confinement)
+	}
+	return cmd, nil, nil
+}
+
+// effectiveUser returns the name of the user the session runs as
+func (spec SessionSpec) effectiveUser() string {
+	if spec.User != "" {
+		return spec.User
+	}
+	if account, err := user.Current(); err == nil {
+		return account.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// LookupUser finds a user by name, falling back to a numeric uid
+func LookupUser(name string) (*user.User, error) {
+	account, err := user.Lookup(name)
+	if err == nil {
+		return account, nil
+	}
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		return user.LookupId(name)
+	}
+	return nil, err
+}
+
+// credentialOf returns the uid, gid and supplementary groups of a user
+func credentialOf(account *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIds, _ := account.GroupIds() // Best effort, the primary group is always set
+	for _, groupID := range groupIds {
+		if id, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+// environ filters the inherited environment through the allow/deny lists and adds the spec variables
+func (spec SessionSpec) environ(inherited []string) []string {
+	env := make(map[string]string)
+	for _, variable := range inherited {
+		key, value, _ := strings.Cut(variable, "=")
+		if spec.allows(key) && !matchesAny(spec.EnvDeny, key) {
+			env[key] = value
+		}
+	}
+	for key, value := range spec.Env {
+		if !matchesAny(spec.EnvDeny, key) {
+			env[key] = value
+		}
+	}
+	if spec.Width > 0 && spec.Height > 0 {
+		env["COLUMNS"] = fmt.Sprint(spec.Width)
+		env["LINES"] = fmt.Sprint(spec.Height)
+	}
+	environ := make([]string, 0, len(env))
+	for key, value := range env {
+		environ = append(environ, key+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+// allows tells if the variable key may be inherited or requested, by the allow list
+func (spec SessionSpec) allows(key string) bool {
+	return len(spec.EnvAllow) == 0 || matchesAny(spec.EnvAllow, key)
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
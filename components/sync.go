@@ -0,0 +1,439 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	modeStream          = "stream" // The output of a session is sent as it is
+	modeSync            = "sync"   // The screen of a session is sent as frames
+	initialRetryTimeout = time.Second
+	minRetryTimeout     = 50 * time.Millisecond
+	maxRetryTimeout     = 5 * time.Second
+	maxFramesInFlight   = 8  // Frames not acknowledged yet kept to diff against, older ones are forgotten
+	keypadMode          = 66 // DECNKM, stands for the application keypad in the modes of a frame
+)
+
+// modePayload answers a start message asking for a mode
+type modePayload struct {
+	Mode     string `json:"mode"`
+	Interval int64  `json:"interval,omitempty"` // Milliseconds between two frames at least
+}
+
+// framePayload is the payload of a frame message. Applied to the frame Base, 0 for a blank screen
+// of the size of the frame, the runs of cells make up the screen of frame ID.
+type framePayload struct {
+	ID     uint64      `json:"id"`
+	Base   uint64      `json:"base"`
+	Width  int         `json:"width"`
+	Height int         `json:"height"`
+	Cursor frameCursor `json:"cursor"`
+	Title  string      `json:"title"`
+	Modes  []int       `json:"modes,omitempty"` // Private modes set, e.g. 1 for application cursor keys or 2004 for bracketed paste
+	Runs   []cellRun   `json:"runs,omitempty"`
+}
+
+type frameCursor struct {
+	X       int  `json:"x"`
+	Y       int  `json:"y"`
+	Visible bool `json:"visible"`
+}
+
+// cellRun is a row of cells changed, of the same style, starting at X
+type cellRun struct {
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Text    string `json:"text"`          // The characters of the cells, a wide one takes two
+	SGR     string `json:"sgr,omitempty"` // The parameters of the SGR sequence selecting the style, e.g. "1;31"
+	columns int
+}
+
+// frameState is the part of a screen a frame reproduces
+type frameState struct {
+	width  int
+	height int
+	lines  [][]cell
+	cursor frameCursor
+	title  string
+	modes  []int
+	sent   time.Time
+}
+
+// frame returns the state of the screen shown
+func (screen *screen) frame() *frameState {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	state := &frameState{
+		width:  screen.width,
+		height: screen.height,
+		lines:  make([][]cell, len(screen.buffer.lines)),
+		cursor: frameCursor{X: screen.x, Y: screen.y, Visible: !screen.cursorHidden},
+		title:  screen.title,
+	}
+	for y, line := range screen.buffer.lines {
+		state.lines[y] = append([]cell(nil), line...)
+	}
+	for _, mode := range replayedModes {
+		if screen.modes[mode] {
+			state.modes = append(state.modes, mode)
+		}
+	}
+	if screen.keypad {
+		state.modes = append(state.modes, keypadMode)
+	}
+	return state
+}
+
+func (state *frameState) equal(other *frameState) bool {
+	if state.width != other.width || state.height != other.height || state.cursor != other.cursor ||
+		state.title != other.title || len(state.modes) != len(other.modes) {
+		return false
+	}
+	for i, mode := range state.modes {
+		if other.modes[i] != mode {
+			return false
+		}
+	}
+	for y, line := range state.lines {
+		for x, cell := range line {
+			if other.lines[y][x] != cell {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// diffCells returns the runs of cells of current differing from base, from a blank screen when base is nil
+func diffCells(base *frameState, current *frameState) []cellRun {
+	var runs []cellRun
+	for y, line := range current.lines {
+		last := -1 // The run ending on this line
+		for x := 0; x < len(line); {
+			columns := 1
+			if line[x].width == 2 && x+1 < len(line) {
+				columns = 2 // A wide character is changed along with the cell it covers
+			}
+			if !unchanged(base, y, x, line[x:x+columns]) {
+				text := line[x].text
+				if line[x].width == 0 {
+					text = " "
+				}
+				parameters := sgrParameters(line[x].style)
+				if last >= 0 && runs[last].X+runs[last].columns == x && runs[last].SGR == parameters {
+					runs[last].Text += text
+					runs[last].columns += columns
+				} else {
+					runs = append(runs, cellRun{X: x, Y: y, Text: text, SGR: parameters, columns: columns})
+					last = len(runs) - 1
+				}
+			}
+			x += columns
+		}
+	}
+	return runs
+}
+
+// unchanged tells if the cells at x on line y are the same in base
+func unchanged(base *frameState, y int, x int, cells []cell) bool {
+	for i, cell := range cells {
+		if base == nil && cell != blankCell || base != nil && base.lines[y][x+i] != cell {
+			return false
+		}
+	}
+	return true
+}
+
+// sgrParameters returns the parameters selecting style after a reset, empty for the default style
+func sgrParameters(style style) string {
+	if style == defaultStyle {
+		return ""
+	}
+	sequence := sgr(style)
+	return sequence[len("\x1b[0;") : len(sequence)-1]
+}
+
+// frameSender sends the screen of a session in sync mode, as frames of the cells changed since the
+// frame the cloud acknowledged last. A frame or an acknowledgement lost on the way is made good by
+// the next frame, which holds the changes of the lost one too. A frame not acknowledged in time is
+// followed by another, after about twice the round trip. Frames follow each other one interval or half
+// a round trip apart at the least, so that a flood of output is sent as a few screens rather than every
+// byte of it, and a frame does not repeat the changes of many frames in flight.
+type frameSender struct {
+	mutex    *sync.Mutex
+	screen   *screen
+	interval time.Duration
+	send     func(framePayload)
+	next     uint64                 // ID of the next frame
+	acked    uint64                 // Frame acknowledged last, 0 for none
+	frames   map[uint64]*frameState // The frame acknowledged and the ones sent after it, by ID
+	last     *frameState            // Sent last
+	rtt      time.Duration          // Smoothed round trip of the frames, 0 until measured
+	timer    *time.Timer            // Sends the changes of the screen
+	retry    *time.Timer            // Sends a frame again unless the last one is acknowledged
+	waiting  bool                   // The screen changed while the first frame is not acknowledged
+	closed   bool
+}
+
+func newFrameSender(screen *screen, interval time.Duration, send func(framePayload)) *frameSender {
+	return &frameSender{mutex: &sync.Mutex{}, screen: screen, interval: interval, send: send, next: 1, frames: make(map[uint64]*frameState)}
+}
+
+// changed schedules a frame once the screen changed, paced after the last frame
+func (sender *frameSender) changed() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	sender.schedule()
+}
+
+// schedule arms the timer sending the next frame. Until the first frame is acknowledged the next
+// one waits, rather than repeating the whole screen before the round trip is known. The caller
+// holds the mutex.
+func (sender *frameSender) schedule() {
+	if sender.closed || sender.timer != nil {
+		return
+	}
+	if sender.rtt == 0 && sender.last != nil {
+		sender.waiting = true
+		return
+	}
+	delay := time.Duration(0)
+	if sender.last != nil {
+		delay = sender.pace() - time.Since(sender.last.sent)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	sender.timer = time.AfterFunc(delay, func() {
+		sender.mutex.Lock()
+		defer sender.mutex.Unlock()
+		sender.timer = nil
+		if !sender.closed {
+			sender.sendFrame(false)
+		}
+	})
+}
+
+// notice shows text on the screen, as if the program printed it
+func (sender *frameSender) notice(text string) {
+	sender.screen.write(text)
+	sender.changed()
+}
+
+// ack takes note that the cloud holds the screen of frame id
+func (sender *frameSender) ack(id uint64) {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	state, ok := sender.frames[id]
+	if !ok || id <= sender.acked { // Superseded, or forgotten
+		return
+	}
+	if sample := time.Since(state.sent); sender.rtt == 0 {
+		sender.rtt = sample
+	} else {
+		sender.rtt = (7*sender.rtt + sample) / 8
+	}
+	sender.acked = id
+	for other := range sender.frames {
+		if other < id {
+			delete(sender.frames, other)
+		}
+	}
+	if id == sender.next-1 && sender.retry != nil {
+		sender.retry.Stop()
+		sender.retry = nil
+	}
+	if sender.waiting {
+		sender.waiting = false
+		sender.schedule()
+	}
+}
+
+// reset sends the whole screen, to a cloud that lost the frames acknowledged
+func (sender *frameSender) reset() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if sender.closed {
+		return
+	}
+	sender.acked = 0
+	sender.frames = make(map[uint64]*frameState)
+	sender.sendFrame(true)
+}
+
+// close sends what changed since the last frame, before the end message
+func (sender *frameSender) close() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if sender.closed {
+		return
+	}
+	sender.closed = true
+	if sender.timer != nil {
+		sender.timer.Stop()
+	}
+	if sender.retry != nil {
+		sender.retry.Stop()
+	}
+	sender.sendFrame(false)
+}
+
+// sendFrame sends the changes of the screen since the frame acknowledged, even if there are
+// none since the last frame when force is set. The caller holds the mutex.
+func (sender *frameSender) sendFrame(force bool) {
+	current := sender.screen.frame()
+	sender.waiting = false
+	if !force && sender.last != nil && current.equal(sender.last) {
+		return
+	}
+	frame := framePayload{
+		ID:     sender.next,
+		Width:  current.width,
+		Height: current.height,
+		Cursor: current.cursor,
+		Title:  current.title,
+		Modes:  current.modes,
+	}
+	base := sender.frames[sender.acked]
+	if base != nil && (base.width != current.width || base.height != current.height) {
+		base = nil // Resized, sent whole
+	}
+	if base != nil {
+		frame.Base = sender.acked
+	}
+	frame.Runs = diffCells(base, current)
+
+	current.sent = time.Now()
+	sender.frames[sender.next] = current
+	if len(sender.frames) > maxFramesInFlight {
+		sender.forgetOldest()
+	}
+	sender.next++
+	sender.last = current
+	sender.send(frame)
+	if sender.retry == nil {
+		sender.retry = time.AfterFunc(sender.retryTimeout(), sender.expire)
+	}
+}
+
+// forgetOldest drops the oldest frame not acknowledged, an acknowledgement of it is then ignored
+func (sender *frameSender) forgetOldest() {
+	oldest := uint64(0)
+	for id := range sender.frames {
+		if id != sender.acked && (oldest == 0 || id < oldest) {
+			oldest = id
+		}
+	}
+	delete(sender.frames, oldest)
+}
+
+// expire sends another frame when the last one was not acknowledged in time
+func (sender *frameSender) expire() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	sender.retry = nil
+	if !sender.closed && sender.acked != sender.next-1 {
+		sender.sendFrame(true)
+	}
+}
+
+// retryTimeout is how long a frame waits for its acknowledgement. The caller holds the mutex.
+func (sender *frameSender) retryTimeout() time.Duration {
+	if sender.rtt == 0 {
+		return initialRetryTimeout
+	}
+	return clampDuration(2*sender.rtt+sender.pace(), minRetryTimeout, maxRetryTimeout)
+}
+
+// pace is the time between two frames, at least half a round trip so that a frame is based on one of
+// the previous two. The caller holds the mutex.
+func (sender *frameSender) pace() time.Duration {
+	if sender.rtt/2 > sender.interval {
+		return sender.rtt / 2
+	}
+	return sender.interval
+}
+
+func clampDuration(value time.Duration, low time.Duration, high time.Duration) time.Duration {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+// parseFrameID validates the payload of an ack message decoded with UseNumber
+func parseFrameID(payload interface{}) (uint64, error) {
+	number, ok := payload.(json.Number)
+	if !ok {
+		return 0, errors.New("should be a number")
+	}
+	id, err := number.Int64()
+	if err != nil || id <= 0 {
+		return 0, errors.New("should be a positive frame ID")
+	}
+	return uint64(id), nil
+}
+
+// newFrames returns what sends the screen of a session asking for sync mode, nil when the
+// session falls back to stream mode
+func (tunnel *SocketTunnel) newFrames(sessionID string, options TunnelOptions, request startRequest, term console) *frameSender {
+	if !request.sync || options.SyncInterval <= 0 {
+		return nil
+	}
+	channel := request.channel
+	return newFrameSender(term.mirror().screen, options.SyncInterval, func(frame framePayload) {
+		envelope := envelope{Type: typeFrame, SessionID: sessionID, Payload: frame}
+		if channel != nil {
+			envelope = channel.sealEnvelope(envelope)
+		}
+		tunnel.sendEnvelope(envelope)
+	})
+}
+
+// answerMode tells the cloud which mode a session asking for sync mode runs in, before any frame or output
+func (tunnel *SocketTunnel) answerMode(sessionID string, request startRequest, frames *frameSender) {
+	if !request.sync {
+		return
+	}
+	if frames == nil {
+		tunnel.logger.Info("Sync mode is disabled, streaming the output", zap.String("sessionID", sessionID))
+		tunnel.sendEnvelope(envelope{Type: typeMode, SessionID: sessionID, Payload: modePayload{Mode: modeStream}})
+		return
+	}
+	tunnel.sendEnvelope(envelope{Type: typeMode, SessionID: sessionID, Payload: modePayload{Mode: modeSync, Interval: frames.interval.Milliseconds()}})
+}
+
+func (tunnel *SocketTunnel) onAck(sessionID string, id uint64) {
+	session := tunnel.getSession(sessionID)
+	if session == nil || session.frames == nil {
+		tunnel.logger.Debug("Ignoring ack, session not in sync mode", zap.String("sessionID", sessionID))
+		return
+	}
+	session.frames.ack(id)
+}
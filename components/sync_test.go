@@ -0,0 +1,318 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedScreen is the screen of a frame as the cloud builds it
+type receivedScreen struct {
+	width  int
+	height int
+	cells  [][]string // Empty when covered by a wide character
+	cursor frameCursor
+}
+
+func (received *receivedScreen) text() []string {
+	lines := make([]string, 0, received.height)
+	for _, line := range received.cells {
+		lines = append(lines, strings.TrimRight(strings.Join(line, ""), " "))
+	}
+	return lines
+}
+
+// frameReceiver plays the part of the cloud in sync mode, keeping the screens of the frames
+// that later ones may be based on
+type frameReceiver struct {
+	screens map[uint64]*receivedScreen
+	latest  uint64
+}
+
+func newFrameReceiver() *frameReceiver {
+	return &frameReceiver{screens: make(map[uint64]*receivedScreen)}
+}
+
+// apply builds the screen of frame, and tells if it should be acknowledged
+func (receiver *frameReceiver) apply(frame framePayload) bool {
+	base, ok := receiver.screens[frame.Base]
+	if frame.ID <= receiver.latest || frame.Base != 0 && !ok {
+		return false // Stale, or based on a frame lost or forgotten
+	}
+	received := &receivedScreen{width: frame.Width, height: frame.Height, cursor: frame.Cursor}
+	for y := 0; y < frame.Height; y++ {
+		line := make([]string, frame.Width)
+		if base != nil {
+			copy(line, base.cells[y])
+		} else {
+			for x := range line {
+				line[x] = " "
+			}
+		}
+		received.cells = append(received.cells, line)
+	}
+	for _, run := range frame.Runs {
+		x, previous := run.X, run.X
+		for _, r := range run.Text {
+			width := runeWidth(r)
+			if width == 0 && x > run.X {
+				received.cells[run.Y][previous] += string(r)
+				continue
+			}
+			received.cells[run.Y][x] = string(r)
+			if width == 2 {
+				received.cells[run.Y][x+1] = ""
+			}
+			previous = x
+			x += max(width, 1)
+		}
+	}
+	receiver.screens[frame.ID] = received
+	receiver.latest = frame.ID
+	for id := range receiver.screens {
+		if id < frame.Base {
+			delete(receiver.screens, id)
+		}
+	}
+	return true
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// frameOf decodes the payload of a frame message
+func frameOf(t *testing.T, message envelope) framePayload {
+	t.Helper()
+	if message.Type != typeFrame {
+		t.Fatalf("Expected a frame, got %+v", message)
+	}
+	encoded, _ := json.Marshal(message.Payload)
+	var frame framePayload
+	if err := json.Unmarshal(encoded, &frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestDiffCells(t *testing.T) {
+	screen := newScreen(10, 3)
+	screen.write("ab\x1b[1;31mcd\x1b[0m\r\n日本")
+	first := screen.frame()
+	runs := diffCells(nil, first)
+	if len(runs) != 3 || runs[0] != (cellRun{X: 0, Y: 0, Text: "ab", columns: 2}) ||
+		runs[1].Text != "cd" || runs[1].SGR != "1;31" || runs[2].Text != "日本" || runs[2].columns != 4 {
+		t.Fatalf("Unexpected runs of a blank screen %+v", runs)
+	}
+
+	// Only the cells changed, a wide character along with the one it covers
+	screen.write("\x1b[1;2HX\x1b[2;2Hx")
+	second := screen.frame()
+	runs = diffCells(first, second)
+	if len(runs) != 2 || runs[0].Text != "X" || runs[0].X != 1 || runs[1].Text != " x" || runs[1].X != 0 || runs[1].Y != 1 {
+		t.Fatalf("Unexpected runs of the changes %+v", runs)
+	}
+	if diffCells(second, screen.frame()) != nil || !second.equal(screen.frame()) {
+		t.Fatal("Expected no runs without changes")
+	}
+	screen.write("\x1b[?2004h\x1b=")
+	if third := screen.frame(); third.equal(second) || len(third.modes) != 2 || third.modes[1] != keypadMode {
+		t.Fatalf("Expected the modes in the frame, got %v", third.modes)
+	}
+}
+
+// topScreen is the output of the update-th redraw of a program like top
+func topScreen(update int) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "\x1b[H\x1b[1mtop - up %d min, load average: %d.%02d\x1b[0m\x1b[K\r\n", update, update%4, update*7%100)
+	for process := 0; process < 22; process++ {
+		fmt.Fprintf(&out, "%5d root      20   0 %8d %6d S \x1b[1m%5.1f\x1b[0m  0.%d   0:%02d.%02d worker/%d\x1b[K\r\n",
+			1000+process, 100000+process*4096, 5000+process*17, float64(update*process*13%1000)/10, process%10, update%60, update*process%100, process)
+	}
+	return out.String()
+}
+
+// linkStats measures sync mode over a link
+type linkStats struct {
+	frames      int
+	bytes       int           // Of the frame messages, lost or not
+	streamBytes int           // Of the output messages the same output makes in stream mode
+	latency     time.Duration // From the last update until the cloud shows it
+}
+
+// simulateLink redraws a screen like top, over a link that delays every frame and acknowledgement
+// and loses a share of them. The cloud acknowledges the frames it can build.
+func simulateLink(loss float64, delay time.Duration, seed int64) (linkStats, bool) {
+	var stats linkStats
+	mutex := &sync.Mutex{} // Of stats, random and receiver
+	random := rand.New(rand.NewSource(seed))
+	receiver := newFrameReceiver()
+	screen := newScreen(80, 24)
+	var sender *frameSender
+	sender = newFrameSender(screen, 20*time.Millisecond, func(frame framePayload) {
+		message, _ := json.Marshal(envelope{Type: typeFrame, SessionID: "2c8b7c5e-41d6-4b86-8f5c-8f2f0c1c9a3e", Payload: frame})
+		mutex.Lock()
+		defer mutex.Unlock()
+		stats.frames++
+		stats.bytes += len(message)
+		if random.Float64() < loss {
+			return
+		}
+		time.AfterFunc(delay, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if receiver.apply(frame) && random.Float64() >= loss {
+				time.AfterFunc(delay, func() { sender.ack(frame.ID) })
+			}
+		})
+	})
+	defer sender.close()
+
+	for update := 0; update < 100; update++ {
+		output := topScreen(update)
+		message, _ := json.Marshal(envelope{Type: typeOutput, SessionID: "2c8b7c5e-41d6-4b86-8f5c-8f2f0c1c9a3e", Payload: output})
+		stats.streamBytes += len(message)
+		screen.write(output)
+		sender.changed()
+		time.Sleep(5 * time.Millisecond)
+	}
+	final := strings.Join(screen.text(), "\n")
+	updated := time.Now()
+	for time.Since(updated) < 10*time.Second {
+		mutex.Lock()
+		shown := receiver.screens[receiver.latest]
+		converged := shown != nil && strings.Join(shown.text(), "\n") == final
+		mutex.Unlock()
+		if converged {
+			stats.latency = time.Since(updated)
+			return stats, true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return stats, false
+}
+
+func TestSyncLoss(t *testing.T) {
+	for _, loss := range []float64{0, 0.1, 0.3} {
+		stats, ok := simulateLink(loss, 20*time.Millisecond, 1)
+		if !ok {
+			t.Fatalf("%.0f%% loss: the cloud did not get the last screen after %d frames", loss*100, stats.frames)
+		}
+		t.Logf("%.0f%% loss: %d frames, %d bytes (%d as output), shown %v after the last update",
+			loss*100, stats.frames, stats.bytes, stats.streamBytes, stats.latency.Round(time.Millisecond))
+		if stats.bytes > stats.streamBytes/2 {
+			t.Errorf("%.0f%% loss: expected far fewer bytes than the output, got %d of %d", loss*100, stats.bytes, stats.streamBytes)
+		}
+		if stats.latency > 2*time.Second {
+			t.Errorf("%.0f%% loss: expected the last screen shown sooner, got %v", loss*100, stats.latency)
+		}
+	}
+}
+
+func TestSyncMode(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		SyncInterval:   10 * time.Millisecond,
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"mode": "sync", "width": 40, "height": 10}}`)
+	if message := nextMessage(t, messages); message.Type != typeMode || message.Payload.(map[string]interface{})["mode"] != modeSync {
+		t.Fatalf("Expected sync mode, got %+v", message)
+	}
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "hello\n"}`)
+
+	// Frames instead of the output, until the echo and the output of cat are shown
+	receiver := newFrameReceiver()
+	for {
+		frame := frameOf(t, nextMessage(t, messages))
+		if !receiver.apply(frame) {
+			t.Fatalf("Expected frame %d based on the one acknowledged, got base %d", frame.ID, frame.Base)
+		}
+		tunnel.onMessage(fmt.Sprintf(`{"type": "ack", "sessionID": "s1", "payload": %d}`, frame.ID))
+		if lines := receiver.screens[frame.ID].text(); lines[0] == "hello" && lines[1] == "hello" {
+			if frame.Width != 40 || frame.Height != 10 || frame.Cursor != (frameCursor{X: 0, Y: 2, Visible: true}) {
+				t.Fatalf("Unexpected frame %+v", frame)
+			}
+			break
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case message := <-messages:
+		t.Fatalf("Expected no frame without changes, got %+v", message)
+	default:
+	}
+
+	// A resize and an attach are answered with the whole screen
+	tunnel.onMessage(`{"type": "resize", "sessionID": "s1", "payload": {"width": 20, "height": 5}}`)
+	if frame := frameOf(t, nextMessage(t, messages)); frame.Base != 0 || frame.Width != 20 || frame.Height != 5 {
+		t.Fatalf("Expected a frame of the resized screen, got %+v", frame)
+	}
+	tunnel.onMessage(`{"type": "attach", "sessionID": "s1", "payload": null}`)
+	if frame := frameOf(t, nextMessage(t, messages)); frame.Base != 0 || len(frame.Runs) != 2 {
+		t.Fatalf("Expected a frame of the whole screen, got %+v", frame)
+	}
+	tunnel.onMessage(`{"type": "ack", "sessionID": "s1", "payload": "1"}`)
+	tunnel.onMessage(`{"type": "end", "sessionID": "s1", "payload": null}`)
+	for message := nextMessage(t, messages); message.Type != typeEnd; message = nextMessage(t, messages) {
+		frameOf(t, message)
+	}
+
+	// Without sync mode the output is streamed
+	tunnel.SetOptions(TunnelOptions{Profiles: map[string]Profile{"default": {Spec: spec}}, DefaultProfile: "default"})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": {"mode": "sync"}}`)
+	if message := nextMessage(t, messages); message.Type != typeMode || message.Payload.(map[string]interface{})["mode"] != modeStream {
+		t.Fatalf("Expected stream mode, got %+v", message)
+	}
+	tunnel.onMessage(`{"type": "input", "sessionID": "s2", "payload": "hello\n"}`)
+	if output, _ := collectOutput(t, messages, "s2", 300*time.Millisecond); !strings.Contains(output, "hello") {
+		t.Fatalf("Expected the output streamed, got %q", output)
+	}
+	tunnel.onMessage(`{"type": "end", "sessionID": "s2", "payload": null}`)
+}
+
+func BenchmarkSyncLoss(b *testing.B) {
+	for _, loss := range []float64{0, 0.1, 0.3} {
+		b.Run(fmt.Sprintf("loss=%.0f%%", loss*100), func(b *testing.B) {
+			var bytes, streamBytes, latency float64
+			for i := 0; i < b.N; i++ {
+				stats, ok := simulateLink(loss, 100*time.Millisecond, int64(i))
+				if !ok {
+					b.Fatal("The cloud did not get the last screen")
+				}
+				bytes += float64(stats.bytes)
+				streamBytes += float64(stats.streamBytes)
+				latency += float64(stats.latency.Milliseconds())
+			}
+			b.ReportMetric(bytes/float64(b.N), "sync-bytes/op")
+			b.ReportMetric(streamBytes/float64(b.N), "stream-bytes/op")
+			b.ReportMetric(latency/float64(b.N), "latency-ms/op")
+		})
+	}
+}
@@ -0,0 +1,112 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+const (
+	auditArch = 0xc000003e // AUDIT_ARCH_X86_64
+	x32Bit    = 0x40000000 // System calls of the x32 ABI, always denied
+)
+
+// syscallNumbers maps the system calls a confinement can deny to their numbers
+var syscallNumbers = map[string][]uint32{
+	"accept":            {43},
+	"accept4":           {288},
+	"acct":              {163},
+	"add_key":           {248},
+	"adjtimex":          {159},
+	"bind":              {49},
+	"bpf":               {321},
+	"chmod":             {90},
+	"chown":             {92},
+	"chroot":            {161},
+	"clock_adjtime":     {305},
+	"clock_settime":     {227},
+	"connect":           {42},
+	"delete_module":     {176},
+	"execve":            {59},
+	"execveat":          {322},
+	"fanotify_init":     {300},
+	"fchmod":            {91},
+	"fchmodat":          {268},
+	"fchown":            {93},
+	"fchownat":          {260},
+	"finit_module":      {313},
+	"fsconfig":          {431},
+	"fsmount":           {432},
+	"fsopen":            {430},
+	"fspick":            {433},
+	"init_module":       {175},
+	"io_uring_enter":    {426},
+	"io_uring_register": {427},
+	"io_uring_setup":    {425},
+	"kcmp":              {312},
+	"kexec_file_load":   {320},
+	"kexec_load":        {246},
+	"keyctl":            {250},
+	"kill":              {62},
+	"lchown":            {94},
+	"listen":            {50},
+	"memfd_create":      {319},
+	"mknod":             {133},
+	"mknodat":           {259},
+	"mount":             {165},
+	"mount_setattr":     {442},
+	"move_mount":        {429},
+	"name_to_handle_at": {303},
+	"open_by_handle_at": {304},
+	"open_tree":         {428},
+	"perf_event_open":   {298},
+	"personality":       {135},
+	"pidfd_getfd":       {438},
+	"pidfd_open":        {434},
+	"pidfd_send_signal": {424},
+	"pivot_root":        {155},
+	"process_vm_readv":  {310},
+	"process_vm_writev": {311},
+	"ptrace":            {101},
+	"quotactl":          {179},
+	"reboot":            {169},
+	"request_key":       {249},
+	"seccomp":           {317},
+	"setdomainname":     {171},
+	"setgid":            {106},
+	"setgroups":         {116},
+	"sethostname":       {170},
+	"setns":             {308},
+	"setregid":          {114},
+	"setresgid":         {119},
+	"setresuid":         {117},
+	"setreuid":          {113},
+	"settimeofday":      {164},
+	"setuid":            {105},
+	"socket":            {41},
+	"socketpair":        {53},
+	"swapoff":           {168},
+	"swapon":            {167},
+	"syslog":            {103},
+	"tgkill":            {234},
+	"tkill":             {200},
+	"umount2":           {166},
+	"unshare":           {272},
+	"userfaultfd":       {323},
+	"vhangup":           {153},
+}
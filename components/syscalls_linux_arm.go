@@ -0,0 +1,112 @@
+//go:build linux && arm
+// +build linux,arm
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+const (
+	auditArch = 0x40000028 // AUDIT_ARCH_ARM
+	x32Bit    = 0
+)
+
+// syscallNumbers maps the system calls a confinement can deny to their numbers
+var syscallNumbers = map[string][]uint32{
+	"accept":            {285},
+	"accept4":           {366},
+	"acct":              {51},
+	"add_key":           {309},
+	"adjtimex":          {124},
+	"bind":              {282},
+	"bpf":               {386},
+	"chmod":             {15},
+	"chown":             {182, 212},
+	"chroot":            {61},
+	"clock_adjtime":     {372},
+	"clock_settime":     {262},
+	"connect":           {283},
+	"delete_module":     {129},
+	"execve":            {11},
+	"execveat":          {387},
+	"fanotify_init":     {367},
+	"fchmod":            {94},
+	"fchmodat":          {333},
+	"fchown":            {95, 207},
+	"fchownat":          {325},
+	"finit_module":      {379},
+	"fsconfig":          {431},
+	"fsmount":           {432},
+	"fsopen":            {430},
+	"fspick":            {433},
+	"init_module":       {128},
+	"io_uring_enter":    {426},
+	"io_uring_register": {427},
+	"io_uring_setup":    {425},
+	"kcmp":              {378},
+	"kexec_file_load":   {401},
+	"kexec_load":        {347},
+	"keyctl":            {311},
+	"kill":              {37},
+	"lchown":            {16, 198},
+	"listen":            {284},
+	"memfd_create":      {385},
+	"mknod":             {14},
+	"mknodat":           {324},
+	"mount":             {21},
+	"mount_setattr":     {442},
+	"move_mount":        {429},
+	"name_to_handle_at": {370},
+	"open_by_handle_at": {371},
+	"open_tree":         {428},
+	"perf_event_open":   {364},
+	"personality":       {136},
+	"pidfd_getfd":       {438},
+	"pidfd_open":        {434},
+	"pidfd_send_signal": {424},
+	"pivot_root":        {218},
+	"process_vm_readv":  {376},
+	"process_vm_writev": {377},
+	"ptrace":            {26},
+	"quotactl":          {131},
+	"reboot":            {88},
+	"request_key":       {310},
+	"seccomp":           {383},
+	"setdomainname":     {121},
+	"setgid":            {46, 214},
+	"setgroups":         {81, 206},
+	"sethostname":       {74},
+	"setns":             {375},
+	"setregid":          {71, 204},
+	"setresgid":         {170, 210},
+	"setresuid":         {164, 208},
+	"setreuid":          {70, 203},
+	"settimeofday":      {79},
+	"setuid":            {23, 213},
+	"socket":            {281},
+	"socketpair":        {288},
+	"swapoff":           {115},
+	"swapon":            {87},
+	"syslog":            {103},
+	"tgkill":            {268},
+	"tkill":             {238},
+	"umount2":           {52},
+	"unshare":           {337},
+	"userfaultfd":       {388},
+	"vhangup":           {111},
+}
@@ -0,0 +1,111 @@
+//go:build linux && (arm64 || riscv64)
+// +build linux
+// +build arm64 riscv64
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import "runtime"
+
+const x32Bit = 0
+
+// auditArch identifies the architecture in seccomp filters, both share the generic system call table
+var auditArch = map[string]uint32{"arm64": 0xc00000b7, "riscv64": 0xc00000f3}[runtime.GOARCH]
+
+// syscallNumbers maps the system calls a confinement can deny to their numbers
+var syscallNumbers = map[string][]uint32{
+	"accept":            {202},
+	"accept4":           {242},
+	"acct":              {89},
+	"add_key":           {217},
+	"adjtimex":          {171},
+	"bind":              {200},
+	"bpf":               {280},
+	"chroot":            {51},
+	"clock_adjtime":     {266},
+	"clock_settime":     {112},
+	"connect":           {203},
+	"delete_module":     {106},
+	"execve":            {221},
+	"execveat":          {281},
+	"fanotify_init":     {262},
+	"fchmod":            {52},
+	"fchmodat":          {53},
+	"fchown":            {55},
+	"fchownat":          {54},
+	"finit_module":      {273},
+	"fsconfig":          {431},
+	"fsmount":           {432},
+	"fsopen":            {430},
+	"fspick":            {433},
+	"init_module":       {105},
+	"io_uring_enter":    {426},
+	"io_uring_register": {427},
+	"io_uring_setup":    {425},
+	"kcmp":              {272},
+	"kexec_file_load":   {294},
+	"kexec_load":        {104},
+	"keyctl":            {219},
+	"kill":              {129},
+	"listen":            {201},
+	"memfd_create":      {279},
+	"mknodat":           {33},
+	"mount":             {40},
+	"mount_setattr":     {442},
+	"move_mount":        {429},
+	"name_to_handle_at": {264},
+	"open_by_handle_at": {265},
+	"open_tree":         {428},
+	"perf_event_open":   {241},
+	"personality":       {92},
+	"pidfd_getfd":       {438},
+	"pidfd_open":        {434},
+	"pidfd_send_signal": {424},
+	"pivot_root":        {41},
+	"process_vm_readv":  {270},
+	"process_vm_writev": {271},
+	"ptrace":            {117},
+	"quotactl":          {60},
+	"reboot":            {142},
+	"request_key":       {218},
+	"seccomp":           {277},
+	"setdomainname":     {162},
+	"setgid":            {144},
+	"setgroups":         {159},
+	"sethostname":       {161},
+	"setns":             {268},
+	"setregid":          {143},
+	"setresgid":         {149},
+	"setresuid":         {147},
+	"setreuid":          {145},
+	"settimeofday":      {170},
+	"setuid":            {146},
+	"socket":            {198},
+	"socketpair":        {199},
+	"swapoff":           {225},
+	"swapon":            {224},
+	"syslog":            {116},
+	"tgkill":            {131},
+	"tkill":             {130},
+	"umount2":           {39},
+	"unshare":           {97},
+	"userfaultfd":       {282},
+	"vhangup":           {58},
+}
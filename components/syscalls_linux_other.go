@@ -0,0 +1,30 @@
+//go:build linux && !amd64 && !arm64 && !riscv64 && !arm
+// +build linux,!amd64,!arm64,!riscv64,!arm
+
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+// Confinements are not supported on the other architectures
+const (
+	auditArch = 0
+	x32Bit    = 0
+)
+
+var syscallNumbers = map[string][]uint32{}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier implements the sd_notify protocol of systemd, see sd_notify(3). Outside of a
+// systemd service with Type=notify, NOTIFY_SOCKET is not set and notifications are dropped.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// NewNotifier reads the notify socket and the watchdog interval from the environment
+func NewNotifier() *Notifier {
+	notifier := &Notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	if strings.HasPrefix(notifier.socket, "@") {
+		notifier.socket = "\x00" + notifier.socket[1:] // Abstract namespace
+	}
+	// The watchdog applies to the main process only
+	if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+		if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+			notifier.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return notifier
+}
+
+// Enabled tells if pe-terminal runs as a systemd service expecting notifications
+func (notifier *Notifier) Enabled() bool {
+	return notifier.socket != ""
+}
+
+// WatchdogInterval returns WatchdogSec of the service, zero if the watchdog is disabled
+func (notifier *Notifier) WatchdogInterval() time.Duration {
+	return notifier.watchdog
+}
+
+// Notify sends the given VARIABLE=value assignments, e.g. READY=1, in a single datagram
+func (notifier *Notifier) Notify(assignments ...string) error {
+	if !notifier.Enabled() {
+		return nil
+	}
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifier.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	_, err = connection.Write([]byte(strings.Join(assignments, "\n")))
+	return err
+}
@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens like systemd does and returns the socket for reading notifications
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return listener
+}
+
+func readNotification(t *testing.T, listener *net.UnixConn) string {
+	buffer := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	length, err := listener.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:length])
+}
+
+func TestNotifier(t *testing.T) {
+	listener := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	notifier := NewNotifier()
+	if !notifier.Enabled() || notifier.WatchdogInterval() != 30*time.Second {
+		t.Fatalf("Unexpected notifier %+v", notifier)
+	}
+	if err := notifier.Notify("READY=1", "STATUS=Connected"); err != nil {
+		t.Fatal(err)
+	}
+	if message := readNotification(t, listener); message != "READY=1\nSTATUS=Connected" {
+		t.Fatalf("Unexpected notification %q", message)
+	}
+	if err := notifier.Notify("WATCHDOG=1"); err != nil {
+		t.Fatal(err)
+	}
+	if message := readNotification(t, listener); message != "WATCHDOG=1" {
+		t.Fatalf("Unexpected notification %q", message)
+	}
+
+	// The watchdog of another process is ignored
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := NewNotifier().WatchdogInterval(); interval != 0 {
+		t.Fatalf("Expected no watchdog, got %v", interval)
+	}
+
+	// Outside of systemd notifications are dropped
+	t.Setenv("NOTIFY_SOCKET", "")
+	if notifier := NewNotifier(); notifier.Enabled() || notifier.Notify("READY=1") != nil {
+		t.Fatal("Expected a disabled notifier")
+	}
+}
+
+func TestTunnelHealthy(t *testing.T) {
+	tunnel, _ := newTestTunnel(TunnelOptions{})
+	if !tunnel.Healthy() {
+		t.Fatal("A new tunnel should be healthy until it connected")
+	}
+	// A loop that stops making progress becomes unhealthy
+	tunnel.socket.expectProgress(-time.Second)
+	if tunnel.Healthy() {
+		t.Fatal("Expected a stuck tunnel to be unhealthy")
+	}
+	// Waiting to reconnect is progress
+	tunnel.socket.expectProgress(time.Second)
+	if !tunnel.Healthy() {
+		t.Fatal("Expected a healthy tunnel")
+	}
+}
@@ -21,10 +21,17 @@ limitations under the License.
 package components
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"go.uber.org/zap"
@@ -35,51 +42,158 @@ import (
  * @author github.com/adwardstark
  */
 
+// KillPolicy describes how the processes of a session are stopped when it is closed
+type KillPolicy struct {
+	Signals    []syscall.Signal // Sent in order to every process of the session
+	Timeout    time.Duration    // How long to wait for the processes to exit after each signal
+	CgroupRoot string           // Optional, each session gets its own cgroup below this directory
+}
+
+// DefaultKillPolicy hangs up the session, then terminates and finally kills what is left
+func DefaultKillPolicy() KillPolicy {
+	return KillPolicy{
+		Signals: []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL},
+		Timeout: 2 * time.Second,
+	}
+}
+
+// ParseSignal converts a signal name like "SIGTERM" or "term" to a signal
+func ParseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "KILL":
+		return syscall.SIGKILL, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	default:
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+}
+
 // Terminal struct holds terminal related information
 type Terminal struct {
-	cmd    *exec.Cmd
-	tty    *os.File
-	logger *zap.Logger
-	mutex  *sync.Mutex
+	cmd        *exec.Cmd
+	tty        *os.File
+	logger     *zap.Logger
+	mutex      *sync.Mutex
+	killPolicy KillPolicy
+	cgroup     string
+	exited     chan struct{}
+	closeOnce  *sync.Once
+	screen     *screenMirror
 }
 
-// NewTerminal returns a new instance of tty
-func NewTerminal(command string, logger *zap.Logger, onData func(string), onClose func()) (Terminal, error) {
+// NewTerminal returns a new instance of tty running the process described by spec
+// onClose receives the read error that ended the session, or nil when the terminal was closed
+func NewTerminal(spec SessionSpec, logger *zap.Logger, onData func(string), onClose func(error)) (Terminal, error) {
 	tLogger := logger.With(zap.String("component", "terminal"))
-	tLogger.Info("Starting new session.")
+	tLogger.Info("Starting new session.", zap.Strings("argv", spec.Argv), zap.String("dir", spec.Dir))
 
-	cmd := exec.Command(command)
-	tty, err := pty.Start(cmd)
+	cmd, supervisor, err := spec.command()
 	if err != nil {
 		return Terminal{}, err
 	}
+	// Start the shell as leader of its own session, every process it spawns
+	// (including background jobs in other process groups) remains in that session
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	var size *pty.Winsize
+	if spec.Width > 0 && spec.Height > 0 {
+		size = &pty.Winsize{Rows: spec.Height, Cols: spec.Width, X: spec.PixelWidth, Y: spec.PixelHeight}
+	}
+	tty, err := pty.StartWithSize(cmd, size)
+	for _, file := range cmd.ExtraFiles {
+		file.Close() // Copies of the shell
+	}
+	if err != nil {
+		if supervisor != nil {
+			supervisor.Close()
+		}
+		return Terminal{}, err
+	}
 
 	term := Terminal{
-		tty:    tty,
-		cmd:    cmd,
-		logger: tLogger,
-		mutex:  &sync.Mutex{},
+		tty:        tty,
+		cmd:        cmd,
+		logger:     tLogger,
+		mutex:      &sync.Mutex{},
+		killPolicy: spec.Kill,
+		exited:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		screen:     newScreenMirror(spec.Width, spec.Height, onData),
 	}
+	if spec.Kill.CgroupRoot != "" {
+		cgroup, err := joinCgroup(spec.Kill.CgroupRoot, cmd.Process.Pid)
+		if err != nil {
+			tLogger.Warn("Failed to create session cgroup", zap.Error(err))
+		}
+		term.cgroup = cgroup
+	}
+	if supervisor != nil {
+		go superviseSyscalls(supervisor, spec.Confinement, tLogger, term.exited)
+	}
+	// Reap the shell as soon as it exits
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			tLogger.Debug("Shell exited", zap.Error(err))
+		}
+		close(term.exited)
+	}()
 	// Spin-up watcher-service
 	go func() {
 		tLogger.Debug("Starting watcher-service")
+		var chunker outputChunker
+		buffer := make([]byte, 1024) // In bytes [ buffer-size ]
 		for {
-			buffer := make([]byte, 1024) // In bytes [ buffer-size ]
 			readLength, err := term.tty.Read(buffer)
 			if err != nil {
 				tLogger.Debug("Failed to read from terminal", zap.Error(err))
+				if rest := chunker.flush(); rest != "" {
+					term.screen.write(rest)
+				}
 				term.Close()
-				onClose()
+				// EIO is how a pty reports that the shell side has been closed
+				if errors.Is(err, io.EOF) || errors.Is(err, syscall.EIO) || errors.Is(err, os.ErrClosed) {
+					err = nil
+				}
+				onClose(err)
 				return
 			}
-			payload := string(buffer[:readLength])
-			tLogger.Debug("Sending message burst", zap.Int("bytes", readLength))
-			onData(payload)
+			// Whole characters and escape sequences only, the rest is sent with the next read
+			payload := chunker.next(buffer[:readLength])
+			if payload == "" {
+				continue
+			}
+			tLogger.Debug("Sending message burst", zap.Int("bytes", len(payload)))
+			term.screen.write(payload)
 		}
 	}()
 	return term, nil
 }
 
+// Pid returns the process-id of the shell
+func (term *Terminal) Pid() int {
+	return term.cmd.Process.Pid
+}
+
+// exitCode waits for the shell to exit and returns its exit status, -1 if killed by a signal
+func (term *Terminal) exitCode() int {
+	<-term.exited
+	return term.cmd.ProcessState.ExitCode()
+}
+
 // Write function writes to the tty
 func (term *Terminal) Write(command string) error {
 	term.mutex.Lock()
@@ -94,23 +208,133 @@ func (term *Terminal) Resize(width uint16, height uint16) error {
 	term.mutex.Lock()
 	defer term.mutex.Unlock()
 	term.logger.Debug("Resizing terminal", zap.Uint16("width", width), zap.Uint16("height", height))
-	termSize := pty.Winsize{Y: height, X: width} // X is width, Y is height
+	termSize := pty.Winsize{Rows: height, Cols: width} // X and Y are the size in pixels
 	err := pty.Setsize(term.tty, &termSize)
+	term.screen.resize(width, height)
 	return err
 }
 
-// Close function closes the tty session
+// mirror returns the model of the screen of the terminal
+func (term *Terminal) mirror() *screenMirror {
+	return term.screen
+}
+
+// Close function closes the tty session and stops every process started in it,
+// calling it more than once is safe
 func (term *Terminal) Close() error {
-	term.logger.Info("Stopping terminal.")
-	if err := term.cmd.Process.Kill(); err != nil {
-		return err
+	var err error
+	term.closeOnce.Do(func() {
+		term.logger.Info("Stopping terminal.")
+		term.killSession()
+		<-term.exited
+		if term.cgroup != "" {
+			if err := os.Remove(term.cgroup); err != nil {
+				term.logger.Warn("Failed to remove session cgroup", zap.String("cgroup", term.cgroup), zap.Error(err))
+			}
+		}
+		if err = term.tty.Close(); err != nil {
+			return
+		}
+		term.logger.Debug("Terminal stopped successfully")
+	})
+	return err
+}
+
+// killSession walks through the kill-policy signals until no process of the session is left
+func (term *Terminal) killSession() {
+	sid := term.cmd.Process.Pid
+	for _, signal := range term.killPolicy.Signals {
+		pids := term.processes()
+		if len(pids) == 0 {
+			return
+		}
+		term.logger.Debug("Signalling session processes", zap.String("signal", signal.String()), zap.Ints("pids", pids))
+		// Covers the shell's own process group on platforms without /proc
+		syscall.Kill(-sid, signal)
+		for _, pid := range pids {
+			syscall.Kill(pid, signal)
+		}
+		deadline := time.Now().Add(term.killPolicy.Timeout)
+		for len(term.processes()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
 	}
-	if _, err := term.cmd.Process.Wait(); err != nil {
-		return err
+	if pids := term.processes(); len(pids) > 0 {
+		term.logger.Warn("Session processes survived the kill-policy, killing", zap.Ints("pids", pids))
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// processes lists the live processes belonging to the session of the shell and to its cgroup
+func (term *Terminal) processes() []int {
+	sid := term.cmd.Process.Pid
+	seen := make(map[int]bool)
+	var pids []int
+	add := func(pid int) {
+		if !seen[pid] && pid != os.Getpid() {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+	select {
+	case <-term.exited:
+	default:
+		add(sid)
+	}
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if session, state, ok := readProcStat(pid); ok && session == sid && state != 'Z' {
+			add(pid)
+		}
+	}
+	if term.cgroup != "" {
+		data, _ := os.ReadFile(filepath.Join(term.cgroup, "cgroup.procs"))
+		for _, line := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(line); err == nil {
+				if _, state, ok := readProcStat(pid); ok && state != 'Z' {
+					add(pid)
+				}
+			}
+		}
+	}
+	return pids
+}
+
+// readProcStat returns the session-id and state of a process from /proc/<pid>/stat
+func readProcStat(pid int) (int, byte, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The command name may contain spaces, fields are read after its closing bracket:
+	// <pid> (<comm>) <state> <ppid> <pgrp> <session> ...
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 4 {
+		return 0, 0, false
+	}
+	session, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return 0, 0, false
+	}
+	return session, fields[0][0], true
+}
+
+// joinCgroup creates a cgroup for the session below root and moves pid into it
+func joinCgroup(root string, pid int) (string, error) {
+	cgroup := filepath.Join(root, fmt.Sprintf("pe-terminal-%d", pid))
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return "", err
 	}
-	if err := term.tty.Close(); err != nil {
-		return err
+	if err := os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		os.Remove(cgroup)
+		return "", err
 	}
-	term.logger.Debug("Terminal stopped successfully")
-	return nil
+	return cgroup, nil
 }
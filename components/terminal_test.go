@@ -20,7 +20,13 @@ limitations under the License.
 package components
 
 import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -33,6 +39,7 @@ import (
  */
 var logger *zap.Logger
 var shellCommand string
+var shellSpec SessionSpec
 var isCompleted chan bool
 var timeoutAfter <-chan time.Time
 var runInScope = beforeEach(setup, teardown)
@@ -48,6 +55,7 @@ func beforeEach(setup func(), teardown func()) func(func()) {
 func setup() {
 	logger, _ = zap.NewProduction()
 	shellCommand = "/bin/bash"
+	shellSpec, _ = NewSessionSpec(shellCommand)
 	isCompleted = make(chan bool)
 	timeoutAfter = time.After(time.Duration(5) * time.Second)
 }
@@ -58,10 +66,10 @@ func teardown() {
 
 func TestTerminalSetup(t *testing.T) {
 	runInScope(func() {
-		term, err := NewTerminal(shellCommand, logger,
+		term, err := NewTerminal(shellSpec, logger,
 			func(output string) {
 				// Do nothing
-			}, func() {
+			}, func(err error) {
 				// Do nothing
 			})
 		if err != nil {
@@ -73,10 +81,10 @@ func TestTerminalSetup(t *testing.T) {
 
 func TestTerminalResize(t *testing.T) {
 	runInScope(func() {
-		term, err := NewTerminal(shellCommand, logger,
+		term, err := NewTerminal(shellSpec, logger,
 			func(output string) {
 				// Do nothing
-			}, func() {
+			}, func(err error) {
 				// Do nothing
 			})
 		if err != nil {
@@ -91,12 +99,13 @@ func TestTerminalResize(t *testing.T) {
 
 func TestTerminalPromptReturned(t *testing.T) {
 	runInScope(func() {
-		term, err := NewTerminal(shellCommand, logger,
+		completed := isCompleted // The next test replaces isCompleted while the watcher may still run
+		term, err := NewTerminal(shellSpec, logger,
 			func(output string) {
 				for strings.Contains(output, "$") {
-					isCompleted <- true
+					completed <- true
 				} // If not found, test will fail on timeout
-			}, func() {
+			}, func(err error) {
 				// Do nothing
 			})
 		if err != nil {
@@ -106,7 +115,7 @@ func TestTerminalPromptReturned(t *testing.T) {
 
 		for {
 			select {
-			case <-isCompleted:
+			case <-completed:
 				return
 			case <-timeoutAfter:
 				t.Fatal("Timeout, did not received response: \"bash\" within 2 seconds")
@@ -117,12 +126,13 @@ func TestTerminalPromptReturned(t *testing.T) {
 
 func TestTerminalCommandExecuted(t *testing.T) {
 	runInScope(func() {
-		term, err := NewTerminal(shellCommand, logger,
+		completed := isCompleted // The next test replaces isCompleted while the watcher may still run
+		term, err := NewTerminal(shellSpec, logger,
 			func(output string) {
 				for strings.Contains(output, "echo something") {
-					isCompleted <- true
+					completed <- true
 				}
-			}, func() {
+			}, func(err error) {
 				// Do nothing
 			})
 		if err != nil {
@@ -135,7 +145,7 @@ func TestTerminalCommandExecuted(t *testing.T) {
 
 		for {
 			select {
-			case <-isCompleted:
+			case <-completed:
 				return
 			case <-timeoutAfter:
 				t.Fatal("Timeout, did not received response: \"echo something\" within 2 seconds")
@@ -143,3 +153,272 @@ func TestTerminalCommandExecuted(t *testing.T) {
 		}
 	})
 }
+
+// startBackgroundChild runs command in the background of a new terminal and returns the terminal and the child pid
+func startBackgroundChild(t *testing.T, policy KillPolicy, command string) (Terminal, int) {
+	pidPattern := regexp.MustCompile(`bgpid=(\d+)`)
+	pidFound := make(chan int, 1)
+	var output strings.Builder
+	spec := shellSpec
+	spec.Kill = policy
+	term, err := NewTerminal(spec, logger,
+		func(data string) {
+			output.WriteString(data)
+			if match := pidPattern.FindStringSubmatch(output.String()); match != nil {
+				pid, _ := strconv.Atoi(match[1])
+				select {
+				case pidFound <- pid:
+				default:
+				}
+			}
+		}, func(err error) {
+			// Do nothing
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Write(command + " & echo bgpid=$!\r"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pid := <-pidFound:
+		return term, pid
+	case <-timeoutAfter:
+		term.Close()
+		t.Fatal("Timeout, background child did not report its pid")
+	}
+	return term, 0
+}
+
+// isAlive tells if pid is a running (non-zombie) process
+func isAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	return fields[0] != "Z"
+}
+
+func TestTerminalCloseKillsBackgroundJobs(t *testing.T) {
+	runInScope(func() {
+		policy := DefaultKillPolicy()
+		policy.Timeout = 500 * time.Millisecond
+		term, pid := startBackgroundChild(t, policy, "nohup sleep 1000 >/dev/null 2>&1")
+		if !isAlive(pid) {
+			t.Fatal("Background child is not running")
+		}
+		if err := term.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if isAlive(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("Background child survived the session")
+		}
+	})
+}
+
+func TestTerminalCloseEscalatesSignals(t *testing.T) {
+	runInScope(func() {
+		policy := DefaultKillPolicy()
+		policy.Timeout = 200 * time.Millisecond
+		// The child ignores SIGHUP and SIGTERM, only SIGKILL can stop it
+		term, pid := startBackgroundChild(t, policy, "bash -c \"trap '' HUP TERM; sleep 1000\"")
+		if err := term.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if isAlive(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("Background child survived the session")
+		}
+	})
+}
+
+func TestTerminalCloseTwice(t *testing.T) {
+	runInScope(func() {
+		term, err := NewTerminal(shellSpec, logger,
+			func(output string) {
+				// Do nothing
+			}, func(err error) {
+				// Do nothing
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := term.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := term.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := map[string][]string{
+		"/bin/bash":                   {"/bin/bash"},
+		"/bin/bash -l":                {"/bin/bash", "-l"},
+		"  su  -  operator ":          {"su", "-", "operator"},
+		`sh -c 'echo "a b"; exit'`:    {"sh", "-c", `echo "a b"; exit`},
+		`printf "%s\n" "x y" z\ w ''`: {"printf", `%s\n`, "x y", "z w", ""},
+	}
+	for command, expected := range tests {
+		argv, err := SplitCommand(command)
+		if err != nil {
+			t.Fatalf("%q: %v", command, err)
+		}
+		if strings.Join(argv, "|") != strings.Join(expected, "|") || len(argv) != len(expected) {
+			t.Errorf("%q: expected %q, got %q", command, expected, argv)
+		}
+	}
+	for _, command := range []string{"", "   ", "sh -c 'unterminated", "trailing\\"} {
+		if _, err := SplitCommand(command); err == nil {
+			t.Errorf("%q: expected an error", command)
+		}
+	}
+}
+
+func TestSessionSpecEnviron(t *testing.T) {
+	spec := SessionSpec{
+		Env:      map[string]string{"TERM": "xterm-256color", "LD_PRELOAD": "evil.so"},
+		EnvAllow: []string{"PATH", "LC_*", "LD_*"},
+		EnvDeny:  []string{"LD_*"},
+		Width:    100,
+		Height:   40,
+	}
+	environ := spec.environ([]string{"PATH=/bin", "LC_ALL=C", "SECRET=1", "LD_LIBRARY_PATH=/opt", "TERM=dumb"})
+	expected := []string{"COLUMNS=100", "LC_ALL=C", "LINES=40", "PATH=/bin", "TERM=xterm-256color"}
+	if strings.Join(environ, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %q, got %q", expected, environ)
+	}
+}
+
+func TestTerminalSessionSpec(t *testing.T) {
+	runInScope(func() {
+		os.Setenv("PE_TERMINAL_TEST_SECRET", "leaked")
+		defer os.Unsetenv("PE_TERMINAL_TEST_SECRET")
+		spec, err := NewSessionSpec(shellCommand + " --noprofile -l")
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.Env = map[string]string{"TERM": "vt100"}
+		spec.EnvDeny = []string{"PE_TERMINAL_*"}
+		spec.Dir = os.TempDir()
+
+		output := newSyncBuilder()
+		completed := make(chan string, 1)
+		term, err := NewTerminal(spec, logger,
+			func(data string) {
+				if text := output.append(data); strings.Contains(text, ":end") {
+					select {
+					case completed <- text:
+					default:
+					}
+				}
+			}, func(err error) {
+				// Do nothing
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer term.Close() // gracefully close, best effort
+		if err := term.Write("echo \"result:$TERM:${PE_TERMINAL_TEST_SECRET}:$PWD:$(shopt -q login_shell && echo login):e\"\"nd\"\r"); err != nil {
+			t.Fatal(err)
+		}
+
+		var text string
+		select {
+		case text = <-completed:
+		case <-timeoutAfter:
+			t.Fatalf("Timeout, did not receive the environment of the shell: %q", output.String())
+		}
+		expected := "result:vt100::" + os.TempDir() + ":login:end"
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected %q in output %q", expected, text)
+		}
+	})
+}
+
+// syncBuilder collects the output of a terminal, written by its watcher and read by the test
+type syncBuilder struct {
+	mutex   *sync.Mutex
+	builder strings.Builder
+}
+
+func newSyncBuilder() *syncBuilder {
+	return &syncBuilder{mutex: &sync.Mutex{}}
+}
+
+// append adds data and returns the output so far
+func (output *syncBuilder) append(data string) string {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.builder.WriteString(data)
+	return output.builder.String()
+}
+
+func (output *syncBuilder) String() string {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.builder.String()
+}
+
+// sttySize starts a terminal from spec, optionally resizes it and returns what `stty size` reports
+func sttySize(t *testing.T, spec SessionSpec, resize func(term *Terminal) error) string {
+	sizePattern := regexp.MustCompile(`size=(\d+ \d+)`)
+	sizeFound := make(chan string, 1)
+	output := newSyncBuilder()
+	term, err := NewTerminal(spec, logger,
+		func(data string) {
+			if match := sizePattern.FindStringSubmatch(output.append(data)); match != nil {
+				select {
+				case sizeFound <- match[1]:
+				default:
+				}
+			}
+		}, func(err error) {
+			// Do nothing
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close() // gracefully close, best effort
+	if resize != nil {
+		if err := resize(&term); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := term.Write("echo size=$(stty size)\r"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-sizeFound:
+		return size
+	case <-timeoutAfter:
+		t.Fatalf("Timeout, did not receive the size of the terminal: %q", output.String())
+	}
+	return ""
+}
+
+func TestTerminalInitialSize(t *testing.T) {
+	runInScope(func() {
+		spec := shellSpec
+		spec.Width = 132
+		spec.Height = 43
+		if size := sttySize(t, spec, nil); size != "43 132" {
+			t.Fatalf("Expected size \"43 132\", got %q", size)
+		}
+	})
+}
+
+func TestTerminalResizeApplied(t *testing.T) {
+	runInScope(func() {
+		size := sttySize(t, shellSpec, func(term *Terminal) error {
+			return term.Resize(120, 50)
+		})
+		if size != "50 120" {
+			t.Fatalf("Expected size \"50 120\", got %q", size)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	throttleWindow     = time.Second // Output is dropped this long once a rate limit is exceeded
+	throttleNotice     = "\r\n*** pe-terminal: output throttled: %d bytes dropped ***\r\n"
+	interruptCharacter = "\x03" // Ctrl-C
+)
+
+// throttledPayload is the payload of a throttled message
+type throttledPayload struct {
+	Dropped int64 `json:"dropped"`
+}
+
+// rateLimiter is a token bucket of bytes, holding one second of its rate at most
+type rateLimiter struct {
+	mutex  *sync.Mutex
+	rate   int // In bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{mutex: &sync.Mutex{}, rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// take returns how many of wanted bytes may pass now, a nil limiter lets everything pass
+func (limiter *rateLimiter) take(wanted int, now time.Time) int {
+	if limiter == nil {
+		return wanted
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if elapsed := now.Sub(limiter.last); elapsed > 0 {
+		limiter.tokens += elapsed.Seconds() * float64(limiter.rate)
+		if limiter.tokens > float64(limiter.rate) {
+			limiter.tokens = float64(limiter.rate)
+		}
+		limiter.last = now
+	}
+	allowed := wanted
+	if float64(allowed) > limiter.tokens {
+		allowed = int(limiter.tokens)
+	}
+	limiter.tokens -= float64(allowed)
+	return allowed
+}
+
+// refund gives back bytes taken but not sent
+func (limiter *rateLimiter) refund(bytes int) {
+	if limiter == nil {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.tokens += float64(bytes)
+}
+
+// reset fills the bucket
+func (limiter *rateLimiter) reset(now time.Time) {
+	if limiter == nil {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.tokens = float64(limiter.rate)
+	limiter.last = now
+}
+
+// throttle protects the tunnel from runaway output, e.g. of `yes` or `cat /dev/urandom`. Once
+// the output of a session exceeds its own or the global rate limit, its output is dropped for a
+// while, then a notice tells how much was dropped.
+type throttle struct {
+	mutex       *sync.Mutex
+	session     *rateLimiter
+	global      *rateLimiter // Shared by every session
+	bypass      int          // Bytes that may pass without counting against the global limit
+	dropped     int64        // Since the notice
+	generation  int          // Tells a timer of an earlier window from the one of the current window
+	timer       *time.Timer  // Ends the window output is dropped in
+	interrupted atomic.Bool  // Set by a Ctrl-C, taken by the next write
+	queue       *outputQueue // Of the output passed, which may wait for credit
+	throttled   func(int64)  // Reports the bytes dropped, once the notice is out
+}
+
+func newThrottle(session *rateLimiter, global *rateLimiter, output func(string), throttled func(int64)) *throttle {
+	return &throttle{mutex: &sync.Mutex{}, session: session, global: global, queue: newOutputQueue(output), throttled: throttled}
+}
+
+// write passes output on as the rate limits allow, or drops it while throttled
+func (throttle *throttle) write(output string) {
+	throttle.mutex.Lock()
+	dropped := throttle.limit(output)
+	throttle.mutex.Unlock()
+	throttle.queue.drain(true)
+	throttle.report(dropped)
+}
+
+// limit queues the part of output the rate limits allow, the mutex must be held. It returns
+// the bytes dropped before a Ctrl-C, to be reported once the notice is out.
+func (throttle *throttle) limit(output string) int64 {
+	if throttle.session == nil && throttle.global == nil {
+		throttle.queue.push(output)
+		return 0
+	}
+	var dropped int64
+	if throttle.interrupted.Swap(false) {
+		dropped = throttle.notice()
+		throttle.session.reset(time.Now())
+		if throttle.session != nil {
+			throttle.bypass = throttle.session.rate
+		} else {
+			throttle.bypass = throttle.global.rate
+		}
+	}
+	if throttle.timer != nil {
+		throttle.dropped += int64(len(output))
+		return dropped
+	}
+	now := time.Now()
+	allowed := throttle.session.take(len(output), now)
+	if allowed > throttle.bypass {
+		global := throttle.global.take(allowed-throttle.bypass, now)
+		throttle.session.refund(allowed - throttle.bypass - global)
+		allowed = throttle.bypass + global
+	}
+	allowed = utf8Boundary(output, allowed) // The rest of a character cut is dropped along
+	throttle.bypass -= allowed
+	if throttle.bypass < 0 {
+		throttle.bypass = 0
+	}
+	if allowed > 0 {
+		throttle.queue.push(output[:allowed])
+	}
+	if allowed < len(output) {
+		throttle.dropped += int64(len(output) - allowed)
+		generation := throttle.generation
+		throttle.timer = time.AfterFunc(throttleWindow, func() { throttle.expire(generation) })
+	}
+	return dropped
+}
+
+// expire ends the window the timer was started for, unless it was ended already
+func (throttle *throttle) expire(generation int) {
+	var dropped int64
+	throttle.mutex.Lock()
+	if generation == throttle.generation {
+		dropped = throttle.notice()
+	}
+	throttle.mutex.Unlock()
+	throttle.queue.drain(true)
+	throttle.report(dropped)
+}
+
+// interrupt gives way to the output following a Ctrl-C, so that the user sees the prompt
+// again while other sessions use up the global limit. Called by the goroutine reading the
+// socket, it does not wait for the output, which may wait for credit read by that goroutine.
+func (throttle *throttle) interrupt() {
+	if throttle.session != nil || throttle.global != nil {
+		throttle.interrupted.Store(true)
+	}
+}
+
+// close ends the window output is dropped in, with a notice if output was dropped
+func (throttle *throttle) close() {
+	throttle.mutex.Lock()
+	dropped := throttle.notice()
+	throttle.mutex.Unlock()
+	throttle.queue.drain(true)
+	throttle.report(dropped)
+}
+
+// notice ends the window output is dropped in and queues a notice telling how much was dropped,
+// the mutex must be held. It returns the bytes dropped.
+func (throttle *throttle) notice() int64 {
+	if throttle.timer != nil {
+		throttle.timer.Stop()
+		throttle.timer = nil
+	}
+	throttle.generation++
+	if throttle.dropped == 0 {
+		return 0
+	}
+	dropped := throttle.dropped
+	throttle.dropped = 0
+	throttle.queue.push(fmt.Sprintf(throttleNotice, dropped))
+	return dropped
+}
+
+// report tells the bytes dropped, once the notice is out
+func (throttle *throttle) report(dropped int64) {
+	if dropped > 0 {
+		throttle.throttled(dropped)
+	}
+}
+
+// isInterrupt tells if input holds a Ctrl-C
+func isInterrupt(input string) bool {
+	return strings.Contains(input, interruptCharacter)
+}
+
+// outputLimiter returns the global limiter of output for rate, shared by the sessions started
+// with the same rate, the mutex must be held
+func (tunnel *SocketTunnel) outputLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if tunnel.globalLimiter == nil || tunnel.globalLimiter.rate != rate {
+		tunnel.globalLimiter = newRateLimiter(rate)
+	}
+	return tunnel.globalLimiter
+}
+
+// onThrottled reports output of a session dropped by the rate limits
+func (tunnel *SocketTunnel) onThrottled(sessionID string, dropped int64) {
+	tunnel.logger.Warn("Session output throttled", zap.String("sessionID", sessionID), zap.Int64("dropped", dropped))
+	tunnel.metrics.droppedBytes.add(float64(dropped))
+	tunnel.sendEnvelope(envelope{Type: typeThrottled, SessionID: sessionID, Payload: throttledPayload{Dropped: dropped}})
+	event := Event{Type: EventThrottled, SessionID: sessionID, Dropped: dropped}
+	if session := tunnel.getSession(sessionID); session != nil {
+		event.Profile = session.profile
+		event.User = session.user
+		event.Operator = session.operator
+	}
+	tunnel.events.Publish(event)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	now := limiter.last
+	if allowed := limiter.take(150, now); allowed != 100 {
+		t.Fatalf("Expected the burst of one second, got %d", allowed)
+	}
+	if allowed := limiter.take(10, now); allowed != 0 {
+		t.Fatalf("Expected nothing left, got %d", allowed)
+	}
+	if allowed := limiter.take(100, now.Add(300*time.Millisecond)); allowed != 30 {
+		t.Fatalf("Expected the bucket refilled at the rate, got %d", allowed)
+	}
+	limiter.refund(20)
+	if allowed := limiter.take(100, now.Add(300*time.Millisecond)); allowed != 20 {
+		t.Fatalf("Expected the refund, got %d", allowed)
+	}
+	if allowed := limiter.take(500, now.Add(time.Hour)); allowed != 100 {
+		t.Fatalf("Expected the bucket to hold one second at most, got %d", allowed)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	var output strings.Builder
+	var dropped []int64
+	mutex := &sync.Mutex{} // The notice is written by the timer
+	global := newRateLimiter(1000)
+	throttle := newThrottle(newRateLimiter(100), global, func(text string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		output.WriteString(text)
+	}, func(bytes int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		dropped = append(dropped, bytes)
+	})
+
+	// Output beyond the limit is dropped, along with what follows while throttled
+	throttle.write(strings.Repeat("a", 150))
+	throttle.write(strings.Repeat("b", 20))
+	if output.String() != strings.Repeat("a", 100) || len(dropped) != 0 {
+		t.Fatalf("Expected the output within the limit, got %q %v", output.String(), dropped)
+	}
+
+	// Ctrl-C ends the throttling with a notice, and lets the output following it pass even
+	// though other sessions used up the global limit
+	global.take(1000, time.Now())
+	output.Reset()
+	throttle.interrupt()
+	throttle.write("^C\r\n$ ")
+	if output.String() != fmt.Sprintf(throttleNotice, 70)+"^C\r\n$ " || len(dropped) != 1 || dropped[0] != 70 {
+		t.Fatalf("Expected a notice and the prompt, got %q %v", output.String(), dropped)
+	}
+
+	// The notice also follows once the output was dropped for a while
+	output.Reset()
+	throttle.write(strings.Repeat("c", 200))
+	time.Sleep(throttleWindow + 200*time.Millisecond)
+	mutex.Lock()
+	passed := strings.Count(output.String(), "c") // 7 bytes of the burst went to the prompt, some more may have been refilled since
+	if passed < 93 || output.String() != strings.Repeat("c", passed)+fmt.Sprintf(throttleNotice, 200-passed) || len(dropped) != 2 {
+		t.Fatalf("Expected a notice once throttled for a while, got %q %v", output.String(), dropped)
+	}
+	mutex.Unlock()
+
+	// Without limits everything passes
+	output.Reset()
+	throttle = newThrottle(nil, nil, func(text string) { output.WriteString(text) }, nil)
+	throttle.write(strings.Repeat("d", 10000))
+	throttle.interrupt()
+	throttle.close()
+	if output.Len() != 10000 {
+		t.Fatalf("Expected the output unlimited, got %d bytes", output.Len())
+	}
+}
+
+func TestThrottleStaleExpiry(t *testing.T) {
+	var output strings.Builder
+	var dropped []int64
+	throttle := newThrottle(newRateLimiter(100), nil, func(text string) { output.WriteString(text) }, func(bytes int64) { dropped = append(dropped, bytes) })
+
+	// The window started by the first output is ended by a Ctrl-C, then the output following
+	// the prompt starts another window
+	throttle.write(strings.Repeat("a", 150))
+	throttle.interrupt()
+	throttle.write("^C")
+	throttle.write(strings.Repeat("b", 300))
+	output.Reset()
+
+	// The timer of the first window firing late, as it may have before it was stopped, leaves
+	// the window running
+	throttle.expire(0)
+	if output.Len() != 0 || len(dropped) != 1 {
+		t.Fatalf("Expected the current window kept, got %q %v", output.String(), dropped)
+	}
+	throttle.write("c")
+	throttle.close()
+	if output.String() != fmt.Sprintf(throttleNotice, 203) || len(dropped) != 2 || dropped[1] != 203 {
+		t.Fatalf("Expected one notice for the current window, got %q %v", output.String(), dropped)
+	}
+}
+
+func TestThrottledSession(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		RateLimit:      64,
+	})
+	events := make(chan Event, 16)
+	tunnel.Events().Subscribe(EventFunc(func(event Event) { events <- event }), EventThrottled)
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "` + strings.Repeat("x", 200) + `\n"}`)
+	if output, _ := collectOutput(t, messages, "s1", 300*time.Millisecond); output != strings.Repeat("x", 64) {
+		t.Fatalf("Expected the output within the limit, got %q", output)
+	}
+
+	// Ctrl-C stops cat, the user is told what was dropped
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "\u0003"}`)
+	var output strings.Builder
+	var throttled envelope
+	for message := nextMessage(t, messages); message.Type != typeEnd; message = nextMessage(t, messages) {
+		switch message.Type {
+		case typeOutput:
+			output.WriteString(message.Payload.(string))
+		case typeThrottled:
+			throttled = message
+		}
+	}
+	if !strings.HasPrefix(output.String(), fmt.Sprintf(throttleNotice, 404-64)) || !strings.Contains(output.String(), "^C") {
+		t.Fatalf("Expected a notice followed by the echo of Ctrl-C, got %q", output.String())
+	}
+	if payload, ok := throttled.Payload.(map[string]interface{}); !ok || payload["dropped"] != float64(404-64) {
+		t.Fatalf("Expected a throttled message, got %+v", throttled)
+	}
+	if event := <-events; event.SessionID != "s1" || event.Dropped != 404-64 {
+		t.Fatalf("Expected a throttled event, got %+v", event)
+	}
+}
+
+func TestInterruptWithoutCredit(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+		RateLimit:      1 << 20,
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"window": 4}}`)
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "hello world\n"}`)
+	if output, _ := collectOutput(t, messages, "s1", 300*time.Millisecond); output != "hell" {
+		t.Fatalf("Expected the output within the credit, got %q", output)
+	}
+
+	// The output waiting for credit does not hold up a Ctrl-C, nor the credit following it
+	interrupted := make(chan struct{})
+	go func() {
+		tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "\u0003"}`)
+		tunnel.onMessage(`{"type": "credit", "sessionID": "s1", "payload": 1000}`)
+		close(interrupted)
+	}()
+	select {
+	case <-interrupted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout, Ctrl-C blocked by the output waiting for credit")
+	}
+	if output, ended := collectOutput(t, messages, "s1", 2*time.Second); !ended || !strings.HasPrefix(output, "o world") {
+		t.Fatalf("Expected the rest of the output once credit is granted, got %q", output)
+	}
+}
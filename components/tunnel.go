@@ -21,13 +21,18 @@ limitations under the License.
 package components
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
@@ -42,6 +47,7 @@ type envelope struct {
 	Type      string      `json:"type"`
 	SessionID string      `json:"sessionID"`
 	Payload   interface{} `json:"payload"`
+	Reason    string      `json:"reason,omitempty"`
 }
 
 const (
@@ -50,8 +56,29 @@ const (
 	typeResize             = "resize"
 	typeStart              = "start"
 	typeEnd                = "end"
+	typeError              = "error"
+	typeProfiles           = "profiles"
+	typeStatus             = "status"
+	typeE2E                = "e2e"       // Answer to the key exchange of an encrypted session
+	typeSealed             = "sealed"    // Encrypted input, output or resize of a session
+	typeCredit             = "credit"    // Bytes of output the cloud is ready to receive more
+	typeThrottled          = "throttled" // Output of a session was dropped, exceeding a rate limit
+	typeAttach             = "attach"    // An operator joins a running session, answered with a snapshot of its screen
+	typeMode               = "mode"      // Answer to a start message asking for a mode
+	typeFrame              = "frame"     // Cells of the screen of a session in sync mode changed since a frame
+	typeAck                = "ack"       // The cloud holds the screen of a frame
 	errInvalidEnvelope     = "Data could not be parsed as JSON"
 	errInvalidObjectFormat = "Object format invalid"
+	errInvalidSealed       = "Sealed message could not be opened"
+	reasonShutdown         = "device shutting down"
+	reasonMaxDuration      = "session time limit reached"
+	reasonKilledLocally    = "terminated by local operator"
+	reasonExited           = "shell exited"
+	reasonStartFailed      = "session failed to start"
+	reasonCancelled        = "cancelled by the cloud"
+	reasonUnknownSession   = "no such session"
+	sendQueueSize          = 16 // Messages queued per session for the websocket write-loop
+	shutdownNotice         = "\r\n*** pe-terminal: device shutting down, this session will be closed ***\r\n"
 )
 
 func isValidJSON(s string) bool {
@@ -59,36 +86,160 @@ func isValidJSON(s string) bool {
 	return json.Unmarshal([]byte(s), &js) == nil
 }
 
+// Error codes sent to the cloud in the payload of an error message
+const (
+	errCodeInvalidRequest = "invalid-request"
+	errCodeUnknownProfile = "unknown-profile"
+	errCodeForbidden      = "forbidden"
+	errCodeLimitReached   = "limit-reached"
+	errCodeShuttingDown   = "shutting-down"
+	errCodeStartFailed    = "start-failed"
+	errCodeSessionExists  = "session-exists" // Does not end the session running
+	errCodeVetoed         = "vetoed"
+	errCodeDenied         = "denied"
+	errCodeUnauthorized   = "unauthorized"
+	errCodePolicy         = "policy-violation" // Does not end the session
+)
+
+// errorPayload is the payload of an error message
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// console is what runs for a session, a Terminal or a RestrictedShell
+type console interface {
+	Pid() int
+	Write(input string) error
+	Resize(width uint16, height uint16) error
+	Close() error
+	mirror() *screenMirror
+}
+
+// startup is a session starting, until its shell is spawned
+type startup struct {
+	profile string
+	cancel  context.CancelFunc // Aborts the start, e.g. its pre-start hook
+}
+
+// session holds a running terminal and the reason reported to the cloud once it ends
+type session struct {
+	terminal  console
+	profile   string
+	user      string
+	role      string
+	operator  string
+	recorder  *recorder
+	started   time.Time
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	endReason string
+	channel   *e2eChannel // Seals the messages of an encrypted session, nil in plaintext
+	output    *coalescer
+	flow      *flowControl // Credit of the output, nil without flow control
+	throttle  *throttle
+	frames    *frameSender // Sends the screen instead of the output in sync mode, nil in stream mode
+}
+
+// SessionInfo describes a running session
+type SessionInfo struct {
+	SessionID string    `json:"sessionID"`
+	Profile   string    `json:"profile"`
+	User      string    `json:"user"`
+	Role      string    `json:"role,omitempty"`
+	Operator  string    `json:"operator,omitempty"`
+	Pid       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Age       string    `json:"age"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Encrypted bool      `json:"encrypted,omitempty"` // End-to-end
+}
+
+// TunnelStatus describes the state of the tunnel
+type TunnelStatus struct {
+	URL            string     `json:"url"`
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	ReconnectWait  int        `json:"reconnectWait"`
+	ShuttingDown   bool       `json:"shuttingDown"`
+	Sessions       int        `json:"sessions"`
+	Pending        int        `json:"pending"` // Sessions waiting for approval
+	SendQueue      int        `json:"sendQueue"`
+}
+
 // SocketTunnel defines structure of the tunnel and callbacks
 type SocketTunnel struct {
 	socket        Socket
 	reconnectWait int
 	logger        *zap.Logger
-	command       string
+	options       TunnelOptions
 	mutex         *sync.Mutex
-	sessionsMap   map[string]*Terminal
+	sessionsMap   map[string]*session
+	sessionsWait  *sync.WaitGroup
+	pending       map[string]*pendingApproval // Sessions waiting for a local operator
+	reserved      map[string]*startup         // Sessions starting, by session
+	usedTokens    map[string]time.Time        // Expiry of the authorization tokens accepted, by session
+	globalLimiter *rateLimiter                // Output of every session, nil without a global rate limit
+	shuttingDown  bool
+	connectedAt   time.Time
+	metrics       *Metrics
+	events        *EventBus
 }
 
 // NewTunnel returns a new instance of SocketTunnel
-func NewTunnel(url string, command string, logger *zap.Logger) SocketTunnel {
+func NewTunnel(url string, options TunnelOptions, logger *zap.Logger) SocketTunnel {
+	queue := newScheduler(sendQueueSize)
+	mutex := &sync.Mutex{}
+	sessionsMap := make(map[string]*session)
+	progress := &atomic.Int64{}
+	progress.Store(time.Now().Add(handshakeTimeout + loopStallTimeout).UnixNano())
 	return SocketTunnel{
 		socket: Socket{
 			url:         url,
 			logger:      logger.With(zap.String("component", "socket")),
-			messageBus:  make(chan []byte),
-			closeSignal: make(chan bool),
+			queue:       queue,
+			closeSignal: make(chan []byte),
+			mutex:       &sync.Mutex{},
+			progress:    progress,
 		},
 		reconnectWait: 1,
 		logger:        logger.With(zap.String("component", "tunnel")),
-		command:       command,
-		mutex:         &sync.Mutex{},
-		sessionsMap:   make(map[string]*Terminal),
+		options:       options,
+		mutex:         mutex,
+		sessionsMap:   sessionsMap,
+		sessionsWait:  &sync.WaitGroup{},
+		pending:       make(map[string]*pendingApproval),
+		reserved:      make(map[string]*startup),
+		usedTokens:    make(map[string]time.Time),
+		metrics:       newMetrics(queue, sessionsMap, mutex),
+		events:        newEventBus(logger),
 	}
 }
 
+// Metrics returns the Prometheus metrics of the tunnel
+func (tunnel *SocketTunnel) Metrics() *Metrics {
+	return tunnel.metrics
+}
+
+// Events returns the bus publishing the events of the tunnel and its sessions
+func (tunnel *SocketTunnel) Events() *EventBus {
+	return tunnel.events
+}
+
 // Connect the tunnel
 func (tunnel *SocketTunnel) Connect() {
-	tunnel.socket.SetupSocket(tunnel.onConnected, tunnel.onError, tunnel.onMessage)
+	connected := false
+	tunnel.socket.compression = tunnel.getOptions().Compression
+	tunnel.socket.SetupSocket(func() {
+		connected = true
+		tunnel.onConnected()
+	}, func(err error) {
+		if !connected {
+			tunnel.events.Publish(Event{Type: EventError, URL: tunnel.socket.getURL(), Code: errCodeConnectFailed, Reason: err.Error()})
+		}
+		tunnel.onError(err)
+	}, tunnel.onMessage)
 }
 
 // Close the tunnel
@@ -96,21 +247,205 @@ func (tunnel *SocketTunnel) Close() {
 	tunnel.socket.Close()
 }
 
+// Shutdown stops accepting new sessions, warns and ends every open session, waits for
+// their pending output to be flushed and closes the connection. It returns false if
+// the sessions could not be drained within gracePeriod.
+func (tunnel *SocketTunnel) Shutdown(gracePeriod time.Duration) bool {
+	deadline := time.Now().Add(gracePeriod)
+
+	tunnel.mutex.Lock()
+	tunnel.shuttingDown = true
+	for _, reserved := range tunnel.reserved {
+		reserved.cancel() // The pre-start hooks running
+	}
+	sessions := make(map[string]*session, len(tunnel.sessionsMap))
+	for sessionID, session := range tunnel.sessionsMap {
+		session.endReason = reasonShutdown
+		sessions[sessionID] = session
+	}
+	tunnel.mutex.Unlock()
+
+	tunnel.logger.Info("Shutting down tunnel", zap.Int("sessions", len(sessions)))
+	tunnel.cancelApprovals(approvalDecision{code: errCodeShuttingDown, reason: reasonShutdown})
+	for sessionID, session := range sessions {
+		session.flow.release() // The cloud may not grant credit any more
+		if session.frames != nil {
+			session.frames.notice(shutdownNotice)
+		} else {
+			session.output.write(shutdownNotice) // After the output held back
+		}
+		go func(sessionID string, term console) {
+			if err := term.Close(); err != nil {
+				tunnel.logger.Debug("Failed to kill terminal", zap.String("sessionID", sessionID), zap.Error(err))
+			}
+		}(sessionID, session.terminal)
+	}
+
+	// Sessions are released by their watcher once the terminal output is drained
+	drained := make(chan struct{})
+	go func() {
+		tunnel.sessionsWait.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		tunnel.logger.Warn("Timed out waiting for sessions to end")
+		tunnel.socket.CloseWithReason(websocket.CloseGoingAway, reasonShutdown, 0)
+		return false
+	}
+
+	if !tunnel.Status().Connected {
+		tunnel.socket.CloseWithReason(websocket.CloseGoingAway, reasonShutdown, 0) // Nothing to close
+		return true
+	}
+	if !tunnel.socket.CloseWithReason(websocket.CloseGoingAway, reasonShutdown, time.Until(deadline)) {
+		tunnel.logger.Warn("Timed out closing the connection")
+		return false
+	}
+	return true
+}
+
+// IsShuttingDown tells if Shutdown has been requested
+func (tunnel *SocketTunnel) IsShuttingDown() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.shuttingDown
+}
+
 func (tunnel *SocketTunnel) onConnected() {
 	tunnel.logger.Info("Tunnel connected", zap.String("url", tunnel.socket.getURL()))
 	tunnel.reconnectWait = 1
+	tunnel.mutex.Lock()
+	tunnel.connectedAt = time.Now()
+	sessions := make([]*session, 0, len(tunnel.sessionsMap))
+	for _, session := range tunnel.sessionsMap {
+		sessions = append(sessions, session)
+	}
+	tunnel.mutex.Unlock()
+	tunnel.metrics.tunnelConnected.set(1)
+	tunnel.metrics.reconnectBackoff.set(0)
+	tunnel.events.Publish(Event{Type: EventConnected, URL: tunnel.socket.getURL()})
+	// Output lost along with the previous connection is made good by redrawing the screens
+	for _, session := range sessions {
+		if session.frames != nil {
+			go session.frames.reset()
+		} else {
+			go session.terminal.mirror().snapshot(session.output.write)
+		}
+	}
 }
 
+// onError reports a failed or lost connection, Connect returns once the connection is gone
+// and the caller re-establishes it with HandleReConnection
 func (tunnel *SocketTunnel) onError(err error) {
 	tunnel.logger.Error("Tunnel error", zap.Error(err))
-	if !tunnel.socket.IsExited() {
-		tunnel.HandleReConnection()
+	tunnel.metrics.tunnelConnected.set(0)
+	tunnel.mutex.Lock()
+	wasConnected := !tunnel.connectedAt.IsZero()
+	tunnel.connectedAt = time.Time{}
+	tunnel.mutex.Unlock()
+	// A lost connection is reported more than once, by the close-handler and the reader
+	if wasConnected {
+		tunnel.events.Publish(Event{Type: EventDisconnected, URL: tunnel.socket.getURL(), Reason: err.Error()})
 	}
 }
 
+// SetOptions replaces the session settings, running sessions keep the settings they were started with
+func (tunnel *SocketTunnel) SetOptions(options TunnelOptions) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.options = options
+}
+
+func (tunnel *SocketTunnel) getOptions() TunnelOptions {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.options
+}
+
+// Healthy tells if the connection loop is making progress, that is serving the connection,
+// dialing or waiting to reconnect. A wedged loop stops being healthy within seconds.
+func (tunnel *SocketTunnel) Healthy() bool {
+	return tunnel.socket.healthy()
+}
+
+// SetURL changes the URL of the cloud, it is used once the tunnel reconnects
+func (tunnel *SocketTunnel) SetURL(url string) {
+	tunnel.socket.setURL(url)
+}
+
+// Status returns the state of the tunnel
+func (tunnel *SocketTunnel) Status() TunnelStatus {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	status := TunnelStatus{
+		URL:           tunnel.socket.getURL(),
+		Connected:     !tunnel.connectedAt.IsZero(),
+		ReconnectWait: tunnel.reconnectWait,
+		ShuttingDown:  tunnel.shuttingDown,
+		Sessions:      len(tunnel.sessionsMap),
+		Pending:       len(tunnel.pending),
+		SendQueue:     tunnel.socket.queue.len(),
+	}
+	if status.Connected {
+		connectedAt := tunnel.connectedAt
+		status.ConnectedSince = &connectedAt
+	}
+	return status
+}
+
+// Sessions lists the running sessions, oldest first
+func (tunnel *SocketTunnel) Sessions() []SessionInfo {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	infos := make([]SessionInfo, 0, len(tunnel.sessionsMap))
+	for sessionID, session := range tunnel.sessionsMap {
+		infos = append(infos, SessionInfo{
+			SessionID: sessionID,
+			Profile:   session.profile,
+			User:      session.user,
+			Role:      session.role,
+			Operator:  session.operator,
+			Pid:       session.terminal.Pid(),
+			Started:   session.started,
+			Age:       time.Since(session.started).Round(time.Second).String(),
+			BytesIn:   session.bytesIn.Load(),
+			BytesOut:  session.bytesOut.Load(),
+			Encrypted: session.channel != nil,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// KillSession closes a session on behalf of a local operator, the cloud is notified with an end message
+func (tunnel *SocketTunnel) KillSession(sessionID string) error {
+	tunnel.mutex.Lock()
+	session, ok := tunnel.sessionsMap[sessionID]
+	if ok {
+		session.endReason = reasonKilledLocally
+	}
+	tunnel.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no such session %q", sessionID)
+	}
+	tunnel.logger.Info("Session killed locally, killing terminal.", zap.String("sessionID", sessionID))
+	return session.terminal.Close()
+}
+
+// Reconnect drops the current connection, which then gets re-established by HandleReConnection
+func (tunnel *SocketTunnel) Reconnect() error {
+	tunnel.logger.Info("Forcing the tunnel to reconnect")
+	if !tunnel.socket.Reconnect(time.Second) {
+		return errors.New("tunnel is not connected")
+	}
+	return nil
+}
+
 func (tunnel *SocketTunnel) onMessage(message string) {
 	if ok := isValidJSON(message); !ok {
-		tunnel.logger.Error(errInvalidEnvelope, zap.String("payload", message))
+		tunnel.invalidMessage(errInvalidEnvelope, message, nil)
 		return
 	}
 
@@ -123,102 +458,482 @@ func (tunnel *SocketTunnel) onMessage(message string) {
 
 	err := decoder.Decode(&envelope)
 	if err != nil {
-		tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		tunnel.invalidMessage(errInvalidObjectFormat, message, nil)
 		return
 	}
 
+	tunnel.metrics.messages.add(1, "in", envelope.Type)
+	tunnel.metrics.bytes.add(float64(len(message)), "in", envelope.Type)
 	switch envelope.Type {
 	case typeResize:
-		resize, ok := envelope.Payload.(map[string]interface{})
+		width, height, ok := parseResize(envelope.Payload)
 		if !ok {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+			tunnel.invalidMessage(errInvalidObjectFormat, message, nil)
 			return
 		}
-
-		width, widthOK := resize["width"]
-		height, heightOK := resize["height"]
-		if !widthOK || !heightOK {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		if tunnel.refusePlaintext(envelope.SessionID, envelope.Type) {
 			return
 		}
-
-		w, ok := width.(json.Number)
-		if !ok {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		tunnel.onResize(envelope.SessionID, width, height)
+	case typeInput:
+		// Validate payload type
+		if reflect.TypeOf(envelope.Payload) == nil || reflect.TypeOf(envelope.Payload).Name() != "string" {
+			tunnel.invalidMessage(errInvalidObjectFormat, message, nil)
 			return
 		}
-
-		intWidth, err := w.Int64()
-		if err != nil || intWidth < 0 {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		if tunnel.refusePlaintext(envelope.SessionID, envelope.Type) {
 			return
 		}
-
-		h, ok := height.(json.Number)
+		tunnel.onInput(envelope.SessionID, envelope.Payload.(string))
+	case typeSealed:
+		payload, ok := envelope.Payload.(string)
 		if !ok {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+			tunnel.invalidMessage(errInvalidObjectFormat, message, nil)
 			return
 		}
-
-		intHeight, err := h.Int64()
-		if err != nil || intHeight < 0 {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		tunnel.onSealed(envelope.SessionID, payload)
+	case typeStart:
+		request, err := parseStartRequest(envelope.Payload)
+		if err != nil {
+			tunnel.invalidMessage(errInvalidObjectFormat, message, err)
+			tunnel.reject(envelope.SessionID, errCodeInvalidRequest, err.Error())
 			return
 		}
-
-		tunnel.onResize(envelope.SessionID, intWidth, intHeight)
-	case typeInput:
-		// Validate payload type
-		if reflect.TypeOf(envelope.Payload) == nil || reflect.TypeOf(envelope.Payload).Name() != "string" {
-			tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		tunnel.onStart(envelope.SessionID, request)
+	case typeCredit:
+		credit, err := parseCredit(envelope.Payload)
+		if err != nil {
+			tunnel.invalidMessage(errInvalidObjectFormat, message, err)
 			return
 		}
-		tunnel.onInput(envelope.SessionID, envelope.Payload.(string))
-	case typeStart:
-		tunnel.onStart(envelope.SessionID)
+		tunnel.onCredit(envelope.SessionID, credit)
+	case typeAttach:
+		tunnel.onAttach(envelope.SessionID)
+	case typeAck:
+		id, err := parseFrameID(envelope.Payload)
+		if err != nil {
+			tunnel.invalidMessage(errInvalidObjectFormat, message, err)
+			return
+		}
+		if tunnel.refusePlaintext(envelope.SessionID, envelope.Type) {
+			return
+		}
+		tunnel.onAck(envelope.SessionID, id)
+	case typeProfiles:
+		tunnel.onProfiles(envelope.SessionID)
 	case typeEnd:
 		tunnel.onEnd(envelope.SessionID)
 	default:
-		tunnel.logger.Error(errInvalidObjectFormat, zap.String("payload", message))
+		tunnel.invalidMessage(errInvalidObjectFormat, message, nil)
+	}
+}
+
+// parseResize validates the payload of a resize message decoded with UseNumber
+func parseResize(payload interface{}) (int64, int64, bool) {
+	resize, ok := payload.(map[string]interface{})
+	if !ok {
+		return 0, 0, false
+	}
+	width, widthOK := resize["width"].(json.Number)
+	height, heightOK := resize["height"].(json.Number)
+	if !widthOK || !heightOK {
+		return 0, 0, false
+	}
+	intWidth, err := width.Int64()
+	if err != nil || intWidth < 0 {
+		return 0, 0, false
+	}
+	intHeight, err := height.Int64()
+	if err != nil || intHeight < 0 {
+		return 0, 0, false
+	}
+	return intWidth, intHeight, true
+}
+
+// invalidMessage logs and counts a message that could not be parsed
+func (tunnel *SocketTunnel) invalidMessage(reason string, message string, err error) {
+	tunnel.logger.Error(reason, zap.String("payload", message), zap.Error(err))
+	tunnel.metrics.parseErrors.add(1, reason)
+}
+
+func (tunnel *SocketTunnel) onStart(sessionID string, request startRequest) {
+	if tunnel.IsShuttingDown() {
+		tunnel.logger.Warn("Rejecting new session, device is shutting down", zap.String("sessionID", sessionID))
+		tunnel.reject(sessionID, errCodeShuttingDown, reasonShutdown)
+		return
+	}
+	if tunnel.isDuplicate(sessionID) {
+		tunnel.refuseDuplicate(sessionID)
+		return
+	}
+	options := tunnel.getOptions()
+	profileName := request.profile
+	if profileName == "" {
+		profileName = options.DefaultProfile
+	}
+	if !tunnel.authorize(sessionID, options, profileName, &request) {
+		return
 	}
+	profile, ok := options.Profiles[profileName]
+	if !ok {
+		tunnel.logger.Warn("Rejecting new session, unknown profile", zap.String("sessionID", sessionID), zap.String("profile", profileName))
+		tunnel.reject(sessionID, errCodeUnknownProfile, fmt.Sprintf("unknown profile %q", profileName))
+		return
+	}
+	if !profile.allowsRole(request.role) {
+		tunnel.logger.Warn("Rejecting new session, role not allowed", zap.String("sessionID", sessionID), zap.String("profile", profileName), zap.String("role", request.role))
+		tunnel.reject(sessionID, errCodeForbidden, fmt.Sprintf("role %q may not start profile %q", request.role, profileName))
+		return
+	}
+	if !tunnel.acceptE2E(sessionID, options, &request) {
+		return
+	}
+	if options.Approval.requires(profileName) {
+		tunnel.requestApproval(sessionID, options, profileName, request)
+		return
+	}
+	tunnel.startSession(sessionID, options, profileName, request)
 }
 
-func (tunnel *SocketTunnel) onStart(sessionID string) {
-	// Spawn a new shell
-	term, err := NewTerminal(tunnel.command, tunnel.logger,
-		func(output string) { // onData
-			if tunnel.hasSession(sessionID) {
-				tunnel.send(sessionID, output)
-				tunnel.logger.Debug("Received response from terminal", zap.String("output", output), zap.String("sessionID", sessionID))
+// startSession spawns the shell of a session once it has been accepted. A pre-start hook
+// runs in the background, so that other sessions are not held up meanwhile.
+func (tunnel *SocketTunnel) startSession(sessionID string, options TunnelOptions, profileName string, request startRequest) {
+	ctx, ok := tunnel.reserve(sessionID, profileName, options.Profiles[profileName])
+	if !ok {
+		return
+	}
+	if options.PreStartHook != nil {
+		go tunnel.launchSession(ctx, sessionID, options, profileName, request)
+	} else {
+		tunnel.launchSession(ctx, sessionID, options, profileName, request)
+	}
+}
+
+// launchSession runs the pre-start hook of a reserved session and spawns its shell
+func (tunnel *SocketTunnel) launchSession(ctx context.Context, sessionID string, options TunnelOptions, profileName string, request startRequest) {
+	profile := options.Profiles[profileName]
+	spec := profile.sessionSpec(request)
+	registered := false
+	defer func() {
+		if !registered {
+			tunnel.release(sessionID)
+		}
+	}()
+	hookEvent := Event{
+		SessionID: sessionID,
+		Profile:   profileName,
+		User:      spec.effectiveUser(),
+		Role:      request.role,
+		Operator:  request.operator,
+		Width:     spec.Width,
+		Height:    spec.Height,
+	}
+	if !tunnel.preStart(ctx, options, hookEvent) {
+		return
+	}
+	// Pair the pre-start hook with a post-end one, even if the shell fails to start
+	started := false
+	if options.PreStartHook != nil {
+		defer func() {
+			if !started {
+				if hookEvent.Reason == "" {
+					hookEvent.Reason = reasonStartFailed
+				}
+				go tunnel.postEnd(options, hookEvent)
 			}
-		}, func() { // onClose
-			tunnel.clearSession(sessionID)
-			tunnel.logger.Info("Terminal exited, notifying cloud.", zap.String("sessionID", sessionID))
-			tunnel.end(sessionID)
-		})
+		}()
+	}
+	if ctx.Err() != nil { // While the hook ran
+		if tunnel.IsShuttingDown() {
+			hookEvent.Reason = reasonShutdown
+			tunnel.reject(sessionID, errCodeShuttingDown, reasonShutdown)
+		} else {
+			hookEvent.Reason = reasonCancelled
+			tunnel.end(sessionID, reasonCancelled)
+		}
+		return
+	}
+
+	var rec *recorder
+	if profile.Recording && options.RecordingDir != "" {
+		var err error
+		if rec, err = newRecorder(options.RecordingDir, sessionID, spec); err != nil {
+			tunnel.logger.Error("Failed to start session recording", zap.String("sessionID", sessionID), zap.Error(err))
+			tunnel.reject(sessionID, errCodeStartFailed, "failed to start session recording")
+			return
+		}
+	}
+	var flow *flowControl
+	if request.window > 0 && !(request.sync && options.SyncInterval > 0) { // Frames are paced by their acknowledgements
+		flow = newFlowControl(request.window)
+	}
+	coalescer := newCoalescer(options.Coalescing, func(output string) { tunnel.sendFlow(sessionID, flow, output) })
+	var sessionLimiter *rateLimiter
+	if options.RateLimit > 0 {
+		sessionLimiter = newRateLimiter(options.RateLimit)
+	}
+	tunnel.mutex.Lock()
+	globalLimiter := tunnel.outputLimiter(options.GlobalRateLimit)
+	tunnel.mutex.Unlock()
+	throttle := newThrottle(sessionLimiter, globalLimiter, coalescer.write,
+		func(dropped int64) { tunnel.onThrottled(sessionID, dropped) })
+	// The terminal is not heard of until the session is registered, so that its output
+	// follows the answers to the start message and its end is not of an unknown session
+	registeredSession := make(chan struct{})
+	onData := func(output string) {
+		<-registeredSession
+		if session := tunnel.getSession(sessionID); session != nil {
+			session.bytesOut.Add(int64(len(output)))
+			if rec != nil {
+				rec.event("o", output)
+			}
+			if session.frames != nil {
+				session.frames.changed()
+			} else {
+				throttle.write(output)
+			}
+			tunnel.logger.Debug("Received response from terminal", zap.String("output", output), zap.String("sessionID", sessionID))
+		}
+	}
+	onClose := func(err error) {
+		<-registeredSession
+		if err != nil {
+			tunnel.logger.Warn("Failed to read from terminal", zap.String("sessionID", sessionID), zap.Error(err))
+			tunnel.metrics.ptyErrors.add(1, "read")
+		}
+		throttle.close()
+		coalescer.close() // Before the end message, while an encrypted session can still be sealed
+		session := tunnel.clearSession(sessionID)
+		if session == nil {
+			return
+		}
+		if session.frames != nil {
+			session.frames.close()
+		}
+		tunnel.metrics.sessionDuration.observe(time.Since(session.started).Seconds())
+		if session.recorder != nil {
+			session.recorder.close()
+		}
+		tunnel.logger.Info("Terminal exited, notifying cloud.", zap.String("sessionID", sessionID))
+		tunnel.end(sessionID, session.endReason)
+		reason := session.endReason
+		if reason == "" {
+			reason = reasonExited
+		}
+		ended := Event{
+			Type:      EventSessionEnded,
+			SessionID: sessionID,
+			Profile:   session.profile,
+			User:      session.user,
+			Role:      session.role,
+			Operator:  session.operator,
+			Reason:    reason,
+			Duration:  time.Since(session.started).Seconds(),
+			BytesIn:   session.bytesIn.Load(),
+			BytesOut:  session.bytesOut.Load(),
+		}
+		tunnel.events.Publish(ended)
+		tunnel.postEnd(options, ended)
+		tunnel.sessionsWait.Done()
+	}
+	// Spawn a new shell, or the prompt of a restricted session
+	var term console
+	var err error
+	if profile.Policy != nil {
+		term, err = NewRestrictedShell(spec, *profile.Policy, tunnel.logger.With(zap.String("sessionID", sessionID)), onData, onClose,
+			func(command string, reason string) { tunnel.violation(sessionID, command, reason) })
+	} else {
+		var terminal Terminal
+		terminal, err = NewTerminal(spec, tunnel.logger, onData, onClose)
+		term = &terminal
+	}
+	if err == nil && flow != nil {
+		term = flowConsole{console: term, flow: flow}
+	}
 	if err != nil {
 		tunnel.logger.Error("Failed to initialize terminal", zap.Error(err))
+		if rec != nil {
+			rec.close()
+		}
+		tunnel.reject(sessionID, errCodeStartFailed, "failed to start terminal: "+err.Error())
 		return
 	}
-	tunnel.setSession(sessionID, &term)
-	tunnel.logger.Info("New session, terminal created.", zap.String("sessionID", sessionID))
+	session := &session{
+		terminal: term,
+		profile:  profileName,
+		user:     spec.effectiveUser(),
+		role:     request.role,
+		operator: request.operator,
+		recorder: rec,
+		started:  time.Now(),
+		channel:  request.channel,
+		output:   coalescer,
+		flow:     flow,
+		throttle: throttle,
+		frames:   tunnel.newFrames(sessionID, options, request, term),
+	}
+	tunnel.mutex.Lock()
+	// The session may have been ended while the shell was spawned
+	if tunnel.shuttingDown {
+		session.endReason = reasonShutdown
+	} else if ctx.Err() != nil {
+		session.endReason = reasonCancelled
+	}
+	tunnel.reserved[sessionID].cancel()
+	delete(tunnel.reserved, sessionID)
+	tunnel.sessionsMap[sessionID] = session
+	tunnel.mutex.Unlock()
+	registered = true
+	if request.answer != nil {
+		tunnel.sendEnvelope(envelope{Type: typeE2E, SessionID: sessionID, Payload: request.answer})
+	}
+	tunnel.answerMode(sessionID, request, session.frames)
+	close(registeredSession)
+	if session.endReason != "" {
+		go term.Close()
+	}
+
+	tunnel.metrics.sessions.add(1, profileName)
+	if profile.MaxDuration > 0 {
+		time.AfterFunc(profile.MaxDuration, func() {
+			tunnel.mutex.Lock()
+			session, ok := tunnel.sessionsMap[sessionID]
+			if ok && session.terminal == term {
+				session.endReason = reasonMaxDuration
+			}
+			tunnel.mutex.Unlock()
+			if ok && session.terminal == term {
+				tunnel.logger.Info("Session time limit reached, killing terminal.", zap.String("sessionID", sessionID))
+				term.Close()
+			}
+		})
+	}
+	started = true
+	tunnel.logger.Info("New session, terminal created.", zap.String("sessionID", sessionID), zap.String("profile", profileName))
+	tunnel.events.Publish(Event{
+		Type:      EventSessionStarted,
+		SessionID: sessionID,
+		Profile:   profileName,
+		User:      session.user,
+		Role:      request.role,
+		Operator:  request.operator,
+		Pid:       term.Pid(),
+		Width:     spec.Width,
+		Height:    spec.Height,
+	})
+}
+
+// reserve holds the ID of a session about to start, counting it against the limit of its profile
+// and making Shutdown wait for it. It returns false if the session was rejected.
+func (tunnel *SocketTunnel) reserve(sessionID string, profileName string, profile Profile) (context.Context, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel.mutex.Lock()
+	shuttingDown := tunnel.shuttingDown
+	_, running := tunnel.sessionsMap[sessionID]
+	_, starting := tunnel.reserved[sessionID]
+	limited := profile.MaxSessions > 0 && tunnel.countSessions(profileName) >= profile.MaxSessions
+	reserved := !shuttingDown && !running && !starting && !limited
+	if reserved {
+		tunnel.reserved[sessionID] = &startup{profile: profileName, cancel: cancel}
+		tunnel.sessionsWait.Add(1)
+	} else {
+		cancel()
+	}
+	tunnel.mutex.Unlock()
+	switch {
+	case shuttingDown: // While waiting for approval
+		tunnel.reject(sessionID, errCodeShuttingDown, reasonShutdown)
+	case running || starting:
+		tunnel.refuseDuplicate(sessionID)
+	case limited:
+		tunnel.logger.Warn("Rejecting new session, profile limit reached", zap.String("sessionID", sessionID), zap.String("profile", profileName))
+		tunnel.reject(sessionID, errCodeLimitReached, fmt.Sprintf("profile %q allows at most %d sessions", profileName, profile.MaxSessions))
+	}
+	return ctx, reserved
+}
+
+// release gives up the ID of a session that failed to start
+func (tunnel *SocketTunnel) release(sessionID string) {
+	tunnel.mutex.Lock()
+	tunnel.reserved[sessionID].cancel()
+	delete(tunnel.reserved, sessionID)
+	tunnel.mutex.Unlock()
+	tunnel.sessionsWait.Done()
+}
+
+// cancelStart aborts the start of a session, returning false if it does not start
+func (tunnel *SocketTunnel) cancelStart(sessionID string) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if reserved, ok := tunnel.reserved[sessionID]; ok {
+		reserved.cancel()
+		return true
+	}
+	return false
+}
+
+// isDuplicate tells if a session runs or starts already with the ID
+func (tunnel *SocketTunnel) isDuplicate(sessionID string) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	_, running := tunnel.sessionsMap[sessionID]
+	_, starting := tunnel.reserved[sessionID]
+	return running || starting
+}
+
+// refuseDuplicate answers a start message with the ID of a session running already with an error,
+// without the end message that would tell the cloud the running session ended
+func (tunnel *SocketTunnel) refuseDuplicate(sessionID string) {
+	tunnel.logger.Warn("Rejecting new session, the session exists already", zap.String("sessionID", sessionID))
+	message := fmt.Sprintf("session %q exists already", sessionID)
+	tunnel.sendEnvelope(envelope{
+		Type:      typeError,
+		Payload:   errorPayload{Code: errCodeSessionExists, Message: message},
+		SessionID: sessionID,
+	})
+	tunnel.events.Publish(Event{Type: EventError, SessionID: sessionID, Code: errCodeSessionExists, Reason: message})
+}
+
+// onProfiles answers a profiles query with the profiles available on the device
+func (tunnel *SocketTunnel) onProfiles(sessionID string) {
+	envelope := envelope{
+		Type:      typeProfiles,
+		SessionID: sessionID,
+		Payload:   tunnel.getOptions().profileInfos(),
+	}
+	tunnel.sendEnvelope(envelope)
 }
 
 func (tunnel *SocketTunnel) onEnd(sessionID string) {
-	if tunnel.hasSession(sessionID) {
+	if tunnel.decide(sessionID, approvalDecision{reason: reasonCancelled}) == nil {
+		tunnel.logger.Info("Session ended while waiting for approval", zap.String("sessionID", sessionID))
+		return
+	}
+	if tunnel.cancelStart(sessionID) {
+		tunnel.logger.Info("Session ended while starting", zap.String("sessionID", sessionID))
+		return
+	}
+	if session := tunnel.getSession(sessionID); session != nil {
 		tunnel.logger.Info("Session ended, killing terminal.", zap.String("sessionID", sessionID))
-		err := tunnel.getSession(sessionID).Close()
-		if err != nil {
-			tunnel.logger.Error("Failed to kill terminal", zap.Error(err))
-		}
+		// Killing escalates over seconds, the other sessions are not held up meanwhile
+		go func() {
+			if err := session.terminal.Close(); err != nil {
+				tunnel.logger.Error("Failed to kill terminal", zap.Error(err))
+			}
+		}()
 	}
 }
 
 func (tunnel *SocketTunnel) onInput(sessionID string, payload string) {
-	if tunnel.hasSession(sessionID) {
-		err := tunnel.getSession(sessionID).Write(payload)
+	if session := tunnel.getSession(sessionID); session != nil {
+		session.bytesIn.Add(int64(len(payload)))
+		if isInterrupt(payload) {
+			session.throttle.interrupt() // So that the user sees what follows, e.g. the prompt
+		}
+		err := session.terminal.Write(payload)
 		if err != nil {
 			tunnel.logger.Error("Failed to write on terminal", zap.Error(err))
+			tunnel.metrics.ptyErrors.add(1, "write")
 		}
 	}
 }
@@ -226,21 +941,39 @@ func (tunnel *SocketTunnel) onInput(sessionID string, payload string) {
 func (tunnel *SocketTunnel) onResize(sessionID string, width int64, height int64) {
 	if tunnel.hasSession(sessionID) {
 		tunnel.logger.Info("Resize terminal", zap.String("sessionID", sessionID), zap.Int64("width", width), zap.Int64("height", height))
-		err := tunnel.getSession(sessionID).Resize(uint16(width), uint16(height))
+		session := tunnel.getSession(sessionID)
+		err := session.terminal.Resize(uint16(width), uint16(height))
 		if err != nil {
 			tunnel.logger.Error("Failed to resize terminal", zap.Error(err))
+			tunnel.metrics.ptyErrors.add(1, "resize")
 		}
+		if session.frames != nil {
+			session.frames.changed()
+		}
+		if session.recorder != nil {
+			session.recorder.event("r", fmt.Sprintf("%dx%d", width, height))
+		}
+		tunnel.events.Publish(Event{Type: EventResize, SessionID: sessionID, Profile: session.profile, Width: uint16(width), Height: uint16(height)})
 	}
 }
 
 // HandleReConnection re-establishes the connection after an issue after a delay (tunnel.reconnectWait)
 func (tunnel *SocketTunnel) HandleReConnection() {
+	if tunnel.IsShuttingDown() {
+		return
+	}
 	tunnel.logger.Error("Tunnel is attempting to establish connection in " + fmt.Sprint(tunnel.reconnectWait) + " seconds...")
+	tunnel.metrics.reconnectAttempts.add(1)
+	tunnel.metrics.reconnectBackoff.set(float64(tunnel.reconnectWait))
+	tunnel.socket.expectProgress(time.Duration(tunnel.reconnectWait)*time.Second + loopStallTimeout)
 	time.Sleep(time.Duration(tunnel.reconnectWait) * time.Second)
 
 	if tunnel.reconnectWait < 32 {
 		tunnel.reconnectWait *= 2
 	}
+	if tunnel.IsShuttingDown() {
+		return
+	}
 	tunnel.Connect()
 }
 
@@ -251,43 +984,91 @@ func (tunnel *SocketTunnel) hasSession(sessionID string) bool {
 	return ok
 }
 
-func (tunnel *SocketTunnel) getSession(sessionID string) *Terminal {
+func (tunnel *SocketTunnel) getSession(sessionID string) *session {
 	tunnel.mutex.Lock()
 	defer tunnel.mutex.Unlock()
 	session := tunnel.sessionsMap[sessionID]
 	return session
 }
 
-func (tunnel *SocketTunnel) setSession(sessionID string, terminal *Terminal) {
-	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
-	tunnel.sessionsMap[sessionID] = terminal
+// countSessions counts the running and starting sessions of a profile, the caller holds the mutex
+func (tunnel *SocketTunnel) countSessions(profile string) int {
+	count := 0
+	for _, session := range tunnel.sessionsMap {
+		if session.profile == profile {
+			count++
+		}
+	}
+	for _, reserved := range tunnel.reserved {
+		if reserved.profile == profile {
+			count++
+		}
+	}
+	return count
 }
 
-func (tunnel *SocketTunnel) clearSession(sessionID string) {
+// clearSession removes the session and returns it, or nil if it was already removed
+func (tunnel *SocketTunnel) clearSession(sessionID string) *session {
 	tunnel.mutex.Lock()
 	defer tunnel.mutex.Unlock()
+	session, ok := tunnel.sessionsMap[sessionID]
+	if !ok {
+		return nil
+	}
 	delete(tunnel.sessionsMap, sessionID)
+	return session
 }
 
-// Send will send data in JSON format
+// Send will send data in JSON format, sealed for an encrypted session
 func (tunnel *SocketTunnel) send(sessionID string, payload string) {
 	envelope := envelope{
 		Type:      typeOutput,
 		Payload:   payload,
 		SessionID: sessionID,
 	}
-	json, _ := json.Marshal(envelope)
-	tunnel.socket.Send(json)
+	if session := tunnel.getSession(sessionID); session != nil && session.channel != nil {
+		envelope = session.channel.sealEnvelope(envelope)
+	}
+	tunnel.sendEnvelope(envelope)
 }
 
-// End is used to send an end-session message in JSON format
-func (tunnel *SocketTunnel) end(sessionID string) {
+// End is used to send an end-session message in JSON format, reason is optional
+func (tunnel *SocketTunnel) end(sessionID string, reason string) {
 	envelope := envelope{
 		Type:      typeEnd,
 		Payload:   sessionID,
 		SessionID: sessionID,
+		Reason:    reason,
+	}
+	tunnel.sendEnvelope(envelope)
+}
+
+// reject is used to refuse a session with an error message followed by an end-session message
+func (tunnel *SocketTunnel) reject(sessionID string, code string, message string) {
+	envelope := envelope{
+		Type:      typeError,
+		Payload:   errorPayload{Code: code, Message: message},
+		SessionID: sessionID,
 	}
-	json, _ := json.Marshal(envelope)
-	tunnel.socket.Send(json)
+	tunnel.sendEnvelope(envelope)
+	tunnel.end(sessionID, message)
+	tunnel.events.Publish(Event{Type: EventError, SessionID: sessionID, Code: code, Reason: message})
+}
+
+// violation reports a command-line refused by the policy of a restricted session
+func (tunnel *SocketTunnel) violation(sessionID string, command string, reason string) {
+	tunnel.sendEnvelope(envelope{
+		Type:      typeError,
+		Payload:   errorPayload{Code: errCodePolicy, Message: reason},
+		SessionID: sessionID,
+	})
+	tunnel.events.Publish(Event{Type: EventError, SessionID: sessionID, Code: errCodePolicy, Reason: fmt.Sprintf("%s: %s", command, reason)})
+}
+
+// sendEnvelope serializes and queues a message for the cloud
+func (tunnel *SocketTunnel) sendEnvelope(envelope envelope) {
+	message, _ := json.Marshal(envelope)
+	tunnel.metrics.messages.add(1, "out", envelope.Type)
+	tunnel.metrics.bytes.add(float64(len(message)), "out", envelope.Type)
+	tunnel.socket.sendFor(envelope.SessionID, message)
 }
@@ -0,0 +1,266 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// decodePayload decodes a start payload the way onMessage does
+func decodePayload(t *testing.T, payload string) interface{} {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// newTestTunnel returns a tunnel whose outgoing messages are delivered on the returned channel
+func newTestTunnel(options TunnelOptions) (*SocketTunnel, chan envelope) {
+	tunnel := NewTunnel("ws://localhost", options, zap.NewNop())
+	messages := make(chan envelope, 16)
+	go func() {
+		for range tunnel.socket.queue.ready {
+			for message, ok := tunnel.socket.queue.pop(); ok; message, ok = tunnel.socket.queue.pop() {
+				var envelope envelope
+				json.Unmarshal(message, &envelope)
+				messages <- envelope
+			}
+		}
+	}()
+	return &tunnel, messages
+}
+
+// nextMessage waits for the next message sent by the tunnel
+func nextMessage(t *testing.T, messages chan envelope) envelope {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout, tunnel did not send a message")
+	}
+	return envelope{}
+}
+
+func TestStartPayload(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/bash")
+	spec.Env = map[string]string{"TERM": "xterm"}
+
+	// Payload-less start keeps the configured spec
+	for _, payload := range []string{`null`, `"session-id"`} {
+		request, err := parseStartRequest(decodePayload(t, payload))
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+		started := request.apply(spec)
+		if request.profile != "" || started.Width != 0 || started.Height != 0 || started.Env["TERM"] != "xterm" {
+			t.Fatalf("%s: unexpected spec %+v", payload, started)
+		}
+	}
+
+	request, err := parseStartRequest(decodePayload(t, `{"profile": "operator", "role": "admin", "width": 120, "height": 40, "pixelWidth": 960, "pixelHeight": 640, "term": "vt220", "env": {"FOO": "bar"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.profile != "operator" || request.role != "admin" {
+		t.Fatalf("Unexpected request %+v", request)
+	}
+	started := request.apply(spec)
+	if started.Width != 120 || started.Height != 40 || started.PixelWidth != 960 || started.PixelHeight != 640 {
+		t.Fatalf("Unexpected size %+v", started)
+	}
+	if started.Env["TERM"] != "vt220" || started.Env["FOO"] != "bar" {
+		t.Fatalf("Unexpected environment %v", started.Env)
+	}
+	if spec.Env["TERM"] != "xterm" || len(spec.Env) != 1 {
+		t.Fatalf("Configured environment was modified: %v", spec.Env)
+	}
+
+	// The allow list applies to the variables of the request too
+	allowing := spec
+	allowing.Env = map[string]string{"TERM": "xterm", "EDITOR": "vi"}
+	allowing.EnvAllow = []string{"TERM", "LC_*"}
+	request, err = parseStartRequest(decodePayload(t, `{"term": "vt220", "env": {"FOO": "bar", "LC_ALL": "C", "EDITOR": "nano"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	environ := request.apply(allowing).environ([]string{"PATH=/bin", "FOO=inherited"})
+	if expected := []string{"EDITOR=vi", "LC_ALL=C", "TERM=vt220"}; strings.Join(environ, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %q, got %q", expected, environ)
+	}
+
+	for _, payload := range []string{
+		`{"width": 120}`,
+		`{"width": -1, "height": 40}`,
+		`{"width": 70000, "height": 40}`,
+		`{"width": "120", "height": 40}`,
+		`{"profile": 1}`,
+		`{"mode": "fast"}`,
+		`{"unknown": true}`,
+	} {
+		if _, err := parseStartRequest(decodePayload(t, payload)); err == nil {
+			t.Errorf("%s: expected an error", payload)
+		}
+	}
+}
+
+func TestStartProfiles(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/bash")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles: map[string]Profile{
+			"maintenance": {Spec: spec, AllowedRoles: []string{"admin"}},
+			"logs":        {Spec: spec, Recording: true},
+		},
+		DefaultProfile: "logs",
+	})
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": {"profile": "unknown"}}`)
+	if message := nextMessage(t, messages); message.Type != typeError || message.SessionID != "s1" ||
+		message.Payload.(map[string]interface{})["code"] != errCodeUnknownProfile {
+		t.Fatalf("Expected an unknown-profile error, got %+v", message)
+	}
+	if message := nextMessage(t, messages); message.Type != typeEnd || message.SessionID != "s1" {
+		t.Fatalf("Expected an end message, got %+v", message)
+	}
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s2", "payload": {"profile": "maintenance", "role": "operator"}}`)
+	if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeForbidden {
+		t.Fatalf("Expected a forbidden error, got %+v", message)
+	}
+	nextMessage(t, messages)
+
+	tunnel.onMessage(`{"type": "start", "sessionID": "s3", "payload": {"profile": "maintenance", "role": "admin"}}`)
+	if !tunnel.hasSession("s3") || tunnel.getSession("s3").profile != "maintenance" {
+		t.Fatal("Expected session s3 to run profile maintenance")
+	}
+	tunnel.onEnd("s3")
+
+	tunnel.onMessage(`{"type": "profiles", "sessionID": "", "payload": null}`)
+	for {
+		message := nextMessage(t, messages)
+		if message.Type != typeProfiles {
+			continue
+		}
+		profiles := message.Payload.([]interface{})
+		if len(profiles) != 2 {
+			t.Fatalf("Expected 2 profiles, got %v", profiles)
+		}
+		logs := profiles[0].(map[string]interface{})
+		if logs["name"] != "logs" || logs["default"] != true || logs["recording"] != true {
+			t.Fatalf("Unexpected profile %v", logs)
+		}
+		return
+	}
+}
+
+func TestDuplicateStart(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/cat")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	term := tunnel.getSession("s1").terminal
+
+	// The session running is kept, the cloud is not told it ended
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	if message := nextMessage(t, messages); message.Type != typeError || message.Payload.(map[string]interface{})["code"] != errCodeSessionExists {
+		t.Fatalf("Expected a session-exists error, got %+v", message)
+	}
+	if tunnel.getSession("s1").terminal != term {
+		t.Fatal("Expected the running session kept")
+	}
+	tunnel.onMessage(`{"type": "input", "sessionID": "s1", "payload": "hello\n"}`)
+	if output, ended := collectOutput(t, messages, "s1", 300*time.Millisecond); ended || !strings.Contains(output, "hello") {
+		t.Fatalf("Expected the session still running, got %q", output)
+	}
+
+	// Shutdown waits for the one session only
+	ended := make(chan bool)
+	go func() { ended <- tunnel.Shutdown(5 * time.Second) }()
+	if _, ok := collectOutput(t, messages, "s1", 5*time.Second); !ok {
+		t.Fatal("Expected the session ended")
+	}
+	if !<-ended {
+		t.Fatal("Expected the shutdown to complete")
+	}
+}
+
+func TestEndStubbornShell(t *testing.T) {
+	spec, _ := NewSessionSpec(`/bin/sh -c "trap '' HUP TERM; while true; do sleep 1; done"`)
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	time.Sleep(100 * time.Millisecond) // Until the traps are set
+
+	// The messages of other sessions are not held up while the shell is killed
+	begin := time.Now()
+	tunnel.onMessage(`{"type": "end", "sessionID": "s1", "payload": null}`)
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected the end handled at once, took %v", elapsed)
+	}
+	if _, ended := collectOutput(t, messages, "s1", 10*time.Second); !ended {
+		t.Fatal("Expected the shell killed in the end")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	spec, _ := NewSessionSpec("/bin/bash")
+	tunnel, messages := newTestTunnel(TunnelOptions{
+		Profiles:       map[string]Profile{"default": {Spec: spec}},
+		DefaultProfile: "default",
+	})
+	tunnel.onMessage(`not json`)
+	tunnel.onMessage(`{"type": "bogus", "sessionID": "s1", "payload": null}`)
+	tunnel.onMessage(`{"type": "start", "sessionID": "s1", "payload": null}`)
+	nextMessage(t, messages) // First output of the shell
+	tunnel.onEnd("s1")
+	for nextMessage(t, messages).Type != typeEnd {
+	}
+
+	recorder := httptest.NewRecorder()
+	tunnel.Metrics().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE pe_terminal_messages_total counter\n",
+		`pe_terminal_messages_total{direction="in",type="start"} 1` + "\n",
+		`pe_terminal_messages_total{direction="out",type="end"} 1` + "\n",
+		`pe_terminal_message_parse_errors_total{reason="Data could not be parsed as JSON"} 1` + "\n",
+		`pe_terminal_message_parse_errors_total{reason="Object format invalid"} 1` + "\n",
+		`pe_terminal_sessions_total{profile="default"} 1` + "\n",
+		"pe_terminal_sessions_active 0\n",
+		"pe_terminal_session_duration_seconds_count 1\n",
+		`pe_terminal_session_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"pe_terminal_tunnel_connected 0\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the configuration of pe-terminal. Defaults, the config-file,
+// PE_TERMINAL_* environment variables and command-line flags are layered in that order.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PelionIoT/pe-terminal/components"
+)
+
+// Config holds the configuration items, fields missing everywhere are nil
+type Config struct {
+	CloudURL            *string                      `json:"cloud,omitempty"`
+	Command             *string                      `json:"command,omitempty"`
+	LogLevel            *string                      `json:"logLevel,omitempty"`
+	ShutdownGracePeriod *int                         `json:"shutdownGracePeriod,omitempty"` // In seconds
+	KillSignals         []string                     `json:"killSignals,omitempty"`
+	KillTimeout         *int                         `json:"killTimeout,omitempty"` // In seconds, per signal
+	CgroupRoot          *string                      `json:"cgroupRoot,omitempty"`
+	Args                []string                     `json:"args,omitempty"`
+	Env                 map[string]string            `json:"env,omitempty"`
+	EnvAllow            []string                     `json:"envAllow,omitempty"`
+	EnvDeny             []string                     `json:"envDeny,omitempty"`
+	Cwd                 *string                      `json:"cwd,omitempty"`
+	Term                *string                      `json:"term,omitempty"`
+	Lang                *string                      `json:"lang,omitempty"`
+	Columns             *uint16                      `json:"columns,omitempty"`
+	Rows                *uint16                      `json:"rows,omitempty"`
+	User                *string                      `json:"user,omitempty"`
+	Recording           *bool                        `json:"recording,omitempty"`
+	RecordingDir        *string                      `json:"recordingDir,omitempty"`
+	Limits              *LimitsConfig                `json:"limits,omitempty"`
+	Profiles            map[string]ProfileConfig     `json:"profiles,omitempty"`
+	DefaultProfile      *string                      `json:"defaultProfile,omitempty"`
+	MetricsAddress      *string                      `json:"metricsAddress,omitempty"`  // e.g. 127.0.0.1:9464, disabled when empty
+	AdminSocket         *string                      `json:"adminSocket,omitempty"`     // Unix socket of the admin API, disabled when empty
+	AdminSocketMode     *string                      `json:"adminSocketMode,omitempty"` // Octal, defaults to 0600
+	AdminSocketGroup    *string                      `json:"adminSocketGroup,omitempty"`
+	WatchConfig         *bool                        `json:"watchConfig,omitempty"` // Reload on changes, besides on SIGHUP
+	NotifyReady         *string                      `json:"notifyReady,omitempty"` // When to report readiness to systemd, see NotifyReadyModes
+	Events              *EventsConfig                `json:"events,omitempty"`
+	SessionHooks        *SessionHooksConfig          `json:"sessionHooks,omitempty"`
+	Approval            *ApprovalConfig              `json:"approval,omitempty"`
+	Sandbox             *SandboxConfig               `json:"sandbox,omitempty"`
+	Confinement         *string                      `json:"confinement,omitempty"`  // Name of a built-in or custom confinement, none when empty
+	Confinements        map[string]ConfinementConfig `json:"confinements,omitempty"` // Custom confinements by name
+	E2E                 *E2EConfig                   `json:"e2e,omitempty"`
+	Authorization       *AuthorizationConfig         `json:"authorization,omitempty"`
+	Output              *OutputConfig                `json:"output,omitempty"`
+}
+
+// ProfileConfig holds a named session profile, missing fields are taken from the top-level config
+type ProfileConfig struct {
+	Description  *string           `json:"description,omitempty"`
+	Command      *string           `json:"command,omitempty"`
+	Args         []string          `json:"args,omitempty"`
+	User         *string           `json:"user,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Cwd          *string           `json:"cwd,omitempty"`
+	Recording    *bool             `json:"recording,omitempty"`
+	AllowedRoles []string          `json:"allowedRoles,omitempty"`
+	Limits       *LimitsConfig     `json:"limits,omitempty"`
+	Restricted   *RestrictedConfig `json:"restricted,omitempty"`  // Replaces the shell by a prompt running allowed commands only
+	Sandbox      *SandboxConfig    `json:"sandbox,omitempty"`     // Replaces the top-level sandbox as a whole
+	Confinement  *string           `json:"confinement,omitempty"` // Replaces the top-level confinement, none when empty
+}
+
+// RestrictedConfig holds the command policy of a restricted profile
+type RestrictedConfig struct {
+	Commands map[string]CommandConfig `json:"commands,omitempty"` // By the name typed at the prompt
+	Deny     []string                 `json:"deny,omitempty"`     // Regular expressions denying matching command-lines
+}
+
+// CommandConfig holds a command allowed in a restricted profile
+type CommandConfig struct {
+	Path *string `json:"path,omitempty"` // Absolute path of the binary
+	Args *string `json:"args,omitempty"` // Regular expression the arguments, joined by spaces, must match
+}
+
+// LimitsConfig holds the session limits of a profile
+type LimitsConfig struct {
+	MaxSessions *int `json:"maxSessions,omitempty"`
+	MaxDuration *int `json:"maxDuration,omitempty"` // In seconds
+}
+
+// EventsConfig holds the sinks of the session events, every sink is optional
+type EventsConfig struct {
+	Socket      *string                  `json:"socket,omitempty"`     // Unix socket streaming events as JSON lines
+	SocketMode  *string                  `json:"socketMode,omitempty"` // Octal, defaults to 0600
+	SocketGroup *string                  `json:"socketGroup,omitempty"`
+	Webhooks    map[string]WebhookConfig `json:"webhooks,omitempty"`
+	Hooks       map[string]HookConfig    `json:"hooks,omitempty"`
+}
+
+// WebhookConfig holds a URL events are posted to
+type WebhookConfig struct {
+	URL     *string  `json:"url,omitempty"`
+	Events  []string `json:"events,omitempty"`  // Types of events to post, all when empty
+	Timeout *int     `json:"timeout,omitempty"` // In seconds
+}
+
+// HookConfig holds a command run for events
+type HookConfig struct {
+	Command *string  `json:"command,omitempty"`
+	Events  []string `json:"events,omitempty"`  // Types of events to run for, all when empty
+	Timeout *int     `json:"timeout,omitempty"` // In seconds
+}
+
+// SessionHooksConfig holds the commands run around every session
+type SessionHooksConfig struct {
+	PreStart *SessionHookConfig `json:"preStart,omitempty"` // Before the shell is spawned
+	PostEnd  *SessionHookConfig `json:"postEnd,omitempty"`  // Once the shell exited
+}
+
+// SessionHookConfig holds a lifecycle hook
+type SessionHookConfig struct {
+	Command *string `json:"command,omitempty"`
+	Timeout *int    `json:"timeout,omitempty"` // In seconds
+	Veto    *bool   `json:"veto,omitempty"`    // Reject the session if the pre-start hook fails
+}
+
+// ApprovalConfig holds the approval mode, sessions then wait for a local operator. Besides
+// through the admin socket, sessions are approved by the command or the flag-files in dir.
+type ApprovalConfig struct {
+	Enabled  *bool    `json:"enabled,omitempty"`
+	Timeout  *int     `json:"timeout,omitempty"`  // In seconds, sessions not approved in time are rejected
+	Profiles []string `json:"profiles,omitempty"` // Profiles requiring approval, all when empty
+	Command  *string  `json:"command,omitempty"`  // Exit status 0 approves
+	Dir      *string  `json:"dir,omitempty"`      // Holds <sessionID>.pending, the operator creates <sessionID>.approve or .deny
+}
+
+// SandboxConfig holds the namespace sandbox of the shells, Linux only
+type SandboxConfig struct {
+	Enabled        *bool    `json:"enabled,omitempty"`
+	Mounts         []string `json:"mounts,omitempty"`         // Read-only, "path" or "source:target", the system directories when empty
+	Scratch        *string  `json:"scratch,omitempty"`        // Directory of the gateway mounted writable at /scratch
+	Hostname       *string  `json:"hostname,omitempty"`       // Host name in the sandbox
+	PrivateNetwork *bool    `json:"privateNetwork,omitempty"` // Only loopback, no access to the network of the gateway
+}
+
+// ConfinementConfig holds a custom confinement of the shells, Linux only
+type ConfinementConfig struct {
+	ReadOnly     []string `json:"readOnly,omitempty"`     // Absolute paths, the file-system is not restricted if both lists are empty
+	ReadWrite    []string `json:"readWrite,omitempty"`    // Absolute paths
+	DenySyscalls []string `json:"denySyscalls,omitempty"` // System call names, e.g. mount
+	DenyNetwork  *bool    `json:"denyNetwork,omitempty"`  // Only Unix sockets can be created
+}
+
+// E2EConfig holds the end-to-end encryption of sessions between operators and the device
+type E2EConfig struct {
+	Enabled       *bool    `json:"enabled,omitempty"`
+	Required      *bool    `json:"required,omitempty"`      // Reject sessions that are not encrypted
+	OperatorKeys  []string `json:"operatorKeys,omitempty"`  // Base64 Ed25519 public keys of the operators allowed
+	DeviceKeyFile *string  `json:"deviceKeyFile,omitempty"` // Holds the base64 Ed25519 private key of the device, optional
+}
+
+// AuthorizationConfig holds the keys verifying the tokens the cloud signs start messages with
+type AuthorizationConfig struct {
+	Enabled     *bool             `json:"enabled,omitempty"`
+	Keys        map[string]string `json:"keys,omitempty"`        // Base64 Ed25519 public keys by key ID, several during a rotation
+	Audience    *string           `json:"audience,omitempty"`    // Required in the aud claim of tokens when set
+	MaxLifetime *int              `json:"maxLifetime,omitempty"` // In seconds, tokens expiring later are refused
+	Leeway      *int              `json:"leeway,omitempty"`      // In seconds, tolerated clock skew
+}
+
+// OutputConfig holds how the output of sessions is sent to the cloud
+type OutputConfig struct {
+	Compression     *bool `json:"compression,omitempty"`     // Negotiate permessage-deflate, defaults to true
+	CoalesceWindow  *int  `json:"coalesceWindow,omitempty"`  // In milliseconds output is held back at most, 0 disables coalescing
+	CoalesceBytes   *int  `json:"coalesceBytes,omitempty"`   // Output held back is sent once it reaches this size
+	RateLimit       *int  `json:"rateLimit,omitempty"`       // Output of a session in bytes per second, unlimited when 0
+	GlobalRateLimit *int  `json:"globalRateLimit,omitempty"` // Output of all sessions in bytes per second, unlimited when 0
+	SyncInterval    *int  `json:"syncInterval,omitempty"`    // In milliseconds between two frames of a session in sync mode, 0 disables sync mode
+}
+
+const (
+	DefaultLogLevel            = "info"
+	DefaultCommand             = "/bin/bash"
+	DefaultShutdownGracePeriod = 5 // In seconds
+	DefaultAdminSocketMode     = "0600"
+	DefaultNotifyReady         = NotifyReadyStart
+	DefaultEventTimeout        = 5   // In seconds, for webhooks and hooks
+	DefaultSessionHookTimeout  = 10  // In seconds
+	DefaultApprovalTimeout     = 120 // In seconds
+	DefaultTokenMaxLifetime    = 300 // In seconds
+	DefaultTokenLeeway         = 30  // In seconds
+	DefaultCoalesceWindow      = 10  // In milliseconds
+	DefaultCoalesceBytes       = 16384
+	maxCoalesceWindow          = 1000 // In milliseconds, longer windows make the terminal sluggish
+	DefaultSyncInterval        = 50   // In milliseconds
+	maxSyncInterval            = 5000 // In milliseconds
+)
+
+const (
+	NotifyReadyStart     = "start"     // As soon as pe-terminal runs
+	NotifyReadyConnected = "connected" // Once the tunnel connected for the first time
+)
+
+// NotifyReadyModes are the accepted values of notifyReady
+var NotifyReadyModes = []string{NotifyReadyStart, NotifyReadyConnected}
+
+// LogLevels are the accepted values of logLevel
+var LogLevels = []string{"debug", "info", "warn", "error", "fatal"}
+
+// defaults is the bottom layer of every configuration
+func defaults() map[string]interface{} {
+	return map[string]interface{}{
+		"logLevel":            DefaultLogLevel,
+		"command":             DefaultCommand,
+		"shutdownGracePeriod": DefaultShutdownGracePeriod,
+		"adminSocketMode":     DefaultAdminSocketMode,
+		"notifyReady":         DefaultNotifyReady,
+	}
+}
+
+// Source tells Load where to read the configuration from, every layer is optional
+type Source struct {
+	File    string            // Format chosen by extension: .json, .yaml, .yml or .toml
+	Environ []string          // KEY=VALUE pairs as returned by os.Environ, only PE_TERMINAL_* are used
+	Flags   map[string]string // Set command-line flags, as collected by BindFlags
+}
+
+// FieldError is a problem with a single field, or with a whole layer when Field is empty
+type FieldError struct {
+	Field   string `json:"field,omitempty"` // Path of the field, e.g. profiles.admin.command
+	Message string `json:"message"`
+}
+
+func (err *FieldError) Error() string {
+	if err.Field == "" {
+		return err.Message
+	}
+	return fmt.Sprintf("`%s`: %s", err.Field, err.Message)
+}
+
+// Errors holds every problem found while loading a configuration
+type Errors []*FieldError
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (errs *Errors) add(field string, format string, args ...interface{}) {
+	*errs = append(*errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Load merges and validates the layers of source. On failure the returned error is
+// Errors, listing every problem rather than the first one.
+func Load(source Source) (Config, error) {
+	var errs Errors
+	tree := defaults()
+	if source.File != "" {
+		fileTree, err := readFile(source.File)
+		if err != nil {
+			return Config{}, Errors{{Message: err.Error()}}
+		}
+		merge(tree, fileTree)
+	}
+	merge(tree, environTree(source.Environ, &errs))
+	merge(tree, flagsTree(source.Flags, &errs))
+
+	var config Config
+	decode(tree, &config, &errs)
+	config.complete()
+	config.validate(&errs)
+	if len(errs) > 0 {
+		return Config{}, errs
+	}
+	return config, nil
+}
+
+// ReadyOnConnect tells if readiness is reported to systemd once the tunnel connected, rather than at start
+func (config *Config) ReadyOnConnect() bool {
+	return config.NotifyReady != nil && *config.NotifyReady == NotifyReadyConnected
+}
+
+// ApprovalEnabled tells if sessions wait for a local operator to approve them
+func (config *Config) ApprovalEnabled() bool {
+	return config.Approval != nil && config.Approval.Enabled != nil && *config.Approval.Enabled
+}
+
+// E2EEnabled tells if sessions can be encrypted end-to-end
+func (config *Config) E2EEnabled() bool {
+	return config.E2E != nil && config.E2E.Enabled != nil && *config.E2E.Enabled
+}
+
+// AuthorizationEnabled tells if start messages need a signed token
+func (config *Config) AuthorizationEnabled() bool {
+	return config.Authorization != nil && config.Authorization.Enabled != nil && *config.Authorization.Enabled
+}
+
+// IsEnabled tells if sandbox is set and enabled, sandbox may be nil
+func (sandbox *SandboxConfig) IsEnabled() bool {
+	return sandbox != nil && sandbox.Enabled != nil && *sandbox.Enabled
+}
+
+// complete falls back to the defaults for fields set to an empty value
+func (config *Config) complete() {
+	if config.LogLevel == nil || *config.LogLevel == "" {
+		logLevel := DefaultLogLevel
+		config.LogLevel = &logLevel
+	}
+	if config.Command == nil || *config.Command == "" {
+		command := DefaultCommand
+		config.Command = &command
+	}
+	if config.ShutdownGracePeriod == nil || *config.ShutdownGracePeriod <= 0 {
+		gracePeriod := DefaultShutdownGracePeriod
+		config.ShutdownGracePeriod = &gracePeriod
+	}
+	if config.AdminSocketMode == nil || *config.AdminSocketMode == "" {
+		mode := DefaultAdminSocketMode
+		config.AdminSocketMode = &mode
+	}
+	if config.NotifyReady == nil || *config.NotifyReady == "" {
+		notifyReady := DefaultNotifyReady
+		config.NotifyReady = &notifyReady
+	}
+}
+
+func (config *Config) validate(errs *Errors) {
+	// Check cloud-url
+	if config.CloudURL == nil {
+		errs.add("cloud", "missing")
+	} else if *config.CloudURL != "" && !strings.HasPrefix(*config.CloudURL, "ws://") && !strings.HasPrefix(*config.CloudURL, "wss://") {
+		errs.add("cloud", "should start with ws:// or wss://")
+	}
+	// Check logging-level
+	if !contains(LogLevels, strings.ToLower(*config.LogLevel)) {
+		errs.add("logLevel", "should be one of %s", strings.Join(LogLevels, ", "))
+	}
+	// Check shell-command
+	if _, err := components.SplitCommand(*config.Command); err != nil {
+		errs.add("command", "%v", err)
+	}
+	// Check kill-signals
+	for _, name := range config.KillSignals {
+		if _, err := components.ParseSignal(name); err != nil {
+			errs.add("killSignals", "%v", err)
+		}
+	}
+	// Check initial window-size
+	if (config.Columns == nil) != (config.Rows == nil) {
+		errs.add("columns", "columns and rows should be set together")
+	}
+	// Check profiles
+	for name, profile := range config.Profiles {
+		if profile.Restricted != nil {
+			profile.Restricted.validate("profiles."+name+".restricted", errs)
+		}
+		if profile.Sandbox.IsEnabled() {
+			profile.Sandbox.validate("profiles."+name+".sandbox", errs)
+		}
+		config.validateConfinementName("profiles."+name+".confinement", profile.Confinement, errs)
+		if profile.Command == nil {
+			continue
+		}
+		if _, err := components.SplitCommand(*profile.Command); err != nil {
+			errs.add("profiles."+name+".command", "%v", err)
+		}
+	}
+	if config.DefaultProfile != nil {
+		if _, ok := config.Profiles[*config.DefaultProfile]; !ok {
+			errs.add("defaultProfile", "no such profile %q", *config.DefaultProfile)
+		}
+	}
+	// Check admin-socket mode
+	if _, err := strconv.ParseUint(*config.AdminSocketMode, 8, 32); err != nil {
+		errs.add("adminSocketMode", "should be octal like 0660")
+	}
+	// Check event sinks
+	if config.Events != nil {
+		config.Events.validate(errs)
+	}
+	// Check session hooks
+	if config.SessionHooks != nil {
+		config.SessionHooks.PreStart.validate("sessionHooks.preStart", errs)
+		config.SessionHooks.PostEnd.validate("sessionHooks.postEnd", errs)
+		if config.SessionHooks.PostEnd != nil && config.SessionHooks.PostEnd.Veto != nil {
+			errs.add("sessionHooks.postEnd.veto", "only applies to preStart")
+		}
+	}
+	// Check approval mode
+	if config.ApprovalEnabled() {
+		config.validateApproval(errs)
+	}
+	// Check sandbox
+	if config.Sandbox.IsEnabled() {
+		config.Sandbox.validate("sandbox", errs)
+	}
+	// Check confinements
+	builtins := components.ConfinementProfiles()
+	for name, confinement := range config.Confinements {
+		if _, ok := builtins[name]; ok || name == "" {
+			errs.add("confinements", "invalid name %q, should not be empty or a built-in confinement", name)
+		}
+		confinement.validate("confinements."+name, errs)
+	}
+	config.validateConfinementName("confinement", config.Confinement, errs)
+	// Check end-to-end encryption
+	if config.E2EEnabled() {
+		if len(config.E2E.OperatorKeys) == 0 {
+			errs.add("e2e.operatorKeys", "should allow at least one operator")
+		}
+		for _, key := range config.E2E.OperatorKeys {
+			if _, err := components.ParseEd25519Key(key, false); err != nil {
+				errs.add("e2e.operatorKeys", "%v", err)
+			}
+		}
+	}
+	// Check authorization
+	if config.AuthorizationEnabled() {
+		authorization := config.Authorization
+		if len(authorization.Keys) == 0 {
+			errs.add("authorization.keys", "should hold at least one key")
+		}
+		for keyID, key := range authorization.Keys {
+			if _, err := components.ParseEd25519Key(key, false); err != nil {
+				errs.add("authorization.keys."+keyID, "%v", err)
+			}
+		}
+		if authorization.MaxLifetime != nil && *authorization.MaxLifetime <= 0 {
+			errs.add("authorization.maxLifetime", "should be positive")
+		}
+		if authorization.Leeway != nil && *authorization.Leeway < 0 {
+			errs.add("authorization.leeway", "should not be negative")
+		}
+	}
+	// Check output
+	if output := config.Output; output != nil {
+		if output.CoalesceWindow != nil && (*output.CoalesceWindow < 0 || *output.CoalesceWindow > maxCoalesceWindow) {
+			errs.add("output.coalesceWindow", "should be between 0 and %d", maxCoalesceWindow)
+		}
+		if output.CoalesceBytes != nil && *output.CoalesceBytes <= 0 {
+			errs.add("output.coalesceBytes", "should be positive")
+		}
+		if output.RateLimit != nil && *output.RateLimit < 0 {
+			errs.add("output.rateLimit", "should not be negative")
+		}
+		if output.GlobalRateLimit != nil && *output.GlobalRateLimit < 0 {
+			errs.add("output.globalRateLimit", "should not be negative")
+		}
+		if output.SyncInterval != nil && (*output.SyncInterval < 0 || *output.SyncInterval > maxSyncInterval) {
+			errs.add("output.syncInterval", "should be between 0 and %d", maxSyncInterval)
+		}
+	}
+	// Check systemd readiness
+	if !contains(NotifyReadyModes, *config.NotifyReady) {
+		errs.add("notifyReady", "should be one of %s", strings.Join(NotifyReadyModes, ", "))
+	}
+}
+
+func (events *EventsConfig) validate(errs *Errors) {
+	if events.SocketMode != nil {
+		if _, err := strconv.ParseUint(*events.SocketMode, 8, 32); err != nil {
+			errs.add("events.socketMode", "should be octal like 0660")
+		}
+	}
+	for name, webhook := range events.Webhooks {
+		field := "events.webhooks." + name
+		if webhook.URL == nil {
+			errs.add(field+".url", "missing")
+		} else if parsed, err := url.Parse(*webhook.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs.add(field+".url", "should be an http:// or https:// URL")
+		}
+		validateEventTypes(field, webhook.Events, webhook.Timeout, errs)
+	}
+	for name, hook := range events.Hooks {
+		field := "events.hooks." + name
+		if hook.Command == nil || *hook.Command == "" {
+			errs.add(field+".command", "missing")
+		} else if _, err := components.SplitCommand(*hook.Command); err != nil {
+			errs.add(field+".command", "%v", err)
+		}
+		validateEventTypes(field, hook.Events, hook.Timeout, errs)
+	}
+}
+
+func (restricted *RestrictedConfig) validate(field string, errs *Errors) {
+	if len(restricted.Commands) == 0 {
+		errs.add(field+".commands", "should allow at least one command")
+	}
+	for name, command := range restricted.Commands {
+		if name == "" || strings.ContainsAny(name, " \t\"'\\") || name == "help" || name == "exit" {
+			errs.add(field+".commands", "invalid command name %q", name)
+		}
+		if command.Path == nil || !path.IsAbs(*command.Path) {
+			errs.add(field+".commands."+name+".path", "should be an absolute path")
+		}
+		if command.Args != nil {
+			if _, err := regexp.Compile(*command.Args); err != nil {
+				errs.add(field+".commands."+name+".args", "%v", err)
+			}
+		}
+	}
+	for _, pattern := range restricted.Deny {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs.add(field+".deny", "%v", err)
+		}
+	}
+}
+
+func (sandbox *SandboxConfig) validate(field string, errs *Errors) {
+	for _, mount := range sandbox.Mounts {
+		if _, err := components.ParseMount(mount); err != nil {
+			errs.add(field+".mounts", "%v", err)
+		}
+	}
+	if sandbox.Scratch != nil && *sandbox.Scratch != "" && !path.IsAbs(*sandbox.Scratch) {
+		errs.add(field+".scratch", "should be an absolute path")
+	}
+	if sandbox.Hostname != nil && (len(*sandbox.Hostname) > 64 || strings.ContainsAny(*sandbox.Hostname, " \t/")) {
+		errs.add(field+".hostname", "invalid host name %q", *sandbox.Hostname)
+	}
+}
+
+func (confinement *ConfinementConfig) validate(field string, errs *Errors) {
+	for _, dir := range append(append([]string{}, confinement.ReadOnly...), confinement.ReadWrite...) {
+		if !path.IsAbs(dir) {
+			errs.add(field, "invalid path %q, should be absolute", dir)
+		}
+	}
+	for _, name := range confinement.DenySyscalls {
+		if err := components.ValidateSyscall(name); err != nil {
+			errs.add(field+".denySyscalls", "%v", err)
+		}
+	}
+}
+
+// validateConfinementName checks that name, if set, is a built-in or custom confinement
+func (config *Config) validateConfinementName(field string, name *string, errs *Errors) {
+	if name == nil || *name == "" {
+		return
+	}
+	if _, ok := components.ConfinementProfiles()[*name]; ok {
+		return
+	}
+	if _, ok := config.Confinements[*name]; !ok {
+		errs.add(field, "no such confinement %q", *name)
+	}
+}
+
+func (config *Config) validateApproval(errs *Errors) {
+	approval := config.Approval
+	if approval.Timeout != nil && *approval.Timeout <= 0 {
+		errs.add("approval.timeout", "should be positive")
+	}
+	for _, profile := range approval.Profiles {
+		if _, ok := config.Profiles[profile]; !ok && len(config.Profiles) > 0 {
+			errs.add("approval.profiles", "no such profile %q", profile)
+		}
+	}
+	if approval.Command != nil && *approval.Command != "" {
+		if _, err := components.SplitCommand(*approval.Command); err != nil {
+			errs.add("approval.command", "%v", err)
+		}
+	}
+	hasApprover := (approval.Command != nil && *approval.Command != "") || (approval.Dir != nil && *approval.Dir != "") ||
+		(config.AdminSocket != nil && *config.AdminSocket != "")
+	if !hasApprover {
+		errs.add("approval", "no way to approve sessions, set adminSocket, approval.command or approval.dir")
+	}
+}
+
+func (hook *SessionHookConfig) validate(field string, errs *Errors) {
+	if hook == nil {
+		return
+	}
+	if hook.Command == nil || *hook.Command == "" {
+		errs.add(field+".command", "missing")
+	} else if _, err := components.SplitCommand(*hook.Command); err != nil {
+		errs.add(field+".command", "%v", err)
+	}
+	if hook.Timeout != nil && *hook.Timeout <= 0 {
+		errs.add(field+".timeout", "should be positive")
+	}
+}
+
+func validateEventTypes(field string, types []string, timeout *int, errs *Errors) {
+	for _, eventType := range types {
+		if !contains(components.EventTypes, eventType) {
+			errs.add(field+".events", "unknown event %q, should be one of %s", eventType, strings.Join(components.EventTypes, ", "))
+		}
+	}
+	if timeout != nil && *timeout <= 0 {
+		errs.add(field+".timeout", "should be positive")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
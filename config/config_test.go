@@ -0,0 +1,339 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to a file called name in a temporary directory
+func writeFile(t *testing.T, name string, content string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// fieldsOf lists the fields reported by err, which must be Errors
+func fieldsOf(t *testing.T, err error) []string {
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected Errors, got %v", err)
+	}
+	var fields []string
+	for _, fieldError := range errs {
+		fields = append(fields, fieldError.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := Load(Source{Environ: []string{"PE_TERMINAL_CLOUD=wss://example.com/relay-term", "HOME=/root"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *config.CloudURL != "wss://example.com/relay-term" || *config.LogLevel != DefaultLogLevel || *config.Command != DefaultCommand ||
+		*config.ShutdownGracePeriod != DefaultShutdownGracePeriod || *config.AdminSocketMode != DefaultAdminSocketMode {
+		t.Fatalf("Defaults not applied: %+v", config)
+	}
+	if config.Limits != nil || config.Profiles != nil || config.Recording != nil {
+		t.Fatalf("Unset fields should stay nil: %+v", config)
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+			"cloud": "ws://localhost:8080/relay-term",
+			"command": "/bin/bash -l",
+			"killSignals": ["SIGHUP", "SIGKILL"],
+			"env": {"LANG": "C.UTF-8"},
+			"columns": 80, "rows": 24,
+			"recording": true,
+			"limits": {"maxSessions": 2},
+			"profiles": {
+				"admin": {"description": "Root shell: full access", "user": "root", "allowedRoles": ["admin"], "limits": {"maxDuration": 600}},
+				"logs": {"command": "/usr/bin/journalctl -f"}
+			},
+			"defaultProfile": "logs"
+		}`,
+		"config.yaml": `---
+# pe-terminal
+cloud: ws://localhost:8080/relay-term
+command: "/bin/bash -l"   # login shell
+killSignals: [SIGHUP, 'SIGKILL']
+env:
+  LANG: C.UTF-8
+columns: 80
+rows: 24
+recording: true
+limits: {maxSessions: 2}
+profiles:
+  admin:
+    description: "Root shell: full access"
+    user: root
+    allowedRoles:
+    - admin
+    limits:
+      maxDuration: 600
+  logs:
+    command: /usr/bin/journalctl -f
+defaultProfile: logs
+`,
+		"config.toml": `# pe-terminal
+cloud = "ws://localhost:8080/relay-term"
+command = '/bin/bash -l' # login shell
+killSignals = [
+  "SIGHUP",
+  "SIGKILL", # last resort
+]
+env = { LANG = "C.UTF-8" }
+columns = 80
+rows = 24
+recording = true
+limits.maxSessions = 2
+defaultProfile = "logs"
+
+[profiles.admin]
+description = "Root shell: full access"
+user = "root"
+allowedRoles = ["admin"]
+
+[profiles.admin.limits]
+maxDuration = 600
+
+[profiles."logs"]
+command = "/usr/bin/journalctl -f"
+`,
+	}
+	var expected Config
+	for _, name := range []string{"config.json", "config.yaml", "config.toml"} {
+		config, err := Load(Source{File: writeFile(t, name, files[name])})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if *config.Command != "/bin/bash -l" || *config.Profiles["admin"].Description != "Root shell: full access" ||
+			*config.Profiles["admin"].Limits.MaxDuration != 600 || *config.Limits.MaxSessions != 2 || config.Env["LANG"] != "C.UTF-8" {
+			t.Fatalf("%s: unexpected config %+v", name, config)
+		}
+		if name == "config.json" {
+			expected = config
+		} else if !reflect.DeepEqual(config, expected) {
+			t.Fatalf("%s: config differs from JSON\n%+v\n%+v", name, config, expected)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	fileName := writeFile(t, "config.yaml", "cloud: ws://file\nlogLevel: debug\ncwd: /tmp\nlimits:\n  maxSessions: 1\n")
+	flags := flag.NewFlagSet("pe-terminal", flag.ContinueOnError)
+	overrides := BindFlags(flags)
+	if err := flags.Parse([]string{"-log-level=error", "-kill-signals", "SIGTERM, SIGKILL"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(Source{
+		File:    fileName,
+		Environ: []string{"PE_TERMINAL_CLOUD=ws://env", "PE_TERMINAL_LOG_LEVEL=warn", "PE_TERMINAL_LIMITS_MAX_DURATION=60", "PE_TERMINAL_ENV=A=1,B=2"},
+		Flags:   overrides,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *config.CloudURL != "ws://env" || *config.LogLevel != "error" || *config.Cwd != "/tmp" {
+		t.Fatalf("Layers applied in the wrong order: %+v", config)
+	}
+	if *config.Limits.MaxSessions != 1 || *config.Limits.MaxDuration != 60 {
+		t.Fatalf("Nested fields should be merged: %+v", config.Limits)
+	}
+	if !reflect.DeepEqual(config.KillSignals, []string{"SIGTERM", "SIGKILL"}) || !reflect.DeepEqual(config.Env, map[string]string{"A": "1", "B": "2"}) {
+		t.Fatalf("Lists not parsed: %v %v", config.KillSignals, config.Env)
+	}
+}
+
+func TestUnknownEnviron(t *testing.T) {
+	environ := []string{"PE_TERMINAL_CLOUD=ws://env", "PE_TERMINAL_NOPE=1", "PE_TERMINAL_LOG_LEVL=debug", "PE_TERMINALS=1", "HOME=/root"}
+	config, err := Load(Source{Environ: environ})
+	if err != nil {
+		t.Fatalf("Expected unknown environment variables ignored, got %v", err)
+	}
+	if *config.CloudURL != "ws://env" || *config.LogLevel != DefaultLogLevel {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+	if unknown := UnknownEnviron(environ); !reflect.DeepEqual(unknown, []string{"PE_TERMINAL_LOG_LEVL", "PE_TERMINAL_NOPE"}) {
+		t.Fatalf("Expected the unknown variables listed, got %v", unknown)
+	}
+
+	// Validate reports them as warnings, unknown file keys stay errors
+	findings := Validate(Source{File: writeFile(t, "config.json", `{"cloud": "wss://localhost", "nope": 1}`), Environ: environ})
+	if len(findings) != 1 || findings[0].Severity != SeverityError || findings[0].Field != "nope" {
+		t.Fatalf("Expected an error for the unknown key, got %+v", findings)
+	}
+	var warnings []string
+	for _, finding := range Validate(Source{File: writeFile(t, "config.json", `{"cloud": "wss://localhost"}`), Environ: environ}) {
+		if finding.Severity == SeverityWarning && strings.Contains(finding.Message, "PE_TERMINAL_") {
+			warnings = append(warnings, finding.Message)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("Expected a warning per unknown variable, got %v", warnings)
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	fileName := writeFile(t, "config.json", `{
+		"cloud": "http://localhost",
+		"logLevel": "verbose",
+		"command": "/bin/bash '-l",
+		"killSignals": ["SIGNOPE"],
+		"columns": 80,
+		"rows": -1,
+		"recordng": true,
+		"limits": {"maxSessions": "two"},
+		"profiles": {
+			"admin": {"commnd": "/bin/sh"},
+			"diag": {"restricted": {"commands": {"ping": {"path": "ping", "args": "("}}, "deny": ["["]}},
+			"jail": {"sandbox": {"enabled": true, "mounts": ["/usr", "/srv:/tmp"], "hostname": "a b"}, "confinement": "missing"}
+		},
+		"defaultProfile": "missing",
+		"adminSocketMode": "rw-------",
+		"sessionHooks": {"preStart": {"timeout": 0}, "postEnd": {"command": "/bin/true", "veto": true}},
+		"approval": {"enabled": true, "timeout": -1, "profiles": ["admin", "nope"]},
+		"sandbox": {"enabled": true, "mounts": ["usr"], "scratch": "scratch"},
+		"confinement": "locked",
+		"confinements": {
+			"locked": {"readOnly": ["/usr", "etc"], "denySyscalls": ["mount", "no_such_call"]},
+			"no-network": {"denyNetwork": true}
+		},
+		"e2e": {"enabled": true, "operatorKeys": ["AAAA"]},
+		"authorization": {"enabled": true, "keys": {"2024": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", "old": "AAAA"}, "maxLifetime": 0, "leeway": -1},
+		"output": {"coalesceWindow": 5000, "coalesceBytes": 0, "rateLimit": -1, "globalRateLimit": -1, "syncInterval": -1}
+	}`)
+	_, err := Load(Source{File: fileName, Environ: []string{"PE_TERMINAL_WATCH_CONFIG=sometimes", "PE_TERMINAL_NOPE=1"}})
+	expected := []string{"adminSocketMode", "approval", "approval.profiles", "approval.timeout", "authorization.keys.old", "authorization.leeway", "authorization.maxLifetime", "cloud", "command", "confinements", "confinements.locked", "confinements.locked.denySyscalls", "defaultProfile", "e2e.operatorKeys", "killSignals", "limits.maxSessions",
+		"logLevel", "output.coalesceBytes", "output.coalesceWindow", "output.globalRateLimit", "output.rateLimit", "output.syncInterval", "profiles.admin.commnd", "profiles.diag.restricted.commands.ping.args", "profiles.diag.restricted.commands.ping.path",
+		"profiles.diag.restricted.deny", "profiles.jail.confinement", "profiles.jail.sandbox.hostname", "profiles.jail.sandbox.mounts", "recordng", "rows",
+		"sandbox.mounts", "sandbox.scratch", "sessionHooks.postEnd.veto", "sessionHooks.preStart.command",
+		"sessionHooks.preStart.timeout", "watchConfig"}
+	if fields := fieldsOf(t, err); !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected errors for %v, got %v: %v", expected, fields, err)
+	}
+
+	// A missing cloud-url is reported too
+	if fields := fieldsOf(t, func() error { _, err := Load(Source{}); return err }()); !reflect.DeepEqual(fields, []string{"cloud"}) {
+		t.Fatalf("Expected a missing cloud-url, got %v", fields)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"broken.json": `{"cloud": }`,
+		"tabs.yaml":   "limits:\n\tmaxSessions: 1\n",
+		"indent.yaml": "cloud: ws://localhost\n  logLevel: info\n",
+		"list.yaml":   "- cloud: ws://localhost\n",
+		"dup.yaml":    "cloud: ws://a\ncloud: ws://b\n",
+		"dup.toml":    "cloud = \"ws://a\"\ncloud = \"ws://b\"\n",
+		"table.toml":  "[profiles.admin]\n[profiles.admin]\n",
+		"value.toml":  "cloud = ws://localhost\n",
+	} {
+		_, err := Load(Source{File: writeFile(t, name, content)})
+		if fields := fieldsOf(t, err); !reflect.DeepEqual(fields, []string{""}) {
+			t.Fatalf("%s: expected a parse error, got %v", name, err)
+		}
+	}
+
+	// Lists of tables parse, but are reported where a table is expected
+	for name, content := range map[string]string{
+		"list.yaml":  "cloud: ws://localhost\nprofiles:\n  - name: admin\n",
+		"array.toml": "cloud = \"ws://localhost\"\n[[profiles]]\nname = \"admin\"\n",
+	} {
+		_, err := Load(Source{File: writeFile(t, name, content)})
+		if fields := fieldsOf(t, err); !reflect.DeepEqual(fields, []string{"profiles"}) {
+			t.Fatalf("%s: expected a profiles error, got %v", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileName := writeFile(t, "config.yaml", `cloud: ws://localhost/relay-term
+command: /bin/sh
+user: root
+cwd: `+dir+`
+recordingDir: `+filepath.Join(dir, "missing")+`
+metricsAddress: 127.0.0.1:9464
+sandbox:
+  enabled: true
+  mounts: [/usr, /etc]
+  scratch: `+filepath.Join(dir, "scratch")+`
+profiles:
+  script:
+    command: `+script+`
+    cwd: `+script+`
+    user: no-such-user-pe-terminal
+    sandbox: {enabled: true, mounts: ['`+filepath.Join(dir, "missing")+`:/opt']}
+    confinement: diagnostics-readonly
+e2e:
+  enabled: true
+  operatorKeys: [11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=]
+  deviceKeyFile: `+script+`
+confinements:
+  tools:
+    readOnly: [/usr, `+filepath.Join(dir, "missing")+`]
+`)
+	findings := make(map[string]string)
+	for _, finding := range Validate(Source{File: fileName}) {
+		findings[finding.Field] = finding.Severity
+	}
+	expected := map[string]string{
+		"cloud":                          SeverityWarning, // Not encrypted
+		"recordingDir":                   SeverityWarning, // Missing, but nothing is recorded
+		"profiles.script.command":        SeverityError,   // Not executable
+		"profiles.script.cwd":            SeverityError,   // Not a directory
+		"profiles.script.user":           SeverityError,
+		"profiles.script.sandbox.mounts": SeverityError,
+		"sandbox.scratch":                SeverityError,
+		"confinements.tools":             SeverityWarning, // Missing paths are skipped
+		"e2e.deviceKeyFile":              SeverityError,   // Not a key
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Fatalf("Expected findings %v, got %v", expected, findings)
+	}
+
+	// Load errors are findings too
+	findings = make(map[string]string)
+	for _, finding := range Validate(Source{File: writeFile(t, "config.json", `{"cloud": "ws://localhost", "logLevel": "loud"}`)}) {
+		findings[finding.Field] = finding.Severity
+	}
+	if !reflect.DeepEqual(findings, map[string]string{"logLevel": SeverityError}) {
+		t.Fatalf("Expected a logLevel error, got %v", findings)
+	}
+}
@@ -0,0 +1,368 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding config fields
+const EnvPrefix = "PE_TERMINAL_"
+
+// Every layer is turned into a tree of maps, lists and scalars as produced by encoding/json,
+// the merged tree is decoded into Config at once.
+
+// readFile parses the config-file into a tree
+func readFile(fileName string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config-file: %w", err)
+	}
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config-file %s: %w", fileName, err)
+	}
+	if tree == nil {
+		tree = make(map[string]interface{})
+	}
+	return tree, nil
+}
+
+// merge copies src into dst, nested maps are merged rather than replaced
+func merge(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			merge(dstMap, srcMap)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// leaf is a config field that can be set from a single string, by an environment variable or a flag
+type leaf struct {
+	path  []string // JSON names, e.g. [limits maxSessions]
+	kind  reflect.Type
+	usage string
+}
+
+// leaves lists the fields of Config settable from a string, profiles are left to the config-file
+func leaves() []leaf {
+	var result []leaf
+	var walk func(t reflect.Type, path []string)
+	walk = func(t reflect.Type, path []string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonName(field)
+			fieldPath := append(append([]string{}, path...), name)
+			kind := field.Type
+			if kind.Kind() == reflect.Ptr {
+				kind = kind.Elem()
+			}
+			switch {
+			case kind.Kind() == reflect.Struct:
+				walk(kind, fieldPath)
+			case kind.Kind() == reflect.Map && kind.Elem().Kind() != reflect.String:
+				continue
+			default:
+				result = append(result, leaf{path: fieldPath, kind: kind, usage: usage(kind)})
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), nil)
+	return result
+}
+
+func (leaf leaf) field() string {
+	return strings.Join(leaf.path, ".")
+}
+
+// flagName is the kebab-case name of the field, e.g. limits-max-sessions
+func (leaf leaf) flagName() string {
+	return strings.ToLower(splitWords(leaf.path, "-"))
+}
+
+// envName is the environment variable of the field, e.g. PE_TERMINAL_LIMITS_MAX_SESSIONS
+func (leaf leaf) envName() string {
+	return EnvPrefix + strings.ToUpper(splitWords(leaf.path, "_"))
+}
+
+// splitWords joins the camel-case words of path with separator
+func splitWords(path []string, separator string) string {
+	var builder strings.Builder
+	for i, name := range path {
+		if i > 0 {
+			builder.WriteString(separator)
+		}
+		for j, r := range name {
+			if j > 0 && unicode.IsUpper(r) {
+				builder.WriteString(separator)
+			}
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// parse converts value to the type of the field
+func (leaf leaf) parse(value string) (interface{}, error) {
+	switch leaf.kind.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint16:
+		return strconv.ParseUint(value, 10, 16)
+	case reflect.Slice:
+		list := []interface{}{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case reflect.Map:
+		entries := map[string]interface{}{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			key, entry, ok := strings.Cut(item, "=")
+			if !ok {
+				return nil, fmt.Errorf("missing = in %q", item)
+			}
+			entries[key] = entry
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", leaf.kind)
+}
+
+func usage(kind reflect.Type) string {
+	switch kind.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Uint16:
+		return "a number"
+	case reflect.Slice:
+		return "comma-separated list"
+	case reflect.Map:
+		return "comma-separated KEY=VALUE list"
+	}
+	return "a string"
+}
+
+// set stores value at path in tree, creating the nested maps
+func set(tree map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		nested, ok := tree[name].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			tree[name] = nested
+		}
+		tree = nested
+	}
+	tree[path[len(path)-1]] = value
+}
+
+// environTree collects the PE_TERMINAL_* variables of environ, the unknown ones are left to UnknownEnviron
+func environTree(environ []string, errs *Errors) map[string]interface{} {
+	variables := prefixedVariables(environ)
+	tree := make(map[string]interface{})
+	for _, leaf := range leaves() {
+		value, ok := variables[leaf.envName()]
+		if !ok {
+			continue
+		}
+		parsed, err := leaf.parse(value)
+		if err != nil {
+			errs.add(leaf.field(), "invalid %s=%q, should be %s", leaf.envName(), value, leaf.usage)
+			continue
+		}
+		set(tree, leaf.path, parsed)
+	}
+	return tree
+}
+
+// UnknownEnviron lists the PE_TERMINAL_* variables of environ matching no field, sorted. Load
+// ignores them, a variable set for another version of pe-terminal should not keep it from starting.
+func UnknownEnviron(environ []string) []string {
+	known := make(map[string]bool)
+	for _, leaf := range leaves() {
+		known[leaf.envName()] = true
+	}
+	var unknown []string
+	for name := range prefixedVariables(environ) {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// prefixedVariables returns the PE_TERMINAL_* variables of environ by name
+func prefixedVariables(environ []string) map[string]string {
+	variables := make(map[string]string)
+	for _, variable := range environ {
+		if name, value, ok := strings.Cut(variable, "="); ok && strings.HasPrefix(name, EnvPrefix) {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+// flagsTree collects the flags registered by BindFlags, by flag name
+func flagsTree(flags map[string]string, errs *Errors) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for _, leaf := range leaves() {
+		value, ok := flags[leaf.flagName()]
+		if !ok {
+			continue
+		}
+		parsed, err := leaf.parse(value)
+		if err != nil {
+			errs.add(leaf.field(), "invalid flag -%s=%q, should be %s", leaf.flagName(), value, leaf.usage)
+			continue
+		}
+		set(tree, leaf.path, parsed)
+	}
+	return tree
+}
+
+// BindFlags registers a flag on flags for every field settable from a string. The
+// returned map holds the flags set on the command-line once flags are parsed.
+func BindFlags(flags *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	for _, leaf := range leaves() {
+		name := leaf.flagName()
+		flags.Func(name, fmt.Sprintf("Overrides %s of the config-file, %s", leaf.field(), leaf.usage), func(value string) error {
+			values[name] = value
+			return nil
+		})
+	}
+	return values
+}
+
+// decode stores tree into target, a pointer to a struct. Unknown and mistyped fields are
+// reported for all fields rather than stopping at the first.
+func decode(tree map[string]interface{}, target interface{}, errs *Errors) {
+	decodeStruct(tree, reflect.ValueOf(target).Elem(), "", errs)
+}
+
+func decodeStruct(tree map[string]interface{}, target reflect.Value, prefix string, errs *Errors) {
+	fields := make(map[string]int)
+	for i := 0; i < target.NumField(); i++ {
+		fields[jsonName(target.Type().Field(i))] = i
+	}
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := tree[name]
+		index, ok := fields[name]
+		if !ok {
+			errs.add(prefix+name, "unknown field")
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		field := target.Field(index)
+		nested, isMap := value.(map[string]interface{})
+		switch {
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct && isMap:
+			field.Set(reflect.New(field.Type().Elem()))
+			decodeStruct(nested, field.Elem(), prefix+name+".", errs)
+		case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Struct && isMap:
+			field.Set(reflect.MakeMap(field.Type()))
+			for key, entry := range nested {
+				element := reflect.New(field.Type().Elem()).Elem()
+				if entryTree, ok := entry.(map[string]interface{}); ok {
+					decodeStruct(entryTree, element, prefix+name+"."+key+".", errs)
+				} else if entry != nil {
+					errs.add(prefix+name+"."+key, "should be a table of fields")
+				}
+				field.SetMapIndex(reflect.ValueOf(key), element)
+			}
+		default:
+			encoded, _ := json.Marshal(value)
+			if err := json.Unmarshal(encoded, field.Addr().Interface()); err != nil {
+				kind := field.Type()
+				if kind.Kind() == reflect.Ptr {
+					kind = kind.Elem()
+				}
+				errs.add(prefix+name, "should be %s", describe(kind))
+			}
+		}
+	}
+}
+
+// describe names the expected type of a field in error messages
+func describe(kind reflect.Type) string {
+	switch kind.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int:
+		return "a whole number"
+	case reflect.Uint16:
+		return "a whole number between 0 and 65535"
+	case reflect.Slice:
+		return "a list of strings"
+	case reflect.Map:
+		if kind.Elem().Kind() == reflect.Struct {
+			return "a table of tables"
+		}
+		return "a table of strings"
+	case reflect.Struct:
+		return "a table of fields"
+	}
+	return "a string"
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/PelionIoT/pe-terminal/components"
+)
+
+// Severities of a finding
+const (
+	SeverityError   = "error"   // pe-terminal would not start, or sessions would fail
+	SeverityWarning = "warning" // Works, but likely not as intended
+)
+
+// Finding is a problem reported by Validate
+type Finding struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Validate loads source the way Load does, then checks the configuration against the
+// host: the commands, users, groups and directories it refers to
+func Validate(source Source) []Finding {
+	config, err := Load(source)
+	if err != nil {
+		var errs Errors
+		if !errors.As(err, &errs) {
+			return []Finding{{Severity: SeverityError, Message: err.Error()}}
+		}
+		findings := make([]Finding, len(errs))
+		for i, fieldError := range errs {
+			findings[i] = Finding{Severity: SeverityError, Field: fieldError.Field, Message: fieldError.Message}
+		}
+		return findings
+	}
+
+	var findings []Finding
+	report := func(severity string, field string, format string, args ...interface{}) {
+		findings = append(findings, Finding{Severity: severity, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range UnknownEnviron(source.Environ) {
+		report(SeverityWarning, "", "unknown environment variable %s, ignored", name)
+	}
+
+	// Check cloud-url
+	if cloud, err := url.Parse(*config.CloudURL); err != nil {
+		report(SeverityError, "cloud", "invalid URL: %v", err)
+	} else if cloud.Host == "" {
+		report(SeverityError, "cloud", "missing host")
+	} else if cloud.Scheme == "ws" {
+		report(SeverityWarning, "cloud", "the tunnel is not encrypted, use wss://")
+	}
+	checkE2E(report, config)
+
+	// Check the sessions of every profile, the top-level fields apply to profiles not overriding them
+	recording := config.Recording != nil && *config.Recording
+	checkSession(report, "", config.Command, config.User, config.Cwd)
+	checkSandbox(report, "sandbox", config.Sandbox)
+	checkConfinement(report, "confinement", config.Confinement)
+	confinements := make([]string, 0, len(config.Confinements))
+	for name := range config.Confinements {
+		confinements = append(confinements, name)
+	}
+	sort.Strings(confinements)
+	for _, name := range confinements {
+		confinement := config.Confinements[name]
+		for _, dir := range append(append([]string{}, confinement.ReadOnly...), confinement.ReadWrite...) {
+			if _, err := os.Stat(dir); err != nil {
+				report(SeverityWarning, "confinements."+name, "%v, skipped", err)
+			}
+		}
+	}
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := config.Profiles[name]
+		checkSession(report, "profiles."+name+".", profile.Command, profile.User, profile.Cwd)
+		checkSandbox(report, "profiles."+name+".sandbox", profile.Sandbox)
+		checkConfinement(report, "profiles."+name+".confinement", profile.Confinement)
+		if profile.Restricted != nil {
+			commands := make([]string, 0, len(profile.Restricted.Commands))
+			for command := range profile.Restricted.Commands {
+				commands = append(commands, command)
+			}
+			sort.Strings(commands)
+			for _, command := range commands {
+				if _, err := exec.LookPath(*profile.Restricted.Commands[command].Path); err != nil {
+					report(SeverityWarning, "profiles."+name+".restricted.commands."+command+".path", "%v", err)
+				}
+			}
+		}
+		if profile.Recording != nil && *profile.Recording {
+			recording = true
+		}
+	}
+
+	// Check directories
+	if config.RecordingDir != nil && *config.RecordingDir != "" {
+		if err := checkDir(*config.RecordingDir); err != nil {
+			severity := SeverityWarning
+			if recording {
+				severity = SeverityError
+			}
+			report(severity, "recordingDir", "%v", err)
+		}
+	} else if recording {
+		report(SeverityWarning, "recordingDir", "recording is enabled but no recordingDir is set, sessions are not recorded")
+	}
+	if config.CgroupRoot != nil && *config.CgroupRoot != "" {
+		if err := checkDir(*config.CgroupRoot); err != nil {
+			report(SeverityWarning, "cgroupRoot", "%v, sessions are killed without a cgroup", err)
+		}
+	}
+
+	// Check admin socket and metrics
+	if config.AdminSocket != nil && *config.AdminSocket != "" {
+		if err := checkDir(filepath.Dir(*config.AdminSocket)); err != nil {
+			report(SeverityWarning, "adminSocket", "%v, it must exist before pe-terminal starts", err)
+		}
+	}
+	if config.AdminSocketGroup != nil && *config.AdminSocketGroup != "" {
+		if _, err := components.LookupGroup(*config.AdminSocketGroup); err != nil {
+			report(SeverityError, "adminSocketGroup", "%v", err)
+		}
+	}
+	if config.MetricsAddress != nil && *config.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(*config.MetricsAddress); err != nil {
+			report(SeverityError, "metricsAddress", "%v", err)
+		}
+	}
+
+	// Check approval flag-files
+	if config.ApprovalEnabled() && config.Approval.Dir != nil && *config.Approval.Dir != "" {
+		if err := checkDir(*config.Approval.Dir); err != nil {
+			report(SeverityError, "approval.dir", "%v, sessions can not be approved through flag-files", err)
+		}
+	}
+	return findings
+}
+
+// checkSession checks the command, user and working directory of a session, prefix is
+// the path of the profile holding them
+func checkSession(report func(string, string, string, ...interface{}), prefix string, command *string, account *string, cwd *string) {
+	if command != nil {
+		argv, _ := components.SplitCommand(*command) // Validated by Load
+		if len(argv) == 0 {
+			report(SeverityError, prefix+"command", "empty command")
+		} else if _, err := exec.LookPath(argv[0]); err != nil {
+			report(SeverityError, prefix+"command", "%v", err)
+		}
+	}
+	if account != nil && *account != "" {
+		if _, err := components.LookupUser(*account); err != nil {
+			report(SeverityError, prefix+"user", "%v", err)
+		}
+	}
+	if cwd != nil && *cwd != "" {
+		if err := checkDir(*cwd); err != nil {
+			report(SeverityError, prefix+"cwd", "%v", err)
+		}
+	}
+}
+
+// checkSandbox checks that the mounts and scratch directory of a sandbox exist on the gateway
+func checkSandbox(report func(string, string, string, ...interface{}), field string, sandbox *SandboxConfig) {
+	if !sandbox.IsEnabled() {
+		return
+	}
+	if runtime.GOOS != "linux" {
+		report(SeverityError, field, "sandboxes are only supported on Linux")
+	}
+	for _, mount := range sandbox.Mounts {
+		parsed, _ := components.ParseMount(mount) // Validated by Load
+		if _, err := os.Lstat(parsed.Source); err != nil {
+			report(SeverityError, field+".mounts", "%v", err)
+		}
+	}
+	if sandbox.Scratch != nil && *sandbox.Scratch != "" {
+		if err := checkDir(*sandbox.Scratch); err != nil {
+			report(SeverityError, field+".scratch", "%v", err)
+		}
+	}
+}
+
+// checkE2E checks that the device key can be read
+func checkE2E(report func(string, string, string, ...interface{}), config Config) {
+	if !config.E2EEnabled() || config.E2E.DeviceKeyFile == nil || *config.E2E.DeviceKeyFile == "" {
+		return
+	}
+	if _, err := components.ReadEd25519Key(*config.E2E.DeviceKeyFile); err != nil {
+		report(SeverityError, "e2e.deviceKeyFile", "%v", err)
+	}
+}
+
+// checkConfinement checks that the confinement of the sessions can be applied on the gateway
+func checkConfinement(report func(string, string, string, ...interface{}), field string, name *string) {
+	if name != nil && *name != "" && runtime.GOOS != "linux" {
+		report(SeverityError, field, "confinements are only supported on Linux")
+	}
+}
+
+// checkDir fails unless path is an existing directory
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
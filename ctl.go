@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PelionIoT/pe-terminal/components"
+)
+
+const defaultAdminSocket = "/run/pe-terminal/admin.sock"
+
+const ctlUsage = `Usage: pe-terminal ctl [-socket=<path>] <command> [arguments]
+
+Commands:
+  status             Show the state of the tunnel
+  sessions           List the running sessions
+  kill <sessionID>   Terminate a session
+  screen <sessionID> Print the text on the screen of a session
+  pending            List the sessions waiting for approval
+  approve <sessionID>
+                     Let a pending session start
+  deny <sessionID> [reason]
+                     Reject a pending session
+  reconnect          Drop and re-establish the tunnel connection
+  loglevel [level]   Show or change the log-level (debug, info, warn, error)
+`
+
+// runCtl runs a ctl subcommand against the admin socket and returns the exit-code
+func runCtl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socket := flags.String("socket", defaultAdminSocket, "Path of the admin socket")
+	flags.Usage = func() { fmt.Fprint(flags.Output(), ctlUsage) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+	command, args := flags.Arg(0), flags.Args()[1:]
+	var err error
+	switch {
+	case command == "status" && len(args) == 0:
+		var status components.TunnelStatus
+		if err = ctlRequest(client, http.MethodGet, "/status", nil, &status); err == nil {
+			printJSON(status)
+		}
+	case command == "sessions" && len(args) == 0:
+		var sessions []components.SessionInfo
+		if err = ctlRequest(client, http.MethodGet, "/sessions", nil, &sessions); err == nil {
+			printSessions(sessions)
+		}
+	case command == "kill" && len(args) == 1:
+		err = ctlRequest(client, http.MethodDelete, "/sessions/"+url.PathEscape(args[0]), nil, nil)
+	case command == "screen" && len(args) == 1:
+		var screenshot components.Screenshot
+		if err = ctlRequest(client, http.MethodGet, "/sessions/"+url.PathEscape(args[0])+"/screen", nil, &screenshot); err == nil {
+			printScreenshot(screenshot)
+		}
+	case command == "pending" && len(args) == 0:
+		var pending []components.PendingSession
+		if err = ctlRequest(client, http.MethodGet, "/approvals", nil, &pending); err == nil {
+			printPending(pending)
+		}
+	case command == "approve" && len(args) == 1:
+		err = ctlRequest(client, http.MethodPost, "/approvals/"+url.PathEscape(args[0]), components.ApprovalRequest{Approve: true}, nil)
+	case command == "deny" && (len(args) == 1 || len(args) == 2):
+		request := components.ApprovalRequest{}
+		if len(args) == 2 {
+			request.Reason = args[1]
+		}
+		err = ctlRequest(client, http.MethodPost, "/approvals/"+url.PathEscape(args[0]), request, nil)
+	case command == "reconnect" && len(args) == 0:
+		err = ctlRequest(client, http.MethodPost, "/reconnect", nil, nil)
+	case command == "loglevel" && len(args) <= 1:
+		var level map[string]string
+		if len(args) == 1 {
+			err = ctlRequest(client, http.MethodPut, "/loglevel", map[string]string{"level": args[0]}, &level)
+		} else {
+			err = ctlRequest(client, http.MethodGet, "/loglevel", nil, &level)
+		}
+		if err == nil {
+			fmt.Println(level["level"])
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pe-terminal ctl:", err)
+		return 1
+	}
+	return 0
+}
+
+// ctlRequest sends body as JSON and decodes the JSON answer into result, if not nil
+func ctlRequest(client *http.Client, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, "http://pe-terminal"+path, reader)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s", response.Status, failure.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func printSessions(sessions []components.SessionInfo) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "SESSION\tPROFILE\tUSER\tOPERATOR\tPID\tAGE\tBYTES IN\tBYTES OUT")
+	for _, session := range sessions {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%s\t%d\t%d\n",
+			session.SessionID, session.Profile, session.User, session.Operator, session.Pid, session.Age, session.BytesIn, session.BytesOut)
+	}
+	writer.Flush()
+}
+
+// printScreenshot prints the lines of a screen, down to the last one holding text
+func printScreenshot(screenshot components.Screenshot) {
+	lines := screenshot.Lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+func printPending(pending []components.PendingSession) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "SESSION\tPROFILE\tUSER\tROLE\tOPERATOR\tWAITING\tEXPIRES IN")
+	for _, session := range pending {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", session.SessionID, session.Profile, session.User, session.Role, session.Operator,
+			time.Since(session.Requested).Round(time.Second), time.Until(session.Expires).Round(time.Second))
+	}
+	writer.Flush()
+}
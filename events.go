@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/PelionIoT/pe-terminal/components"
+	"github.com/PelionIoT/pe-terminal/config"
+	"go.uber.org/zap"
+)
+
+// subscribeEvents attaches the event sinks of the config to bus, a sink failing to set up is logged and skipped
+func subscribeEvents(events *config.EventsConfig, bus *components.EventBus) {
+	if events == nil {
+		return
+	}
+	if events.Socket != nil && *events.Socket != "" {
+		mode := uint64(0600)
+		if events.SocketMode != nil {
+			mode, _ = strconv.ParseUint(*events.SocketMode, 8, 32) // Validated by config.Load
+		}
+		group := ""
+		if events.SocketGroup != nil {
+			group = *events.SocketGroup
+		}
+		if eventSocket, err := components.NewEventSocket(*events.Socket, os.FileMode(mode), group, logger); err != nil {
+			logger.Error("Failed to create event socket", zap.String("socket", *events.Socket), zap.Error(err))
+		} else {
+			bus.Subscribe(eventSocket)
+		}
+	}
+	for _, name := range sortedKeys(events.Webhooks) {
+		webhook := events.Webhooks[name]
+		logger.Info("Posting events to webhook", zap.String("webhook", name), zap.Strings("events", webhook.Events))
+		bus.Subscribe(components.NewWebhook(*webhook.URL, eventTimeout(webhook.Timeout)), webhook.Events...)
+	}
+	for _, name := range sortedKeys(events.Hooks) {
+		hook := events.Hooks[name]
+		execHook, err := components.NewExecHook(*hook.Command, eventTimeout(hook.Timeout), logger)
+		if err != nil {
+			logger.Error("Failed to set up event hook", zap.String("hook", name), zap.Error(err))
+			continue
+		}
+		logger.Info("Running hook on events", zap.String("hook", name), zap.Strings("events", hook.Events))
+		bus.Subscribe(execHook, hook.Events...)
+	}
+}
+
+func eventTimeout(timeout *int) time.Duration {
+	if timeout == nil {
+		return config.DefaultEventTimeout * time.Second
+	}
+	return time.Duration(*timeout) * time.Second
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -3,9 +3,11 @@ module github.com/PelionIoT/pe-terminal
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/creack/pty v1.1.21
 	github.com/gorilla/websocket v1.5.3
 	go.uber.org/zap v1.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require go.uber.org/multierr v1.10.0 // indirect
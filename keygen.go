@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const keygenHelp = `Usage: pe-terminal keygen [-out=<filename>]
+
+Generates an Ed25519 key pair for end-to-end encryption, as the device key or the key of an operator.
+The private key is written to the file given, readable by its owner only, or printed along with the public key.
+`
+
+// keygenReport is printed by the keygen subcommand
+type keygenReport struct {
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey,omitempty"`
+}
+
+// runKeygen runs the keygen subcommand and returns the exit-code
+func runKeygen(args []string) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	out := flags.String("out", "", "File to write the private key to")
+	flags.Usage = func() { fmt.Fprint(flags.Output(), keygenHelp) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := keygenReport{PublicKey: base64.StdEncoding.EncodeToString(public)}
+	encoded := base64.StdEncoding.EncodeToString(private.Seed())
+	if *out == "" {
+		report.PrivateKey = encoded
+	} else if err := os.WriteFile(*out, []byte(encoded+"\n"), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printJSON(report)
+	return 0
+}
@@ -26,9 +26,9 @@ run() {
 test() {
     go vet
     if [[ -n "$1" ]]; then
-        go test "$1" -timeout 15s github.com/PelionIoT/pe-terminal/components
+        go test "$1" -timeout 60s github.com/PelionIoT/pe-terminal/components github.com/PelionIoT/pe-terminal/config
     else
-        go test -timeout 15s github.com/PelionIoT/pe-terminal/components
+        go test -timeout 60s github.com/PelionIoT/pe-terminal/components github.com/PelionIoT/pe-terminal/config
     fi
 }
 
@@ -20,15 +20,21 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
+	"crypto/ed25519"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/PelionIoT/pe-terminal/components"
+	"github.com/PelionIoT/pe-terminal/config"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -38,21 +44,36 @@ import (
  * @author github.com/adwardstark
  */
 
-// Config struct holds JSON-based configuration items
-type Config struct {
-	CloudURL *string `json:"cloud"`
-	Command  *string `json:"command"`
-	LogLevel *string `json:"logLevel"`
-}
+const (
+	defaultTerm        = "xterm-256color"
+	defaultProfileName = "default"
+)
 
 var logger *zap.Logger
 
 func main() {
+	components.RunSandboxInit() // Does not return when started as the helper of a sandboxed session
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		os.Exit(runKeygen(os.Args[2:]))
+	}
+
 	var configFile string
-	var config Config
+	var printConfig bool
 
-	flag.StringVar(&configFile, "config", "", "Run with a JSON config")
+	flag.StringVar(&configFile, "config", "", "Run with a config-file (.json, .yaml, .yml or .toml)")
+	flag.BoolVar(&printConfig, "print-config", false, "Print the effective configuration and exit")
+	overrides := config.BindFlags(flag.CommandLine)
 	flag.Parse()
+	source := config.Source{File: configFile, Environ: os.Environ(), Flags: overrides}
+	if printConfig {
+		os.Exit(runPrintConfig(source))
+	}
 
 	// Set up logging
 	atom := zap.NewAtomicLevel()
@@ -66,77 +87,465 @@ func main() {
 	logger.Info("=====[ Pelion Edge Terminal ]=====")
 
 	// Parse configuration
-	config = readConfig(configFile)
+	config := readConfig(source)
 	atom.SetLevel(zapLogLevel(*config.LogLevel))
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	configChanged := make(chan struct{}, 1)
+	if config.WatchConfig != nil && *config.WatchConfig && configFile != "" {
+		if err := watchConfig(configFile, configChanged); err != nil {
+			logger.Error("Failed to watch config-file, reload with SIGHUP instead", zap.Error(err))
+		}
+	}
 
 	// Setup tunnel-connection
-	tunnel := components.NewTunnel(*config.CloudURL, *config.Command, logger)
-	// Watch for interrupt
+	tunnel := components.NewTunnel(*config.CloudURL, tunnelOptions(config), logger)
+	// Expose metrics
+	if config.MetricsAddress != nil && *config.MetricsAddress != "" {
+		go serveMetrics(*config.MetricsAddress, tunnel.Metrics())
+	}
+	// Serve admin API
+	var admin *components.AdminServer
+	if config.AdminSocket != nil && *config.AdminSocket != "" {
+		mode, _ := strconv.ParseUint(*config.AdminSocketMode, 8, 32) // Validated by config.Load
+		group := ""
+		if config.AdminSocketGroup != nil {
+			group = *config.AdminSocketGroup
+		}
+		var err error
+		if admin, err = components.NewAdminServer(*config.AdminSocket, os.FileMode(mode), group, &tunnel, atom, logger); err != nil {
+			logger.Error("Failed to create admin socket", zap.String("socket", *config.AdminSocket), zap.Error(err))
+		} else {
+			go admin.Serve()
+		}
+	}
+	// Publish session events
+	subscribeEvents(config.Events, tunnel.Events())
+	// Report to systemd
+	notifier := components.NewNotifier()
+	if notifier.Enabled() {
+		go notifySystemd(notifier, &tunnel, config.ReadyOnConnect())
+	}
+	// Watch for interrupt and config changes
 	go func() {
-		<-interrupt
-		tunnel.Close()
-		<-time.After(time.Second)
-		logger.Info("External interrupt, exiting pe-terminal.")
-		os.Exit(1)
+		for {
+			select {
+			case sig := <-interrupt:
+				if sig == syscall.SIGHUP {
+					reloadConfig(source, &config, atom, &tunnel)
+					continue
+				}
+				gracePeriod := time.Duration(*config.ShutdownGracePeriod) * time.Second
+				logger.Info("External interrupt, shutting down pe-terminal.", zap.String("signal", sig.String()), zap.Duration("gracePeriod", gracePeriod))
+				notify(notifier, "STOPPING=1")
+				// The steps share the grace period, so that systemd does not kill pe-terminal meanwhile
+				deadline := time.Now().Add(gracePeriod)
+				code := shutdown(&tunnel, deadline)
+				tunnel.Events().Close(time.Until(deadline))
+				if admin != nil {
+					admin.Close()
+				}
+				os.Exit(code)
+			case <-configChanged:
+				reloadConfig(source, &config, atom, &tunnel)
+			}
+		}
 	}()
 
 	// Start tunnel-connection
 	tunnel.Connect()
 
-	for {
+	for !tunnel.IsShuttingDown() {
 		logger.Error("Tunnel disconnected. Attempting to establish connection")
 		tunnel.HandleReConnection()
 	}
+	// Keep running until the shutdown-handler exits
+	select {}
 }
 
-func readConfig(fileName string) Config {
-	if fileName != "" {
-		logger.Info("Using config-file", zap.String("filename", fileName))
-	} else {
-		logger.Error("No config-file provided, use flag -config=<filename>.json")
-		os.Exit(1)
+// shutdown drains the tunnel until deadline and returns the exit-code of pe-terminal
+func shutdown(tunnel *components.SocketTunnel, deadline time.Time) int {
+	gracePeriod := time.Until(deadline)
+	drained := make(chan bool, 1)
+	go func() {
+		drained <- tunnel.Shutdown(gracePeriod)
+	}()
+	select {
+	case ok := <-drained:
+		if !ok {
+			logger.Warn("Shutdown grace period expired, exiting pe-terminal.")
+			return 1
+		}
+		logger.Info("Shutdown complete, exiting pe-terminal.")
+		return 0
+	case <-time.After(gracePeriod):
+		logger.Warn("Shutdown grace period expired, exiting pe-terminal.")
+		return 1
 	}
+}
 
-	configFile, err := os.Open(fileName)
+// serveMetrics runs the HTTP listener of the Prometheus metrics endpoint
+func serveMetrics(address string, metrics http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	logger.Info("Serving metrics", zap.String("address", address))
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error("Failed to serve metrics", zap.Error(err))
+	}
+}
+
+// readConfig loads the configuration, exiting with every problem logged if it is invalid
+func readConfig(source config.Source) config.Config {
+	if source.File != "" {
+		logger.Info("Using config-file", zap.String("filename", source.File))
+	}
+	loaded, err := config.Load(source)
 	if err != nil {
-		logger.Error("Failed to open config-file", zap.Error(err))
+		logConfigErrors("Invalid configuration", err)
 		os.Exit(1)
 	}
-	defer configFile.Close()
+	for _, name := range config.UnknownEnviron(source.Environ) {
+		logger.Warn("Ignoring unknown environment variable", zap.String("name", name))
+	}
+	return loaded
+}
+
+// logConfigErrors logs each problem found by config.Load on its own
+func logConfigErrors(message string, err error) {
+	var errs config.Errors
+	if !errors.As(err, &errs) {
+		logger.Error(message, zap.Error(err))
+		return
+	}
+	for _, fieldError := range errs {
+		logger.Error(message, zap.String("field", fieldError.Field), zap.String("error", fieldError.Message))
+	}
+}
 
-	buffer, err := ioutil.ReadAll(configFile)
+// runPrintConfig prints the merged configuration as JSON and returns the exit-code
+func runPrintConfig(source config.Source) int {
+	loaded, err := config.Load(source)
 	if err != nil {
-		logger.Error("Failed to read config-file", zap.Error(err))
-		os.Exit(1)
+		var errs config.Errors
+		if errors.As(err, &errs) {
+			for _, fieldError := range errs {
+				fmt.Fprintln(os.Stderr, fieldError)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
 	}
+	printJSON(loaded)
+	return 0
+}
 
-	var config Config
-	if err := json.Unmarshal([]byte(buffer), &config); err != nil {
-		logger.Error("Failed to parse config-file", zap.Error(err))
-		os.Exit(1)
+// tunnelOptions builds the session profiles, without profiles in the config
+// the top-level fields make up the "default" profile
+func tunnelOptions(config config.Config) components.TunnelOptions {
+	options := components.TunnelOptions{
+		Profiles:       make(map[string]components.Profile),
+		DefaultProfile: defaultProfileName,
+	}
+	if config.RecordingDir != nil {
+		options.RecordingDir = *config.RecordingDir
+	}
+	if hooks := config.SessionHooks; hooks != nil {
+		options.PreStartHook = sessionHook(hooks.PreStart)
+		options.PreStartVeto = hooks.PreStart != nil && hooks.PreStart.Veto != nil && *hooks.PreStart.Veto
+		options.PostEndHook = sessionHook(hooks.PostEnd)
+	}
+	if config.ApprovalEnabled() {
+		options.Approval = approvalMode(config.Approval)
+	}
+	if config.E2EEnabled() {
+		options.E2E = endToEnd(config.E2E)
 	}
+	if config.AuthorizationEnabled() {
+		options.Authorization = tokenAuthorization(config.Authorization)
+	}
+	applyOutput(&options, config.Output)
+	base := components.Profile{Spec: sessionSpec(config)}
+	if config.Recording != nil {
+		base.Recording = *config.Recording
+	}
+	applyLimits(&base, config.Limits)
+	if len(config.Profiles) == 0 {
+		options.Profiles[defaultProfileName] = base
+		return options
+	}
+	if config.DefaultProfile != nil {
+		options.DefaultProfile = *config.DefaultProfile
+	}
+	for name, profileConfig := range config.Profiles {
+		profile := base
+		spec := base.Spec
+		if profileConfig.Command != nil {
+			spec.Argv, _ = components.SplitCommand(*profileConfig.Command) // Validated by config.Load
+		}
+		spec.Argv = append(append([]string{}, spec.Argv...), profileConfig.Args...)
+		spec.Env = make(map[string]string)
+		for key, value := range base.Spec.Env {
+			spec.Env[key] = value
+		}
+		for key, value := range profileConfig.Env {
+			spec.Env[key] = value
+		}
+		if profileConfig.User != nil {
+			spec.User = *profileConfig.User
+		}
+		if profileConfig.Cwd != nil {
+			spec.Dir = *profileConfig.Cwd
+		}
+		if profileConfig.Sandbox != nil {
+			spec.Sandbox = namespaceSandbox(profileConfig.Sandbox)
+		}
+		if profileConfig.Confinement != nil {
+			spec.Confinement = shellConfinement(*profileConfig.Confinement, config.Confinements)
+		}
+		profile.Spec = spec
+		if profileConfig.Description != nil {
+			profile.Description = *profileConfig.Description
+		}
+		if profileConfig.Recording != nil {
+			profile.Recording = *profileConfig.Recording
+		}
+		profile.AllowedRoles = profileConfig.AllowedRoles
+		applyLimits(&profile, profileConfig.Limits)
+		if profileConfig.Restricted != nil {
+			profile.Policy = commandPolicy(profileConfig.Restricted)
+		}
+		options.Profiles[name] = profile
+	}
+	return options
+}
 
-	// Check cloud-url
-	if config.CloudURL != nil && *config.CloudURL != "" && !strings.HasPrefix(*config.CloudURL, "ws") {
-		logger.Error("Invalid field `cloud` in config, should start with ws://")
-		os.Exit(1)
-	} else if config.CloudURL == nil {
-		logger.Error("Missing field 'cloud` in config")
-		os.Exit(1)
+// applyLimits sets the limits given in the config on profile
+func applyLimits(profile *components.Profile, limits *config.LimitsConfig) {
+	if limits == nil {
+		return
+	}
+	if limits.MaxSessions != nil {
+		profile.MaxSessions = *limits.MaxSessions
+	}
+	if limits.MaxDuration != nil {
+		profile.MaxDuration = time.Duration(*limits.MaxDuration) * time.Second
+	}
+}
+
+// commandPolicy compiles the command policy of a restricted profile
+func commandPolicy(restricted *config.RestrictedConfig) *components.Policy {
+	policy := &components.Policy{Commands: make(map[string]components.CommandRule)}
+	for name, command := range restricted.Commands {
+		rule := components.CommandRule{Path: *command.Path}
+		if command.Args != nil {
+			rule.Args = regexp.MustCompile(*command.Args) // Validated by config.Load
+		}
+		policy.Commands[name] = rule
+	}
+	for _, pattern := range restricted.Deny {
+		policy.Deny = append(policy.Deny, regexp.MustCompile(pattern))
 	}
-	// Set logging-level [ defaults to: INFO]
-	if config.LogLevel == nil && *config.LogLevel == "" {
-		*config.LogLevel = "info"
+	return policy
+}
+
+// sessionHook creates the command of a lifecycle hook, nil if not configured
+func sessionHook(hook *config.SessionHookConfig) *components.ExecHook {
+	if hook == nil {
+		return nil
 	}
-	// Set shell-command
-	if config.Command == nil && *config.Command == "" {
-		*config.Command = "/bin/bash" // [ default ]
+	timeout := config.DefaultSessionHookTimeout * time.Second
+	if hook.Timeout != nil {
+		timeout = time.Duration(*hook.Timeout) * time.Second
 	}
+	execHook, _ := components.NewExecHook(*hook.Command, timeout, logger) // Validated by config.Load
+	return execHook
+}
 
-	return config
+// approvalMode sets up the approval of the sessions by a local operator
+func approvalMode(approvalConfig *config.ApprovalConfig) *components.Approval {
+	approval := &components.Approval{
+		Timeout:  config.DefaultApprovalTimeout * time.Second,
+		Profiles: approvalConfig.Profiles,
+	}
+	if approvalConfig.Timeout != nil {
+		approval.Timeout = time.Duration(*approvalConfig.Timeout) * time.Second
+	}
+	if approvalConfig.Command != nil && *approvalConfig.Command != "" {
+		approval.Hook, _ = components.NewExecHook(*approvalConfig.Command, approval.Timeout, logger) // Validated by config.Load
+	}
+	if approvalConfig.Dir != nil {
+		approval.Dir = *approvalConfig.Dir
+	}
+	return approval
+}
+
+// tokenAuthorization sets up the verification of the tokens signed by the cloud
+func tokenAuthorization(authorizationConfig *config.AuthorizationConfig) *components.Authorization {
+	authorization := &components.Authorization{
+		Keys:        make(map[string]ed25519.PublicKey),
+		MaxLifetime: config.DefaultTokenMaxLifetime * time.Second,
+		Leeway:      config.DefaultTokenLeeway * time.Second,
+	}
+	for keyID, encoded := range authorizationConfig.Keys {
+		key, _ := components.ParseEd25519Key(encoded, false) // Validated by config.Load
+		authorization.Keys[keyID] = key
+	}
+	if authorizationConfig.Audience != nil {
+		authorization.Audience = *authorizationConfig.Audience
+	}
+	if authorizationConfig.MaxLifetime != nil {
+		authorization.MaxLifetime = time.Duration(*authorizationConfig.MaxLifetime) * time.Second
+	}
+	if authorizationConfig.Leeway != nil {
+		authorization.Leeway = time.Duration(*authorizationConfig.Leeway) * time.Second
+	}
+	return authorization
+}
+
+// applyOutput sets how the output of sessions is sent, output may be nil
+func applyOutput(options *components.TunnelOptions, output *config.OutputConfig) {
+	options.Coalescing = components.Coalescing{
+		Window:   config.DefaultCoalesceWindow * time.Millisecond,
+		MaxBytes: config.DefaultCoalesceBytes,
+	}
+	options.Compression = true
+	options.SyncInterval = config.DefaultSyncInterval * time.Millisecond
+	if output == nil {
+		return
+	}
+	if output.CoalesceWindow != nil {
+		options.Coalescing.Window = time.Duration(*output.CoalesceWindow) * time.Millisecond
+	}
+	if output.CoalesceBytes != nil {
+		options.Coalescing.MaxBytes = *output.CoalesceBytes
+	}
+	if output.Compression != nil {
+		options.Compression = *output.Compression
+	}
+	if output.RateLimit != nil {
+		options.RateLimit = *output.RateLimit
+	}
+	if output.GlobalRateLimit != nil {
+		options.GlobalRateLimit = *output.GlobalRateLimit
+	}
+	if output.SyncInterval != nil {
+		options.SyncInterval = time.Duration(*output.SyncInterval) * time.Millisecond
+	}
+}
+
+// sessionSpec builds the spec of the shells spawned for each session
+func sessionSpec(config config.Config) components.SessionSpec {
+	spec, _ := components.NewSessionSpec(*config.Command) // Validated by config.Load
+	spec.Argv = append(spec.Argv, config.Args...)
+	spec.Env = map[string]string{"TERM": defaultTerm}
+	if config.Term != nil {
+		spec.Env["TERM"] = *config.Term
+	}
+	if config.Lang != nil {
+		spec.Env["LANG"] = *config.Lang
+	}
+	for key, value := range config.Env {
+		spec.Env[key] = value
+	}
+	spec.EnvAllow = config.EnvAllow
+	spec.EnvDeny = config.EnvDeny
+	if config.Cwd != nil {
+		spec.Dir = *config.Cwd
+	}
+	if config.User != nil {
+		spec.User = *config.User
+	}
+	if config.Columns != nil && config.Rows != nil {
+		spec.Width = *config.Columns
+		spec.Height = *config.Rows
+	}
+	spec.Kill = killPolicy(config)
+	spec.Sandbox = namespaceSandbox(config.Sandbox)
+	if config.Confinement != nil {
+		spec.Confinement = shellConfinement(*config.Confinement, config.Confinements)
+	}
+	return spec
+}
+
+// endToEnd builds the end-to-end encryption of sessions. Without a readable device key no
+// operator is allowed, so that encrypted sessions are refused rather than unauthenticated.
+func endToEnd(e2eConfig *config.E2EConfig) *components.E2E {
+	e2e := &components.E2E{Required: e2eConfig.Required != nil && *e2eConfig.Required}
+	if e2eConfig.DeviceKeyFile != nil && *e2eConfig.DeviceKeyFile != "" {
+		key, err := components.ReadEd25519Key(*e2eConfig.DeviceKeyFile)
+		if err != nil {
+			logger.Error("Failed to read device key, refusing encrypted sessions", zap.String("filename", *e2eConfig.DeviceKeyFile), zap.Error(err))
+			return e2e
+		}
+		e2e.DeviceKey = key
+	}
+	for _, encoded := range e2eConfig.OperatorKeys {
+		key, _ := components.ParseEd25519Key(encoded, false) // Validated by config.Load
+		e2e.OperatorKeys = append(e2e.OperatorKeys, key)
+	}
+	return e2e
+}
+
+// shellConfinement looks up a built-in or custom confinement, nil for none
+func shellConfinement(name string, custom map[string]config.ConfinementConfig) *components.Confinement {
+	if name == "" {
+		return nil
+	}
+	if confinement, ok := components.ConfinementProfiles()[name]; ok {
+		return &confinement
+	}
+	confinementConfig, ok := custom[name]
+	if !ok {
+		return nil // Refused by config.Load
+	}
+	return &components.Confinement{
+		Name:         name,
+		ReadOnly:     confinementConfig.ReadOnly,
+		ReadWrite:    confinementConfig.ReadWrite,
+		DenySyscalls: confinementConfig.DenySyscalls,
+		DenyNetwork:  confinementConfig.DenyNetwork != nil && *confinementConfig.DenyNetwork,
+	}
+}
+
+// namespaceSandbox builds the namespace sandbox of the shells, nil when disabled
+func namespaceSandbox(sandboxConfig *config.SandboxConfig) *components.Sandbox {
+	if !sandboxConfig.IsEnabled() {
+		return nil
+	}
+	sandbox := &components.Sandbox{}
+	for _, mount := range sandboxConfig.Mounts {
+		parsed, _ := components.ParseMount(mount) // Validated by config.Load
+		sandbox.Mounts = append(sandbox.Mounts, parsed)
+	}
+	if sandboxConfig.Scratch != nil {
+		sandbox.Scratch = *sandboxConfig.Scratch
+	}
+	if sandboxConfig.Hostname != nil {
+		sandbox.Hostname = *sandboxConfig.Hostname
+	}
+	sandbox.PrivateNetwork = sandboxConfig.PrivateNetwork != nil && *sandboxConfig.PrivateNetwork
+	return sandbox
+}
+
+// killPolicy builds the session kill-policy, missing fields keep their defaults
+func killPolicy(config config.Config) components.KillPolicy {
+	policy := components.DefaultKillPolicy()
+	if len(config.KillSignals) > 0 {
+		policy.Signals = nil
+		for _, name := range config.KillSignals {
+			signal, _ := components.ParseSignal(name) // Validated by config.Load
+			policy.Signals = append(policy.Signals, signal)
+		}
+	}
+	if config.KillTimeout != nil && *config.KillTimeout > 0 {
+		policy.Timeout = time.Duration(*config.KillTimeout) * time.Second
+	}
+	if config.CgroupRoot != nil {
+		policy.CgroupRoot = *config.CgroupRoot
+	}
+	return policy
 }
 
 func zapLogLevel(logLevel string) zapcore.Level {
@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/PelionIoT/pe-terminal/components"
+	"github.com/PelionIoT/pe-terminal/config"
+	"go.uber.org/zap"
+)
+
+// configChange is a top-level config field whose value differs between two configs
+type configChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// Fields that are only read at start-up
+var restartOnlyFields = map[string]bool{
+	"metricsAddress":   true,
+	"adminSocket":      true,
+	"adminSocketMode":  true,
+	"adminSocketGroup": true,
+	"watchConfig":      true,
+	"notifyReady":      true,
+	"events":           true,
+}
+
+// diffConfig lists the changed fields by their JSON name, sorted
+func diffConfig(current config.Config, next config.Config) []configChange {
+	fields := func(config config.Config) map[string]interface{} {
+		encoded, _ := json.Marshal(config)
+		var fields map[string]interface{}
+		json.Unmarshal(encoded, &fields)
+		return fields
+	}
+	currentFields, nextFields := fields(current), fields(next)
+	names := make(map[string]bool)
+	for name := range currentFields {
+		names[name] = true
+	}
+	for name := range nextFields {
+		names[name] = true
+	}
+	var changes []configChange
+	for name := range names {
+		if !reflect.DeepEqual(currentFields[name], nextFields[name]) {
+			changes = append(changes, configChange{Field: name, Old: currentFields[name], New: nextFields[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// reloadConfig re-reads the config-file and applies what can be applied to the running instance,
+// an invalid config is rejected and the current one kept
+func reloadConfig(source config.Source, current *config.Config, atom zap.AtomicLevel, tunnel *components.SocketTunnel) {
+	logger.Info("Reloading config-file", zap.String("filename", source.File))
+	next, err := config.Load(source)
+	if err != nil {
+		logConfigErrors("Rejected new config-file, keeping the current configuration", err)
+		return
+	}
+	changes := diffConfig(*current, next)
+	if len(changes) == 0 {
+		logger.Info("Configuration unchanged")
+		return
+	}
+
+	reconnect := false
+	for _, change := range changes {
+		if restartOnlyFields[change.Field] {
+			logger.Warn("Configuration changed, restart pe-terminal to apply", zap.String("field", change.Field), zap.Any("old", change.Old), zap.Any("new", change.New))
+			continue
+		}
+		logger.Info("Configuration changed", zap.String("field", change.Field), zap.Any("old", change.Old), zap.Any("new", change.New))
+		if change.Field == "cloud" {
+			reconnect = true
+		}
+	}
+
+	atom.SetLevel(zapLogLevel(*next.LogLevel))
+	// New sessions use the new profiles, limits and recording settings
+	tunnel.SetOptions(tunnelOptions(next))
+	if reconnect {
+		tunnel.SetURL(*next.CloudURL)
+		if err := tunnel.Reconnect(); err != nil {
+			logger.Info("Tunnel not connected, new URL is used on the next attempt", zap.Error(err))
+		}
+	}
+	// Keep the fields that are only read at start-up, so they are reported again until restarted
+	for field := range restartOnlyFields {
+		copyField(current, &next, field)
+	}
+	*current = next
+}
+
+// copyField copies the field with the given JSON name from config to next
+func copyField(config *config.Config, next *config.Config, field string) {
+	current := reflect.ValueOf(config).Elem()
+	target := reflect.ValueOf(next).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		if name, _, _ := strings.Cut(current.Type().Field(i).Tag.Get("json"), ","); name == field {
+			target.Field(i).Set(current.Field(i))
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PelionIoT/pe-terminal/components"
+	"github.com/PelionIoT/pe-terminal/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloadTest holds an instance started from a config-file, with the logs of reloadConfig kept in a buffer
+type reloadTest struct {
+	t      *testing.T
+	source config.Source
+	config config.Config
+	atom   zap.AtomicLevel
+	tunnel components.SocketTunnel
+	logs   *bytes.Buffer
+}
+
+// logEntry is a line written by the JSON encoder of the logger
+type logEntry struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	Field string `json:"field"`
+}
+
+func newReloadTest(t *testing.T, content string) *reloadTest {
+	test := &reloadTest{t: t, atom: zap.NewAtomicLevel(), logs: &bytes.Buffer{}}
+	test.source = config.Source{File: filepath.Join(t.TempDir(), "config.json")}
+	test.write(content)
+	loaded, err := config.Load(test.source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.config = loaded
+	test.atom.SetLevel(zapLogLevel(*loaded.LogLevel))
+	test.tunnel = components.NewTunnel(*loaded.CloudURL, tunnelOptions(loaded), zap.NewNop())
+
+	previous := logger
+	logger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(test.logs), zap.DebugLevel))
+	t.Cleanup(func() { logger = previous })
+	return test
+}
+
+// write replaces the content of the config-file
+func (test *reloadTest) write(content string) {
+	if err := os.WriteFile(test.source.File, []byte(content), 0600); err != nil {
+		test.t.Fatal(err)
+	}
+}
+
+// reload writes content to the config-file and reloads it, returning what was logged meanwhile
+func (test *reloadTest) reload(content string) []logEntry {
+	test.write(content)
+	test.logs.Reset()
+	reloadConfig(test.source, &test.config, test.atom, &test.tunnel)
+	var entries []logEntry
+	for _, line := range strings.Split(strings.TrimSpace(test.logs.String()), "\n") {
+		var entry logEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			test.t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// findEntry returns the first entry with the given level and message, or nil
+func findEntry(entries []logEntry, level string, msg string) *logEntry {
+	for i := range entries {
+		if entries[i].Level == level && strings.HasPrefix(entries[i].Msg, msg) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	test := newReloadTest(t, `{"cloud": "ws://localhost:1/relay-term", "logLevel": "info"}`)
+
+	for _, content := range []string{
+		`{"cloud": "ws://localhost:1/relay-term", "logLevel": "loud"}`,
+		`{"cloud": "ws://localhost:1/relay-term", "logLevel": "debug"`,
+		`{"cloud": "ws://localhost:2/relay-term", "logLevel": "debug", "nope": true}`,
+	} {
+		entries := test.reload(content)
+		if findEntry(entries, "error", "Rejected new config-file") == nil {
+			t.Fatalf("Expected %s rejected, got %+v", content, entries)
+		}
+		if *test.config.LogLevel != "info" || test.atom.Level() != zap.InfoLevel {
+			t.Fatalf("Expected the running log level kept, got %s", *test.config.LogLevel)
+		}
+		if url := test.tunnel.Status().URL; url != "ws://localhost:1/relay-term" {
+			t.Fatalf("Expected the running URL kept, got %s", url)
+		}
+	}
+}
+
+func TestReloadRestartOnlyFields(t *testing.T) {
+	test := newReloadTest(t, `{"cloud": "ws://localhost:1/relay-term", "metricsAddress": "127.0.0.1:9100"}`)
+
+	// The change is reported until pe-terminal is restarted
+	for i := 0; i < 2; i++ {
+		entries := test.reload(`{"cloud": "ws://localhost:1/relay-term", "metricsAddress": "127.0.0.1:9200"}`)
+		warning := findEntry(entries, "warn", "Configuration changed, restart pe-terminal to apply")
+		if warning == nil || warning.Field != "metricsAddress" {
+			t.Fatalf("Expected a restart warning for metricsAddress, got %+v", entries)
+		}
+		if *test.config.MetricsAddress != "127.0.0.1:9100" {
+			t.Fatalf("Expected the running metrics address kept, got %s", *test.config.MetricsAddress)
+		}
+	}
+}
+
+func TestReloadLogLevel(t *testing.T) {
+	test := newReloadTest(t, `{"cloud": "ws://localhost:1/relay-term", "logLevel": "info"}`)
+
+	entries := test.reload(`{"cloud": "ws://localhost:1/relay-term", "logLevel": "debug"}`)
+	if change := findEntry(entries, "info", "Configuration changed"); change == nil || change.Field != "logLevel" {
+		t.Fatalf("Expected the logLevel change logged, got %+v", entries)
+	}
+	if test.atom.Level() != zap.DebugLevel || *test.config.LogLevel != "debug" {
+		t.Fatalf("Expected the debug level applied, got %s", test.atom.Level())
+	}
+	if entries := test.reload(`{"cloud": "ws://localhost:1/relay-term", "logLevel": "debug"}`); findEntry(entries, "info", "Configuration unchanged") == nil {
+		t.Fatalf("Expected the configuration unchanged, got %+v", entries)
+	}
+}
+
+func TestReloadReconnect(t *testing.T) {
+	test := newReloadTest(t, `{"cloud": "ws://localhost:1/relay-term", "logLevel": "info"}`)
+
+	// Other fields are applied without reconnecting
+	entries := test.reload(`{"cloud": "ws://localhost:1/relay-term", "logLevel": "warn", "command": "/bin/sh"}`)
+	if findEntry(entries, "info", "Tunnel not connected") != nil {
+		t.Fatalf("Expected no reconnect, got %+v", entries)
+	}
+
+	entries = test.reload(`{"cloud": "ws://localhost:2/relay-term", "logLevel": "warn", "command": "/bin/sh"}`)
+	if change := findEntry(entries, "info", "Configuration changed"); change == nil || change.Field != "cloud" {
+		t.Fatalf("Expected the cloud change logged, got %+v", entries)
+	}
+	if findEntry(entries, "info", "Tunnel not connected") == nil {
+		t.Fatalf("Expected a reconnect, got %+v", entries)
+	}
+	if url := test.tunnel.Status().URL; url != "ws://localhost:2/relay-term" {
+		t.Fatalf("Expected the new URL used, got %s", url)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PelionIoT/pe-terminal/components"
+	"go.uber.org/zap"
+)
+
+// notifySystemd reports readiness, the state of the tunnel and liveness to systemd. Watchdog
+// pings are withheld while the connection loop is stuck, so that systemd restarts pe-terminal.
+func notifySystemd(notifier *components.Notifier, tunnel *components.SocketTunnel, readyOnConnect bool) {
+	ready := false
+	if !readyOnConnect {
+		ready = notify(notifier, "READY=1")
+	}
+
+	var watchdog <-chan time.Time
+	if interval := notifier.WatchdogInterval(); interval > 0 {
+		logger.Info("Pinging the systemd watchdog", zap.Duration("interval", interval/2))
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	statusTicker := time.NewTicker(time.Second)
+	defer statusTicker.Stop()
+
+	lastStatus := ""
+	for {
+		select {
+		case <-statusTicker.C:
+			status := tunnel.Status()
+			if !ready && status.Connected {
+				ready = notify(notifier, "READY=1")
+			}
+			if text := statusText(status); text != lastStatus && notify(notifier, "STATUS="+text) {
+				lastStatus = text
+			}
+		case <-watchdog:
+			if tunnel.Healthy() {
+				notify(notifier, "WATCHDOG=1")
+			} else {
+				logger.Warn("Tunnel connection loop is stuck, withholding the systemd watchdog ping")
+			}
+		}
+	}
+}
+
+// notify sends to systemd, returning false on failure
+func notify(notifier *components.Notifier, assignments ...string) bool {
+	if err := notifier.Notify(assignments...); err != nil {
+		logger.Debug("Failed to notify systemd", zap.Strings("assignments", assignments), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// statusText is the one-line status shown by systemctl status
+func statusText(status components.TunnelStatus) string {
+	switch {
+	case status.ShuttingDown:
+		return fmt.Sprintf("Shutting down, %d sessions", status.Sessions)
+	case status.Connected:
+		return fmt.Sprintf("Connected to %s, %d sessions", status.URL, status.Sessions)
+	default:
+		return fmt.Sprintf("Disconnected from %s, retrying every %ds, %d sessions", status.URL, status.ReconnectWait, status.Sessions)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/PelionIoT/pe-terminal/config"
+)
+
+// Exit-codes of the validate subcommand
+const (
+	validateOK       = 0 // No findings
+	validateErrors   = 1 // At least one error
+	validateUsage    = 2 // Invalid arguments
+	validateWarnings = 3 // Only warnings
+)
+
+const validateHelp = `Usage: pe-terminal validate -config=<filename>
+
+Checks a config-file without starting pe-terminal, and prints the findings as JSON.
+Exits with 0 when there are no findings, 1 on errors, 3 on warnings only and 2 on invalid arguments.
+`
+
+// validateReport is printed by the validate subcommand
+type validateReport struct {
+	File     string           `json:"file"`
+	Valid    bool             `json:"valid"` // No errors, there may be warnings
+	Findings []config.Finding `json:"findings"`
+}
+
+// runValidate runs the validate subcommand and returns the exit-code
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Config-file to check (.json, .yaml, .yml or .toml)")
+	flags.Usage = func() { fmt.Fprint(flags.Output(), validateHelp) }
+	if err := flags.Parse(args); err != nil {
+		return validateUsage
+	}
+	if *configFile == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return validateUsage
+	}
+
+	// Only the file is checked, the environment of this host is not the one of the gateways
+	findings := config.Validate(config.Source{File: *configFile})
+	report := validateReport{File: *configFile, Valid: true, Findings: []config.Finding{}}
+	code := validateOK
+	for _, finding := range findings {
+		report.Findings = append(report.Findings, finding)
+		if finding.Severity == config.SeverityError {
+			report.Valid = false
+			code = validateErrors
+		} else if code == validateOK {
+			code = validateWarnings
+		}
+	}
+	printJSON(report)
+	return code
+}
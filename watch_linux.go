@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2023 Izuma Networks
+
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// watchConfig signals onChange whenever the config-file is written or replaced. The directory
+// is watched rather than the file, since editors and config-management replace files by renaming.
+func watchConfig(fileName string, onChange chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(filepath.Clean(fileName))
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			length, err := syscall.Read(fd, buffer)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				logger.Error("Stopped watching config-file", zap.Error(err))
+				return
+			}
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= length; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				name := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				if string(bytes.TrimRight(name, "\x00")) == base {
+					changed = true
+				}
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+			}
+			if changed {
+				// Let the writer finish, a burst of events results in a single reload
+				time.Sleep(200 * time.Millisecond)
+				select {
+				case onChange <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}